@@ -13,38 +13,142 @@ import (
 	"github.com/rs/zerolog/log"
 
 	"github.com/polarbit/bluelabs-wallet/config"
-	"github.com/polarbit/bluelabs-wallet/db"
+	"github.com/polarbit/bluelabs-wallet/jwtauth"
+	"github.com/polarbit/bluelabs-wallet/metrics"
 	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/storage"
 )
 
-func StartAPI() {
-	config.Init()
+// registerRoutes registers every route of the api; each of them is documented
+// by operations of the OpenAPI spec.
+func registerRoutes(e *echo.Echo, h *walletHandler, wh *webhookHandler) {
+	e.POST("/wallets", func(c echo.Context) error { return h.createWallet(c) })
+	e.GET("/wallets/:id", func(c echo.Context) error { return h.getWallet(c) })
+	e.GET("/wallets/:id/balance", func(c echo.Context) error { return h.getWalletBalance(c) })
+	e.GET("/wallets/:id/statements", func(c echo.Context) error { return h.getStatement(c) })
+	e.GET("/wallets/:id/stream", func(c echo.Context) error { return h.streamWallet(c) })
+	e.GET("/wallets/:id/ws", func(c echo.Context) error { return h.streamWalletWs(c) })
+	e.POST("/wallets/:wid/transactions", func(c echo.Context) error { return h.createTransaction(c) })
+	e.GET("/wallets/:wid/transactions/latest", func(c echo.Context) error { return h.getLatestTransaction(c) })
+	e.POST("/webhooks", func(c echo.Context) error { return wh.createSubscription(c) })
+	e.GET("/webhooks", func(c echo.Context) error { return wh.listSubscriptions(c) })
+	e.GET("/webhooks/:id", func(c echo.Context) error { return wh.getSubscription(c) })
+	e.DELETE("/webhooks/:id", func(c echo.Context) error { return wh.deleteSubscription(c) })
+	e.GET("/webhooks/:id/deliveries", func(c echo.Context) error { return wh.listDeliveries(c) })
+	e.POST("/webhooks/:id/deliveries/:did/redeliver", func(c echo.Context) error { return wh.redeliver(c) })
 
-	// init wallet handler
-	h := func() *walletHandler {
-		repo := db.NewRepository(config.Config.Db, log.Logger)
-		service := service.NewWalletService(repo, log.Logger)
-		validate := validator.New()
-		return &walletHandler{s: service, v: validate}
-	}()
+	e.GET("/openapi.json", serveOpenAPI)
+	e.GET("/docs", serveDocs)
+}
+
+// New returns the api with every route registered on the services, without
+// middlewares. Errors are written as problems (RFC 7807).
+func New(s service.Service, ws service.WebhookService) *echo.Echo {
+	h := &walletHandler{s: s, v: validator.New(), l: log.Logger}
+	h.v.RegisterTagNameFunc(jsonFieldName)
+	wh := &webhookHandler{s: ws, l: log.Logger}
 
 	e := echo.New()
-	// e.Logger = lecho.From(log.Logger)                      // Set zerlogger as echo logger
 	e.Validator = &CustomEchoValidator{v: h.v} // Set validator
-	e.Use(middleware.Logger())
+	e.HTTPErrorHandler = problemErrorHandler(log.Logger)
+	registerRoutes(e, h, wh)
+	return e
+}
+
+// StartAPI starts the api and blocks until interrupted. A non-empty storage
+// overrides the storage of the configuration.
+func StartAPI(storageName string) error {
+	config.Init()
+	if storageName != "" {
+		config.Config.Storage = storageName
+	}
+
+	repo, err := storage.NewRepository(config.Config, log.Logger)
+	if err != nil {
+		return err
+	}
+	// before repo is instrumented, so postgres stores share its connections
+	lm := storage.NewLimiter(config.Config, repo, log.Logger)
+	nonces := storage.NewNonceStore(config.Config, repo, log.Logger)
+	var m *metrics.Metrics
+	if config.Config.Metrics || config.Config.MetricsAddr != "" {
+		m = metrics.New()
+		repo = m.Repository(repo)
+	}
+
+	var opts []service.Option
+	if config.Config.Posting == config.PostingLocking {
+		opts = append(opts, service.WithLocking())
+	}
+	if config.Config.PolicyFile != "" {
+		policy, err := service.LoadPolicy(config.Config.PolicyFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, service.WithPolicy(policy))
+	}
+	s := service.NewWalletService(repo, log.Logger, opts...)
+	if m != nil {
+		s = m.Service(s)
+	}
+	e := New(s, service.NewWebhookService(repo, log.Logger))
+	e.Use(requestLogger(log.Logger)) // X-Request-ID, also reported by problems
+	if m != nil {
+		if config.Config.Metrics {
+			e.GET("/metrics", echo.WrapHandler(m.Handler()))
+		}
+		e.Use(observeRequests(m, e.Routes()))
+		if config.Config.MetricsAddr != "" {
+			go m.Serve(config.Config.MetricsAddr, log.Logger)
+		}
+	}
 	e.Use(middleware.Recover())
+	authns := []authenticator{}
+	if config.Config.ApiKeys {
+		if config.Config.Storage == config.StorageMemory {
+			log.Warn().Msg("api keys are required, but memory storage has none; every request is unauthorized")
+		}
+		authns = append(authns, apiKeyAuthenticator(repo, log.Logger))
+	}
+	v, err := jwtauth.NewVerifier(config.Config)
+	if err != nil {
+		return err
+	}
+	if v != nil {
+		authns = append(authns, bearerAuthenticator(v, log.Logger))
+	}
+	proxies, _ := config.ParseIPRanges(config.Config.TrustedProxies)
+	e.IPExtractor = ipExtractor(proxies)
+	if lm != nil {
+		// callers are limited by their address before they are authenticated
+		e.Use(limitIP(lm, log.Logger))
+	}
+	if len(authns) > 0 {
+		e.Use(authenticate(log.Logger, e.Routes(), authns...))
+	}
+	if lm != nil {
+		e.Use(rateLimit(lm, log.Logger))
+	}
+	if len(config.Config.SigningSecrets) > 0 {
+		tolerance, _ := time.ParseDuration(config.Config.SigningTolerance)
+		e.Use(verifySignature(config.Config.SigningSecrets, nonces, tolerance, log.Logger))
+	}
 
-	// Routes
-	e.POST("/wallets", func(c echo.Context) error { return h.createWallet(c) })
-	e.GET("/wallets/:id", func(c echo.Context) error { return h.getWallet(c) })
-	e.GET("/wallets/:id/balance", func(c echo.Context) error { return h.getWalletBalance(c) })
-	e.POST("/wallets/:wid/transactions", func(c echo.Context) error { return h.createTransaction(c) })
-	e.GET("/wallets/:wid/transactions/latest", func(c echo.Context) error { return h.getLatestTransaction(c) })
+	// Start background jobs
+	jobCtx, stopJobs := context.WithCancel(context.Background())
+	defer stopJobs()
+	if config.Config.ReconcileInterval != "" {
+		interval, _ := time.ParseDuration(config.Config.ReconcileInterval)
+		go service.RunReconcileJob(jobCtx, repo, interval, log.Logger.With().Str("job", "reconcile").Logger())
+	}
+	if config.Config.DailySnapshots {
+		go service.RunSnapshotJob(jobCtx, repo, log.Logger.With().Str("job", "snapshot").Logger())
+	}
 
 	// Start server
 	go func() {
 		if err := e.Start(":8080"); err != nil && err != http.ErrServerClosed {
-			e.Logger.Fatal("shutting down the server")
+			log.Fatal().Err(err).Msg("shutting down the server")
 		}
 	}()
 
@@ -55,6 +159,8 @@ func StartAPI() {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	if err := e.Shutdown(ctx); err != nil {
-		e.Logger.Fatal(err)
+		log.Fatal().Err(err).Msg("shutting down the server failed")
 	}
+
+	return nil
 }
@@ -9,8 +9,11 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/go-playground/validator"
 	"github.com/google/uuid"
@@ -51,6 +54,14 @@ func TestApiIntegration(t *testing.T) {
 	t.Run("CreateTransactionOk", func(t *testing.T) {
 		createTransactionOk(tc, t)
 	})
+
+	t.Run("GetWalletBalanceAtOk", func(t *testing.T) {
+		getWalletBalanceAtOk(tc, t)
+	})
+
+	t.Run("GetStatementOk", func(t *testing.T) {
+		getStatementOk(tc, t)
+	})
 }
 
 func createWalletOk(tc *testContext, t *testing.T) {
@@ -119,3 +130,68 @@ func createTransactionOk(tc *testContext, t *testing.T) {
 		tc.t = resp
 	}
 }
+
+func getWalletBalanceAtOk(tc *testContext, t *testing.T) {
+	get := func(at time.Time) *httptest.ResponseRecorder {
+		e := echo.New()
+		q := url.Values{"at": {at.Format(time.RFC3339)}}
+		req := httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/wallets/:id/balance")
+		c.SetParamNames("id")
+		c.SetParamValues(strconv.Itoa(tc.w.ID))
+
+		err := tc.h.getWalletBalance(c)
+		if err != nil {
+			problemErrorHandler(log.Logger)(err, c)
+		}
+		return rec
+	}
+
+	rec := get(time.Now().Add(time.Minute))
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		assert.Equal(t, "9", strings.TrimSpace(rec.Body.String()))
+	}
+
+	rec = get(tc.w.Created.Add(-time.Hour))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
+
+func getStatementOk(tc *testContext, t *testing.T) {
+	get := func(q url.Values) *httptest.ResponseRecorder {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, "/?"+q.Encode(), nil)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		c.SetPath("/wallets/:id/statements")
+		c.SetParamNames("id")
+		c.SetParamValues(strconv.Itoa(tc.w.ID))
+
+		err := tc.h.getStatement(c)
+		if err != nil {
+			problemErrorHandler(log.Logger)(err, c)
+		}
+		return rec
+	}
+
+	today := time.Now().UTC().Format(service.DayLayout)
+
+	rec := get(url.Values{"from": {today}, "to": {today}})
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		st := &service.Statement{}
+		assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), st))
+		assert.Equal(t, 0., st.OpeningBalance)
+		assert.NotEmpty(t, st.Transactions)
+		assert.Equal(t, 9., st.ClosingBalance)
+	}
+
+	rec = get(url.Values{"from": {today}, "to": {today}, "format": {"csv"}})
+	if assert.Equal(t, http.StatusOK, rec.Code) {
+		assert.Contains(t, rec.Header().Get(echo.HeaderContentType), "text/csv")
+		assert.Contains(t, rec.Body.String(), "closing,,"+today+",,,9.00")
+	}
+
+	rec = get(url.Values{"from": {"yesterday"}, "to": {today}})
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+
+	"github.com/polarbit/bluelabs-wallet/jwtauth"
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+// apiKeyHeader carries the api key of requests
+const apiKeyHeader = "X-API-Key"
+
+// routeScopes is the scope required by each route, keyed by method and echo
+// path. Registered routes not listed require ScopeAdmin.
+var routeScopes = map[string]string{
+	"GET /wallets/:id":                      service.ScopeWalletsRead,
+	"GET /wallets/:id/balance":              service.ScopeWalletsRead,
+	"GET /wallets/:id/statements":           service.ScopeWalletsRead,
+	"GET /wallets/:id/stream":               service.ScopeWalletsRead,
+	"GET /wallets/:id/ws":                   service.ScopeWalletsRead,
+	"GET /wallets/:wid/transactions/latest": service.ScopeWalletsRead,
+	"POST /wallets/:wid/transactions":       service.ScopeTransactionsWrite,
+}
+
+// publicRoutes are served without an api key
+var publicRoutes = map[string]bool{
+	"GET /openapi.json": true,
+	"GET /docs":         true,
+}
+
+// routeScope returns the scope required by the route, or empty if it is public.
+func routeScope(method, path string) string {
+	key := method + " " + path
+	if publicRoutes[key] {
+		return ""
+	}
+	if s, ok := routeScopes[key]; ok {
+		return s
+	}
+	return service.ScopeAdmin
+}
+
+// authenticator returns the principal of the credentials of a request, or
+// nil if the request does not carry its kind of credentials.
+type authenticator func(c echo.Context) (*service.Principal, error)
+
+// authenticate authenticates requests with the first authenticator which finds
+// credentials, and authorizes them by the scope of their route; routes are the
+// registered ones, requests of other paths are not found before they are
+// authenticated. The principal is set on the request context, so that the
+// client is recorded on transactions and the service restricts callers of a
+// tenant to its wallets.
+func authenticate(l zerolog.Logger, routes []*echo.Route, authns ...authenticator) echo.MiddlewareFunc {
+	paths := map[string]bool{}
+	for _, r := range routes {
+		paths[r.Path] = true
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			// echo leaves the request path, or a prefix of routes, when no
+			// route matches
+			if c.Path() == "" || !paths[c.Path()] {
+				return echo.ErrNotFound
+			}
+			scope := routeScope(c.Request().Method, c.Path())
+			if scope == "" {
+				return next(c)
+			}
+
+			var p *service.Principal
+			for _, authn := range authns {
+				var err error
+				if p, err = authn(c); err != nil {
+					return err
+				}
+				if p != nil {
+					break
+				}
+			}
+			if p == nil {
+				return echo.NewHTTPError(http.StatusUnauthorized, "api key or bearer token is required")
+			}
+			if !p.HasScope(scope) {
+				l.Debug().Str("client", p.Client).Str("scope", scope).Msg("missing scope")
+				return echo.NewHTTPError(http.StatusForbidden, "missing scope "+scope)
+			}
+
+			ctx := service.WithPrincipal(c.Request().Context(), p)
+			c.SetRequest(c.Request().WithContext(ctx))
+			return next(c)
+		}
+	}
+}
+
+// apiKeyAuthenticator authenticates the api key of the X-API-Key header.
+func apiKeyAuthenticator(r service.Repository, l zerolog.Logger) authenticator {
+	return func(c echo.Context) (*service.Principal, error) {
+		key := c.Request().Header.Get(apiKeyHeader)
+		if key == "" {
+			return nil, nil
+		}
+
+		p, err := service.AuthenticateAPIKey(c.Request().Context(), r, key)
+		if err != nil {
+			if errors.Is(err, service.ErrAPIKeyNotFound) {
+				return nil, echo.NewHTTPError(http.StatusUnauthorized, "api key is invalid")
+			}
+			l.Error().Err(err).Msg("authenticate api key failed")
+			return nil, err
+		}
+		return p, nil
+	}
+}
+
+// bearerAuthenticator verifies the token of the Authorization: Bearer header.
+func bearerAuthenticator(v *jwtauth.Verifier, l zerolog.Logger) authenticator {
+	return func(c echo.Context) (*service.Principal, error) {
+		h := c.Request().Header.Get(echo.HeaderAuthorization)
+		if len(h) < 7 || !strings.EqualFold(h[:7], "bearer ") {
+			return nil, nil
+		}
+
+		p, err := v.Verify(strings.TrimSpace(h[7:]))
+		if err != nil {
+			l.Debug().Err(err).Msg("verify bearer token failed")
+			return nil, echo.NewHTTPError(http.StatusUnauthorized, "bearer token is invalid")
+		}
+		return p, nil
+	}
+}
@@ -0,0 +1,88 @@
+//go:build !integration
+// +build !integration
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/polarbit/bluelabs-wallet/memdb"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIKeyAuth(t *testing.T) {
+	ctx := context.Background()
+	repo := memdb.NewRepository(zerolog.Nop())
+	s := service.NewWalletService(repo, zerolog.Nop())
+	e := New(s, service.NewWebhookService(repo, zerolog.Nop()))
+	e.Use(authenticate(zerolog.Nop(), e.Routes(), apiKeyAuthenticator(repo, zerolog.Nop())))
+
+	newKey := func(name string, scopes ...string) string {
+		key, k, err := service.GenerateAPIKey(name, scopes)
+		require.NoError(t, err)
+		require.NoError(t, repo.CreateAPIKey(ctx, k))
+		return key
+	}
+	reader := newKey("reader", service.ScopeWalletsRead)
+	billing := newKey("billing", service.ScopeTransactionsWrite)
+	revoked := newKey("revoked", service.ScopeAdmin)
+	require.NoError(t, repo.RevokeAPIKey(ctx, 3, time.Now()))
+
+	w, err := s.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+	require.NoError(t, err)
+	wallet := "/wallets/" + strconv.Itoa(w.ID)
+
+	do := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if key != "" {
+			req.Header.Set(apiKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	tests := []struct {
+		name         string
+		method, path string
+		key, body    string
+		status       int
+	}{
+		{"Public", http.MethodGet, "/openapi.json", "", "", http.StatusOK},
+		{"Missing", http.MethodGet, wallet, "", "", http.StatusUnauthorized},
+		{"Unknown", http.MethodGet, wallet, "bwk_unknown", "", http.StatusUnauthorized},
+		{"Revoked", http.MethodGet, wallet, revoked, "", http.StatusUnauthorized},
+		{"Read", http.MethodGet, wallet + "/balance", reader, "", http.StatusOK},
+		{"ReadCannotWrite", http.MethodPost, wallet + "/transactions", reader,
+			`{"amount": 1, "description": "d", "fingerprint": "f1"}`, http.StatusForbidden},
+		{"WriteCannotRead", http.MethodGet, wallet, billing, "", http.StatusForbidden},
+		{"AdminOnly", http.MethodGet, "/webhooks", billing, "", http.StatusForbidden},
+		{"UnknownRoute", http.MethodGet, "/unknown/path", "", "", http.StatusNotFound},
+		{"UnknownSubroute", http.MethodGet, wallet + "/unknown", billing, "", http.StatusNotFound},
+		{"UnknownPrefix", http.MethodGet, "/web", "", "", http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.status, do(tt.method, tt.path, tt.key, tt.body).Code)
+		})
+	}
+
+	// the client of the key is recorded on the transaction
+	rec := do(http.MethodPost, wallet+"/transactions", billing, `{"amount": 1, "description": "d", "fingerprint": "f2"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	tr := service.Transaction{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &tr))
+	assert.Equal(t, "apikey:billing", tr.Client)
+}
@@ -0,0 +1,158 @@
+//go:build !integration
+// +build !integration
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/polarbit/bluelabs-wallet/memdb"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// faultRepository fails wallet and transaction writes and wallet reads with
+// err, if set.
+type faultRepository struct {
+	service.Repository
+	err error
+}
+
+func (r *faultRepository) CreateWallet(ctx context.Context, w *service.Wallet) error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.Repository.CreateWallet(ctx, w)
+}
+
+func (r *faultRepository) GetWallet(ctx context.Context, wid int) (*service.Wallet, error) {
+	if r.err != nil {
+		return nil, r.err
+	}
+	return r.Repository.GetWallet(ctx, wid)
+}
+
+func (r *faultRepository) CreateTransaction(ctx context.Context, wid int, t *service.Transaction) error {
+	if r.err != nil {
+		return r.err
+	}
+	return r.Repository.CreateTransaction(ctx, wid, t)
+}
+
+func TestErrorResponses(t *testing.T) {
+	ctx := context.Background()
+	repo := &faultRepository{Repository: memdb.NewRepository(zerolog.Nop())}
+	policy := &service.Policy{Default: service.EffectAllow, Rules: []*service.PolicyRule{
+		{Name: "no-bonus", Effect: service.EffectDeny, Labels: map[string][]string{"reason": {"bonus"}}},
+	}}
+	s := service.NewWalletService(repo, zerolog.Nop(), service.WithPolicy(policy))
+	e := New(s, service.NewWebhookService(repo, zerolog.Nop()))
+
+	w, err := s.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+	require.NoError(t, err)
+	_, err = s.CreateTransaction(ctx, w.ID, &service.TransactionModel{Amount: 10, Description: "d", Fingerprint: "f1"})
+	require.NoError(t, err)
+	empty, err := s.CreateWallet(ctx, &service.WalletModel{ExternalID: "empty"})
+	require.NoError(t, err)
+
+	wallet := "/wallets/" + strconv.Itoa(w.ID)
+	transactions := wallet + "/transactions"
+	tx := func(amount, fingerprint, labels string) string {
+		return `{"amount": ` + amount + `, "description": "d", "fingerprint": "` + fingerprint + `", "labels": {` + labels + `}}`
+	}
+	dbErr := service.NewDbError(errors.New("dial tcp 10.0.0.5:5432: connection refused"))
+	unknownErr := errors.New("unexpected secret detail")
+
+	tests := []struct {
+		name         string
+		method, path string
+		body         string
+		fault        error
+		status       int
+		code         string
+	}{
+		{"RouteNotFound", http.MethodGet, "/unknown", "", nil, http.StatusNotFound, "not_found"},
+		{"MethodNotAllowed", http.MethodDelete, wallet, "", nil, http.StatusMethodNotAllowed, "method_not_allowed"},
+
+		{"CreateWalletSyntax", http.MethodPost, "/wallets", `{"externalId":`, nil, http.StatusBadRequest, "bad_request"},
+		{"CreateWalletValidation", http.MethodPost, "/wallets", `{}`, nil, http.StatusBadRequest, codeValidationFailed},
+		{"CreateWalletExists", http.MethodPost, "/wallets", `{"externalId": "w1"}`, nil, http.StatusConflict, "wallet_already_exists"},
+		{"CreateWalletPolicy", http.MethodPost, "/wallets", `{"externalId": "w2", "labels": {"reason": "bonus"}}`, nil, http.StatusForbidden, "policy_denied"},
+		{"CreateWalletDb", http.MethodPost, "/wallets", `{"externalId": "w3"}`, dbErr, http.StatusServiceUnavailable, "unavailable"},
+		{"CreateWalletUnknown", http.MethodPost, "/wallets", `{"externalId": "w3"}`, unknownErr, http.StatusInternalServerError, "internal_error"},
+
+		{"GetWalletId", http.MethodGet, "/wallets/x", "", nil, http.StatusBadRequest, "bad_request"},
+		{"GetWalletNotFound", http.MethodGet, "/wallets/999", "", nil, http.StatusNotFound, "wallet_not_found"},
+		{"GetWalletDb", http.MethodGet, wallet, "", dbErr, http.StatusServiceUnavailable, "unavailable"},
+
+		{"BalanceAt", http.MethodGet, wallet + "/balance?at=yesterday", "", nil, http.StatusBadRequest, "bad_request"},
+		{"BalanceNotFound", http.MethodGet, "/wallets/999/balance", "", nil, http.StatusNotFound, "wallet_not_found"},
+
+		{"StatementFrom", http.MethodGet, wallet + "/statements?from=x&to=2021-01-01", "", nil, http.StatusBadRequest, "bad_request"},
+		{"StatementOrder", http.MethodGet, wallet + "/statements?from=2021-01-02&to=2021-01-01", "", nil, http.StatusBadRequest, "bad_request"},
+		{"StatementFormat", http.MethodGet, wallet + "/statements?from=2021-01-01&to=2021-01-01&format=pdf", "", nil, http.StatusBadRequest, "bad_request"},
+		{"StatementNotFound", http.MethodGet, "/wallets/999/statements?from=2021-01-01&to=2021-01-01", "", nil, http.StatusNotFound, "wallet_not_found"},
+		{"StatementRange", http.MethodGet, wallet + "/statements?from=2021-01-01&to=2022-01-02", "", nil, http.StatusBadRequest, "statement_range_too_long"},
+
+		{"StreamNotFound", http.MethodGet, "/wallets/999/stream", "", nil, http.StatusNotFound, "wallet_not_found"},
+		{"StreamLastEventId", http.MethodGet, wallet + "/stream?lastEventId=x", "", nil, http.StatusBadRequest, "bad_request"},
+
+		{"TransactionWalletId", http.MethodPost, "/wallets/x/transactions", tx("5", "f", ""), nil, http.StatusBadRequest, "bad_request"},
+		{"TransactionSyntax", http.MethodPost, transactions, `{"amount": "ten"}`, nil, http.StatusBadRequest, "bad_request"},
+		{"TransactionValidation", http.MethodPost, transactions, `{"amount": 5}`, nil, http.StatusBadRequest, codeValidationFailed},
+		{"TransactionAmount", http.MethodPost, transactions, tx("0.5", "f2", ""), nil, http.StatusUnprocessableEntity, "invalid_amount"},
+		{"TransactionDecimals", http.MethodPost, transactions, tx("2.675", "f2", ""), nil, http.StatusUnprocessableEntity, "invalid_amount"},
+		{"TransactionWalletNotFound", http.MethodPost, "/wallets/999/transactions", tx("5", "f3", ""), nil, http.StatusNotFound, "wallet_not_found"},
+		{"TransactionBalance", http.MethodPost, transactions, tx("-50", "f4", ""), nil, http.StatusUnprocessableEntity, "insufficient_balance"},
+		{"TransactionFingerprint", http.MethodPost, transactions, tx("5", "f1", ""), nil, http.StatusConflict, "transaction_fingerprint_exists"},
+		{"TransactionPolicy", http.MethodPost, transactions, tx("5", "f5", `"reason": "bonus"`), nil, http.StatusForbidden, "policy_denied"},
+		{"TransactionConsistency", http.MethodPost, transactions, tx("5", "f6", ""), service.ErrTransactionConsistency, http.StatusConflict, "transaction_conflict"},
+		{"TransactionDb", http.MethodPost, transactions, tx("5", "f7", ""), dbErr, http.StatusServiceUnavailable, "unavailable"},
+		{"TransactionUnknown", http.MethodPost, transactions, tx("5", "f8", ""), unknownErr, http.StatusInternalServerError, "internal_error"},
+
+		{"LatestTransactionId", http.MethodGet, "/wallets/x/transactions/latest", "", nil, http.StatusBadRequest, "bad_request"},
+		{"LatestTransactionNotFound", http.MethodGet, "/wallets/" + strconv.Itoa(empty.ID) + "/transactions/latest", "", nil, http.StatusNotFound, "transaction_not_found"},
+
+		{"SubscriptionValidation", http.MethodPost, "/webhooks", `{"url": "not a url", "eventtypes": []}`, nil, http.StatusBadRequest, codeValidationFailed},
+		{"SubscriptionId", http.MethodGet, "/webhooks/x", "", nil, http.StatusBadRequest, "bad_request"},
+		{"SubscriptionNotFound", http.MethodGet, "/webhooks/999", "", nil, http.StatusNotFound, "subscription_not_found"},
+		{"DeleteSubscriptionNotFound", http.MethodDelete, "/webhooks/999", "", nil, http.StatusNotFound, "subscription_not_found"},
+		{"DeliveriesNotFound", http.MethodGet, "/webhooks/999/deliveries", "", nil, http.StatusNotFound, "subscription_not_found"},
+		{"RedeliverNotFound", http.MethodPost, "/webhooks/999/deliveries/1/redeliver", "", nil, http.StatusNotFound, "delivery_not_found"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			repo.err = tt.fault
+			defer func() { repo.err = nil }()
+
+			req := httptest.NewRequest(tt.method, tt.path, strings.NewReader(tt.body))
+			req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+			rec := httptest.NewRecorder()
+			e.ServeHTTP(rec, req)
+
+			require.Equal(t, tt.status, rec.Code, rec.Body.String())
+			assert.Equal(t, mimeProblemJSON, rec.Header().Get(echo.HeaderContentType))
+			p := &Problem{}
+			require.NoError(t, json.Unmarshal(rec.Body.Bytes(), p))
+			assert.Equal(t, tt.status, p.Status)
+			assert.Equal(t, tt.code, p.Code)
+
+			// details of server errors are not revealed
+			if tt.status >= http.StatusInternalServerError {
+				assert.Empty(t, p.Detail)
+				assert.NotContains(t, rec.Body.String(), "secret")
+				assert.NotContains(t, rec.Body.String(), "10.0.0.5")
+			}
+		})
+	}
+}
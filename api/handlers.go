@@ -1,9 +1,9 @@
 package api
 
 import (
-	"errors"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/go-playground/validator"
 	"github.com/labstack/echo/v4"
@@ -15,6 +15,9 @@ type walletHandler struct {
 	s service.Service
 	v *validator.Validate
 	l zerolog.Logger
+
+	// heartbeat is the interval of stream heartbeats; defaultHeartbeat if zero
+	heartbeat time.Duration
 }
 
 func (h *walletHandler) createWallet(c echo.Context) error {
@@ -22,25 +25,20 @@ func (h *walletHandler) createWallet(c echo.Context) error {
 
 	// bind
 	if err := c.Bind(req); err != nil {
-		h.l.Debug().Err(err).Msg("bind error")
+		requestLog(c, &h.l).Debug().Err(err).Msg("bind error")
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
 	// validate
 	if err := c.Validate(req); err != nil {
-		h.l.Debug().Err(err).Msg("validate error")
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		requestLog(c, &h.l).Debug().Err(err).Msg("validate error")
+		return validationError(err)
 	}
 
 	// handle
 	w, err := h.s.CreateWallet(c.Request().Context(), &req.WalletModel)
 	if err != nil {
-		if errors.Is(err, service.ErrWalletAlreadyExists) {
-			return echo.NewHTTPError(http.StatusConflict, err.Error())
-		}
-
-		h.l.Debug().Err(err).Msg("")
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return err
 	}
 
 	return c.JSON(http.StatusOK, CreateWalletResponse{*w})
@@ -50,19 +48,14 @@ func (h *walletHandler) getWallet(c echo.Context) error {
 	// validate
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		h.l.Debug().Err(err).Msg("route error")
+		requestLog(c, &h.l).Debug().Err(err).Msg("route error")
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
 	// handle
 	w, err := h.s.GetWallet(c.Request().Context(), id)
 	if err != nil {
-		if errors.Is(err, service.ErrWalletNotFound) {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
-		}
-
-		h.l.Debug().Err(err).Msg("")
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return err
 	}
 
 	return c.JSON(http.StatusOK, CreateWalletResponse{*w})
@@ -72,44 +65,27 @@ func (h *walletHandler) createTransaction(c echo.Context) error {
 	// route
 	wid, err := strconv.Atoi(c.Param("wid"))
 	if err != nil {
-		h.l.Debug().Err(err).Msg("route error")
+		requestLog(c, &h.l).Debug().Err(err).Msg("route error")
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
 	// bind
 	req := &CreateTransactionRequest{}
 	if err := c.Bind(req); err != nil {
-		h.l.Debug().Err(err).Msg("bind error")
+		requestLog(c, &h.l).Debug().Err(err).Msg("bind error")
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
 	// validate
 	if err := c.Validate(req); err != nil {
-		h.l.Debug().Err(err).Msg("validate error")
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		requestLog(c, &h.l).Debug().Err(err).Msg("validate error")
+		return validationError(err)
 	}
 
 	// handle
 	tr, err := h.s.CreateTransaction(c.Request().Context(), wid, &req.TransactionModel)
 	if err != nil {
-		if errors.Is(err, service.ErrWalletNotFound) {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
-		}
-		if errors.Is(err, service.ErrNotEnoughWalletBalance) {
-			return echo.NewHTTPError(http.StatusUnprocessableEntity, err.Error())
-		}
-		if errors.Is(err, service.ErrTransactionAlreadyExistsByFingerprint) {
-			return echo.NewHTTPError(http.StatusConflict, err.Error())
-		}
-		if errors.Is(err, service.ErrTransactionAlreadyExistsByRefNo) {
-			return echo.NewHTTPError(http.StatusConflict, err.Error())
-		}
-		if errors.Is(err, service.ErrTransactionConsistency) {
-			return echo.NewHTTPError(http.StatusConflict, err.Error())
-		}
-
-		h.l.Debug().Err(err).Msg("")
-		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		return err
 	}
 
 	return c.JSON(http.StatusOK, CreateTransactionResponse{*tr})
@@ -119,19 +95,14 @@ func (h *walletHandler) getLatestTransaction(c echo.Context) error {
 	// validate
 	id, err := strconv.Atoi(c.Param("wid"))
 	if err != nil {
-		h.l.Debug().Err(err).Msg("route error")
+		requestLog(c, &h.l).Debug().Err(err).Msg("route error")
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
 	// handle
 	tr, err := h.s.GetLatestTransaction(c.Request().Context(), id)
 	if err != nil {
-		if errors.Is(err, service.ErrTransactionNotFound) {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
-		}
-
-		h.l.Debug().Err(err).Msg("")
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		return err
 	}
 
 	return c.JSON(http.StatusOK, GetTransactionResponse{*tr})
@@ -141,20 +112,74 @@ func (h *walletHandler) getWalletBalance(c echo.Context) error {
 	// validate
 	id, err := strconv.Atoi(c.Param("id"))
 	if err != nil {
-		h.l.Debug().Err(err).Msg("route error")
+		requestLog(c, &h.l).Debug().Err(err).Msg("route error")
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
 	// handle
-	b, err := h.s.GetWalletBalance(c.Request().Context(), id)
-	if err != nil {
-		if errors.Is(err, service.ErrWalletNotFound) {
-			return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	var b float64
+	if at := c.QueryParam("at"); at != "" {
+		t, perr := time.Parse(time.RFC3339, at)
+		if perr != nil {
+			requestLog(c, &h.l).Debug().Err(perr).Msg("query error")
+			return echo.NewHTTPError(http.StatusBadRequest, "at should be an RFC3339 timestamp")
 		}
-
-		h.l.Debug().Err(err).Msg("")
-		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		b, err = h.s.GetBalanceAt(c.Request().Context(), id, t)
+	} else {
+		b, err = h.s.GetWalletBalance(c.Request().Context(), id)
+	}
+	if err != nil {
+		return err
 	}
 
 	return c.JSON(http.StatusOK, b)
 }
+
+func (h *walletHandler) getStatement(c echo.Context) error {
+	// validate
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		requestLog(c, &h.l).Debug().Err(err).Msg("route error")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	from, err := time.Parse(service.DayLayout, c.QueryParam("from"))
+	if err != nil {
+		requestLog(c, &h.l).Debug().Err(err).Msg("query error")
+		return echo.NewHTTPError(http.StatusBadRequest, "from should be a day like 2006-01-02")
+	}
+	to, err := time.Parse(service.DayLayout, c.QueryParam("to"))
+	if err != nil {
+		requestLog(c, &h.l).Debug().Err(err).Msg("query error")
+		return echo.NewHTTPError(http.StatusBadRequest, "to should be a day like 2006-01-02")
+	}
+	if to.Before(from) {
+		return echo.NewHTTPError(http.StatusBadRequest, "to should not be before from")
+	}
+
+	format := c.QueryParam("format")
+	if format == "" {
+		format = formatJson
+	}
+	if format != formatJson && format != formatCsv && format != formatText {
+		return echo.NewHTTPError(http.StatusBadRequest, "format should be one of json, csv, text")
+	}
+
+	// handle
+	st, err := h.s.GetStatement(c.Request().Context(), id, from, to)
+	if err != nil {
+		return err
+	}
+
+	switch format {
+	case formatCsv:
+		c.Response().Header().Set(echo.HeaderContentType, mimeTextCsv)
+		c.Response().WriteHeader(http.StatusOK)
+		return writeStatementCsv(c.Response(), st)
+	case formatText:
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextPlainCharsetUTF8)
+		c.Response().WriteHeader(http.StatusOK)
+		return writeStatementText(c.Response(), st)
+	}
+	return c.JSON(http.StatusOK, st)
+}
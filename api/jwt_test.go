@@ -0,0 +1,102 @@
+//go:build !integration
+// +build !integration
+
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/labstack/echo/v4"
+	"github.com/polarbit/bluelabs-wallet/config"
+	"github.com/polarbit/bluelabs-wallet/jwtauth"
+	"github.com/polarbit/bluelabs-wallet/memdb"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// jwtFixture verifies tokens of its rsa key with kid r1 and issuer gateway;
+// the verifier itself is tested by package jwtauth.
+type jwtFixture struct {
+	rsa *rsa.PrivateKey
+	v   *jwtauth.Verifier
+}
+
+func newJWTFixture(t *testing.T) *jwtFixture {
+	f := &jwtFixture{}
+	var err error
+	f.rsa, err = rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kid": "r1", "kty": "RSA", "alg": "RS256", "n": b64(f.rsa.N.Bytes()), "e": b64(big.NewInt(int64(f.rsa.E)).Bytes())}}})
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, jwks, 0600))
+
+	f.v, err = jwtauth.NewVerifier(&config.AppConfig{Jwks: path, JwtIssuer: "gateway"})
+	require.NoError(t, err)
+	return f
+}
+
+// token returns a token of the fixture for sub with the claims.
+func (f *jwtFixture) token(t *testing.T, claims jwt.MapClaims) string {
+	c := jwt.MapClaims{"sub": "svc-1", "iss": "gateway", "exp": time.Now().Add(time.Hour).Unix()}
+	for k, v := range claims {
+		c[k] = v
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, c)
+	tok.Header["kid"] = "r1"
+	s, err := tok.SignedString(f.rsa)
+	require.NoError(t, err)
+	return s
+}
+
+func TestBearerAuth(t *testing.T) {
+	f := newJWTFixture(t)
+	ctx := context.Background()
+	repo := memdb.NewRepository(zerolog.Nop())
+	s := service.NewWalletService(repo, zerolog.Nop())
+	e := New(s, service.NewWebhookService(repo, zerolog.Nop()))
+	e.Use(authenticate(zerolog.Nop(), e.Routes(), apiKeyAuthenticator(repo, zerolog.Nop()), bearerAuthenticator(f.v, zerolog.Nop())))
+
+	other, err := s.CreateWallet(ctx, &service.WalletModel{ExternalID: "other", Labels: map[string]string{service.TenantLabel: "brand2"}})
+	require.NoError(t, err)
+
+	do := func(method, path, token, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	admin := f.token(t, jwt.MapClaims{"scope": "admin", "tenant": "brand1"})
+
+	// wallets created by a tenant are labeled with it
+	rec := do(http.MethodPost, "/wallets", admin, `{"externalId": "mine"}`)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	w := service.Wallet{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &w))
+	assert.Equal(t, "brand1", w.Labels[service.TenantLabel])
+
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/wallets/"+strconv.Itoa(w.ID), admin, "").Code)
+	assert.Equal(t, http.StatusNotFound, do(http.MethodGet, "/wallets/"+strconv.Itoa(other.ID), admin, "").Code)
+	assert.Equal(t, http.StatusUnauthorized, do(http.MethodGet, "/wallets/"+strconv.Itoa(w.ID), "a.b.c", "").Code)
+}
@@ -0,0 +1,64 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/polarbit/bluelabs-wallet/metrics"
+)
+
+// unmatchedRoute is the route of requests matching no route; their paths are
+// not recorded as they are unbounded.
+const unmatchedRoute = "unmatched"
+
+// streamRoutes are not recorded, as their requests last as long as the
+// caller listens and would skew the latencies of the others.
+var streamRoutes = map[string]bool{
+	"/wallets/:id/stream": true,
+	"/wallets/:id/ws":     true,
+}
+
+// metricMethods are the methods recorded as is; others are recorded as
+// "other".
+var metricMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodHead:    true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// observeRequests records the latency of requests by route in m, except of
+// streams; routes are the registered ones. It writes the errors of handlers itself, to record
+// their status.
+func observeRequests(m *metrics.Metrics, routes []*echo.Route) echo.MiddlewareFunc {
+	paths := map[string]bool{}
+	for _, r := range routes {
+		paths[r.Path] = true
+	}
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			if err := next(c); err != nil {
+				c.Error(err)
+			}
+
+			method, route := c.Request().Method, c.Path()
+			if streamRoutes[route] {
+				return nil
+			}
+			if !metricMethods[method] {
+				method = "other"
+			}
+			if !paths[route] {
+				route = unmatchedRoute
+			}
+			m.ObserveRequest(method, route, c.Response().Status, time.Since(start))
+			return nil
+		}
+	}
+}
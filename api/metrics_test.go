@@ -0,0 +1,57 @@
+//go:build !integration
+// +build !integration
+
+package api
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/polarbit/bluelabs-wallet/memdb"
+	"github.com/polarbit/bluelabs-wallet/metrics"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestObserveRequests(t *testing.T) {
+	repo := memdb.NewRepository(zerolog.Nop())
+	m := metrics.New()
+	s := m.Service(service.NewWalletService(m.Repository(repo), zerolog.Nop()))
+	e := New(s, service.NewWebhookService(repo, zerolog.Nop()))
+	e.Use(observeRequests(m, e.Routes()))
+
+	w, err := s.CreateWallet(context.Background(), &service.WalletModel{ExternalID: "w1"})
+	require.NoError(t, err)
+
+	for _, r := range [][2]string{
+		{http.MethodGet, "/wallets/" + strconv.Itoa(w.ID)},
+		{http.MethodGet, "/wallets/999"},
+		{http.MethodGet, "/unknown/path"},
+		{"PURGE", "/wallets/1"},
+		{http.MethodGet, "/wallets/999/stream"},
+		{http.MethodGet, "/wallets/999/ws"},
+	} {
+		e.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(r[0], r[1], nil))
+	}
+
+	rec := httptest.NewRecorder()
+	m.Handler().ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body, _ := io.ReadAll(rec.Body)
+	out := string(body)
+
+	assert.Contains(t, out, `wallet_http_request_duration_seconds_count{method="GET",route="/wallets/:id",status="200"} 1`)
+	assert.Contains(t, out, `wallet_http_request_duration_seconds_count{method="GET",route="/wallets/:id",status="404"} 1`)
+	assert.Contains(t, out, `wallet_http_request_duration_seconds_count{method="GET",route="unmatched",status="404"} 1`)
+	assert.Contains(t, out, `wallet_http_request_duration_seconds_count{method="other",route="/wallets/:id",status="405"} 1`)
+	assert.NotContains(t, out, "/unknown/path")
+	assert.NotContains(t, out, "/wallets/:id/stream")
+	assert.NotContains(t, out, "/wallets/:id/ws")
+	assert.Contains(t, out, "wallet_wallets_created_total 1")
+	assert.Contains(t, out, "go_goroutines")
+}
@@ -0,0 +1,469 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+type (
+	// schema is an OpenAPI schema object
+	schema map[string]interface{}
+
+	// operation documents a route registered by registerRoutes. Path
+	// parameters are taken from the path; they are all integer ids.
+	operation struct {
+		method    string
+		path      string // echo path, e.g. /wallets/:id
+		id        string
+		tag       string
+		summary   string
+		params    []param
+		body      interface{} // request body, nil if none
+		responses []response
+	}
+
+	param struct {
+		name        string
+		in          string // query or header
+		description string
+		required    bool
+		schema      schema
+	}
+
+	response struct {
+		status      int
+		description string
+		// content maps media types to a go value whose type is documented, or
+		// to a schema; nil if there is no body
+		content map[string]interface{}
+	}
+)
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+	schemaType     = reflect.TypeOf(schema{})
+)
+
+func jsonContent(v interface{}) map[string]interface{} {
+	return map[string]interface{}{echo.MIMEApplicationJSON: v}
+}
+
+// problemContent is the content of error responses
+var problemContent = map[string]interface{}{mimeProblemJSON: Problem{}}
+
+func ok(description string, v interface{}) response {
+	return response{status: http.StatusOK, description: description, content: jsonContent(v)}
+}
+
+func fail(status int, description string) response {
+	return response{status: status, description: description, content: problemContent}
+}
+
+var (
+	badRequest = fail(http.StatusBadRequest, "invalid request")
+	notFound   = fail(http.StatusNotFound, "not found")
+	denied     = fail(http.StatusForbidden, "missing scope, or operation is not allowed by policy")
+
+	afterParams = []param{
+		{name: "Last-Event-ID", in: "header", description: "refno of the last received transaction; the stream starts after it",
+			schema: schema{"type": "integer", "minimum": 0}},
+		{name: "lastEventId", in: "query", description: "same as the Last-Event-ID header, for clients which cannot set it",
+			schema: schema{"type": "integer", "minimum": 0}},
+	}
+)
+
+// operations documents every route of the api
+var operations = []operation{
+	{method: http.MethodPost, path: "/wallets", id: "createWallet", tag: "wallets",
+		summary: "Creates a wallet; externalId is unique and makes the request idempotent",
+		body:    CreateWalletRequest{},
+		responses: []response{ok("the created wallet", CreateWalletResponse{}), badRequest,
+			denied, fail(http.StatusConflict, "a wallet with the external id exists")}},
+	{method: http.MethodGet, path: "/wallets/:id", id: "getWallet", tag: "wallets",
+		summary:   "Returns the wallet",
+		responses: []response{ok("the wallet", CreateWalletResponse{}), badRequest, notFound}},
+	{method: http.MethodGet, path: "/wallets/:id/balance", id: "getWalletBalance", tag: "wallets",
+		summary: "Returns the current balance of the wallet, or its balance at a time",
+		params: []param{{name: "at", in: "query", description: "RFC3339 time; the balance after the last transaction at or before it",
+			schema: schema{"type": "string", "format": "date-time"}}},
+		responses: []response{ok("the balance", schema{"type": "number", "format": "double"}), badRequest, notFound}},
+	{method: http.MethodGet, path: "/wallets/:id/statements", id: "getStatement", tag: "wallets",
+		summary: "Lists transactions created between two days (UTC, inclusive) with opening and closing balances",
+		params: []param{
+			{name: "from", in: "query", description: "first day", required: true, schema: schema{"type": "string", "format": "date"}},
+			{name: "to", in: "query", description: "last day, at most 365 days after from", required: true, schema: schema{"type": "string", "format": "date"}},
+			{name: "format", in: "query", schema: schema{"type": "string", "enum": []string{formatJson, formatCsv, formatText}, "default": formatJson}},
+		},
+		responses: []response{{status: http.StatusOK, description: "the statement", content: map[string]interface{}{
+			echo.MIMEApplicationJSON: service.Statement{},
+			mimeTextCsv:              schema{"type": "string"},
+			echo.MIMETextPlain:       schema{"type": "string"},
+		}}, badRequest, notFound,
+			fail(http.StatusUnprocessableEntity, "statement has more than 10000 transactions")}},
+	{method: http.MethodGet, path: "/wallets/:id/stream", id: "streamWallet", tag: "wallets",
+		summary: "Streams transaction and balance events of the wallet as server-sent events",
+		params:  afterParams,
+		responses: []response{{status: http.StatusOK, description: "event stream; event ids are refnos",
+			content: map[string]interface{}{"text/event-stream": schema{"type": "string"}}}, badRequest, notFound}},
+	{method: http.MethodGet, path: "/wallets/:id/ws", id: "streamWalletWs", tag: "wallets",
+		summary: "Streams transaction and balance events of the wallet over a websocket, as json StreamMessages",
+		params:  afterParams,
+		responses: []response{{status: http.StatusSwitchingProtocols, description: "websocket of StreamMessage",
+			content: jsonContent(StreamMessage{})}, badRequest, notFound}},
+	{method: http.MethodPost, path: "/wallets/:wid/transactions", id: "createTransaction", tag: "transactions",
+		summary: "Adds a transaction to the wallet; fingerprint is unique and makes the request idempotent",
+		body:    CreateTransactionRequest{},
+		responses: []response{ok("the created transaction", CreateTransactionResponse{}), badRequest, denied, notFound,
+			fail(http.StatusConflict, "a transaction with the fingerprint exists, or a concurrent transaction won; retriable"),
+			fail(http.StatusUnprocessableEntity, "wallet balance is not enough, or amount is between -1.0 and 1.0 or has more than two decimals")}},
+	{method: http.MethodGet, path: "/wallets/:wid/transactions/latest", id: "getLatestTransaction", tag: "transactions",
+		summary:   "Returns the latest transaction of the wallet",
+		responses: []response{ok("the latest transaction", GetTransactionResponse{}), badRequest, notFound}},
+	{method: http.MethodPost, path: "/webhooks", id: "createSubscription", tag: "webhooks",
+		summary:   "Subscribes a url to events; the secret is generated when not given and returned only here",
+		body:      CreateSubscriptionRequest{},
+		responses: []response{ok("the subscription with its secret", service.Subscription{}), badRequest}},
+	{method: http.MethodGet, path: "/webhooks", id: "listSubscriptions", tag: "webhooks",
+		summary:   "Lists subscriptions",
+		responses: []response{ok("the subscriptions", []service.Subscription{})}},
+	{method: http.MethodGet, path: "/webhooks/:id", id: "getSubscription", tag: "webhooks",
+		summary:   "Returns the subscription",
+		responses: []response{ok("the subscription", service.Subscription{}), badRequest, notFound}},
+	{method: http.MethodDelete, path: "/webhooks/:id", id: "deleteSubscription", tag: "webhooks",
+		summary:   "Deletes the subscription with its deliveries",
+		responses: []response{{status: http.StatusNoContent, description: "deleted"}, badRequest, notFound}},
+	{method: http.MethodGet, path: "/webhooks/:id/deliveries", id: "listDeliveries", tag: "webhooks",
+		summary: "Lists deliveries of the subscription ordered by id",
+		params: []param{
+			{name: "after", in: "query", description: "delivery id to list after", schema: schema{"type": "integer", "format": "int64"}},
+			{name: "limit", in: "query", schema: schema{"type": "integer", "minimum": 1, "maximum": maxDeliveryPage, "default": maxDeliveryPage}},
+		},
+		responses: []response{ok("the deliveries", []service.Delivery{}), badRequest, notFound}},
+	{method: http.MethodPost, path: "/webhooks/:id/deliveries/:did/redeliver", id: "redeliver", tag: "webhooks",
+		summary:   "Schedules the delivery again with a fresh retry budget",
+		responses: []response{ok("the delivery", service.Delivery{}), badRequest, notFound}},
+	{method: http.MethodGet, path: "/openapi.json", id: "getOpenAPI", tag: "docs",
+		summary:   "Returns this document",
+		responses: []response{ok("OpenAPI 3 document", schema{"type": "object"})}},
+	{method: http.MethodGet, path: "/docs", id: "getDocs", tag: "docs",
+		summary: "Interactive documentation of the api",
+		responses: []response{{status: http.StatusOK, description: "html page",
+			content: map[string]interface{}{echo.MIMETextHTML: schema{"type": "string"}}}}},
+}
+
+var openAPI struct {
+	once sync.Once
+	doc  []byte
+	err  error
+}
+
+func serveOpenAPI(c echo.Context) error {
+	openAPI.once.Do(func() {
+		var spec map[string]interface{}
+		if spec, openAPI.err = buildOpenAPI(); openAPI.err == nil {
+			openAPI.doc, openAPI.err = json.Marshal(spec)
+		}
+	})
+	if openAPI.err != nil {
+		return openAPI.err
+	}
+	return c.JSONBlob(http.StatusOK, openAPI.doc)
+}
+
+const docsPage = `<!DOCTYPE html>
+<html>
+<head>
+	<title>Wallet API</title>
+	<link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@5/swagger-ui.css">
+</head>
+<body>
+	<div id="swagger-ui"></div>
+	<script src="https://unpkg.com/swagger-ui-dist@5/swagger-ui-bundle.js"></script>
+	<script>SwaggerUIBundle({url: "/openapi.json", dom_id: "#swagger-ui"});</script>
+</body>
+</html>
+`
+
+func serveDocs(c echo.Context) error {
+	return c.HTML(http.StatusOK, docsPage)
+}
+
+// buildOpenAPI returns the OpenAPI 3 document of operations. Schemas of
+// request and response types are reflected from their json and validate tags.
+func buildOpenAPI() (map[string]interface{}, error) {
+	b := &specBuilder{schemas: map[string]interface{}{}}
+	paths := map[string]interface{}{}
+
+	for _, op := range operations {
+		params := []interface{}{}
+		for _, name := range pathParams(op.path) {
+			params = append(params, schema{"name": name, "in": "path", "required": true, "schema": schema{"type": "integer"}})
+		}
+		for _, p := range op.params {
+			ps := schema{"name": p.name, "in": p.in, "required": p.required, "schema": p.schema}
+			if p.description != "" {
+				ps["description"] = p.description
+			}
+			params = append(params, ps)
+		}
+
+		responses := map[string]interface{}{}
+		for _, r := range op.responses {
+			res := schema{"description": r.description}
+			if r.content != nil {
+				content := map[string]interface{}{}
+				for mt, v := range r.content {
+					content[mt] = schema{"schema": b.schemaOf(reflect.TypeOf(v), v)}
+				}
+				res["content"] = content
+			}
+			responses[strconv.Itoa(r.status)] = res
+		}
+
+		o := schema{
+			"operationId": op.id,
+			"tags":        []string{op.tag},
+			"summary":     op.summary,
+			"parameters":  params,
+			"responses":   responses,
+		}
+		if scope := routeScope(op.method, op.path); scope != "" {
+			o["security"] = []interface{}{schema{"apiKey": []string{}}, schema{"bearer": []string{}}}
+			o["description"] = "Requires an api key or bearer token with scope " + scope + "."
+			// routes of clients are rate limited when limits are configured
+			responses[strconv.Itoa(http.StatusTooManyRequests)] = schema{
+				"description": "rate limit of the client or the wallet exceeded; retry after Retry-After seconds",
+				"headers": schema{
+					headerRetryAfter:         schema{"schema": schema{"type": "integer"}},
+					headerRateLimitLimit:     schema{"schema": schema{"type": "integer"}},
+					headerRateLimitRemaining: schema{"schema": schema{"type": "integer"}},
+					headerRateLimitReset:     schema{"schema": schema{"type": "integer"}},
+				},
+				"content": schema{mimeProblemJSON: schema{"schema": b.schemaOf(reflect.TypeOf(Problem{}), Problem{})}},
+			}
+		}
+		if op.body != nil {
+			o["requestBody"] = schema{"required": true, "content": jsonContent(schema{"schema": b.schemaOf(reflect.TypeOf(op.body), nil)})}
+		}
+
+		path := openAPIPath(op.path)
+		item, ok := paths[path].(schema)
+		if !ok {
+			item = schema{}
+			paths[path] = item
+		}
+		item[strings.ToLower(op.method)] = o
+	}
+
+	if b.err != nil {
+		return nil, b.err
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": schema{
+			"title":       "Wallet API",
+			"version":     "1.0",
+			"description": "Wallets, transactions and webhooks. Errors are returned as application/problem+json (RFC 7807) with a stable code, e.g. insufficient_balance.",
+		},
+		"paths": paths,
+		"components": schema{
+			"schemas": b.schemas,
+			"securitySchemes": schema{
+				"apiKey": schema{"type": "apiKey", "in": "header", "name": apiKeyHeader},
+				"bearer": schema{"type": "http", "scheme": "bearer", "bearerFormat": "JWT"},
+			},
+		},
+	}, nil
+}
+
+// openAPIPath converts echo path parameters (:id) to OpenAPI ones ({id})
+func openAPIPath(path string) string {
+	segs := strings.Split(path, "/")
+	for i, s := range segs {
+		if strings.HasPrefix(s, ":") {
+			segs[i] = "{" + s[1:] + "}"
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+func pathParams(path string) []string {
+	names := []string{}
+	for _, s := range strings.Split(path, "/") {
+		if strings.HasPrefix(s, ":") {
+			names = append(names, s[1:])
+		}
+	}
+	return names
+}
+
+// specBuilder reflects schemas of go types; structs are added to the
+// components by name and referenced.
+type specBuilder struct {
+	schemas map[string]interface{}
+	err     error
+}
+
+// schemaOf returns the schema of t; v is returned as is if it is a schema.
+func (b *specBuilder) schemaOf(t reflect.Type, v interface{}) schema {
+	if t == schemaType {
+		return v.(schema)
+	}
+	for t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+
+	switch t {
+	case timeType:
+		return schema{"type": "string", "format": "date-time"}
+	case rawMessageType:
+		return schema{"description": "any json value"}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return schema{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return schema{"type": "integer"}
+	case reflect.Int64, reflect.Uint64:
+		return schema{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return schema{"type": "number", "format": "double"}
+	case reflect.String:
+		return schema{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		return schema{"type": "array", "items": b.schemaOf(t.Elem(), nil)}
+	case reflect.Map:
+		return schema{"type": "object", "additionalProperties": b.schemaOf(t.Elem(), nil)}
+	case reflect.Interface:
+		return schema{}
+	case reflect.Struct:
+		if _, ok := b.schemas[t.Name()]; !ok {
+			b.schemas[t.Name()] = schema{} // placeholder for recursive types
+			b.schemas[t.Name()] = b.structSchema(t)
+		}
+		return schema{"$ref": "#/components/schemas/" + t.Name()}
+	}
+
+	b.fail(fmt.Errorf("%v: type is not supported", t))
+	return schema{}
+}
+
+func (b *specBuilder) structSchema(t reflect.Type) schema {
+	props := map[string]interface{}{}
+	required := []string{}
+	b.fields(t, props, &required)
+
+	s := schema{"type": "object", "properties": props}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// fields adds the json fields of t to props, inlining embedded structs as
+// encoding/json does.
+func (b *specBuilder) fields(t reflect.Type, props map[string]interface{}, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		name := strings.Split(tag, ",")[0]
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			b.fields(f.Type, props, required)
+			continue
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+
+		s := b.schemaOf(f.Type, nil)
+		if rules := f.Tag.Get("validate"); rules != "" {
+			if b.applyRules(s, f.Type, rules) {
+				*required = append(*required, name)
+			}
+		}
+		props[name] = s
+	}
+}
+
+// applyRules adds the validate rules of a field of type t to its schema s and
+// reports whether the field is required. Rules after dive apply to items.
+func (b *specBuilder) applyRules(s schema, t reflect.Type, rules string) bool {
+	required := false
+	for _, rule := range strings.Split(rules, ",") {
+		name, arg := rule, ""
+		if i := strings.Index(rule, "="); i >= 0 {
+			name, arg = rule[:i], rule[i+1:]
+		}
+
+		switch name {
+		case "required":
+			required = true
+		case "omitempty":
+		case "dive":
+			items, ok := s["items"].(schema)
+			if !ok {
+				b.fail(fmt.Errorf("%q: dive into %v", rules, t))
+				return required
+			}
+			s, t = items, t.Elem()
+		case "min", "max":
+			n, err := strconv.ParseFloat(arg, 64)
+			if err != nil {
+				b.fail(fmt.Errorf("%q: %w", rules, err))
+				continue
+			}
+			s[limitKeyword(t, name)] = n
+		case "url":
+			s["format"] = "uri"
+		case "oneof":
+			s["enum"] = strings.Fields(arg)
+		default:
+			b.fail(fmt.Errorf("%q: rule %s is not documented", rules, name))
+		}
+	}
+	return required
+}
+
+// limitKeyword returns the schema keyword of a min or max rule, which limits
+// length of strings, size of slices and maps and value of numbers.
+func limitKeyword(t reflect.Type, rule string) string {
+	var kw string
+	switch t.Kind() {
+	case reflect.String:
+		kw = "Length"
+	case reflect.Slice, reflect.Array:
+		kw = "Items"
+	case reflect.Map:
+		kw = "Properties"
+	default:
+		if rule == "min" {
+			return "minimum"
+		}
+		return "maximum"
+	}
+	return rule + kw
+}
+
+func (b *specBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
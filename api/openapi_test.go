@@ -0,0 +1,89 @@
+//go:build !integration
+// +build !integration
+
+package api
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// TestOpenAPIRoutes fails when a route is registered without being
+// documented, or documented without being registered.
+func TestOpenAPIRoutes(t *testing.T) {
+	e := echo.New()
+	registerRoutes(e, &walletHandler{}, &webhookHandler{})
+
+	routes := []string{}
+	for _, r := range e.Routes() {
+		routes = append(routes, r.Method+" "+openAPIPath(r.Path))
+	}
+
+	spec, err := buildOpenAPI()
+	require.NoError(t, err)
+
+	documented := []string{}
+	for path, item := range spec["paths"].(map[string]interface{}) {
+		for method := range item.(schema) {
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+		}
+	}
+
+	sort.Strings(routes)
+	sort.Strings(documented)
+	assert.Equal(t, routes, documented)
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	spec, err := buildOpenAPI()
+	require.NoError(t, err)
+	schemas := spec["components"].(schema)["schemas"].(map[string]interface{})
+	props := func(name string) map[string]interface{} {
+		return schemas[name].(schema)["properties"].(map[string]interface{})
+	}
+
+	// constraints come from validate tags of embedded models
+	wallet := schemas["CreateWalletRequest"].(schema)
+	assert.Equal(t, []string{"externalId"}, wallet["required"])
+	assert.Equal(t, 50., props("CreateWalletRequest")["externalId"].(schema)["maxLength"])
+	assert.Equal(t, 10., props("CreateWalletRequest")["labels"].(schema)["maxProperties"])
+
+	assert.ElementsMatch(t, []string{"amount", "description", "fingerprint"}, schemas["CreateTransactionRequest"].(schema)["required"])
+	assert.Equal(t, 100., props("CreateTransactionRequest")["description"].(schema)["maxLength"])
+
+	sub := props("CreateSubscriptionRequest")
+	assert.Equal(t, "uri", sub["url"].(schema)["format"])
+	assert.Equal(t, 1., sub["eventtypes"].(schema)["minItems"])
+	assert.Equal(t, []string{"WalletCreated", "TransactionCreated", "BalanceChanged", "TransactionVoid"},
+		sub["eventtypes"].(schema)["items"].(schema)["enum"])
+
+	// json:"-" fields are not documented
+	assert.NotContains(t, props("Transaction"), "Journal")
+	assert.Equal(t, "#/components/schemas/Transaction", props("Statement")["transactions"].(schema)["items"].(schema)["$ref"])
+}
+
+func TestServeOpenAPI(t *testing.T) {
+	e := echo.New()
+	registerRoutes(e, &walletHandler{}, &webhookHandler{})
+
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/openapi.json", nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	doc := map[string]interface{}{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &doc))
+	assert.Equal(t, "3.0.3", doc["openapi"])
+
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/docs", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Contains(t, rec.Body.String(), "/openapi.json")
+}
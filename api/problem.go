@@ -0,0 +1,239 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/go-playground/validator"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+// mimeProblemJSON is the media type of error responses (RFC 7807)
+const mimeProblemJSON = "application/problem+json"
+
+// problemTypeBase prefixes the code of a problem to make its type uri
+const problemTypeBase = "urn:bluelabs-wallet:problem:"
+
+// Codes of problems which are not service errors
+const (
+	codeValidationFailed = "validation_failed"
+	codeRateLimited      = "rate_limited"
+)
+
+// statusCodes are the codes of problems without a more specific one
+var statusCodes = map[int]string{
+	http.StatusBadRequest:            "bad_request",
+	http.StatusUnauthorized:          "unauthorized",
+	http.StatusForbidden:             "forbidden",
+	http.StatusNotFound:              "not_found",
+	http.StatusMethodNotAllowed:      "method_not_allowed",
+	http.StatusConflict:              "conflict",
+	http.StatusRequestEntityTooLarge: "request_too_large",
+	http.StatusUnprocessableEntity:   "unprocessable",
+	http.StatusTooManyRequests:       codeRateLimited,
+	http.StatusInternalServerError:   "internal_error",
+	http.StatusServiceUnavailable:    "unavailable",
+}
+
+// Problem is the body of error responses, an RFC 7807 problem details object
+// with a stable Code for machines and the id of the request.
+type Problem struct {
+	Type      string       `json:"type"`
+	Title     string       `json:"title"`
+	Status    int          `json:"status"`
+	Detail    string       `json:"detail,omitempty"`
+	Code      string       `json:"code"`
+	RequestID string       `json:"requestId,omitempty"`
+	Errors    []FieldError `json:"errors,omitempty"`
+}
+
+// FieldError is a field of the request body which failed validation.
+type FieldError struct {
+	Field   string `json:"field"` // json path, e.g. labels or eventtypes[0]
+	Rule    string `json:"rule"`
+	Param   string `json:"param,omitempty"`
+	Message string `json:"message"`
+}
+
+// serviceStatuses are the statuses of service errors returned by handlers;
+// other service errors are internal errors.
+var serviceStatuses = map[*service.ServiceError]int{
+	service.ErrWalletNotFound:                        http.StatusNotFound,
+	service.ErrTransactionNotFound:                   http.StatusNotFound,
+	service.ErrSnapshotNotFound:                      http.StatusNotFound,
+	service.ErrSubscriptionNotFound:                  http.StatusNotFound,
+	service.ErrDeliveryNotFound:                      http.StatusNotFound,
+	service.ErrWalletAlreadyExists:                   http.StatusConflict,
+	service.ErrTransactionAlreadyExistsByFingerprint: http.StatusConflict,
+	service.ErrTransactionAlreadyExistsByRefNo:       http.StatusConflict,
+	service.ErrTransactionConsistency:                http.StatusConflict,
+	service.ErrAPIKeyAlreadyExists:                   http.StatusConflict,
+	service.ErrAPIKeyNotFound:                        http.StatusUnauthorized,
+	service.ErrPolicyDenied:                          http.StatusForbidden,
+	service.ErrNotEnoughWalletBalance:                http.StatusUnprocessableEntity,
+	service.ErrInvalidAmount:                         http.StatusUnprocessableEntity,
+	service.ErrStatementRangeTooLong:                 http.StatusBadRequest,
+	service.ErrStatementTooLarge:                     http.StatusUnprocessableEntity,
+}
+
+// validationError returns the response of a request body which failed
+// validation, listing the failed fields.
+func validationError(err error) *echo.HTTPError {
+	return echo.NewHTTPError(http.StatusBadRequest, "request body is invalid").SetInternal(err)
+}
+
+// newProblem returns the problem of a handler error:
+//   - *echo.HTTPError keeps its status and message; its internal error may
+//     be a service or validation error, which sets the code
+//   - validation errors of the request body are 400 and list the fields
+//   - service errors have the status of serviceStatuses
+//   - *service.DbError is 503, as the storage is likely unavailable
+//   - anything else is 500
+//
+// Details of 5xx problems are hidden; the caller logs them.
+func newProblem(err error) *Problem {
+	p := &Problem{Status: http.StatusInternalServerError}
+	cause := err
+
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		p.Status, p.Detail = he.Code, fmt.Sprint(he.Message)
+		cause = he.Internal
+	}
+
+	var se *service.ServiceError
+	var ve validator.ValidationErrors
+	var de *service.DbError
+	switch {
+	case cause == nil:
+	case errors.As(cause, &ve):
+		if he == nil {
+			p.Status, p.Detail = http.StatusBadRequest, "request body is invalid"
+		}
+		p.Code = codeValidationFailed
+		p.Errors = fieldErrors(ve)
+	case errors.As(cause, &se):
+		if he == nil {
+			status, ok := serviceStatuses[se]
+			if !ok {
+				status = http.StatusInternalServerError
+			}
+			p.Status, p.Detail = status, err.Error()
+		}
+		if p.Status < http.StatusInternalServerError {
+			p.Code, p.Title = se.Code, se.Msg
+		}
+	case errors.As(cause, &de):
+		if he == nil {
+			p.Status = http.StatusServiceUnavailable
+		}
+	}
+
+	if p.Title == "" {
+		p.Title = http.StatusText(p.Status)
+	}
+	if p.Status >= http.StatusInternalServerError || p.Detail == p.Title {
+		p.Detail = ""
+	}
+	if p.Code == "" {
+		p.Code = statusCodes[p.Status]
+	}
+	if p.Code == "" {
+		p.Code = strings.ReplaceAll(strings.ToLower(p.Title), " ", "_")
+	}
+	p.Type = problemTypeBase + p.Code
+	return p
+}
+
+// problemErrorHandler is the error handler of the api: it writes errors of
+// handlers and middlewares as application/problem+json (see newProblem).
+func problemErrorHandler(l zerolog.Logger) echo.HTTPErrorHandler {
+	return func(err error, c echo.Context) {
+		rl := requestLog(c, &l)
+		if c.Response().Committed {
+			rl.Debug().Err(err).Msg("error after response is committed")
+			return
+		}
+
+		p := newProblem(err)
+		if p.Status >= http.StatusInternalServerError {
+			rl.Error().Err(err).Msg("request failed")
+		} else {
+			rl.Debug().Err(err).Msg("request rejected")
+		}
+		p.RequestID = c.Response().Header().Get(echo.HeaderXRequestID)
+		if p.RequestID == "" {
+			p.RequestID = c.Request().Header.Get(echo.HeaderXRequestID)
+		}
+
+		if c.Request().Method == http.MethodHead {
+			err = c.NoContent(p.Status)
+		} else {
+			c.Response().Header().Set(echo.HeaderContentType, mimeProblemJSON)
+			err = c.JSON(p.Status, p)
+		}
+		if err != nil {
+			rl.Error().Err(err).Msg("write error response failed")
+		}
+	}
+}
+
+// fieldErrors converts validation errors to field errors named by json.
+func fieldErrors(ve validator.ValidationErrors) []FieldError {
+	errs := make([]FieldError, 0, len(ve))
+	for _, fe := range ve {
+		errs = append(errs, FieldError{
+			Field:   fieldPath(fe.Namespace(), fe.StructNamespace()),
+			Rule:    fe.Tag(),
+			Param:   fe.Param(),
+			Message: ruleMessage(fe.Tag(), fe.Param()),
+		})
+	}
+	return errs
+}
+
+// fieldPath returns the json path of a field from its namespaces, without the
+// request type and embedded structs, whose json and go names are the same.
+func fieldPath(ns, structNs string) string {
+	names := strings.Split(ns, ".")
+	goNames := strings.Split(structNs, ".")
+	path := []string{}
+	for i := 1; i < len(names); i++ {
+		if i < len(names)-1 && i < len(goNames) && names[i] == goNames[i] {
+			continue
+		}
+		path = append(path, names[i])
+	}
+	return strings.Join(path, ".")
+}
+
+func ruleMessage(rule, param string) string {
+	switch rule {
+	case "required":
+		return "is required"
+	case "max":
+		return "should be at most " + param
+	case "min":
+		return "should be at least " + param
+	case "url":
+		return "should be a url"
+	case "oneof":
+		return "should be one of " + strings.ReplaceAll(param, " ", ", ")
+	}
+	return "failed on rule " + rule
+}
+
+// jsonFieldName names fields of validation errors by their json names.
+func jsonFieldName(f reflect.StructField) string {
+	name := strings.SplitN(f.Tag.Get("json"), ",", 2)[0]
+	if name == "-" {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,86 @@
+//go:build !integration
+// +build !integration
+
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/polarbit/bluelabs-wallet/memdb"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProblems(t *testing.T) {
+	ctx := context.Background()
+	repo := memdb.NewRepository(zerolog.Nop())
+	s := service.NewWalletService(repo, zerolog.Nop())
+	e := New(s, service.NewWebhookService(repo, zerolog.Nop()))
+	e.Use(requestLogger(zerolog.Nop()))
+
+	w, err := s.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+	require.NoError(t, err)
+	transactions := "/wallets/" + strconv.Itoa(w.ID) + "/transactions"
+
+	do := func(method, path, body string) (*httptest.ResponseRecorder, *Problem) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		assert.Equal(t, mimeProblemJSON, rec.Header().Get(echo.HeaderContentType))
+		p := &Problem{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), p))
+		assert.Equal(t, rec.Code, p.Status)
+		assert.Equal(t, problemTypeBase+p.Code, p.Type)
+		assert.Equal(t, rec.Header().Get(echo.HeaderXRequestID), p.RequestID)
+		assert.NotEmpty(t, p.RequestID)
+		return rec, p
+	}
+
+	t.Run("ServiceError", func(t *testing.T) {
+		_, p := do(http.MethodPost, transactions, `{"amount": -10, "description": "withdraw", "fingerprint": "f1"}`)
+		assert.Equal(t, http.StatusUnprocessableEntity, p.Status)
+		assert.Equal(t, service.ErrNotEnoughWalletBalance.Code, p.Code)
+		assert.Equal(t, service.ErrNotEnoughWalletBalance.Msg, p.Title)
+
+		_, p = do(http.MethodGet, "/wallets/999", "")
+		assert.Equal(t, service.ErrWalletNotFound.Code, p.Code)
+	})
+
+	t.Run("Validation", func(t *testing.T) {
+		_, p := do(http.MethodPost, transactions, `{"amount": 10, "description": "`+strings.Repeat("d", 101)+`"}`)
+		assert.Equal(t, http.StatusBadRequest, p.Status)
+		assert.Equal(t, codeValidationFailed, p.Code)
+		assert.Equal(t, []FieldError{
+			{Field: "description", Rule: "max", Param: "100", Message: "should be at most 100"},
+			{Field: "fingerprint", Rule: "required", Message: "is required"},
+		}, p.Errors)
+
+		_, p = do(http.MethodPost, "/webhooks", `{"url": "http://localhost/hook", "eventtypes": ["WalletCreated", "Unknown"]}`)
+		require.Len(t, p.Errors, 1)
+		assert.Equal(t, "eventtypes[1]", p.Errors[0].Field)
+		assert.Equal(t, "oneof", p.Errors[0].Rule)
+	})
+
+	t.Run("Generic", func(t *testing.T) {
+		_, p := do(http.MethodGet, "/wallets/abc", "")
+		assert.Equal(t, "bad_request", p.Code)
+		assert.NotEmpty(t, p.Detail)
+
+		_, p = do(http.MethodGet, "/unknown", "")
+		assert.Equal(t, http.StatusNotFound, p.Status)
+		assert.Equal(t, "not_found", p.Code)
+		assert.Equal(t, http.StatusText(http.StatusNotFound), p.Title)
+		assert.Empty(t, p.Detail)
+	})
+}
@@ -0,0 +1,119 @@
+package api
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+
+	"github.com/polarbit/bluelabs-wallet/ratelimit"
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+// Headers of rate limited responses (draft-ietf-httpapi-ratelimit-headers)
+const (
+	headerRateLimitLimit     = "RateLimit-Limit"
+	headerRateLimitRemaining = "RateLimit-Remaining"
+	headerRateLimitReset     = "RateLimit-Reset"
+	headerRetryAfter         = "Retry-After"
+)
+
+// walletLimitedRoutes are limited per wallet too, keyed by method and echo
+// path; concurrent transactions of a wallet conflict with each other.
+var walletLimitedRoutes = map[string]bool{
+	"POST /wallets/:wid/transactions": true,
+}
+
+// ipExtractor returns the extractor of the ip of callers. Callers cannot
+// choose it by X-Forwarded-For: it is the address of the connection, or with
+// trusted proxies the last address of X-Forwarded-For which is not of one.
+func ipExtractor(proxies []*net.IPNet) echo.IPExtractor {
+	if len(proxies) == 0 {
+		return echo.ExtractIPDirect()
+	}
+	opts := []echo.TrustOption{echo.TrustLoopback(false), echo.TrustLinkLocal(false), echo.TrustPrivateNet(false)}
+	for _, n := range proxies {
+		opts = append(opts, echo.TrustIPRange(n))
+	}
+	return echo.ExtractIPFromXFFHeader(opts...)
+}
+
+// rateLimit rejects requests over the limits of their client, or of their
+// wallet on walletLimitedRoutes, with 429 and Retry-After. Requests are
+// counted per principal, or per ip of callers without one, so it runs after
+// authenticate. Requests are allowed if the store fails.
+func rateLimit(lm *ratelimit.Limiter, l zerolog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if publicRoutes[req.Method+" "+c.Path()] {
+				return next(c)
+			}
+
+			client := "ip:" + c.RealIP()
+			if p := service.PrincipalFrom(req.Context()); p != nil {
+				client = p.Client
+			}
+			wid := 0
+			if walletLimitedRoutes[req.Method+" "+c.Path()] {
+				// invalid ids are rejected by the handler
+				wid, _ = strconv.Atoi(c.Param("wid"))
+			}
+
+			r, err := lm.Allow(req.Context(), client, wid)
+			if err != nil {
+				l.Error().Err(err).Msg("rate limit failed")
+				return next(c)
+			}
+
+			if r.Limit > 0 {
+				h := c.Response().Header()
+				h.Set(headerRateLimitLimit, strconv.Itoa(r.Limit))
+				h.Set(headerRateLimitRemaining, strconv.Itoa(r.Remaining))
+				h.Set(headerRateLimitReset, ceilSeconds(r.Reset))
+			}
+			if !r.Allowed {
+				l.Debug().Str("client", client).Int("wid", wid).Msg("rate limit exceeded")
+				c.Response().Header().Set(headerRetryAfter, ceilSeconds(r.RetryAfter))
+				return echo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
+			}
+			return next(c)
+		}
+	}
+}
+
+// limitIP rejects requests over the limit of their ip with 429 and
+// Retry-After. It runs before authenticate, so requests failing to
+// authenticate are limited too. Requests are allowed if the store fails.
+func limitIP(lm *ratelimit.Limiter, l zerolog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if publicRoutes[req.Method+" "+c.Path()] {
+				return next(c)
+			}
+
+			ip := c.RealIP()
+			r, err := lm.AllowIP(req.Context(), ip)
+			if err != nil {
+				l.Error().Err(err).Msg("rate limit failed")
+				return next(c)
+			}
+			if !r.Allowed {
+				l.Debug().Str("ip", ip).Msg("ip rate limit exceeded")
+				c.Response().Header().Set(headerRetryAfter, ceilSeconds(r.RetryAfter))
+				return echo.NewHTTPError(http.StatusTooManyRequests, "rate limit exceeded")
+			}
+			return next(c)
+		}
+	}
+}
+
+// ceilSeconds formats d as whole seconds, rounded up
+func ceilSeconds(d time.Duration) string {
+	return strconv.Itoa(int(math.Ceil(d.Seconds())))
+}
@@ -0,0 +1,144 @@
+//go:build !integration
+// +build !integration
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/polarbit/bluelabs-wallet/config"
+	"github.com/polarbit/bluelabs-wallet/memdb"
+	"github.com/polarbit/bluelabs-wallet/ratelimit"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimit(t *testing.T) {
+	ctx := context.Background()
+	repo := memdb.NewRepository(zerolog.Nop())
+	s := service.NewWalletService(repo, zerolog.Nop())
+	e := New(s, service.NewWebhookService(repo, zerolog.Nop()))
+	e.Use(authenticate(zerolog.Nop(), e.Routes(), apiKeyAuthenticator(repo, zerolog.Nop())))
+	lm := ratelimit.NewLimiter(ratelimit.NewMemoryStore(), ratelimit.Limit{Rate: 0.001, Burst: 4}, ratelimit.Limit{Rate: 0.001, Burst: 2})
+	e.Use(rateLimit(lm, zerolog.Nop()))
+
+	newKey := func(name string) string {
+		key, k, err := service.GenerateAPIKey(name, []string{service.ScopeAdmin})
+		require.NoError(t, err)
+		require.NoError(t, repo.CreateAPIKey(ctx, k))
+		return key
+	}
+	a, b := newKey("a"), newKey("b")
+
+	w1, err := s.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+	require.NoError(t, err)
+	w2, err := s.CreateWallet(ctx, &service.WalletModel{ExternalID: "w2"})
+	require.NoError(t, err)
+
+	do := func(method, path, key, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(apiKeyHeader, key)
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	deposit := func(wid int, key string) *httptest.ResponseRecorder {
+		return do(http.MethodPost, "/wallets/"+strconv.Itoa(wid)+"/transactions", key,
+			`{"amount": 10, "description": "deposit", "fingerprint": "`+uuid.NewString()+`"}`)
+	}
+
+	rec := do(http.MethodGet, "/wallets/"+strconv.Itoa(w1.ID), a, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "4", rec.Header().Get(headerRateLimitLimit))
+	assert.Equal(t, "3", rec.Header().Get(headerRateLimitRemaining))
+	assert.Equal(t, "1000", rec.Header().Get(headerRateLimitReset))
+
+	// transactions report the wallet bucket, which is the most restrictive
+	rec = deposit(w1.ID, a)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	assert.Equal(t, "2", rec.Header().Get(headerRateLimitLimit))
+	assert.Equal(t, "1", rec.Header().Get(headerRateLimitRemaining))
+
+	// the wallet limit applies to every client
+	assert.Equal(t, http.StatusOK, deposit(w1.ID, b).Code)
+	rec = deposit(w1.ID, b)
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "0", rec.Header().Get(headerRateLimitRemaining))
+	assert.Equal(t, "1000", rec.Header().Get(headerRetryAfter))
+	assert.Contains(t, rec.Body.String(), "rate limit exceeded")
+
+	// other wallets are not limited until the client is
+	assert.Equal(t, http.StatusOK, deposit(w2.ID, a).Code)
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/wallets/"+strconv.Itoa(w1.ID), a, "").Code)
+	rec = do(http.MethodGet, "/wallets/"+strconv.Itoa(w1.ID), a, "")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "4", rec.Header().Get(headerRateLimitLimit))
+	assert.Equal(t, http.StatusOK, do(http.MethodGet, "/wallets/"+strconv.Itoa(w1.ID), b, "").Code)
+
+	// public routes are not limited
+	rec = do(http.MethodGet, "/openapi.json", a, "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Empty(t, rec.Header().Get(headerRateLimitLimit))
+}
+
+func TestLimitIP(t *testing.T) {
+	repo := memdb.NewRepository(zerolog.Nop())
+	e := New(service.NewWalletService(repo, zerolog.Nop()), service.NewWebhookService(repo, zerolog.Nop()))
+	lm := ratelimit.NewLimiter(ratelimit.NewMemoryStore(), ratelimit.Limit{}, ratelimit.Limit{})
+	lm.IP = ratelimit.Limit{Rate: 0.001, Burst: 2}
+	e.Use(limitIP(lm, zerolog.Nop()))
+	e.Use(authenticate(zerolog.Nop(), e.Routes(), apiKeyAuthenticator(repo, zerolog.Nop())))
+
+	do := func(ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/wallets/1", nil)
+		req.RemoteAddr = ip + ":1234"
+		req.Header.Set(apiKeyHeader, "invalid")
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// failed attempts are limited by their address
+	assert.Equal(t, http.StatusUnauthorized, do("10.0.0.1").Code)
+	assert.Equal(t, http.StatusUnauthorized, do("10.0.0.1").Code)
+	rec := do("10.0.0.1")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+	assert.Equal(t, "1000", rec.Header().Get(headerRetryAfter))
+	assert.Equal(t, http.StatusUnauthorized, do("10.0.0.2").Code)
+}
+
+func TestIPExtractor(t *testing.T) {
+	req := func(remote, xff string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/wallets/1", nil)
+		r.RemoteAddr = remote + ":1234"
+		if xff != "" {
+			r.Header.Set(echo.HeaderXForwardedFor, xff)
+		}
+		return r
+	}
+
+	// without trusted proxies X-Forwarded-For is ignored
+	direct := ipExtractor(nil)
+	assert.Equal(t, "10.0.0.9", direct(req("10.0.0.9", "1.1.1.1")))
+
+	proxies, err := config.ParseIPRanges([]string{"10.0.0.0/24", "192.168.1.5"})
+	require.NoError(t, err)
+	extract := ipExtractor(proxies)
+	assert.Equal(t, "2.2.2.2", extract(req("10.0.0.9", "1.1.1.1, 2.2.2.2, 192.168.1.5")))
+	assert.Equal(t, "10.0.0.9", extract(req("10.0.0.9", "")))
+
+	// callers which are not proxies cannot choose their address, nor can
+	// other private addresses
+	assert.Equal(t, "3.3.3.3", extract(req("3.3.3.3", "1.1.1.1")))
+	assert.Equal(t, "172.16.0.1", extract(req("10.0.0.9", "1.1.1.1, 172.16.0.1")))
+}
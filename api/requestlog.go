@@ -0,0 +1,72 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+// requestLogger identifies each request by its X-Request-ID, or a new one,
+// and puts a logger with the request id, and the wallet of /wallets routes,
+// on the request context; authentication adds the client. Handlers, the
+// service and repositories log through it. Requests are logged when served,
+// so it runs first and writes the errors of the handlers itself.
+func requestLogger(l zerolog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			req := c.Request()
+			id := service.RequestID(req.Header.Get(echo.HeaderXRequestID))
+			c.Response().Header().Set(echo.HeaderXRequestID, id)
+
+			lc := l.With().Str("requestId", id)
+			if wid, ok := routeWallet(c); ok {
+				lc = lc.Int("wid", wid)
+			}
+			c.SetRequest(req.WithContext(service.WithLogger(req.Context(), lc.Logger())))
+
+			if err := next(c); err != nil {
+				c.Error(err)
+			}
+
+			// the request of c carries the client once authenticated
+			rl := requestLog(c, &l)
+			res := c.Response()
+			e := rl.Info()
+			if res.Status >= http.StatusInternalServerError {
+				e = rl.Error()
+			}
+			e.Str("method", req.Method).
+				Str("uri", req.RequestURI).
+				Str("route", c.Path()).
+				Int("status", res.Status).
+				Int64("bytes", res.Size).
+				Dur("latency", time.Since(start)).
+				Str("remoteIp", c.RealIP()).
+				Msg("request served")
+			return nil
+		}
+	}
+}
+
+// requestLog returns the logger of the request of c, or l if it has none.
+func requestLog(c echo.Context, l *zerolog.Logger) *zerolog.Logger {
+	return service.Logger(c.Request().Context(), l)
+}
+
+// routeWallet returns the wallet id of /wallets routes.
+func routeWallet(c echo.Context) (int, bool) {
+	param := strings.TrimPrefix(c.Path(), "/wallets/:")
+	if param == c.Path() {
+		return 0, false
+	}
+	param = strings.SplitN(param, "/", 2)[0]
+	wid, err := strconv.Atoi(c.Param(param))
+	return wid, err == nil
+}
@@ -0,0 +1,98 @@
+//go:build !integration
+// +build !integration
+
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+	"github.com/polarbit/bluelabs-wallet/memdb"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestLogger(t *testing.T) {
+	ctx := context.Background()
+	repo := memdb.NewRepository(zerolog.Nop())
+	policy := &service.Policy{Default: service.EffectAllow, Rules: []*service.PolicyRule{
+		{Name: "no-bonus", Effect: service.EffectDeny, Labels: map[string][]string{"reason": {"bonus"}}},
+	}}
+	s := service.NewWalletService(repo, zerolog.Nop(), service.WithPolicy(policy))
+	e := New(s, service.NewWebhookService(repo, zerolog.Nop()))
+	buf := &bytes.Buffer{}
+	e.Use(requestLogger(zerolog.New(buf).Level(zerolog.InfoLevel)))
+	e.Use(authenticate(zerolog.Nop(), e.Routes(), apiKeyAuthenticator(repo, zerolog.Nop())))
+
+	key, k, err := service.GenerateAPIKey("billing", []string{service.ScopeAdmin})
+	require.NoError(t, err)
+	require.NoError(t, repo.CreateAPIKey(ctx, k))
+	w, err := s.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+	require.NoError(t, err)
+
+	do := func(method, path, requestID, body string) (*httptest.ResponseRecorder, []map[string]interface{}) {
+		buf.Reset()
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(apiKeyHeader, key)
+		if requestID != "" {
+			req.Header.Set(echo.HeaderXRequestID, requestID)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+
+		lines := []map[string]interface{}{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			m := map[string]interface{}{}
+			require.NoError(t, json.Unmarshal([]byte(line), &m), line)
+			lines = append(lines, m)
+		}
+		return rec, lines
+	}
+
+	t.Run("Traced", func(t *testing.T) {
+		rec, lines := do(http.MethodPost, "/wallets/"+strconv.Itoa(w.ID)+"/transactions", "req-1",
+			`{"amount": 10, "description": "d", "fingerprint": "f1", "labels": {"reason": "bonus"}}`)
+		assert.Equal(t, http.StatusForbidden, rec.Code)
+		assert.Equal(t, "req-1", rec.Header().Get(echo.HeaderXRequestID))
+
+		// the denial of the service and the request share the fields
+		require.Len(t, lines, 2)
+		assert.Equal(t, "operation denied by policy", lines[0]["message"])
+		assert.Equal(t, "request served", lines[1]["message"])
+		for _, l := range lines {
+			assert.Equal(t, "req-1", l["requestId"])
+			assert.Equal(t, "apikey:billing", l["client"])
+			assert.Equal(t, float64(w.ID), l["wid"])
+		}
+		assert.Equal(t, float64(http.StatusForbidden), lines[1]["status"])
+		assert.Equal(t, "/wallets/:wid/transactions", lines[1]["route"])
+		assert.Equal(t, "info", lines[1]["level"])
+	})
+
+	t.Run("RequestID", func(t *testing.T) {
+		// invalid ids of callers are replaced
+		rec, lines := do(http.MethodGet, "/wallets/"+strconv.Itoa(w.ID), "bad id\n", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		id := rec.Header().Get(echo.HeaderXRequestID)
+		assert.NotEmpty(t, id)
+		assert.NotEqual(t, "bad id\n", id)
+		require.Len(t, lines, 1)
+		assert.Equal(t, id, lines[0]["requestId"])
+
+		// subscription ids are not wallets
+		_, lines = do(http.MethodGet, "/webhooks/999", "", "")
+		require.Len(t, lines, 1)
+		assert.NotContains(t, lines[0], "wid")
+		assert.Equal(t, float64(http.StatusNotFound), lines[0]["status"])
+	})
+}
@@ -0,0 +1,83 @@
+package api
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/signing"
+)
+
+// maxSignedBody is the largest body of a signed request
+const maxSignedBody = 1 << 20
+
+// signedRoutes require a request signature, keyed by method and echo path
+var signedRoutes = map[string]bool{
+	"POST /wallets/:wid/transactions": true,
+}
+
+// verifySignature rejects requests of signedRoutes without a valid signature
+// of a client of secrets (see package signing). The client must be the
+// authenticated principal, if any, so a caller cannot sign with the secret of
+// another. Nonces are kept for twice the tolerance, which covers every
+// timestamp accepted with them.
+func verifySignature(secrets map[string]string, nonces signing.NonceStore, tolerance time.Duration, l zerolog.Logger) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			if !signedRoutes[req.Method+" "+c.Path()] {
+				return next(c)
+			}
+
+			client := req.Header.Get(signing.HeaderClient)
+			header := req.Header.Get(signing.HeaderSignature)
+			if client == "" || header == "" {
+				return echo.NewHTTPError(http.StatusUnauthorized, "request signature is required")
+			}
+			// config keys are case-insensitive; nonces are tracked by the same key
+			client = strings.ToLower(client)
+			secret, ok := secrets[client]
+			if !ok {
+				return echo.NewHTTPError(http.StatusUnauthorized, signing.ErrInvalidSignature.Error())
+			}
+			if p := service.PrincipalFrom(req.Context()); p != nil && strings.ToLower(p.Client) != client {
+				l.Info().Str("client", client).Str("principal", p.Client).Msg("request signed by another client")
+				return echo.NewHTTPError(http.StatusForbidden, signing.ErrOtherClient.Error())
+			}
+
+			body, err := io.ReadAll(io.LimitReader(req.Body, maxSignedBody+1))
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			if len(body) > maxSignedBody {
+				return echo.NewHTTPError(http.StatusRequestEntityTooLarge, "request body is too large")
+			}
+			req.Body = io.NopCloser(bytes.NewReader(body))
+
+			now := time.Now()
+			nonce, err := signing.Verify(secret, header, req.Method, req.URL.RequestURI(), body, tolerance, now)
+			if err != nil {
+				l.Debug().Err(err).Str("client", client).Msg("verify request signature failed")
+				return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+			}
+
+			if err := nonces.Use(req.Context(), client, nonce, now.Add(2*tolerance)); err != nil {
+				if errors.Is(err, signing.ErrReplayedNonce) {
+					l.Info().Str("client", client).Str("nonce", nonce).Msg("replayed request rejected")
+					return echo.NewHTTPError(http.StatusUnauthorized, err.Error())
+				}
+				l.Error().Err(err).Msg("use nonce failed")
+				return err
+			}
+
+			return next(c)
+		}
+	}
+}
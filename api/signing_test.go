@@ -0,0 +1,107 @@
+//go:build !integration
+// +build !integration
+
+package api
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/polarbit/bluelabs-wallet/memdb"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/signing"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestVerifySignature(t *testing.T) {
+	repo := memdb.NewRepository(zerolog.Nop())
+	s := service.NewWalletService(repo, zerolog.Nop())
+	e := New(s, service.NewWebhookService(repo, zerolog.Nop()))
+	e.Use(verifySignature(map[string]string{"billing": "s3cret"}, signing.NewMemoryNonceStore(), 5*time.Minute, zerolog.Nop()))
+
+	w, err := s.CreateWallet(context.Background(), &service.WalletModel{ExternalID: "w1"})
+	require.NoError(t, err)
+	path := "/wallets/" + strconv.Itoa(w.ID) + "/transactions"
+
+	do := func(client, header, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if client != "" {
+			req.Header.Set(signing.HeaderClient, client)
+		}
+		if header != "" {
+			req.Header.Set(signing.HeaderSignature, header)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	body := `{"amount": 10, "description": "d", "fingerprint": "f1"}`
+	signed := signing.Sign("s3cret", http.MethodPost, path, time.Now(), "n1", []byte(body))
+
+	assert.Equal(t, http.StatusUnauthorized, do("", "", body).Code)
+	assert.Equal(t, http.StatusUnauthorized, do("payouts", signed, body).Code)
+	assert.Equal(t, http.StatusUnauthorized, do("billing", signed, strings.Replace(body, "10", "1000", 1)).Code)
+	stale := signing.Sign("s3cret", http.MethodPost, path, time.Now().Add(-10*time.Minute), "n2", []byte(body))
+	assert.Equal(t, http.StatusUnauthorized, do("billing", stale, body).Code)
+
+	// the handler reads the verified body
+	rec := do("billing", signed, body)
+	require.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+	b, err := s.GetWalletBalance(context.Background(), w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 10., b)
+
+	// replays are rejected, also with another case of the client id
+	assert.Equal(t, http.StatusUnauthorized, do("billing", signed, body).Code)
+	assert.Equal(t, http.StatusUnauthorized, do("Billing", signed, body).Code)
+
+	// other routes are not signed
+	req := httptest.NewRequest(http.MethodGet, "/wallets/"+strconv.Itoa(w.ID), nil)
+	rec = httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
+
+func TestVerifySignaturePrincipal(t *testing.T) {
+	ctx := context.Background()
+	repo := memdb.NewRepository(zerolog.Nop())
+	s := service.NewWalletService(repo, zerolog.Nop())
+	e := New(s, service.NewWebhookService(repo, zerolog.Nop()))
+	e.Use(authenticate(zerolog.Nop(), e.Routes(), apiKeyAuthenticator(repo, zerolog.Nop())))
+	secrets := map[string]string{"apikey:billing": "s3cret", "apikey:payouts": "p4yout"}
+	e.Use(verifySignature(secrets, signing.NewMemoryNonceStore(), 5*time.Minute, zerolog.Nop()))
+
+	key, k, err := service.GenerateAPIKey("billing", []string{service.ScopeTransactionsWrite})
+	require.NoError(t, err)
+	require.NoError(t, repo.CreateAPIKey(ctx, k))
+	w, err := s.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+	require.NoError(t, err)
+	path := "/wallets/" + strconv.Itoa(w.ID) + "/transactions"
+
+	do := func(client, secret, nonce, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, path, strings.NewReader(body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		req.Header.Set(apiKeyHeader, key)
+		req.Header.Set(signing.HeaderClient, client)
+		req.Header.Set(signing.HeaderSignature, signing.Sign(secret, http.MethodPost, path, time.Now(), nonce, []byte(body)))
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec
+	}
+	body := `{"amount": 10, "description": "d", "fingerprint": "f1"}`
+
+	// a caller cannot sign with the secret of another client
+	assert.Equal(t, http.StatusForbidden, do("apikey:payouts", "p4yout", "n1", body).Code)
+
+	rec := do("ApiKey:Billing", "s3cret", "n1", body)
+	assert.Equal(t, http.StatusOK, rec.Code, rec.Body.String())
+}
@@ -0,0 +1,54 @@
+package api
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"strconv"
+	"text/tabwriter"
+	"time"
+
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+// Formats of statements
+const (
+	formatJson = "json"
+	formatCsv  = "csv"
+	formatText = "text"
+)
+
+const mimeTextCsv = "text/csv; charset=UTF-8"
+
+func formatAmount(f float64) string {
+	return strconv.FormatFloat(f, 'f', 2, 64)
+}
+
+// writeStatementCsv writes the opening balance, the transactions and the
+// closing balance as rows of the same columns.
+func writeStatementCsv(w io.Writer, st *service.Statement) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"row", "refno", "created", "description", "amount", "balance"})
+	cw.Write([]string{"opening", "", st.From, "", "", formatAmount(st.OpeningBalance)})
+	for _, t := range st.Transactions {
+		cw.Write([]string{"transaction", strconv.Itoa(t.RefNo), t.Created.UTC().Format(time.RFC3339),
+			t.Description, formatAmount(t.Amount), formatAmount(t.NewBalance)})
+	}
+	cw.Write([]string{"closing", "", st.To, "", "", formatAmount(st.ClosingBalance)})
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeStatementText(w io.Writer, st *service.Statement) error {
+	fmt.Fprintf(w, "Statement of wallet %d, %s - %s\n\n", st.WalletID, st.From, st.To)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "REFNO\tCREATED\tDESCRIPTION\tAMOUNT\tBALANCE\t")
+	fmt.Fprintf(tw, "\t\tOpening balance\t\t%s\t\n", formatAmount(st.OpeningBalance))
+	for _, t := range st.Transactions {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\t\n", t.RefNo, t.Created.UTC().Format(time.RFC3339),
+			t.Description, formatAmount(t.Amount), formatAmount(t.NewBalance))
+	}
+	fmt.Fprintf(tw, "\t\tClosing balance\t\t%s\t\n", formatAmount(st.ClosingBalance))
+	return tw.Flush()
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"golang.org/x/net/websocket"
+)
+
+const defaultHeartbeat = 15 * time.Second
+
+// Events of streams
+const (
+	streamEventTransaction = "transaction"
+	streamEventBalance     = "balance"
+	streamEventHeartbeat   = "heartbeat"
+)
+
+// StreamMessage is a message of the websocket stream
+type StreamMessage struct {
+	ID    int         `json:"id,omitempty"`
+	Event string      `json:"event"`
+	Data  interface{} `json:"data,omitempty"`
+}
+
+func balanceChange(wid int, t *service.Transaction) *service.BalanceChange {
+	return &service.BalanceChange{WalletID: wid, RefNo: t.RefNo, OldBalance: t.OldBalance, NewBalance: t.NewBalance}
+}
+
+// streamParams parses the wallet id and the refno to resume after; the
+// Last-Event-ID header wins over the lastEventId query parameter, which is
+// there for clients that can not set headers.
+func (h *walletHandler) streamParams(c echo.Context) (int, int, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		requestLog(c, &h.l).Debug().Err(err).Msg("route error")
+		return 0, 0, echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	after := 0
+	last := c.Request().Header.Get("Last-Event-ID")
+	if last == "" {
+		last = c.QueryParam("lastEventId")
+	}
+	if last != "" {
+		if after, err = strconv.Atoi(last); err != nil || after < 0 {
+			return 0, 0, echo.NewHTTPError(http.StatusBadRequest, "last event id should be a refno")
+		}
+	}
+
+	// fail before the stream starts
+	if _, err := h.s.GetWallet(c.Request().Context(), id); err != nil {
+		return 0, 0, err
+	}
+
+	return id, after, nil
+}
+
+func (h *walletHandler) heartbeatInterval() time.Duration {
+	if h.heartbeat > 0 {
+		return h.heartbeat
+	}
+	return defaultHeartbeat
+}
+
+// streamWallet streams transactions and balances of the wallet as server-sent
+// events; the id of events is the refno of the transaction.
+func (h *walletHandler) streamWallet(c echo.Context) error {
+	id, after, err := h.streamParams(c)
+	if err != nil {
+		return err
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	write := func(id int, event string, data interface{}) error {
+		b, err := json.Marshal(data)
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(res, "id: %d\nevent: %s\ndata: %s\n\n", id, event, b); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	err = h.s.FollowTransactions(c.Request().Context(), id, after, h.heartbeatInterval(),
+		func(t *service.Transaction) error {
+			if err := write(t.RefNo, streamEventTransaction, t); err != nil {
+				return err
+			}
+			if err := write(t.RefNo, streamEventBalance, balanceChange(id, t)); err != nil {
+				return err
+			}
+			res.Flush()
+			return nil
+		},
+		func() error {
+			if _, err := fmt.Fprint(res, ": heartbeat\n\n"); err != nil {
+				return err
+			}
+			res.Flush()
+			return nil
+		})
+	if err != nil {
+		// headers are sent, the client sees the end of the stream
+		requestLog(c, &h.l).Debug().Err(err).Msg("stream ended")
+	}
+
+	return nil
+}
+
+// streamWalletWs streams the same events as streamWallet over a websocket,
+// as json StreamMessages. Messages of the client are ignored; the stream ends
+// when the client closes the connection.
+func (h *walletHandler) streamWalletWs(c echo.Context) error {
+	id, after, err := h.streamParams(c)
+	if err != nil {
+		return err
+	}
+
+	websocket.Handler(func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		ctx, cancel := context.WithCancel(c.Request().Context())
+		defer cancel()
+
+		// reading is the only way to notice a closed connection
+		go func() {
+			defer cancel()
+			var discard []byte
+			for websocket.Message.Receive(ws, &discard) == nil {
+			}
+		}()
+
+		err := h.s.FollowTransactions(ctx, id, after, h.heartbeatInterval(),
+			func(t *service.Transaction) error {
+				if err := websocket.JSON.Send(ws, &StreamMessage{ID: t.RefNo, Event: streamEventTransaction, Data: t}); err != nil {
+					return err
+				}
+				return websocket.JSON.Send(ws, &StreamMessage{ID: t.RefNo, Event: streamEventBalance, Data: balanceChange(id, t)})
+			},
+			func() error {
+				return websocket.JSON.Send(ws, &StreamMessage{Event: streamEventHeartbeat})
+			})
+		if err != nil {
+			requestLog(c, &h.l).Debug().Err(err).Msg("stream ended")
+		}
+	}).ServeHTTP(c.Response(), c.Request())
+
+	return nil
+}
@@ -0,0 +1,189 @@
+//go:build !integration
+// +build !integration
+
+package api
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/polarbit/bluelabs-wallet/memdb"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+type streamFixture struct {
+	s   service.Service
+	srv *httptest.Server
+	wid int
+}
+
+func newStreamFixture(t *testing.T) *streamFixture {
+	s := service.NewWalletService(memdb.NewRepository(zerolog.Nop()), zerolog.Nop())
+	h := &walletHandler{s: s, l: zerolog.Nop(), heartbeat: 50 * time.Millisecond}
+
+	e := echo.New()
+	e.HTTPErrorHandler = problemErrorHandler(zerolog.Nop())
+	e.GET("/wallets/:id/stream", func(c echo.Context) error { return h.streamWallet(c) })
+	e.GET("/wallets/:id/ws", func(c echo.Context) error { return h.streamWalletWs(c) })
+	srv := httptest.NewServer(e)
+	t.Cleanup(srv.Close)
+
+	w, err := s.CreateWallet(context.Background(), &service.WalletModel{ExternalID: "w1"})
+	require.NoError(t, err)
+
+	f := &streamFixture{s: s, srv: srv, wid: w.ID}
+	f.post(t, 10)
+	f.post(t, 5)
+	return f
+}
+
+func (f *streamFixture) post(t *testing.T, amount float64) {
+	_, err := f.s.CreateTransaction(context.Background(), f.wid, &service.TransactionModel{
+		Amount: amount, Description: "stream", Fingerprint: strconv.FormatInt(time.Now().UnixNano(), 10)})
+	require.NoError(t, err)
+}
+
+// sseEvent is an event or a comment (heartbeat) of the stream
+type sseEvent struct {
+	id, event, data, comment string
+}
+
+func readEvents(r *bufio.Reader, out chan<- sseEvent) {
+	e := sseEvent{}
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			close(out)
+			return
+		}
+		line = strings.TrimSuffix(line, "\n")
+		switch {
+		case line == "":
+			out <- e
+			e = sseEvent{}
+		case strings.HasPrefix(line, ":"):
+			e.comment = strings.TrimSpace(line[1:])
+		case strings.HasPrefix(line, "id: "):
+			e.id = line[4:]
+		case strings.HasPrefix(line, "event: "):
+			e.event = line[7:]
+		case strings.HasPrefix(line, "data: "):
+			e.data = line[6:]
+		}
+	}
+}
+
+func TestStreamWallet(t *testing.T) {
+	f := newStreamFixture(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, f.srv.URL+"/wallets/"+strconv.Itoa(f.wid)+"/stream", nil)
+	req.Header.Set("Last-Event-ID", "1")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Equal(t, "text/event-stream", res.Header.Get(echo.HeaderContentType))
+
+	events := make(chan sseEvent, 100)
+	go readEvents(bufio.NewReader(res.Body), events)
+
+	// next skips heartbeats
+	heartbeats := 0
+	next := func() sseEvent {
+		for {
+			select {
+			case e := <-events:
+				if e.comment == "heartbeat" {
+					heartbeats++
+					continue
+				}
+				return e
+			case <-time.After(5 * time.Second):
+				t.Fatal("no event")
+			}
+		}
+	}
+
+	// resumed after refno 1
+	e := next()
+	assert.Equal(t, "2", e.id)
+	assert.Equal(t, streamEventTransaction, e.event)
+	assert.Contains(t, e.data, `"refno":2`)
+	e = next()
+	assert.Equal(t, "2", e.id)
+	assert.Equal(t, streamEventBalance, e.event)
+	assert.JSONEq(t, `{"wid":`+strconv.Itoa(f.wid)+`,"refno":2,"oldbalance":10,"newbalance":15}`, e.data)
+
+	// new transactions are pushed
+	f.post(t, -3)
+	e = next()
+	assert.Equal(t, "3", e.id)
+	assert.Equal(t, streamEventTransaction, e.event)
+	e = next()
+	assert.Contains(t, e.data, `"newbalance":12`)
+
+	// heartbeats keep the connection alive
+	time.Sleep(120 * time.Millisecond)
+	f.post(t, 1)
+	next()
+	assert.Positive(t, heartbeats)
+}
+
+func TestStreamWalletErrors(t *testing.T) {
+	f := newStreamFixture(t)
+
+	res, err := http.Get(f.srv.URL + "/wallets/999/stream")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusNotFound, res.StatusCode)
+
+	res, err = http.Get(f.srv.URL + "/wallets/" + strconv.Itoa(f.wid) + "/stream?lastEventId=x")
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, res.StatusCode)
+}
+
+func TestStreamWalletWs(t *testing.T) {
+	f := newStreamFixture(t)
+
+	url := "ws" + strings.TrimPrefix(f.srv.URL, "http") + "/wallets/" + strconv.Itoa(f.wid) + "/ws?lastEventId=0"
+	ws, err := websocket.Dial(url, "", f.srv.URL)
+	require.NoError(t, err)
+	defer ws.Close()
+
+	receive := func() *StreamMessage {
+		for {
+			ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+			m := &StreamMessage{}
+			require.NoError(t, websocket.JSON.Receive(ws, m))
+			if m.Event != streamEventHeartbeat {
+				return m
+			}
+		}
+	}
+
+	for _, refno := range []int{1, 1, 2, 2} {
+		assert.Equal(t, refno, receive().ID)
+	}
+
+	f.post(t, 7)
+	m := receive()
+	assert.Equal(t, 3, m.ID)
+	assert.Equal(t, streamEventTransaction, m.Event)
+	m = receive()
+	assert.Equal(t, streamEventBalance, m.Event)
+	assert.Equal(t, 22., m.Data.(map[string]interface{})["newbalance"])
+}
@@ -22,4 +22,8 @@ type (
 	GetTransactionResponse struct {
 		service.Transaction
 	}
+
+	CreateSubscriptionRequest struct {
+		service.SubscriptionModel
+	}
 )
@@ -0,0 +1,135 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+)
+
+const maxDeliveryPage = 100
+
+type webhookHandler struct {
+	s service.WebhookService
+	l zerolog.Logger
+}
+
+func (h *webhookHandler) createSubscription(c echo.Context) error {
+	req := &CreateSubscriptionRequest{}
+
+	// bind
+	if err := c.Bind(req); err != nil {
+		requestLog(c, &h.l).Debug().Err(err).Msg("bind error")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// validate
+	if err := c.Validate(req); err != nil {
+		requestLog(c, &h.l).Debug().Err(err).Msg("validate error")
+		return validationError(err)
+	}
+
+	// handle
+	sub, err := h.s.CreateSubscription(c.Request().Context(), &req.SubscriptionModel)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, sub)
+}
+
+func (h *webhookHandler) listSubscriptions(c echo.Context) error {
+	subs, err := h.s.ListSubscriptions(c.Request().Context())
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, subs)
+}
+
+func (h *webhookHandler) getSubscription(c echo.Context) error {
+	// validate
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		requestLog(c, &h.l).Debug().Err(err).Msg("route error")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// handle
+	sub, err := h.s.GetSubscription(c.Request().Context(), id)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, sub)
+}
+
+func (h *webhookHandler) deleteSubscription(c echo.Context) error {
+	// validate
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		requestLog(c, &h.l).Debug().Err(err).Msg("route error")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// handle
+	if err := h.s.DeleteSubscription(c.Request().Context(), id); err != nil {
+		return err
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func (h *webhookHandler) listDeliveries(c echo.Context) error {
+	// validate
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		requestLog(c, &h.l).Debug().Err(err).Msg("route error")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	var after int64
+	if s := c.QueryParam("after"); s != "" {
+		if after, err = strconv.ParseInt(s, 10, 64); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "after should be a delivery id")
+		}
+	}
+	limit := maxDeliveryPage
+	if s := c.QueryParam("limit"); s != "" {
+		if limit, err = strconv.Atoi(s); err != nil || limit < 1 || limit > maxDeliveryPage {
+			return echo.NewHTTPError(http.StatusBadRequest, "limit should be between 1 and 100")
+		}
+	}
+
+	// handle
+	ds, err := h.s.ListDeliveries(c.Request().Context(), id, after, limit)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, ds)
+}
+
+func (h *webhookHandler) redeliver(c echo.Context) error {
+	// validate
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		requestLog(c, &h.l).Debug().Err(err).Msg("route error")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	did, err := strconv.ParseInt(c.Param("did"), 10, 64)
+	if err != nil {
+		requestLog(c, &h.l).Debug().Err(err).Msg("route error")
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// handle
+	d, err := h.s.Redeliver(c.Request().Context(), id, did)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, d)
+}
@@ -0,0 +1,265 @@
+// Package client is a typed client of the wallet REST api. Errors of the api
+// unwrap to the sentinel errors of the service package:
+//
+//	_, err := c.CreateTransaction(ctx, wid, m)
+//	if errors.Is(err, service.ErrNotEnoughWalletBalance) {
+//		...
+//	}
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/signing"
+)
+
+// sentinels are the service errors the api returns by code
+var sentinels = []*service.ServiceError{
+	service.ErrWalletNotFound,
+	service.ErrWalletAlreadyExists,
+	service.ErrTransactionConsistency,
+	service.ErrTransactionAlreadyExistsByRefNo,
+	service.ErrTransactionAlreadyExistsByFingerprint,
+	service.ErrTransactionNotFound,
+	service.ErrNotEnoughWalletBalance,
+	service.ErrInvalidAmount,
+	service.ErrAPIKeyNotFound,
+	service.ErrPolicyDenied,
+}
+
+// Error is a non 2xx response of the api, read from its problem details
+// (RFC 7807). It unwraps to the service error of its code, if any.
+// RetryAfter is the wait asked by rate limited responses.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+	RequestID  string
+	Fields     []FieldError // fields of the request which failed validation
+	RetryAfter time.Duration
+
+	err error
+}
+
+// FieldError is a field of a request which failed validation.
+type FieldError struct {
+	Field   string `json:"field"`
+	Rule    string `json:"rule"`
+	Param   string `json:"param"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("wallet api: %d %s", e.StatusCode, e.Message)
+}
+
+func (e *Error) Unwrap() error {
+	return e.err
+}
+
+// Client calls the wallet api at BaseURL. CreateTransaction is retried up to
+// MaxRetries times on retriable conflicts and rate limits, waiting RetryDelay
+// doubled on every attempt, or the Retry-After of the api if longer; the
+// fingerprint makes the retries idempotent. APIKey is sent with
+// every request when the api requires api keys. Requests are signed with
+// SigningSecret of SigningClient when it is set (see package signing).
+type Client struct {
+	BaseURL       string
+	APIKey        string
+	SigningClient string
+	SigningSecret string
+	HTTPClient    *http.Client
+	MaxRetries    int
+	RetryDelay    time.Duration
+}
+
+// New returns a client of the api at baseURL, e.g. http://localhost:8080.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+		MaxRetries: 3,
+		RetryDelay: 50 * time.Millisecond,
+	}
+}
+
+// NewFingerprint returns a random fingerprint, for transactions without a
+// business key. Keep it with the request to retry it idempotently.
+func NewFingerprint() string {
+	return uuid.NewString()
+}
+
+// Fingerprint derives a fingerprint from business keys, e.g. Fingerprint("payout",
+// orderID), so that the same operation gets the same fingerprint in every
+// process. It fits the 50 characters limit of fingerprints.
+func Fingerprint(keys ...string) string {
+	h := sha256.New()
+	for _, k := range keys {
+		h.Write([]byte(strconv.Itoa(len(k))))
+		h.Write([]byte{':'})
+		h.Write([]byte(k))
+	}
+	return hex.EncodeToString(h.Sum(nil))[:40]
+}
+
+func (c *Client) CreateWallet(ctx context.Context, m *service.WalletModel) (*service.Wallet, error) {
+	w := &service.Wallet{}
+	if err := c.do(ctx, http.MethodPost, "/wallets", m, w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (c *Client) GetWallet(ctx context.Context, wid int) (*service.Wallet, error) {
+	w := &service.Wallet{}
+	if err := c.do(ctx, http.MethodGet, "/wallets/"+strconv.Itoa(wid), nil, w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (c *Client) GetBalance(ctx context.Context, wid int) (float64, error) {
+	var b float64
+	if err := c.do(ctx, http.MethodGet, "/wallets/"+strconv.Itoa(wid)+"/balance", nil, &b); err != nil {
+		return 0, err
+	}
+	return b, nil
+}
+
+// CreateTransaction posts the transaction, retrying ErrTransactionConsistency
+// and ErrTransactionAlreadyExistsByRefNo conflicts and rate limited requests. An empty fingerprint is
+// set to a new one before the first attempt.
+func (c *Client) CreateTransaction(ctx context.Context, wid int, m *service.TransactionModel) (*service.Transaction, error) {
+	if m.Fingerprint == "" {
+		cp := *m
+		cp.Fingerprint = NewFingerprint()
+		m = &cp
+	}
+
+	delay := c.RetryDelay
+	for attempt := 0; ; attempt++ {
+		t := &service.Transaction{}
+		err := c.do(ctx, http.MethodPost, "/wallets/"+strconv.Itoa(wid)+"/transactions", m, t)
+		if err == nil {
+			return t, nil
+		}
+		if attempt >= c.MaxRetries || !Retriable(err) {
+			return nil, err
+		}
+
+		wait := delay
+		if e := (*Error)(nil); errors.As(err, &e) && e.RetryAfter > wait {
+			wait = e.RetryAfter
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(wait):
+		}
+		delay *= 2
+	}
+}
+
+func (c *Client) GetLatestTransaction(ctx context.Context, wid int) (*service.Transaction, error) {
+	t := &service.Transaction{}
+	if err := c.do(ctx, http.MethodGet, "/wallets/"+strconv.Itoa(wid)+"/transactions/latest", nil, t); err != nil {
+		return nil, err
+	}
+	return t, nil
+}
+
+// Retriable reports whether err is a conflict with a concurrent transaction,
+// or a rate limited request, which succeeds when retried.
+func Retriable(err error) bool {
+	return errors.Is(err, service.ErrTransactionConsistency) ||
+		errors.Is(err, service.ErrTransactionAlreadyExistsByRefNo) ||
+		RateLimited(err)
+}
+
+// RateLimited reports whether err is a response rejected by the rate limits
+// of the api.
+func RateLimited(err error) bool {
+	e := (*Error)(nil)
+	return errors.As(err, &e) && e.StatusCode == http.StatusTooManyRequests
+}
+
+func (c *Client) do(ctx context.Context, method, path string, in, out interface{}) error {
+	var b []byte
+	if in != nil {
+		var err error
+		if b, err = json.Marshal(in); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.BaseURL+path, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	if c.SigningSecret != "" {
+		// every attempt is signed with a new nonce
+		req.Header.Set(signing.HeaderClient, c.SigningClient)
+		req.Header.Set(signing.HeaderSignature, signing.Sign(c.SigningSecret, method, req.URL.RequestURI(), time.Now(), uuid.NewString(), b))
+	}
+	if in != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	if c.APIKey != "" {
+		req.Header.Set("X-API-Key", c.APIKey)
+	}
+
+	res, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return responseError(res)
+	}
+	return json.NewDecoder(res.Body).Decode(out)
+}
+
+func responseError(res *http.Response) error {
+	e := &Error{StatusCode: res.StatusCode, Message: http.StatusText(res.StatusCode)}
+	if sec, err := strconv.Atoi(res.Header.Get("Retry-After")); err == nil {
+		e.RetryAfter = time.Duration(sec) * time.Second
+	}
+
+	var body struct {
+		Title     string       `json:"title"`
+		Detail    string       `json:"detail"`
+		Code      string       `json:"code"`
+		RequestID string       `json:"requestId"`
+		Errors    []FieldError `json:"errors"`
+	}
+	if err := json.NewDecoder(res.Body).Decode(&body); err == nil {
+		e.Code, e.RequestID, e.Fields = body.Code, body.RequestID, body.Errors
+		if body.Detail != "" {
+			e.Message = body.Detail
+		} else if body.Title != "" {
+			e.Message = body.Title
+		}
+	}
+
+	for _, s := range sentinels {
+		if s.Code == e.Code {
+			e.err = s
+			break
+		}
+	}
+	return e
+}
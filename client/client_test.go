@@ -0,0 +1,196 @@
+//go:build !integration
+// +build !integration
+
+package client
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/polarbit/bluelabs-wallet/api"
+	"github.com/polarbit/bluelabs-wallet/memdb"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/signing"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newClient returns a client of an api on memdb. The first `conflicts`
+// transaction posts are answered with a retriable conflict.
+func newClient(t *testing.T, conflicts int32) (*Client, *int32) {
+	repo := memdb.NewRepository(zerolog.Nop())
+	e := api.New(service.NewWalletService(repo, zerolog.Nop()), service.NewWebhookService(repo, zerolog.Nop()))
+
+	var posts int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path != "/wallets" && atomic.AddInt32(&posts, 1) <= conflicts {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.WriteHeader(http.StatusConflict)
+			w.Write([]byte(`{"status":409,"code":"` + service.ErrTransactionConsistency.Code + `"}`))
+			return
+		}
+		e.ServeHTTP(w, r)
+	}))
+	t.Cleanup(srv.Close)
+
+	c := New(srv.URL + "/")
+	c.RetryDelay = time.Millisecond
+	return c, &posts
+}
+
+func TestClient(t *testing.T) {
+	c, _ := newClient(t, 0)
+	ctx := context.Background()
+
+	w, err := c.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1", Labels: map[string]string{"a": "b"}})
+	require.NoError(t, err)
+	assert.Equal(t, "w1", w.ExternalID)
+
+	_, err = c.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+	assert.ErrorIs(t, err, service.ErrWalletAlreadyExists)
+
+	got, err := c.GetWallet(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, w.ID, got.ID)
+	assert.Equal(t, "b", got.Labels["a"])
+
+	_, err = c.GetWallet(ctx, 99)
+	assert.ErrorIs(t, err, service.ErrWalletNotFound)
+	var apiErr *Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusNotFound, apiErr.StatusCode)
+
+	_, err = c.GetLatestTransaction(ctx, w.ID)
+	assert.ErrorIs(t, err, service.ErrTransactionNotFound)
+
+	tr, err := c.CreateTransaction(ctx, w.ID, &service.TransactionModel{Amount: 10, Description: "deposit"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, tr.RefNo)
+	assert.NotEmpty(t, tr.Fingerprint)
+
+	_, err = c.CreateTransaction(ctx, w.ID, &service.TransactionModel{Amount: 10, Description: "deposit", Fingerprint: tr.Fingerprint})
+	assert.ErrorIs(t, err, service.ErrTransactionAlreadyExistsByFingerprint)
+
+	_, err = c.CreateTransaction(ctx, w.ID, &service.TransactionModel{Amount: -20, Description: "withdraw"})
+	assert.ErrorIs(t, err, service.ErrNotEnoughWalletBalance)
+
+	// validation errors are not service errors
+	_, err = c.CreateTransaction(ctx, w.ID, &service.TransactionModel{Amount: 10})
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, http.StatusBadRequest, apiErr.StatusCode)
+	assert.Equal(t, "validation_failed", apiErr.Code)
+	assert.Equal(t, []FieldError{{Field: "description", Rule: "required", Message: "is required"}}, apiErr.Fields)
+	assert.Nil(t, apiErr.Unwrap())
+
+	b, err := c.GetBalance(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 10., b)
+
+	latest, err := c.GetLatestTransaction(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, tr.ID, latest.ID)
+}
+
+func TestCreateTransactionRetries(t *testing.T) {
+	ctx := context.Background()
+
+	c, posts := newClient(t, 2)
+	w, err := c.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+	require.NoError(t, err)
+	tr, err := c.CreateTransaction(ctx, w.ID, &service.TransactionModel{Amount: 10, Description: "deposit"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, tr.RefNo)
+	assert.Equal(t, int32(3), atomic.LoadInt32(posts))
+
+	c, posts = newClient(t, 10)
+	c.MaxRetries = 2
+	w, err = c.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+	require.NoError(t, err)
+	_, err = c.CreateTransaction(ctx, w.ID, &service.TransactionModel{Amount: 10, Description: "deposit"})
+	assert.ErrorIs(t, err, service.ErrTransactionConsistency)
+	assert.True(t, Retriable(err))
+	assert.Equal(t, int32(3), atomic.LoadInt32(posts))
+}
+
+func TestRateLimited(t *testing.T) {
+	repo := memdb.NewRepository(zerolog.Nop())
+	e := api.New(service.NewWalletService(repo, zerolog.Nop()), service.NewWebhookService(repo, zerolog.Nop()))
+
+	var limited int32 = 1
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.URL.Path != "/wallets" && atomic.AddInt32(&limited, -1) >= 0 {
+			w.Header().Set("Content-Type", "application/problem+json")
+			w.Header().Set("Retry-After", "0")
+			if r.Method == http.MethodGet {
+				w.Header().Set("Retry-After", "3")
+			}
+			w.WriteHeader(http.StatusTooManyRequests)
+			w.Write([]byte(`{"status":429,"code":"rate_limited","detail":"rate limit exceeded"}`))
+			return
+		}
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	c.RetryDelay = time.Millisecond
+	ctx := context.Background()
+
+	_, err := c.GetBalance(ctx, 1)
+	var apiErr *Error
+	require.ErrorAs(t, err, &apiErr)
+	assert.Equal(t, 3*time.Second, apiErr.RetryAfter)
+	assert.True(t, RateLimited(err))
+	assert.True(t, Retriable(err))
+
+	// the rate limited post is retried
+	w, err := c.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+	require.NoError(t, err)
+	_, err = c.CreateTransaction(ctx, w.ID, &service.TransactionModel{Amount: 10, Description: "deposit"})
+	require.NoError(t, err)
+}
+
+func TestSigning(t *testing.T) {
+	repo := memdb.NewRepository(zerolog.Nop())
+	e := api.New(service.NewWalletService(repo, zerolog.Nop()), service.NewWebhookService(repo, zerolog.Nop()))
+
+	nonces := map[string]bool{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		assert.Equal(t, "billing", r.Header.Get(signing.HeaderClient))
+		nonce, err := signing.Verify("s3cret", r.Header.Get(signing.HeaderSignature), r.Method, r.URL.RequestURI(), body, time.Minute, time.Now())
+		require.NoError(t, err)
+		assert.False(t, nonces[nonce])
+		nonces[nonce] = true
+
+		r.Body = io.NopCloser(bytes.NewReader(body))
+		e.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL)
+	c.SigningClient, c.SigningSecret = "billing", "s3cret"
+	ctx := context.Background()
+	w, err := c.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+	require.NoError(t, err)
+	_, err = c.CreateTransaction(ctx, w.ID, &service.TransactionModel{Amount: 10, Description: "deposit"})
+	require.NoError(t, err)
+	_, err = c.GetBalance(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Len(t, nonces, 3)
+}
+
+func TestFingerprint(t *testing.T) {
+	assert.Equal(t, Fingerprint("payout", "42"), Fingerprint("payout", "42"))
+	assert.NotEqual(t, Fingerprint("payout", "42"), Fingerprint("payout4", "2"))
+	assert.Len(t, Fingerprint("payout", "42"), 40)
+	assert.NotEqual(t, NewFingerprint(), NewFingerprint())
+}
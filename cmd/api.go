@@ -1,8 +1,6 @@
 package cmd
 
 import (
-	"fmt"
-
 	"github.com/polarbit/bluelabs-wallet/api"
 	"github.com/spf13/cobra"
 )
@@ -11,12 +9,20 @@ func init() {
 	rootCmd.AddCommand(apiCmd)
 }
 
-var apiCmd = &cobra.Command{
-	Use:   "api",
-	Short: "REST API for wallet management",
-	Long:  `This api enables to create wallets and transactions and query wallet and transactions`,
-	Run: func(cmd *cobra.Command, args []string) {
-		api.StartAPI()
-		fmt.Println("wallet api is started")
-	},
-}
+var apiCmd = func() *cobra.Command {
+	var storage string
+
+	c := &cobra.Command{
+		Use:   "api",
+		Short: "REST API for wallet management",
+		Long:  `This api enables to create wallets and transactions and query wallet and transactions`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return api.StartAPI(storage)
+		},
+	}
+
+	c.Flags().StringVar(&storage, "storage", "",
+		"Overrides storage of config; postgres, sqlite or memory (data is lost on exit)")
+
+	return c
+}()
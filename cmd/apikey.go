@@ -0,0 +1,130 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/polarbit/bluelabs-wallet/config"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/storage"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	apikeyCmd.AddCommand(apikeyCreateCmd)
+	apikeyCmd.AddCommand(apikeyRevokeCmd)
+	apikeyCmd.AddCommand(apikeyListCmd)
+	rootCmd.AddCommand(apikeyCmd)
+}
+
+var apikeyCmd = &cobra.Command{
+	Use:   "apikey",
+	Short: "Manages api keys of clients. See help for sub commands.",
+	Long:  `See bl-wallet apikey --help`,
+}
+
+var apikeyCreateCmd = func() *cobra.Command {
+	var name string
+	var scopes []string
+
+	c := &cobra.Command{
+		Use:   "create",
+		Short: "Creates an api key and prints it",
+		Long: `Creates an api key of a client with the given scopes and prints it. Only a hash
+of the key is stored, so it is printed once. Valid scopes are wallets:read,
+transactions:write and admin; admin grants every scope.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config.Init()
+
+			repo, err := storage.NewRepository(config.Config, log.Logger)
+			if err != nil {
+				return err
+			}
+
+			key, k, err := service.GenerateAPIKey(name, scopes)
+			if err != nil {
+				return err
+			}
+			if err := repo.CreateAPIKey(context.Background(), k); err != nil {
+				return err
+			}
+
+			fmt.Printf("created api key %d (%s) with scopes %s\n", k.ID, k.Name, strings.Join(k.Scopes, ","))
+			fmt.Println(key)
+			return nil
+		},
+	}
+
+	c.Flags().StringVar(&name, "name", "", "Name of the client, recorded on its transactions")
+	c.Flags().StringSliceVar(&scopes, "scope", nil, "Scopes of the key, e.g. --scope wallets:read --scope transactions:write")
+	c.MarkFlagRequired("name")
+	c.MarkFlagRequired("scope")
+
+	return c
+}()
+
+var apikeyRevokeCmd = &cobra.Command{
+	Use:   "revoke <id>",
+	Short: "Revokes an api key",
+	Long:  `Revokes an api key; requests with it are rejected from then on. Revoked keys are kept for auditing.`,
+	Args:  cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		id, err := strconv.Atoi(args[0])
+		if err != nil {
+			return fmt.Errorf("id is incorrect, should be an integer. id:%s", args[0])
+		}
+
+		config.Init()
+
+		repo, err := storage.NewRepository(config.Config, log.Logger)
+		if err != nil {
+			return err
+		}
+
+		if err := repo.RevokeAPIKey(context.Background(), id, time.Now()); err != nil {
+			return err
+		}
+
+		fmt.Printf("revoked api key %d\n", id)
+		return nil
+	},
+}
+
+var apikeyListCmd = &cobra.Command{
+	Use:   "list",
+	Short: "Lists api keys",
+	Long:  `Lists api keys with their prefix, which identifies a key without revealing it.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config.Init()
+
+		repo, err := storage.NewRepository(config.Config, log.Logger)
+		if err != nil {
+			return err
+		}
+
+		keys, err := repo.ListAPIKeys(context.Background())
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "ID\tNAME\tPREFIX\tSCOPES\tCREATED\tREVOKED")
+		for _, k := range keys {
+			revoked := "-"
+			if k.Revoked != nil {
+				revoked = k.Revoked.Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%s\t%s\n", k.ID, k.Name, k.Prefix, strings.Join(k.Scopes, ","),
+				k.Created.Format(time.RFC3339), revoked)
+		}
+		w.Flush()
+
+		return nil
+	},
+}
@@ -15,22 +15,32 @@ func init() {
 var dbCmd = func() *cobra.Command {
 	var initdb bool
 	var dropdb bool
+	var migrate bool
 
 	c := &cobra.Command{
 		Use:   "db",
-		Short: "Initializes or drops wallet database. See help for parameters.",
+		Short: "Initializes, migrates or drops wallet database. See help for parameters.",
 		Long:  `See bl-wallet db --help`,
 		RunE: func(cmd *cobra.Command, args []string) error {
 			config.Init()
 
-			if initdb && dropdb {
-				return errors.New("only one of --initdb or --dropdb  parameters should be provided")
-			} else if initdb {
+			n := 0
+			for _, f := range []bool{initdb, dropdb, migrate} {
+				if f {
+					n++
+				}
+			}
+			if n != 1 {
+				return errors.New("either one of --initdb, --migrate or --dropdb parameters should be provided")
+			}
+
+			switch {
+			case initdb:
 				db.InitDb(config.Config.Db)
-			} else if dropdb {
+			case migrate:
+				db.MigrateDb(config.Config.Db)
+			case dropdb:
 				db.DropDb(config.Config.Db)
-			} else {
-				return errors.New("either one of --initdb or --dropdb  parameters should be provided")
 			}
 
 			return nil
@@ -38,6 +48,7 @@ var dbCmd = func() *cobra.Command {
 	}
 
 	c.Flags().BoolVar(&initdb, "initdb", false, "If given, a wallet database is initialized")
+	c.Flags().BoolVar(&migrate, "migrate", false, "If given, schema of the wallet database is brought up to date")
 	c.Flags().BoolVar(&dropdb, "dropdb", false, "If given, a wallet database is dropped")
 
 	return c
@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"github.com/polarbit/bluelabs-wallet/grpcapi"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(grpcCmd)
+}
+
+var grpcCmd = func() *cobra.Command {
+	var storage string
+	var addr string
+
+	c := &cobra.Command{
+		Use:   "grpc",
+		Short: "gRPC API for wallet management",
+		Long: `Serves the wallet.v1.WalletService of grpcapi/walletpb/wallet.proto: the wallet and
+transaction calls of the REST api, and a server stream of transaction history which can
+follow new transactions.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return grpcapi.Serve(storage, addr)
+		},
+	}
+
+	c.Flags().StringVar(&storage, "storage", "",
+		"Overrides storage of config; postgres, sqlite or memory (data is lost on exit)")
+	c.Flags().StringVar(&addr, "addr", ":9090", "Address to listen on")
+
+	return c
+}()
@@ -0,0 +1,92 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/polarbit/bluelabs-wallet/config"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/storage"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	ledgerCmd.AddCommand(ledgerVerifyCmd)
+	ledgerCmd.AddCommand(ledgerTrialBalanceCmd)
+	rootCmd.AddCommand(ledgerCmd)
+}
+
+var ledgerCmd = &cobra.Command{
+	Use:   "ledger",
+	Short: "Audits the transaction ledger. See help for sub commands.",
+	Long:  `See bl-wallet ledger --help`,
+}
+
+var ledgerVerifyCmd = &cobra.Command{
+	Use:   "verify",
+	Short: "Verifies hash chain of transactions of every wallet",
+	Long: `Walks transactions of every wallet in refno order and reports the first broken link
+of each wallet: a missing refno, a prevhash not matching the previous transaction
+or a hash not matching the transaction content. Exits with an error if any link is broken.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config.Init()
+
+		repo, err := storage.NewRepository(config.Config, log.Logger)
+		if err != nil {
+			return err
+		}
+
+		broken := 0
+		n, err := service.VerifyLedger(context.Background(), repo, func(b *service.BrokenLink) {
+			broken++
+			fmt.Println(b)
+		})
+		if err != nil {
+			return err
+		}
+
+		fmt.Printf("verified %d wallets, %d broken\n", n, broken)
+		if broken > 0 {
+			return fmt.Errorf("ledger is broken for %d wallets", broken)
+		}
+		return nil
+	},
+}
+
+var ledgerTrialBalanceCmd = &cobra.Command{
+	Use:   "trial-balance",
+	Short: "Prints debit and credit totals of the general ledger per account",
+	Long:  `Prints debit and credit totals of the general ledger per account. Totals of debits and credits are equal unless the journal is broken.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config.Init()
+
+		repo, err := storage.NewRepository(config.Config, log.Logger)
+		if err != nil {
+			return err
+		}
+
+		bs, err := repo.TrialBalance(context.Background())
+		if err != nil {
+			return err
+		}
+
+		var debit, credit float64
+		w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', tabwriter.AlignRight)
+		fmt.Fprintln(w, "ACCOUNT\tTYPE\tDEBIT\tCREDIT\tBALANCE\t")
+		for _, b := range bs {
+			fmt.Fprintf(w, "%s\t%s\t%.2f\t%.2f\t%.2f\t\n", b.Code, b.Type, b.Debit, b.Credit, b.Balance())
+			debit += b.Debit
+			credit += b.Credit
+		}
+		fmt.Fprintf(w, "TOTAL\t\t%.2f\t%.2f\t%.2f\t\n", debit, credit, debit-credit)
+		w.Flush()
+
+		if fmt.Sprintf("%.2f", debit) != fmt.Sprintf("%.2f", credit) {
+			return fmt.Errorf("trial balance is not balanced")
+		}
+		return nil
+	},
+}
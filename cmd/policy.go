@@ -0,0 +1,112 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/polarbit/bluelabs-wallet/config"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/storage"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	policyCmd.AddCommand(policyValidateCmd)
+	policyCmd.AddCommand(policyDenialsCmd)
+	rootCmd.AddCommand(policyCmd)
+}
+
+var policyCmd = &cobra.Command{
+	Use:   "policy",
+	Short: "Validates policies and lists denied operations. See help for sub commands.",
+	Long:  `See bl-wallet policy --help`,
+}
+
+var policyValidateCmd = &cobra.Command{
+	Use:   "validate [file]",
+	Short: "Validates a policy file",
+	Long:  `Validates a policy file; the configured policy file unless a file is given.`,
+	Args:  cobra.MaximumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		config.Init()
+
+		path := config.Config.PolicyFile
+		if len(args) > 0 {
+			path = args[0]
+		}
+		if path == "" {
+			return fmt.Errorf("policy file is not configured")
+		}
+
+		p, err := service.LoadPolicy(path)
+		if err != nil {
+			return err
+		}
+
+		def := p.Default
+		if def == "" {
+			def = service.EffectDeny
+		}
+		fmt.Printf("policy %s is valid: %d rules, default %s\n", path, len(p.Rules), def)
+		return nil
+	},
+}
+
+var policyDenialsCmd = func() *cobra.Command {
+	var after int64
+	var limit int
+
+	c := &cobra.Command{
+		Use:   "denials",
+		Short: "Lists operations denied by the policy",
+		Long:  `Lists audit records of operations denied by the policy, oldest first.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config.Init()
+
+			repo, err := storage.NewRepository(config.Config, log.Logger)
+			if err != nil {
+				return err
+			}
+
+			ds, err := repo.ListPolicyDenials(context.Background(), after, limit)
+			if err != nil {
+				return err
+			}
+
+			w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+			fmt.Fprintln(w, "ID\tCREATED\tCLIENT\tOPERATION\tWID\tAMOUNT\tRULE\tLABELS")
+			for _, d := range ds {
+				rule := d.Rule
+				if rule == "" {
+					rule = "(default)"
+				}
+				fmt.Fprintf(w, "%d\t%s\t%s\t%s\t%d\t%.2f\t%s\t%s\n", d.ID, d.Created.Format(time.RFC3339), d.Client,
+					d.Operation, d.WalletID, d.Amount, rule, formatLabels(d.Labels))
+			}
+			w.Flush()
+
+			return nil
+		},
+	}
+
+	c.Flags().Int64Var(&after, "after", 0, "List denials with ids greater than this")
+	c.Flags().IntVar(&limit, "limit", 100, "Maximum number of denials to list")
+
+	return c
+}()
+
+// formatLabels returns labels as sorted name=value pairs
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
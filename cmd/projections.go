@@ -0,0 +1,103 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"sort"
+
+	"github.com/polarbit/bluelabs-wallet/config"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/storage"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	projectionsCmd.AddCommand(projectionsRebuildCmd)
+	rootCmd.AddCommand(projectionsCmd)
+}
+
+var projectionsCmd = &cobra.Command{
+	Use:   "projections",
+	Short: "Manages read models built from the transaction log. See help for sub commands.",
+	Long:  `See bl-wallet projections --help`,
+}
+
+var projectionsRebuildCmd = func() *cobra.Command {
+	var wid int
+	var names []string
+	var restart bool
+
+	c := &cobra.Command{
+		Use:   "rebuild",
+		Short: "Rebuilds read models by replaying the transaction log",
+		Long: `Replays transactions of every wallet in refno order into the projections
+(read models) and writes the ones which differ. The balances projection rebuilds
+wallet_balances as the sum of transaction amounts; every change is recorded in the
+balance_repairs audit table.
+
+The service can keep running: a wallet receiving a transaction during its replay is
+replayed again, and skipped (reported) if it keeps changing. Progress is checkpointed
+every 100 wallets, and an interrupted rebuild resumes from its checkpoint unless
+--restart is given. With --wallet, only that wallet is replayed and checkpoints are
+not touched.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config.Init()
+
+			repo, err := storage.NewRepository(config.Config, log.Logger)
+			if err != nil {
+				return err
+			}
+
+			all := service.Projections(repo)
+			if len(names) == 0 {
+				for name := range all {
+					names = append(names, name)
+				}
+				sort.Strings(names)
+			}
+
+			ps := []service.Projection{}
+			for _, name := range names {
+				p, ok := all[name]
+				if !ok {
+					return fmt.Errorf("unknown projection %q", name)
+				}
+				ps = append(ps, p)
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+
+			if wid != 0 {
+				n, changed, err := service.RebuildWallet(ctx, repo, ps, wid)
+				if err != nil {
+					return err
+				}
+				fmt.Printf("rebuilt wallet %d: %d transactions, %d projections changed\n", wid, n, changed)
+				return nil
+			}
+
+			p, err := service.RebuildProjections(ctx, repo, ps, restart, func(p *service.RebuildProgress) {
+				fmt.Printf("rebuilt %d wallets up to %d: %d transactions, %d changed, %d skipped\n",
+					p.Wallets, p.LastWalletID, p.Transactions, p.Changed, len(p.Skipped))
+			})
+			if err != nil {
+				return err
+			}
+
+			if len(p.Skipped) > 0 {
+				return fmt.Errorf("wallets kept changing during rebuild, rebuild them with --wallet: %v", p.Skipped)
+			}
+			return nil
+		},
+	}
+
+	c.Flags().IntVar(&wid, "wallet", 0, "If given, only this wallet is rebuilt")
+	c.Flags().StringSliceVar(&names, "projection", nil, "Projections to rebuild; all if not given")
+	c.Flags().BoolVar(&restart, "restart", false, "If given, checkpoints of an interrupted rebuild are ignored")
+
+	return c
+}()
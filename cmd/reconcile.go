@@ -0,0 +1,83 @@
+package cmd
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/polarbit/bluelabs-wallet/config"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/storage"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(reconcileCmd)
+}
+
+var reconcileCmd = func() *cobra.Command {
+	var format string
+	var repair bool
+
+	c := &cobra.Command{
+		Use:   "reconcile",
+		Short: "Reconciles wallet balances with the transaction ledger",
+		Long: `Checks every wallet for refno gaps, broken old/new balance chains, new balances
+not matching the sum of amounts and materialized balances not matching the latest
+transaction. With --repair, materialized balances are set to the new balance of the
+latest transaction; every repair is recorded in the balance_repairs audit table.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if format != "json" && format != "csv" {
+				return fmt.Errorf("invalid format %q, valid values are: json, csv", format)
+			}
+
+			config.Init()
+
+			repo, err := storage.NewRepository(config.Config, log.Logger)
+			if err != nil {
+				return err
+			}
+
+			report, err := service.Reconcile(context.Background(), repo, repair)
+			if err != nil {
+				return err
+			}
+
+			if format == "csv" {
+				return writeReconcileCsv(os.Stdout, report)
+			}
+
+			enc := json.NewEncoder(os.Stdout)
+			enc.SetIndent("", "  ")
+			return enc.Encode(report)
+		},
+	}
+
+	c.Flags().StringVar(&format, "format", "json", "Report format; json or csv")
+	c.Flags().BoolVar(&repair, "repair", false, "If given, mismatching materialized balances are repaired")
+
+	return c
+}()
+
+func writeReconcileCsv(out io.Writer, report *service.ReconcileReport) error {
+	w := csv.NewWriter(out)
+	w.Write([]string{"wid", "refno", "kind", "expected", "actual", "repaired", "detail"})
+	for _, d := range report.Discrepancies {
+		w.Write([]string{
+			strconv.Itoa(d.WalletID),
+			strconv.Itoa(d.RefNo),
+			d.Kind,
+			strconv.FormatFloat(d.Expected, 'f', 2, 64),
+			strconv.FormatFloat(d.Actual, 'f', 2, 64),
+			strconv.FormatBool(d.Repaired),
+			d.Detail,
+		})
+	}
+	w.Flush()
+	return w.Error()
+}
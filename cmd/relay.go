@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/polarbit/bluelabs-wallet/config"
+	"github.com/polarbit/bluelabs-wallet/publish"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/storage"
+	"github.com/polarbit/bluelabs-wallet/webhook"
+	"github.com/rs/zerolog/log"
+	"github.com/spf13/cobra"
+)
+
+// pruneInterval is the period of deleting published events while relaying
+const pruneInterval = time.Hour
+
+func init() {
+	rootCmd.AddCommand(relayCmd)
+}
+
+var relayCmd = func() *cobra.Command {
+	var out string
+	var interval time.Duration
+	var batch int
+	var once bool
+	var webhooks bool
+	var pruneAfter time.Duration
+
+	c := &cobra.Command{
+		Use:   "relay",
+		Short: "Publishes domain events of the outbox",
+		Long: `Publishes pending outbox events (WalletCreated, TransactionCreated, BalanceChanged)
+in sequence order as json lines, to the standard output or appended to --out. Events
+are marked published only after they are written, so delivery is at-least-once;
+consumers should dedupe by seq.
+
+With --webhooks, events are fanned out to the deliveries of matching webhook
+subscriptions instead, and deliveries are sent with retries. Both relays keep
+their own record of published events, so they can run side by side.
+
+Events published by every relay that ever ran are deleted from the outbox once
+they are older than --prune-after.`,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			config.Init()
+
+			repo, err := storage.NewRepository(config.Config, log.Logger)
+			if err != nil {
+				return err
+			}
+
+			ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+			defer stop()
+
+			if pruneAfter > 0 {
+				if once {
+					defer prune(ctx, repo, pruneAfter)
+				} else {
+					go service.RunPrune(ctx, repo, pruneAfter, pruneInterval, log.Logger.With().Str("job", "prune").Logger())
+				}
+			}
+
+			if webhooks {
+				return relayWebhooks(ctx, repo, interval, batch, once)
+			}
+
+			p := publish.NewStdoutPublisher()
+			if out != "" {
+				if p, err = publish.NewFilePublisher(out); err != nil {
+					return err
+				}
+			}
+			defer p.Close()
+
+			if once {
+				for {
+					n, err := service.RelayEvents(ctx, repo, service.ConsumerRelay, p, batch)
+					if err != nil || n < batch {
+						return err
+					}
+				}
+			}
+
+			service.RunRelay(ctx, repo, service.ConsumerRelay, p, interval, batch, log.Logger.With().Str("job", "relay").Logger())
+			return nil
+		},
+	}
+
+	c.Flags().StringVar(&out, "out", "", "File to append events to; standard output if empty")
+	c.Flags().DurationVar(&interval, "interval", time.Second, "Polling interval when the outbox is drained")
+	c.Flags().IntVar(&batch, "batch", 100, "Number of events read from the outbox at once")
+	c.Flags().BoolVar(&once, "once", false, "If given, exits when the outbox is drained")
+	c.Flags().BoolVar(&webhooks, "webhooks", false, "If given, events are delivered to webhook subscriptions")
+	c.Flags().DurationVar(&pruneAfter, "prune-after", 7*24*time.Hour, "Age of published events deleted from the outbox; 0 keeps them")
+
+	return c
+}()
+
+// relayWebhooks fans events out to webhook deliveries and sends them. With
+// once, it makes a single pass over the outbox and due deliveries.
+func relayWebhooks(ctx context.Context, repo service.Repository, interval time.Duration, batch int, once bool) error {
+	p := service.NewWebhookPublisher(repo)
+	d := webhook.NewDispatcher(repo, log.Logger.With().Str("job", "webhooks").Logger())
+
+	if once {
+		for {
+			n, err := service.RelayEvents(ctx, repo, service.ConsumerWebhooks, p, batch)
+			if err != nil {
+				return err
+			}
+			if n < batch {
+				break
+			}
+		}
+		_, err := d.DeliverDue(ctx, batch)
+		return err
+	}
+
+	go d.Run(ctx, interval, batch)
+	service.RunRelay(ctx, repo, service.ConsumerWebhooks, p, interval, batch, log.Logger.With().Str("job", "relay").Logger())
+	return nil
+}
+
+// prune deletes the published events older than retention from the outbox.
+func prune(ctx context.Context, repo service.Repository, retention time.Duration) {
+	n, err := repo.PruneEvents(ctx, time.Now().UTC().Add(-retention))
+	if err != nil {
+		log.Error().Err(err).Msg("prune outbox failed")
+		return
+	}
+	log.Debug().Int("pruned", n).Msg("outbox pruned")
+}
@@ -2,16 +2,106 @@ package config
 
 import (
 	"fmt"
+	"math"
+	"net"
 	"strings"
+	"time"
 
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/viper"
 )
 
+// Storage backends
+const (
+	StoragePostgres = "postgres"
+	StorageSqlite   = "sqlite"
+	StorageMemory   = "memory"
+)
+
+// Stores of rate limits
+const (
+	RateLimitStoreMemory   = "memory"
+	RateLimitStorePostgres = "postgres"
+)
+
+// Posting modes of transactions
+const (
+	PostingOptimistic = "optimistic"
+	PostingLocking    = "locking"
+)
+
 type AppConfig struct {
 	Db       string `mapstructure:"db"`
+	Storage  string `mapstructure:"storage"`
+	Sqlite   string `mapstructure:"sqlite"`
+	Posting  string `mapstructure:"posting"`
 	LogLevel string `mapstructure:"loglevel"`
+
+	// ReconcileInterval is the period of the in-process reconcile job of the
+	// api, e.g. "1h". Empty disables the job.
+	ReconcileInterval string `mapstructure:"reconcileinterval"`
+
+	// DailySnapshots enables the in-process job of the api that writes the
+	// closing balances of wallets after every midnight (UTC).
+	DailySnapshots bool `mapstructure:"dailysnapshots"`
+
+	// ApiKeys requires an api key with the scope of the route on every request
+	// of the api. Keys are managed by the apikey command, so memory storage
+	// has none.
+	ApiKeys bool `mapstructure:"apikeys"`
+
+	// Jwks is the JSON Web Key Set file or http(s) url of the keys of bearer
+	// tokens (RS256 or ES256); empty disables bearer tokens. JwtIssuer and
+	// JwtAudience are required claims if not empty; JwtClockSkew is tolerated
+	// on exp, nbf and iat, e.g. "1m"; JwtTenantClaim names the claim of the
+	// tenant, "tenant" if empty.
+	Jwks           string `mapstructure:"jwks"`
+	JwtIssuer      string `mapstructure:"jwtissuer"`
+	JwtAudience    string `mapstructure:"jwtaudience"`
+	JwtClockSkew   string `mapstructure:"jwtclockskew"`
+	JwtTenantClaim string `mapstructure:"jwttenantclaim"`
+
+	// SigningSecrets are the secrets of clients signing requests by client id
+	// (case-insensitive); when not empty, adding transactions requires a
+	// request signature. SigningTolerance is the accepted age of signatures,
+	// "5m" if empty.
+	SigningSecrets   map[string]string `mapstructure:"signingsecrets"`
+	SigningTolerance string            `mapstructure:"signingtolerance"`
+
+	// PolicyFile is the policy authorizing wallet creations and transactions
+	// of callers (see service.Policy); empty allows everything.
+	PolicyFile string `mapstructure:"policyfile"`
+
+	// RateLimitClientRate limits requests per client (api key, token subject or
+	// ip of anonymous callers) to a rate per second with bursts of
+	// RateLimitClientBurst; RateLimitWalletRate and RateLimitWalletBurst limit
+	// the transactions added to each wallet. A zero rate disables the limit, a
+	// zero burst is the rate rounded up. RateLimitIPRate and RateLimitIPBurst
+	// limit requests per ip before they are authenticated, failed attempts
+	// included. RateLimitStore keeps the buckets: "memory" (default) or
+	// "postgres", which is shared by the instances.
+	RateLimitClientRate  float64 `mapstructure:"ratelimitclientrate"`
+	RateLimitClientBurst int     `mapstructure:"ratelimitclientburst"`
+	RateLimitWalletRate  float64 `mapstructure:"ratelimitwalletrate"`
+	RateLimitWalletBurst int     `mapstructure:"ratelimitwalletburst"`
+	RateLimitIPRate      float64 `mapstructure:"ratelimitiprate"`
+	RateLimitIPBurst     int     `mapstructure:"ratelimitipburst"`
+	RateLimitStore       string  `mapstructure:"ratelimitstore"`
+
+	// TrustedProxies are addresses or CIDR ranges of the proxies in front of
+	// the api. When set, the ip of a caller is the last address of
+	// X-Forwarded-For which is not of a trusted proxy; otherwise it is the
+	// address of the connection.
+	TrustedProxies []string `mapstructure:"trustedproxies"`
+
+	// Metrics serves the metrics of prometheus on /metrics of the api, which
+	// requires the admin scope when api keys or bearer tokens are on.
+	Metrics bool `mapstructure:"metrics"`
+	// MetricsAddr is the address of a /metrics endpoint of prometheus served
+	// apart from the api, e.g. ":2112", without authentication; it is the only
+	// one of the grpc api. Empty serves none.
+	MetricsAddr string `mapstructure:"metricsaddr"`
 }
 
 var Config *AppConfig
@@ -46,9 +136,79 @@ func initConfig() {
 		panic(fmt.Errorf("loglevel is incorrect, valid values are: panic, fatal, error, warning, debug, trace. err:%v", err))
 	}
 
+	if config.Storage == "" {
+		config.Storage = StoragePostgres
+	}
+	if err := ValidateStorage(config.Storage); err != nil {
+		panic(err)
+	}
+
+	if config.Posting == "" {
+		config.Posting = PostingOptimistic
+	}
+	if config.Posting != PostingOptimistic && config.Posting != PostingLocking {
+		panic(fmt.Errorf("posting is incorrect, valid values are: %s, %s. posting:%s",
+			PostingOptimistic, PostingLocking, config.Posting))
+	}
+
+	if config.ReconcileInterval != "" {
+		if _, err := time.ParseDuration(config.ReconcileInterval); err != nil {
+			panic(fmt.Errorf("reconcileinterval is incorrect, should be a duration like 1h. err:%v", err))
+		}
+	}
+
+	if config.JwtClockSkew != "" {
+		if _, err := time.ParseDuration(config.JwtClockSkew); err != nil {
+			panic(fmt.Errorf("jwtclockskew is incorrect, should be a duration like 1m. err:%v", err))
+		}
+	}
+
+	if config.SigningTolerance == "" {
+		config.SigningTolerance = "5m"
+	}
+	if _, err := time.ParseDuration(config.SigningTolerance); err != nil {
+		panic(fmt.Errorf("signingtolerance is incorrect, should be a duration like 5m. err:%v", err))
+	}
+
+	if config.RateLimitStore == "" {
+		config.RateLimitStore = RateLimitStoreMemory
+	}
+	if config.RateLimitStore != RateLimitStoreMemory && config.RateLimitStore != RateLimitStorePostgres {
+		panic(fmt.Errorf("ratelimitstore is incorrect, valid values are: %s, %s. ratelimitstore:%s",
+			RateLimitStoreMemory, RateLimitStorePostgres, config.RateLimitStore))
+	}
+	if _, err := ParseIPRanges(config.TrustedProxies); err != nil {
+		panic(fmt.Errorf("trustedproxies is incorrect, should be addresses or CIDR ranges. err:%v", err))
+	}
+	config.RateLimitClientBurst = rateLimitBurst("ratelimitclient", config.RateLimitClientRate, config.RateLimitClientBurst)
+	config.RateLimitWalletBurst = rateLimitBurst("ratelimitwallet", config.RateLimitWalletRate, config.RateLimitWalletBurst)
+	config.RateLimitIPBurst = rateLimitBurst("ratelimitip", config.RateLimitIPRate, config.RateLimitIPBurst)
+
 	Config = &config
 }
 
+// rateLimitBurst returns the burst of a rate limit, the rate rounded up if
+// zero; it panics on negative values.
+func rateLimitBurst(name string, rate float64, burst int) int {
+	if rate < 0 || burst < 0 {
+		panic(fmt.Errorf("%srate and %sburst should not be negative. rate:%v burst:%d", name, name, rate, burst))
+	}
+	if burst == 0 {
+		return int(math.Ceil(rate))
+	}
+	return burst
+}
+
+// ValidateStorage returns an error if s is not a known storage backend.
+func ValidateStorage(s string) error {
+	switch s {
+	case StoragePostgres, StorageSqlite, StorageMemory:
+		return nil
+	}
+	return fmt.Errorf("storage is incorrect, valid values are: %s, %s, %s. storage:%s",
+		StoragePostgres, StorageSqlite, StorageMemory, s)
+}
+
 func initLogger() {
 	if level, err := zerolog.ParseLevel(Config.LogLevel); err != nil {
 		panic("invalid log level in config:" + Config.LogLevel)
@@ -64,3 +224,29 @@ func Dump() {
 	fmt.Println("===========")
 	fmt.Printf("%+v\n", *Config)
 }
+
+// ParseIPRanges parses addresses and CIDR ranges; an address is a range of
+// itself.
+func ParseIPRanges(ss []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, s := range ss {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid address %q", s)
+			}
+			bits := 8 * net.IPv6len
+			if ip4 := ip.To4(); ip4 != nil {
+				ip, bits = ip4, 8*net.IPv4len
+			}
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
+}
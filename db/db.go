@@ -29,7 +29,7 @@ func InitDb(url string) {
 
 	fmt.Println("Database is created")
 
-	createSchema(url)
+	MigrateDb(url)
 }
 
 func DropDb(url string) {
@@ -54,7 +54,8 @@ func DropDb(url string) {
 	fmt.Println("Database is dropped")
 }
 
-func createSchema(url string) {
+// MigrateDb brings the schema of the database up to date; see migrations.
+func MigrateDb(url string) {
 	conn, err := pgx.Connect(context.Background(), url)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Unable to connect to database: %v\n", err)
@@ -62,40 +63,10 @@ func createSchema(url string) {
 	}
 	defer conn.Close(context.Background())
 
-	_, err = conn.Exec(context.Background(), schemaSql)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "QueryRow failed: %v\n", err)
+	if err := migrate(context.Background(), conn); err != nil {
+		fmt.Fprintf(os.Stderr, "Migrate schema failed: %v\n", err)
 		os.Exit(1)
 	}
 
-	fmt.Println("Database schema is created")
+	fmt.Println("Database schema is up to date")
 }
-
-const schemaSql = `
-CREATE TABLE IF NOT EXISTS wallets (
-	id			serial		PRIMARY KEY,
-	labels		jsonb		not null,
-	created 	timestamp	not null,
-	externalid	varchar(50)	not null unique
-);
-
-CREATE TABLE IF NOT EXISTS wallet_transactions (
-	id			uuid			PRIMARY KEY,
-	wid			integer			not null,
-	refno		integer			not null,
-	amount		numeric(10,2)	not null,
-	description	varchar(100)	not null,
-	labels		jsonb			not null,
-	fingerprint	varchar(50)		not null unique,
-	created 	timestamp		not null,
-	old_balance	numeric(10,2)	not null,
-	new_balance numeric(10,2)	not null
-);
-
-CREATE TABLE IF NOT EXISTS wallet_balances (
-	wid			integer			PRIMARY KEY,
-	amount		numeric(10,2)	not null
-);
-
-CREATE UNIQUE INDEX ix_wid_refno ON wallet_transactions (wid, refno);
-`
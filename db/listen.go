@@ -0,0 +1,114 @@
+package db
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4"
+	"github.com/rs/zerolog"
+
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+// notifyChannel is the LISTEN/NOTIFY channel of committed transactions; the
+// payload is "<wid>:<refno>"
+const notifyChannel = "wallet_transactions"
+
+// reconnectDelay is the wait before the listener connects again once its
+// connection is lost
+const reconnectDelay = time.Second
+
+// listener shares a single LISTEN connection among the listeners of the
+// process and fans notifications out to them by wallet.
+type listener struct {
+	url string
+	l   zerolog.Logger
+	n   *service.Notifier
+
+	mu      sync.Mutex
+	started bool
+}
+
+func newListener(url string, l zerolog.Logger) *listener {
+	return &listener{url: url, l: l, n: service.NewNotifier()}
+}
+
+// Listen returns a channel receiving refnos of the wallet notified once the
+// shared connection listens. The first call connects; later ones share the
+// connection, which is connected again whenever it is lost. Notifications
+// sent while it is lost are missed, listeners catch up by polling.
+func (ls *listener) Listen(ctx context.Context, wid int) (<-chan int, error) {
+	ls.mu.Lock()
+	defer ls.mu.Unlock()
+
+	if !ls.started {
+		conn, err := ls.connect(ctx)
+		if err != nil {
+			return nil, err
+		}
+		ls.started = true
+		go ls.run(conn)
+	}
+	return ls.n.Listen(ctx, wid), nil
+}
+
+func (ls *listener) connect(ctx context.Context) (*pgx.Conn, error) {
+	conn, err := pgx.Connect(ctx, ls.url)
+	if err != nil {
+		return nil, service.NewDbError(err)
+	}
+	if _, err := conn.Exec(ctx, `listen `+pgx.Identifier{notifyChannel}.Sanitize()); err != nil {
+		conn.Close(context.Background())
+		return nil, service.NewDbError(err)
+	}
+	return conn, nil
+}
+
+// run notifies the listeners of the process for the lifetime of the process.
+func (ls *listener) run(conn *pgx.Conn) {
+	ctx := context.Background()
+	for {
+		for {
+			n, err := conn.WaitForNotification(ctx)
+			if err != nil {
+				ls.l.Error().Err(err).Msg("listen failed")
+				break
+			}
+			wid, refno, ok := parseNotification(n.Payload)
+			if !ok {
+				ls.l.Warn().Str("payload", n.Payload).Msg("invalid notification")
+				continue
+			}
+			ls.n.Notify(wid, refno)
+		}
+		conn.Close(ctx)
+
+		for {
+			time.Sleep(reconnectDelay)
+			var err error
+			if conn, err = ls.connect(ctx); err == nil {
+				break
+			}
+			ls.l.Error().Err(err).Msg("listen reconnect failed")
+		}
+	}
+}
+
+func parseNotification(payload string) (wid int, refno int, ok bool) {
+	i := strings.IndexByte(payload, ':')
+	if i < 0 {
+		return 0, 0, false
+	}
+	wid, err := strconv.Atoi(payload[:i])
+	if err != nil {
+		return 0, 0, false
+	}
+	refno, err = strconv.Atoi(payload[i+1:])
+	if err != nil {
+		return 0, 0, false
+	}
+	return wid, refno, true
+}
@@ -0,0 +1,355 @@
+package db
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v4"
+
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+// migrationLock is the advisory lock key held while migrating, so that
+// instances started together migrate one by one
+const migrationLock = 7310451
+
+// migration is a version of the schema. Statements are idempotent, so that
+// databases created before the schema was versioned adopt the versions they
+// already have.
+type migration struct {
+	sql string
+	// data runs after sql in the same transaction, for changes of rows that
+	// sql cannot make
+	data func(ctx context.Context, tx pgx.Tx) error
+}
+
+// migrations are applied in order; a migration is never changed once released,
+// append a new one instead.
+var migrations = []migration{
+	// 1: initial schema
+	{sql: `
+CREATE TABLE IF NOT EXISTS wallets (
+	id			serial		PRIMARY KEY,
+	labels		jsonb		not null,
+	created 	timestamp	not null,
+	externalid	varchar(50)	not null unique
+);
+
+CREATE TABLE IF NOT EXISTS wallet_transactions (
+	id			uuid			PRIMARY KEY,
+	wid			integer			not null,
+	refno		integer			not null,
+	amount		numeric(10,2)	not null,
+	description	varchar(100)	not null,
+	labels		jsonb			not null,
+	fingerprint	varchar(50)		not null unique,
+	created 	timestamp		not null,
+	old_balance	numeric(10,2)	not null,
+	new_balance numeric(10,2)	not null
+);
+
+CREATE TABLE IF NOT EXISTS wallet_balances (
+	wid			integer			PRIMARY KEY,
+	amount		numeric(10,2)	not null
+);
+
+CREATE UNIQUE INDEX IF NOT EXISTS ix_wid_refno ON wallet_transactions (wid, refno);
+`},
+	// 2: hash chain of transactions; existing transactions are chained
+	{sql: `
+ALTER TABLE wallet_transactions ADD COLUMN IF NOT EXISTS prev_hash varchar(64) not null default '';
+ALTER TABLE wallet_transactions ADD COLUMN IF NOT EXISTS hash varchar(64) not null default '';
+`, data: chainTransactions},
+	// 3: general ledger
+	{sql: `
+CREATE TABLE IF NOT EXISTS accounts (
+	code		varchar(50)		PRIMARY KEY,
+	name		varchar(100)	not null,
+	type		varchar(20)		not null
+);
+
+CREATE TABLE IF NOT EXISTS journal_entries (
+	id				bigserial		PRIMARY KEY,
+	transaction_id	uuid			not null references wallet_transactions (id),
+	wid				integer			not null,
+	account			varchar(50)		not null references accounts (code),
+	amount			numeric(10,2)	not null,
+	created			timestamp		not null
+);
+
+CREATE INDEX IF NOT EXISTS ix_journal_account ON journal_entries (account);
+`},
+	// 4: point in time balances
+	{sql: `
+CREATE INDEX IF NOT EXISTS ix_wid_created ON wallet_transactions (wid, created);
+`},
+	// 5: audit of balance repairs
+	{sql: `
+CREATE TABLE IF NOT EXISTS balance_repairs (
+	id			bigserial		PRIMARY KEY,
+	wid			integer			not null,
+	refno		integer			not null,
+	old_amount	numeric(10,2)	not null,
+	new_amount	numeric(10,2)	not null,
+	created		timestamp		not null
+);
+`},
+	// 6: daily balance snapshots
+	{sql: `
+CREATE TABLE IF NOT EXISTS balance_snapshots (
+	wid			integer			not null,
+	day			date			not null,
+	balance		numeric(10,2)	not null,
+	refno		integer			not null,
+	created		timestamp		not null,
+	PRIMARY KEY (wid, day)
+);
+`},
+	// 7: transactional outbox
+	{sql: `
+CREATE TABLE IF NOT EXISTS outbox (
+	seq			bigserial		PRIMARY KEY,
+	type		varchar(50)		not null,
+	wid			integer			not null,
+	payload		jsonb			not null,
+	created		timestamp		not null,
+	published	timestamp
+);
+
+ALTER TABLE outbox ADD COLUMN IF NOT EXISTS published timestamp;
+
+CREATE INDEX IF NOT EXISTS ix_outbox_pending ON outbox (seq) WHERE published IS NULL;
+`},
+	// 8: webhooks
+	{sql: `
+CREATE TABLE IF NOT EXISTS webhook_subscriptions (
+	id			serial			PRIMARY KEY,
+	url			varchar(500)	not null,
+	event_types	jsonb			not null,
+	labels		jsonb			not null,
+	secret		varchar(100)	not null,
+	created		timestamp		not null
+);
+
+CREATE TABLE IF NOT EXISTS webhook_deliveries (
+	id					bigserial		PRIMARY KEY,
+	subscription_id		integer			not null references webhook_subscriptions (id) on delete cascade,
+	event_seq			bigint			not null,
+	event_type			varchar(50)		not null,
+	wid					integer			not null,
+	payload				jsonb			not null,
+	event_created		timestamp		not null,
+	status				varchar(20)		not null,
+	attempts			integer			not null,
+	next_attempt		timestamp		not null,
+	last_error			text			not null,
+	last_status_code	integer			not null,
+	created				timestamp		not null,
+	updated				timestamp		not null,
+	UNIQUE (subscription_id, event_seq)
+);
+
+CREATE INDEX IF NOT EXISTS ix_deliveries_due ON webhook_deliveries (next_attempt) WHERE status = 'pending';
+`},
+	// 9: projection checkpoints
+	{sql: `
+CREATE TABLE IF NOT EXISTS projection_checkpoints (
+	name		varchar(50)		PRIMARY KEY,
+	wid			integer			not null,
+	updated		timestamp		not null
+);
+`},
+	// 10: api keys and the client of transactions
+	{sql: `
+ALTER TABLE wallet_transactions ADD COLUMN IF NOT EXISTS client varchar(100) not null default '';
+
+CREATE TABLE IF NOT EXISTS api_keys (
+	id			serial			PRIMARY KEY,
+	name		varchar(50)		not null unique,
+	prefix		varchar(20)		not null,
+	hash		varchar(64)		not null unique,
+	scopes		jsonb			not null,
+	created		timestamp		not null,
+	revoked		timestamp		null
+);
+`},
+	// 11: policy denials
+	{sql: `
+CREATE TABLE IF NOT EXISTS policy_denials (
+	id			bigserial		PRIMARY KEY,
+	client		varchar(100)	not null,
+	operation	varchar(20)		not null,
+	wid			integer			not null,
+	amount		numeric(10,2)	not null,
+	labels		jsonb			not null,
+	rule		varchar(100)	not null,
+	created		timestamp		not null
+);
+`},
+	// 12: rate limits shared by instances
+	{sql: `
+CREATE TABLE IF NOT EXISTS rate_limits (
+	key			varchar(200)		PRIMARY KEY,
+	tokens		double precision	not null,
+	updated		timestamp			not null,
+	full_at		timestamp			not null
+);
+
+CREATE INDEX IF NOT EXISTS ix_rate_limits_full_at ON rate_limits (full_at);
+`},
+	// 13: nonces of signed requests shared by instances
+	{sql: `
+CREATE TABLE IF NOT EXISTS signing_nonces (
+	client		varchar(100)	not null,
+	nonce		text			not null,
+	expires		timestamp		not null,
+	PRIMARY KEY (client, nonce)
+);
+
+CREATE INDEX IF NOT EXISTS ix_signing_nonces_expires ON signing_nonces (expires);
+`},
+	// 14: outbox consumers; events published before were published for both
+	{sql: `
+CREATE TABLE IF NOT EXISTS outbox_consumers (
+	name		varchar(50)		PRIMARY KEY
+);
+
+CREATE TABLE IF NOT EXISTS outbox_published (
+	consumer	varchar(50)		not null,
+	seq			bigint			not null REFERENCES outbox (seq) ON DELETE CASCADE,
+	published	timestamp		not null,
+	PRIMARY KEY (consumer, seq)
+);
+
+INSERT INTO outbox_published (consumer, seq, published)
+SELECT c.name, o.seq, o.published FROM outbox o CROSS JOIN (VALUES ('relay'), ('webhooks')) AS c (name)
+WHERE o.published IS NOT NULL
+ON CONFLICT DO NOTHING;
+
+DROP INDEX IF EXISTS ix_outbox_pending;
+ALTER TABLE outbox DROP COLUMN IF EXISTS published;
+CREATE INDEX IF NOT EXISTS ix_outbox_created ON outbox (created);
+`},
+}
+
+// migrate brings the schema of the database of conn up to date and seeds the
+// chart of accounts.
+func migrate(ctx context.Context, conn *pgx.Conn) error {
+	if _, err := conn.Exec(ctx, `select pg_advisory_lock($1)`, migrationLock); err != nil {
+		return fmt.Errorf("lock schema: %w", err)
+	}
+	defer conn.Exec(context.Background(), `select pg_advisory_unlock($1)`, migrationLock)
+
+	_, err := conn.Exec(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version	integer		PRIMARY KEY,
+		applied	timestamp	not null
+	)`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var version int
+	err = conn.QueryRow(ctx, `select coalesce(max(version), 0) from schema_migrations`).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if err := applyMigration(ctx, conn, i+1, migrations[i]); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+
+	// chart of accounts
+	for _, a := range service.Accounts {
+		_, err = conn.Exec(ctx,
+			`insert into accounts (code, name, type) values ($1, $2, $3) on conflict do nothing`, a.Code, a.Name, a.Type)
+		if err != nil {
+			return fmt.Errorf("seed accounts: %w", err)
+		}
+	}
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *pgx.Conn, version int, m migration) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, m.sql); err != nil {
+		return err
+	}
+	if m.data != nil {
+		if err := m.data(ctx, tx); err != nil {
+			return err
+		}
+	}
+	_, err = tx.Exec(ctx, `insert into schema_migrations (version, applied) values ($1, now() at time zone 'utc')`, version)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// chainTransactions sets the hashes of transactions created before they were
+// chained, wallet by wallet in refno order, so that `ledger verify` passes for
+// them. Transactions of that time have no client.
+func chainTransactions(ctx context.Context, tx pgx.Tx) error {
+	var wids []int
+	rows, err := tx.Query(ctx, `select distinct wid from wallet_transactions where hash = '' order by wid`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var wid int
+		if err := rows.Scan(&wid); err != nil {
+			rows.Close()
+			return err
+		}
+		wids = append(wids, wid)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, wid := range wids {
+		rows, err := tx.Query(ctx, `
+		select id, refno, amount, description, labels, fingerprint, created, old_balance, new_balance, hash
+		from wallet_transactions where wid = $1 order by refno`, wid)
+		if err != nil {
+			return err
+		}
+		var trs []*service.Transaction
+		for rows.Next() {
+			t := &service.Transaction{}
+			err := rows.Scan(&t.ID, &t.RefNo, &t.Amount, &t.Description, &t.Labels,
+				&t.Fingerprint, &t.Created, &t.OldBalance, &t.NewBalance, &t.Hash)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			trs = append(trs, t)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+
+		var prev *service.Transaction
+		for _, t := range trs {
+			if t.Hash == "" {
+				service.ChainTransaction(wid, t, prev)
+				_, err := tx.Exec(ctx, `update wallet_transactions set prev_hash = $2, hash = $3 where id = $1`,
+					t.ID, t.PrevHash, t.Hash)
+				if err != nil {
+					return err
+				}
+			}
+			prev = t
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/rs/zerolog"
+
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/signing"
+)
+
+// NonceStore is a signing.NonceStore shared by the instances of the api, so a
+// signed request cannot be replayed against another instance.
+type NonceStore struct {
+	pool *pgxpool.Pool
+	l    zerolog.Logger
+
+	mu    sync.Mutex
+	swept time.Time
+}
+
+// NewNonceStore returns the store of the database of url. It shares the
+// connection pool of repo if repo is the repository of the same database.
+func NewNonceStore(url string, repo service.Repository, logger zerolog.Logger) *NonceStore {
+	if r, ok := repo.(*repository); ok && r.url == url {
+		return &NonceStore{pool: r.pool, l: logger}
+	}
+	return &NonceStore{pool: newPool(url), l: logger}
+}
+
+func (s *NonceStore) Use(ctx context.Context, client, nonce string, expires time.Time) error {
+	now := time.Now().UTC()
+
+	// an expired nonce is the same as a missing one
+	stmt := `insert into signing_nonces (client, nonce, expires) values ($1, $2, $3)
+	on conflict (client, nonce) do update set expires = excluded.expires
+	where signing_nonces.expires <= $4`
+	ctag, err := s.pool.Exec(ctx, stmt, client, nonce, expires.UTC(), now)
+	if err != nil {
+		s.l.Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	if ctag.RowsAffected() != 1 {
+		return signing.ErrReplayedNonce
+	}
+
+	s.sweep(ctx, now)
+	return nil
+}
+
+// sweep deletes expired nonces once a minute.
+func (s *NonceStore) sweep(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	if now.Sub(s.swept) < time.Minute {
+		s.mu.Unlock()
+		return
+	}
+	s.swept = now
+	s.mu.Unlock()
+
+	if _, err := s.pool.Exec(ctx, `delete from signing_nonces where expires <= $1`, now); err != nil {
+		s.l.Warn().Err(err).Msg("sweep signing nonces failed")
+	}
+}
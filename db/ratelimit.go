@@ -0,0 +1,87 @@
+package db
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/rs/zerolog"
+
+	"github.com/polarbit/bluelabs-wallet/ratelimit"
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+// RateLimitStore is a ratelimit.Store shared by the instances of the api. The
+// bucket row is locked while a token is taken, so concurrent requests of
+// different instances take tokens one by one.
+type RateLimitStore struct {
+	pool *pgxpool.Pool
+	l    zerolog.Logger
+
+	mu    sync.Mutex
+	swept time.Time
+}
+
+// NewRateLimitStore returns the store of the database of url. It shares the
+// connection pool of repo if repo is the repository of the same database.
+func NewRateLimitStore(url string, repo service.Repository, logger zerolog.Logger) *RateLimitStore {
+	if r, ok := repo.(*repository); ok && r.url == url {
+		return &RateLimitStore{pool: r.pool, l: logger}
+	}
+	return &RateLimitStore{pool: newPool(url), l: logger}
+}
+
+func (s *RateLimitStore) Take(ctx context.Context, key string, l ratelimit.Limit, now time.Time) (ratelimit.Result, error) {
+	now = now.UTC()
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		s.l.Error().Err(err).Send()
+		return ratelimit.Result{}, service.NewDbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	// a missing bucket is full
+	stmt := `insert into rate_limits (key, tokens, updated, full_at) values ($1, $2, $3, $3)
+	on conflict (key) do nothing`
+	if _, err := tx.Exec(ctx, stmt, key, float64(l.Burst), now); err != nil {
+		s.l.Error().Err(err).Send()
+		return ratelimit.Result{}, service.NewDbError(err)
+	}
+
+	b := ratelimit.Bucket{}
+	stmt = `select tokens, updated from rate_limits where key = $1 for update`
+	if err := tx.QueryRow(ctx, stmt, key).Scan(&b.Tokens, &b.Updated); err != nil {
+		s.l.Error().Err(err).Send()
+		return ratelimit.Result{}, service.NewDbError(err)
+	}
+
+	r := b.Take(l, now)
+	stmt = `update rate_limits set tokens = $2, updated = $3, full_at = $4 where key = $1`
+	if _, err := tx.Exec(ctx, stmt, key, b.Tokens, b.Updated, b.Full(l)); err != nil {
+		s.l.Error().Err(err).Send()
+		return ratelimit.Result{}, service.NewDbError(err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		s.l.Error().Err(err).Send()
+		return ratelimit.Result{}, service.NewDbError(err)
+	}
+
+	s.sweep(ctx, now)
+	return r, nil
+}
+
+// sweep deletes full buckets once a minute; they are the same as missing ones.
+func (s *RateLimitStore) sweep(ctx context.Context, now time.Time) {
+	s.mu.Lock()
+	if now.Sub(s.swept) < time.Minute {
+		s.mu.Unlock()
+		return
+	}
+	s.swept = now
+	s.mu.Unlock()
+
+	if _, err := s.pool.Exec(ctx, `delete from rate_limits where full_at <= $1`, now); err != nil {
+		s.l.Warn().Err(err).Msg("sweep rate limits failed")
+	}
+}
@@ -2,9 +2,12 @@ package db
 
 import (
 	"context"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 	"github.com/polarbit/bluelabs-wallet/service"
 	"github.com/rs/zerolog"
 )
@@ -14,25 +17,53 @@ const (
 	errTextRowNotFound                           = `no rows in result set`
 	errTextTransactionAlreadyExistsByRefno       = `duplicate key value violates unique constraint "ix_wid_refno"`
 	errTextTransactionAlreadyExistsByFingerprint = `duplicate key value violates unique constraint "wallet_transactions_fingerprint_key"`
+	errTextSerializationFailure                  = `could not serialize access`
+	errTextSubscriptionNotFound                  = `violates foreign key constraint "webhook_deliveries_subscription_id_fkey"`
+	errTextAPIKeyAlreadyExists                   = `duplicate key value violates unique constraint "api_keys_name_key"`
 )
 
+const insertTransactionSql = `insert into wallet_transactions 
+	(id, wid, refno, amount, description, labels, fingerprint, old_balance, new_balance, created, prev_hash, hash, client) 
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)`
+
+const deliveryColumns = `id, subscription_id, event_seq, event_type, wid, payload, event_created,
+	status, attempts, next_attempt, last_error, last_status_code, created, updated`
+
+const apiKeyColumns = `id, name, prefix, hash, scopes, created, revoked`
+
+const transactionColumns = `id, refno, amount, description, labels, fingerprint, created, old_balance, new_balance, prev_hash, hash, client`
+
 type repository struct {
-	url string
-	l   zerolog.Logger
+	url  string
+	pool *pgxpool.Pool
+	lis  *listener
+	l    zerolog.Logger
 }
 
+// NewRepository returns the repository of the database of url. Connections
+// are pooled; the pool connects on first use. Listeners share a connection
+// of their own.
 func NewRepository(url string, logger zerolog.Logger) service.Repository {
-	parseUrl(url)
-	return &repository{url: url, l: logger}
+	return &repository{url: url, pool: newPool(url), lis: newListener(url, logger), l: logger}
+}
+
+// Stat returns the statistics of the connection pool.
+func (r *repository) Stat() *pgxpool.Stat {
+	return r.pool.Stat()
+}
+
+// log returns the logger of the request of ctx; see service.Logger.
+func (r *repository) log(ctx context.Context) *zerolog.Logger {
+	return service.Logger(ctx, &r.l)
 }
 
 func (r *repository) CreateWallet(ctx context.Context, w *service.Wallet) error {
-	conn, err := pgx.Connect(context.Background(), r.url)
+	conn, err := r.pool.Acquire(ctx)
 	if err != nil {
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
 		return service.NewDbError(err)
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
 
 	stmt := `
 	insert into wallets 
@@ -42,7 +73,7 @@ func (r *repository) CreateWallet(ctx context.Context, w *service.Wallet) error
 
 	tx, err := conn.Begin(ctx)
 	if err != nil {
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
 		return service.NewDbError(err)
 	}
 
@@ -53,7 +84,7 @@ func (r *repository) CreateWallet(ctx context.Context, w *service.Wallet) error
 		if strings.Contains(err.Error(), errTextWalletAlreadyExists) {
 			return service.ErrWalletAlreadyExists
 		}
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
 		return service.NewDbError(err)
 	}
 
@@ -62,28 +93,37 @@ func (r *repository) CreateWallet(ctx context.Context, w *service.Wallet) error
 		`insert into wallet_balances (wid, amount) values ($1, $2)`, w.ID, 0.)
 	if err != nil {
 		tx.Rollback(ctx)
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
 		return service.NewDbError(err)
 	}
 
-	tx.Commit(ctx)
+	// insert events
+	if err := r.insertEvents(ctx, tx, service.WalletEvents(w)); err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
 
 	return nil
 }
 
 func (r *repository) GetWallet(ctx context.Context, wid int) (*service.Wallet, error) {
-	conn, err := pgx.Connect(context.Background(), r.url)
+	conn, err := r.pool.Acquire(ctx)
 	if err != nil {
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
 		return nil, service.NewDbError(err)
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
 
 	stmt := `select id, externalid, labels, created from wallets where id = $1`
 	rows, err := conn.Query(ctx, stmt, wid)
 
 	if err != nil {
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
 		return nil, service.NewDbError(err)
 	}
 	defer rows.Close()
@@ -95,7 +135,7 @@ func (r *repository) GetWallet(ctx context.Context, wid int) (*service.Wallet, e
 
 	err = rows.Scan(&w.ID, &w.ExternalID, &w.Labels, &w.Created)
 	if err != nil {
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
 		return nil, service.NewDbError(err)
 	}
 
@@ -103,12 +143,12 @@ func (r *repository) GetWallet(ctx context.Context, wid int) (*service.Wallet, e
 }
 
 func (r *repository) GetWalletBalance(ctx context.Context, wid int) (b float64, err error) {
-	conn, err := pgx.Connect(context.Background(), r.url)
+	conn, err := r.pool.Acquire(ctx)
 	if err != nil {
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
 		return 0., service.NewDbError(err)
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
 
 	stmt := `select amount from wallet_balances where wid = $1`
 	err = conn.QueryRow(ctx, stmt, wid).Scan(&b)
@@ -116,7 +156,7 @@ func (r *repository) GetWalletBalance(ctx context.Context, wid int) (b float64,
 		if strings.Contains(err.Error(), errTextRowNotFound) {
 			return 0., service.ErrWalletNotFound
 		}
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
 		return 0., service.NewDbError(err)
 	}
 
@@ -124,88 +164,1045 @@ func (r *repository) GetWalletBalance(ctx context.Context, wid int) (b float64,
 }
 
 func (r *repository) CreateTransaction(ctx context.Context, wid int, t *service.Transaction) error {
-	conn, err := pgx.Connect(context.Background(), r.url)
+	conn, err := r.pool.Acquire(ctx)
 	if err != nil {
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
 		return service.NewDbError(err)
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
 
 	tx, err := conn.BeginTx(ctx, pgx.TxOptions{IsoLevel: pgx.RepeatableRead})
 	if err != nil {
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
 		return service.NewDbError(err)
 	}
 
 	// insert transaction
-	stmt := `insert into wallet_transactions 
-	(id, wid, refno, amount, description, labels, fingerprint, old_balance, new_balance, created) 
-	values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)`
-	_, err = tx.Exec(ctx, stmt, t.ID, wid, t.RefNo, t.Amount, t.Description, t.Labels,
-		t.Fingerprint, t.OldBalance, t.NewBalance, t.Created)
+	_, err = tx.Exec(ctx, insertTransactionSql, t.ID, wid, t.RefNo, t.Amount, t.Description, t.Labels,
+		t.Fingerprint, t.OldBalance, t.NewBalance, t.Created, t.PrevHash, t.Hash, t.Client)
 	if err != nil {
 		tx.Rollback(ctx)
-		r.l.Error().Err(err).Msg("insert transaction failed")
+		r.log(ctx).Error().Err(err).Msg("insert transaction failed")
 		if strings.Contains(err.Error(), errTextTransactionAlreadyExistsByRefno) {
 			return service.ErrTransactionAlreadyExistsByRefNo
 		}
 		if strings.Contains(err.Error(), errTextTransactionAlreadyExistsByFingerprint) {
 			return service.ErrTransactionAlreadyExistsByFingerprint
 		}
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
 		return service.NewDbError(err)
 	}
 
+	// insert journal
+	if err := r.insertJournal(ctx, tx, t); err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+
 	// update balance
-	stmt = `update wallet_balances set amount = $2 where wid=$1 and amount = $3`
+	stmt := `update wallet_balances set amount = $2 where wid=$1 and amount = $3`
 	ctag, err := tx.Exec(ctx, stmt, wid, t.NewBalance, t.OldBalance)
 	if err != nil {
 		tx.Rollback(ctx)
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
+		if strings.Contains(err.Error(), errTextSerializationFailure) {
+			return service.ErrTransactionConsistency
+		}
 		return service.NewDbError(err)
 	}
 	if ctag.RowsAffected() != 1 {
 		tx.Rollback(ctx)
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
 		return service.ErrTransactionConsistency
 	}
 
-	tx.Commit(ctx)
+	// insert events; after the balance update so that seq follows the order of
+	// transactions of the wallet
+	if err := r.insertEvents(ctx, tx, service.TransactionEvents(wid, t)); err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+
+	// notify listeners; delivered on commit
+	if err := r.notify(ctx, tx, wid, t.RefNo); err != nil {
+		tx.Rollback(ctx)
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		if strings.Contains(err.Error(), errTextSerializationFailure) {
+			return service.ErrTransactionConsistency
+		}
+		return service.NewDbError(err)
+	}
 
 	return nil
 }
 
 func (r *repository) GetLatestTransaction(ctx context.Context, wid int) (*service.Transaction, error) {
-	conn, err := pgx.Connect(context.Background(), r.url)
+	conn, err := r.pool.Acquire(ctx)
 	if err != nil {
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
 		return nil, service.NewDbError(err)
 	}
-	defer conn.Close(context.Background())
+	defer conn.Release()
 
-	stmt := `select id, refno, amount, description, labels, fingerprint, created, old_balance, new_balance
+	stmt := `select ` + transactionColumns + `
 	from wallet_transactions where wid = $1 
 	order by wid, refno desc
 	limit 1`
 	rows, err := conn.Query(ctx, stmt, wid)
 
 	if err != nil {
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
 		return nil, service.NewDbError(err)
 	}
 	defer rows.Close()
 
-	t := service.Transaction{}
 	if ok := rows.Next(); !ok {
 		return nil, service.ErrTransactionNotFound
 	}
 
-	err = rows.Scan(&t.ID, &t.RefNo, &t.Amount, &t.Description, &t.Labels,
-		&t.Fingerprint, &t.Created, &t.OldBalance, &t.NewBalance)
+	t, err := scanTransaction(rows)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return t, nil
+}
+
+func (r *repository) PostTransaction(ctx context.Context, wid int, t *service.Transaction) error {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	// read committed; the row lock below serializes writers of the wallet
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	// lock balance
+	var balance float64
+	err = tx.QueryRow(ctx, `select amount from wallet_balances where wid = $1 for update`, wid).Scan(&balance)
+	if err != nil {
+		if strings.Contains(err.Error(), errTextRowNotFound) {
+			return service.ErrWalletNotFound
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	// latest transaction
+	var lt *service.Transaction
+	stmt := `select refno, hash, created from wallet_transactions where wid = $1 order by wid, refno desc limit 1`
+	var refno int
+	var hash string
+	var created time.Time
+	err = tx.QueryRow(ctx, stmt, wid).Scan(&refno, &hash, &created)
+	if err != nil && !strings.Contains(err.Error(), errTextRowNotFound) {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	if err == nil {
+		lt = &service.Transaction{RefNo: refno, Hash: hash, Created: created.UTC()}
+	}
+
+	t.RefNo = refno + 1
+	t.OldBalance = balance
+	t.NewBalance = balance + t.Amount
+	if t.NewBalance < 0. {
+		return service.ErrNotEnoughWalletBalance
+	}
+	service.StampCreated(t, lt)
+	service.ChainTransaction(wid, t, lt)
+
+	// insert transaction
+	_, err = tx.Exec(ctx, insertTransactionSql, t.ID, wid, t.RefNo, t.Amount, t.Description, t.Labels,
+		t.Fingerprint, t.OldBalance, t.NewBalance, t.Created, t.PrevHash, t.Hash, t.Client)
+	if err != nil {
+		if strings.Contains(err.Error(), errTextTransactionAlreadyExistsByFingerprint) {
+			return service.ErrTransactionAlreadyExistsByFingerprint
+		}
+		r.log(ctx).Error().Err(err).Msg("insert transaction failed")
+		return service.NewDbError(err)
+	}
+
+	// insert journal
+	if err := r.insertJournal(ctx, tx, t); err != nil {
+		return err
+	}
+
+	// update balance
+	_, err = tx.Exec(ctx, `update wallet_balances set amount = $2 where wid = $1`, wid, t.NewBalance)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	// insert events
+	if err := r.insertEvents(ctx, tx, service.TransactionEvents(wid, t)); err != nil {
+		return err
+	}
+
+	// notify listeners; delivered on commit
+	if err := r.notify(ctx, tx, wid, t.RefNo); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetTransactionAt(ctx context.Context, wid int, at time.Time) (*service.Transaction, error) {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	// uses ix_wid_created
+	stmt := `select ` + transactionColumns + `
+	from wallet_transactions where wid = $1 and created <= $2
+	order by wid, created desc, refno desc
+	limit 1`
+	t, err := scanTransaction(conn.QueryRow(ctx, stmt, wid, at.UTC()))
+	if err != nil {
+		if strings.Contains(err.Error(), errTextRowNotFound) {
+			return nil, service.ErrTransactionNotFound
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return t, nil
+}
+
+func (r *repository) ListWallets(ctx context.Context, afterID int, limit int) ([]*service.Wallet, error) {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	stmt := `select id, externalid, labels, created from wallets where id > $1 order by id limit $2`
+	rows, err := conn.Query(ctx, stmt, afterID, limit)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	ws := []*service.Wallet{}
+	for rows.Next() {
+		w := service.Wallet{}
+		if err := rows.Scan(&w.ID, &w.ExternalID, &w.Labels, &w.Created); err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		ws = append(ws, &w)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return ws, nil
+}
+
+func (r *repository) ListTransactions(ctx context.Context, wid int, afterRefNo int, limit int) ([]*service.Transaction, error) {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	stmt := `select ` + transactionColumns + `
+	from wallet_transactions where wid = $1 and refno > $2
+	order by wid, refno
+	limit $3`
+	rows, err := conn.Query(ctx, stmt, wid, afterRefNo, limit)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	trs := []*service.Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		trs = append(trs, t)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return trs, nil
+}
+
+func (r *repository) TrialBalance(ctx context.Context) ([]*service.AccountBalance, error) {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	stmt := `select a.code, a.name, a.type,
+		coalesce(sum(j.amount) filter (where j.amount > 0), 0),
+		coalesce(-sum(j.amount) filter (where j.amount < 0), 0)
+	from accounts a left join journal_entries j on j.account = a.code
+	group by a.code, a.name, a.type
+	order by a.code`
+	rows, err := conn.Query(ctx, stmt)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	bs := []*service.AccountBalance{}
+	for rows.Next() {
+		b := service.AccountBalance{}
+		if err := rows.Scan(&b.Code, &b.Name, &b.Type, &b.Debit, &b.Credit); err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		bs = append(bs, &b)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return bs, nil
+}
+
+func (r *repository) RepairBalance(ctx context.Context, wid int, refno int, from, to float64) error {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	// lock balance
+	var balance float64
+	err = tx.QueryRow(ctx, `select amount from wallet_balances where wid = $1 for update`, wid).Scan(&balance)
+	if err != nil {
+		if strings.Contains(err.Error(), errTextRowNotFound) {
+			return service.ErrWalletNotFound
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	var latest int
+	err = tx.QueryRow(ctx, `select coalesce(max(refno), 0) from wallet_transactions where wid = $1`, wid).Scan(&latest)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	if balance != from || latest != refno {
+		return service.ErrTransactionConsistency
+	}
+
+	_, err = tx.Exec(ctx, `update wallet_balances set amount = $2 where wid = $1`, wid, to)
 	if err != nil {
-		r.l.Error().Err(err).Send()
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	_, err = tx.Exec(ctx, `insert into balance_repairs (wid, refno, old_amount, new_amount, created) values ($1, $2, $3, $4, $5)`,
+		wid, refno, from, to, time.Now().UTC())
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	if err := r.insertEvents(ctx, tx, service.RepairEvents(wid, refno, from, to)); err != nil {
+		return err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	r.log(ctx).Warn().Int("wid", wid).Int("refno", refno).Float64("from", from).Float64("to", to).Msg("balance is repaired")
+	return nil
+}
+
+func (r *repository) ListTransactionsBetween(ctx context.Context, wid int, from, to time.Time, afterRefNo int, limit int) ([]*service.Transaction, error) {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
 		return nil, service.NewDbError(err)
 	}
+	defer conn.Release()
+
+	stmt := `select ` + transactionColumns + `
+	from wallet_transactions where wid = $1 and created >= $2 and created <= $3 and refno > $4
+	order by wid, refno
+	limit $5`
+	rows, err := conn.Query(ctx, stmt, wid, from.UTC(), to.UTC(), afterRefNo, limit)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	trs := []*service.Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		trs = append(trs, t)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return trs, nil
+}
+
+func (r *repository) SaveSnapshot(ctx context.Context, s *service.Snapshot) error {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	stmt := `insert into balance_snapshots (wid, day, balance, refno, created) values ($1, $2, $3, $4, $5)
+	on conflict (wid, day) do update set balance = excluded.balance, refno = excluded.refno, created = excluded.created`
+	_, err = conn.Exec(ctx, stmt, s.WalletID, service.Day(s.Day), s.Balance, s.RefNo, s.Created)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetSnapshot(ctx context.Context, wid int, day time.Time) (*service.Snapshot, error) {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	s := service.Snapshot{}
+	stmt := `select wid, day, balance, refno, created from balance_snapshots where wid = $1 and day = $2`
+	err = conn.QueryRow(ctx, stmt, wid, service.Day(day)).Scan(&s.WalletID, &s.Day, &s.Balance, &s.RefNo, &s.Created)
+	if err != nil {
+		if strings.Contains(err.Error(), errTextRowNotFound) {
+			return nil, service.ErrSnapshotNotFound
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return &s, nil
+}
+
+func (r *repository) ListPendingEvents(ctx context.Context, consumer string, limit int) ([]*service.Event, error) {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	if err := r.registerConsumer(ctx, conn, consumer); err != nil {
+		return nil, err
+	}
+
+	stmt := `select seq, type, wid, payload, created from outbox o
+	where not exists (select 1 from outbox_published p where p.consumer = $1 and p.seq = o.seq)
+	order by seq limit $2`
+	rows, err := conn.Query(ctx, stmt, consumer, limit)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	es := []*service.Event{}
+	for rows.Next() {
+		e := &service.Event{}
+		if err := rows.Scan(&e.Seq, &e.Type, &e.WalletID, &e.Payload, &e.Created); err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		es = append(es, e)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return es, nil
+}
+
+func (r *repository) MarkEventsPublished(ctx context.Context, consumer string, seqs []int64) error {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	if err := r.registerConsumer(ctx, conn, consumer); err != nil {
+		return err
+	}
+
+	// events pruned meanwhile are skipped
+	stmt := `insert into outbox_published (consumer, seq, published)
+	select $1, seq, $3 from outbox where seq = any($2)
+	on conflict do nothing`
+	if _, err := conn.Exec(ctx, stmt, consumer, seqs, time.Now().UTC()); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	return nil
+}
+
+func (r *repository) PruneEvents(ctx context.Context, before time.Time) (int, error) {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return 0, service.NewDbError(err)
+	}
+	defer conn.Release()
 
+	// uses ix_outbox_created; published rows are deleted by the cascade
+	stmt := `delete from outbox o where o.created < $1
+	and exists (select 1 from outbox_consumers)
+	and not exists (select 1 from outbox_consumers c where not exists
+		(select 1 from outbox_published p where p.consumer = c.name and p.seq = o.seq))`
+	tag, err := conn.Exec(ctx, stmt, before)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return 0, service.NewDbError(err)
+	}
+
+	return int(tag.RowsAffected()), nil
+}
+
+func (r *repository) CreateSubscription(ctx context.Context, sub *service.Subscription) error {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	stmt := `insert into webhook_subscriptions (url, event_types, labels, secret, created) values ($1, $2, $3, $4, $5) returning id`
+	err = conn.QueryRow(ctx, stmt, sub.URL, sub.EventTypes, sub.Labels, sub.Secret, sub.Created).Scan(&sub.ID)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetSubscription(ctx context.Context, id int) (*service.Subscription, error) {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	sub := &service.Subscription{}
+	stmt := `select id, url, event_types, labels, secret, created from webhook_subscriptions where id = $1`
+	err = conn.QueryRow(ctx, stmt, id).Scan(&sub.ID, &sub.URL, &sub.EventTypes, &sub.Labels, &sub.Secret, &sub.Created)
+	if err != nil {
+		if strings.Contains(err.Error(), errTextRowNotFound) {
+			return nil, service.ErrSubscriptionNotFound
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return sub, nil
+}
+
+func (r *repository) ListSubscriptions(ctx context.Context) ([]*service.Subscription, error) {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `select id, url, event_types, labels, secret, created from webhook_subscriptions order by id`)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	subs := []*service.Subscription{}
+	for rows.Next() {
+		sub := &service.Subscription{}
+		if err := rows.Scan(&sub.ID, &sub.URL, &sub.EventTypes, &sub.Labels, &sub.Secret, &sub.Created); err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		subs = append(subs, sub)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return subs, nil
+}
+
+func (r *repository) DeleteSubscription(ctx context.Context, id int) error {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	// deliveries are deleted on cascade
+	ctag, err := conn.Exec(ctx, `delete from webhook_subscriptions where id = $1`, id)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	if ctag.RowsAffected() != 1 {
+		return service.ErrSubscriptionNotFound
+	}
+
+	return nil
+}
+
+func (r *repository) CreateDeliveries(ctx context.Context, ds []*service.Delivery) error {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer tx.Rollback(ctx)
+
+	stmt := `insert into webhook_deliveries
+	(subscription_id, event_seq, event_type, wid, payload, event_created,
+	status, attempts, next_attempt, last_error, last_status_code, created, updated)
+	values ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+	on conflict (subscription_id, event_seq) do nothing`
+	for _, d := range ds {
+		_, err := tx.Exec(ctx, stmt, d.SubscriptionID, d.Event.Seq, d.Event.Type, d.Event.WalletID, string(d.Event.Payload),
+			d.Event.Created, d.Status, d.Attempts, d.NextAttempt, d.LastError, d.LastStatusCode, d.Created, d.Updated)
+		if err != nil {
+			if strings.Contains(err.Error(), errTextSubscriptionNotFound) {
+				return service.ErrSubscriptionNotFound
+			}
+			r.log(ctx).Error().Err(err).Msg("insert delivery failed")
+			return service.NewDbError(err)
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	return nil
+}
+
+func (r *repository) ClaimDueDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*service.Delivery, error) {
+	// uses ix_deliveries_due; rows claimed by a concurrent dispatcher are
+	// locked until it commits and skipped
+	stmt := `with due as (
+		select id as due_id, next_attempt as due_at from webhook_deliveries
+		where status = $1 and next_attempt <= $2
+		order by next_attempt, id
+		limit $4
+		for update skip locked
+	), claimed as (
+		update webhook_deliveries set next_attempt = $3 from due where id = due_id
+		returning ` + deliveryColumns + `, due_at
+	)
+	select ` + deliveryColumns + ` from claimed order by due_at, id`
+	return r.queryDeliveries(ctx, stmt, service.DeliveryPending, now.UTC(), now.Add(lease).UTC(), limit)
+}
+
+func (r *repository) GetDelivery(ctx context.Context, id int64) (*service.Delivery, error) {
+	ds, err := r.queryDeliveries(ctx, `select `+deliveryColumns+` from webhook_deliveries where id = $1`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(ds) == 0 {
+		return nil, service.ErrDeliveryNotFound
+	}
+	return ds[0], nil
+}
+
+func (r *repository) ListDeliveries(ctx context.Context, sid int, afterID int64, limit int) ([]*service.Delivery, error) {
+	stmt := `select ` + deliveryColumns + ` from webhook_deliveries
+	where subscription_id = $1 and id > $2
+	order by id
+	limit $3`
+	return r.queryDeliveries(ctx, stmt, sid, afterID, limit)
+}
+
+func (r *repository) UpdateDelivery(ctx context.Context, d *service.Delivery) error {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	stmt := `update webhook_deliveries
+	set status = $2, attempts = $3, next_attempt = $4, last_error = $5, last_status_code = $6, updated = $7
+	where id = $1`
+	ctag, err := conn.Exec(ctx, stmt, d.ID, d.Status, d.Attempts, d.NextAttempt, d.LastError, d.LastStatusCode, d.Updated)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	if ctag.RowsAffected() != 1 {
+		return service.ErrDeliveryNotFound
+	}
+
+	return nil
+}
+
+func (r *repository) Listen(ctx context.Context, wid int) (<-chan int, error) {
+	ch, err := r.lis.Listen(ctx, wid)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, err
+	}
+	return ch, nil
+}
+
+func (r *repository) GetCheckpoint(ctx context.Context, projection string) (int, error) {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return 0, service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	var wid int
+	err = conn.QueryRow(ctx, `select wid from projection_checkpoints where name = $1`, projection).Scan(&wid)
+	if err != nil {
+		if strings.Contains(err.Error(), errTextRowNotFound) {
+			return 0, nil
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return 0, service.NewDbError(err)
+	}
+
+	return wid, nil
+}
+
+func (r *repository) SaveCheckpoint(ctx context.Context, projection string, wid int) error {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	stmt := `insert into projection_checkpoints (name, wid, updated) values ($1, $2, $3)
+	on conflict (name) do update set wid = excluded.wid, updated = excluded.updated`
+	if _, err := conn.Exec(ctx, stmt, projection, wid, time.Now().UTC()); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	return nil
+}
+
+func (r *repository) CreateAPIKey(ctx context.Context, k *service.APIKey) error {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	stmt := `insert into api_keys (name, prefix, hash, scopes, created) values ($1, $2, $3, $4, $5) returning id`
+	err = conn.QueryRow(ctx, stmt, k.Name, k.Prefix, k.Hash, k.Scopes, k.Created).Scan(&k.ID)
+	if err != nil {
+		if strings.Contains(err.Error(), errTextAPIKeyAlreadyExists) {
+			return service.ErrAPIKeyAlreadyExists
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetAPIKeyByHash(ctx context.Context, hash string) (*service.APIKey, error) {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	stmt := `select ` + apiKeyColumns + ` from api_keys where hash = $1`
+	k, err := scanAPIKey(conn.QueryRow(ctx, stmt, hash))
+	if err != nil {
+		if strings.Contains(err.Error(), errTextRowNotFound) {
+			return nil, service.ErrAPIKeyNotFound
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return k, nil
+}
+
+func (r *repository) ListAPIKeys(ctx context.Context) ([]*service.APIKey, error) {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, `select `+apiKeyColumns+` from api_keys order by id`)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	keys := []*service.APIKey{}
+	for rows.Next() {
+		k, err := scanAPIKey(rows)
+		if err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return keys, nil
+}
+
+func (r *repository) RevokeAPIKey(ctx context.Context, id int, at time.Time) error {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	// the first revocation time is kept
+	ctag, err := conn.Exec(ctx, `update api_keys set revoked = coalesce(revoked, $2) where id = $1`, id, at.UTC())
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	if ctag.RowsAffected() != 1 {
+		return service.ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+func (r *repository) CreatePolicyDenial(ctx context.Context, d *service.PolicyDenial) error {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	stmt := `insert into policy_denials (client, operation, wid, amount, labels, rule, created)
+	values ($1, $2, $3, $4, $5, $6, $7) returning id`
+	err = conn.QueryRow(ctx, stmt, d.Client, d.Operation, d.WalletID, d.Amount, d.Labels, d.Rule, d.Created).Scan(&d.ID)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	return nil
+}
+
+func (r *repository) ListPolicyDenials(ctx context.Context, afterID int64, limit int) ([]*service.PolicyDenial, error) {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	stmt := `select id, client, operation, wid, amount, labels, rule, created from policy_denials
+	where id > $1 order by id limit $2`
+	rows, err := conn.Query(ctx, stmt, afterID, limit)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	ds := []*service.PolicyDenial{}
+	for rows.Next() {
+		d := &service.PolicyDenial{}
+		if err := rows.Scan(&d.ID, &d.Client, &d.Operation, &d.WalletID, &d.Amount, &d.Labels, &d.Rule, &d.Created); err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		ds = append(ds, d)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return ds, nil
+}
+
+// registerConsumer records the consumer of the outbox, so events are pruned
+// once it published them.
+func (r *repository) registerConsumer(ctx context.Context, conn *pgxpool.Conn, consumer string) error {
+	_, err := conn.Exec(ctx, `insert into outbox_consumers (name) values ($1) on conflict do nothing`, consumer)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Msg("register consumer failed")
+		return service.NewDbError(err)
+	}
+	return nil
+}
+
+func (r *repository) notify(ctx context.Context, tx pgx.Tx, wid int, refno int) error {
+	payload := strconv.Itoa(wid) + ":" + strconv.Itoa(refno)
+	if _, err := tx.Exec(ctx, `select pg_notify($1, $2)`, notifyChannel, payload); err != nil {
+		r.log(ctx).Error().Err(err).Msg("notify failed")
+		return service.NewDbError(err)
+	}
+	return nil
+}
+
+func (r *repository) queryDeliveries(ctx context.Context, stmt string, args ...interface{}) ([]*service.Delivery, error) {
+	conn, err := r.pool.Acquire(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer conn.Release()
+
+	rows, err := conn.Query(ctx, stmt, args...)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	ds := []*service.Delivery{}
+	for rows.Next() {
+		d := &service.Delivery{}
+		err := rows.Scan(&d.ID, &d.SubscriptionID, &d.Event.Seq, &d.Event.Type, &d.Event.WalletID, &d.Event.Payload,
+			&d.Event.Created, &d.Status, &d.Attempts, &d.NextAttempt, &d.LastError, &d.LastStatusCode, &d.Created, &d.Updated)
+		if err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		ds = append(ds, d)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return ds, nil
+}
+
+func (r *repository) insertEvents(ctx context.Context, tx pgx.Tx, es []*service.Event) error {
+	stmt := `insert into outbox (type, wid, payload, created) values ($1, $2, $3, $4) returning seq`
+	for _, e := range es {
+		if err := tx.QueryRow(ctx, stmt, e.Type, e.WalletID, string(e.Payload), e.Created).Scan(&e.Seq); err != nil {
+			r.log(ctx).Error().Err(err).Msg("insert event failed")
+			return service.NewDbError(err)
+		}
+	}
+	return nil
+}
+
+func (r *repository) insertJournal(ctx context.Context, tx pgx.Tx, t *service.Transaction) error {
+	stmt := `insert into journal_entries (transaction_id, wid, account, amount, created) values ($1, $2, $3, $4, $5)`
+	for _, l := range t.Journal {
+		if _, err := tx.Exec(ctx, stmt, l.TransactionID, l.WalletID, l.Account, l.Amount, t.Created); err != nil {
+			r.log(ctx).Error().Err(err).Msg("insert journal failed")
+			return service.NewDbError(err)
+		}
+	}
+	return nil
+}
+
+// scanTransaction scans a row selected with transactionColumns
+func scanTransaction(row pgx.Row) (*service.Transaction, error) {
+	t := service.Transaction{}
+	err := row.Scan(&t.ID, &t.RefNo, &t.Amount, &t.Description, &t.Labels,
+		&t.Fingerprint, &t.Created, &t.OldBalance, &t.NewBalance, &t.PrevHash, &t.Hash, &t.Client)
+	if err != nil {
+		return nil, err
+	}
 	return &t, nil
 }
+
+// scanAPIKey scans a row selected with apiKeyColumns
+func scanAPIKey(row pgx.Row) (*service.APIKey, error) {
+	k := service.APIKey{}
+	err := row.Scan(&k.ID, &k.Name, &k.Prefix, &k.Hash, &k.Scopes, &k.Created, &k.Revoked)
+	if err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
@@ -5,12 +5,20 @@ package db
 
 import (
 	"context"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/jackc/pgx/v4"
 	"github.com/polarbit/bluelabs-wallet/config"
+	"github.com/polarbit/bluelabs-wallet/ratelimit"
 	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/service/repotest"
+	"github.com/polarbit/bluelabs-wallet/signing"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/stretchr/testify/assert"
 )
@@ -69,6 +77,121 @@ func TestRepositoryIntegration(t *testing.T) {
 	})
 }
 
+func TestRepositoryContract(t *testing.T) {
+	config.Init()
+	// the tests share the database, so they share its connection pool too
+	repo := NewRepository(config.Config.Db, log.Logger)
+	repotest.Run(t, func() service.Repository { return repo })
+}
+
+func TestMigrateIntegration(t *testing.T) {
+	config.Init()
+	ctx := context.Background()
+	conn, err := pgx.Connect(ctx, config.Config.Db)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Close(ctx)
+
+	// a database of the initial schema, in a schema of its own
+	schema := "migrate_" + strings.ReplaceAll(uuid.NewString()[:8], "-", "")
+	_, err = conn.Exec(ctx, `create schema `+schema+`; set search_path to `+schema)
+	if !assert.NoError(t, err) {
+		return
+	}
+	defer conn.Exec(ctx, `drop schema `+schema+` cascade`)
+	assert.NoError(t, applyMigration(ctx, conn, 1, migrations[0]))
+	created := time.Now().UTC().Truncate(time.Millisecond)
+	for i, id := range []string{uuid.NewString(), uuid.NewString()} {
+		_, err = conn.Exec(ctx, `insert into wallet_transactions
+		(id, wid, refno, amount, description, labels, fingerprint, created, old_balance, new_balance)
+		values ($1, 1, $2, 10, 'd', '{}', $1, $3, $4, $5)`, id, i+1, created, float64(i*10), float64(i*10+10))
+		assert.NoError(t, err)
+	}
+
+	// existing transactions are chained, and migrating again changes nothing
+	assert.NoError(t, migrate(ctx, conn))
+	assert.NoError(t, migrate(ctx, conn))
+
+	rows, err := conn.Query(ctx, `select `+transactionColumns+` from wallet_transactions order by refno`)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var prev *service.Transaction
+	for rows.Next() {
+		tr, err := scanTransaction(rows)
+		assert.NoError(t, err)
+		assert.Equal(t, service.ComputeHash(1, tr), tr.Hash)
+		if prev != nil {
+			assert.Equal(t, prev.Hash, tr.PrevHash)
+		}
+		prev = tr
+	}
+	rows.Close()
+	assert.NotNil(t, prev)
+}
+
+func TestRateLimitStoreIntegration(t *testing.T) {
+	config.Init()
+	s := NewRateLimitStore(config.Config.Db, NewRepository(config.Config.Db, log.Logger), log.Logger)
+	ctx := context.Background()
+	key := "test:" + uuid.NewString()
+	l := ratelimit.Limit{Rate: 1, Burst: 2}
+	now := time.Now().UTC().Truncate(time.Microsecond)
+
+	// instances take tokens of the same bucket one by one
+	var wg sync.WaitGroup
+	var allowed int32
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r, err := s.Take(ctx, key, l, now)
+			assert.NoError(t, err)
+			if r.Allowed {
+				atomic.AddInt32(&allowed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int32(2), allowed)
+
+	r, err := s.Take(ctx, key, l, now)
+	assert.NoError(t, err)
+	assert.False(t, r.Allowed)
+	assert.Equal(t, time.Second, r.RetryAfter)
+
+	r, err = s.Take(ctx, key, l, now.Add(time.Second))
+	assert.NoError(t, err)
+	assert.True(t, r.Allowed)
+	assert.Equal(t, 0, r.Remaining)
+}
+
+func TestNonceStoreIntegration(t *testing.T) {
+	config.Init()
+	repo := NewRepository(config.Config.Db, log.Logger)
+	ctx := context.Background()
+	client, nonce := "test:"+uuid.NewString(), uuid.NewString()
+
+	// instances use the same nonce once
+	a, b := NewNonceStore(config.Config.Db, repo, log.Logger), NewNonceStore(config.Config.Db, nil, log.Logger)
+	assert.NoError(t, a.Use(ctx, client, nonce, time.Now().Add(time.Minute)))
+	assert.ErrorIs(t, b.Use(ctx, client, nonce, time.Now().Add(time.Minute)), signing.ErrReplayedNonce)
+	assert.NoError(t, b.Use(ctx, client, uuid.NewString(), time.Now().Add(time.Minute)))
+
+	// expired nonces are the same as missing ones
+	nonce = uuid.NewString()
+	assert.NoError(t, a.Use(ctx, client, nonce, time.Now().Add(-time.Second)))
+	assert.NoError(t, b.Use(ctx, client, nonce, time.Now().Add(time.Minute)))
+}
+
+// go test ./db -tags integration -run - -bench .
+func BenchmarkCreateTransaction(b *testing.B) {
+	config.Init()
+	repo := NewRepository(config.Config.Db, zerolog.Nop())
+	repotest.Benchmark(b, func() service.Repository { return repo })
+}
+
 func testCreateWalletOk(tc *testContext, t *testing.T) {
 	tc.w = &service.Wallet{
 		ExternalID: uuid.NewString(),
@@ -1,10 +1,12 @@
 package db
 
 import (
+	"context"
 	"fmt"
 	"os"
 
 	"github.com/jackc/pgx/v4"
+	"github.com/jackc/pgx/v4/pgxpool"
 )
 
 func parseUrl(url string) *pgx.ConnConfig {
@@ -17,3 +19,26 @@ func parseUrl(url string) *pgx.ConnConfig {
 
 	return config
 }
+
+// newPool returns a pool of connections to url, which connects lazily so
+// that the repository can be created while the database is down. The
+// repository used to connect once per call; pooling saves the connection
+// setup of every request and bounds the connections of an instance, which
+// the pool_max_conns parameter of url sets (default max(4, cpus)). The pool
+// statistics are what metrics exports as wallet_db_pool_*.
+func newPool(url string) *pgxpool.Pool {
+	config, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid database url: %v\n", err)
+		os.Exit(1)
+	}
+	config.LazyConnect = true
+
+	pool, err := pgxpool.ConnectConfig(context.Background(), config)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to create connection pool: %v\n", err)
+		os.Exit(1)
+	}
+
+	return pool
+}
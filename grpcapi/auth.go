@@ -0,0 +1,138 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/polarbit/bluelabs-wallet/jwtauth"
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+// apiKeyMetadata carries the api key of calls
+const apiKeyMetadata = "x-api-key"
+
+// authorizationMetadata carries the bearer token of calls, "Bearer <jwt>"
+const authorizationMetadata = "authorization"
+
+// methodScopes is the scope required by each method, keyed by full method
+// name. Methods not listed require ScopeAdmin.
+var methodScopes = map[string]string{
+	"/wallet.v1.WalletService/GetWallet":            service.ScopeWalletsRead,
+	"/wallet.v1.WalletService/GetWalletBalance":     service.ScopeWalletsRead,
+	"/wallet.v1.WalletService/GetLatestTransaction": service.ScopeWalletsRead,
+	"/wallet.v1.WalletService/ListTransactions":     service.ScopeWalletsRead,
+	"/wallet.v1.WalletService/CreateTransaction":    service.ScopeTransactionsWrite,
+}
+
+// Auth returns server options which authenticate calls by their api key, when
+// r is not nil, or their bearer token, when v is not nil, and authorize them
+// by the scope of their method, like the REST api: the first credentials found
+// authenticate the call. Interceptors chain in the order of their options, so
+// LimitIP goes before.
+func Auth(r service.Repository, v *jwtauth.Verifier, l zerolog.Logger) []grpc.ServerOption {
+	a := &authenticator{r: r, v: v, l: l}
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			ctx, err := a.authenticate(ctx, info.FullMethod)
+			if err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			ctx, err := a.authenticate(ss.Context(), info.FullMethod)
+			if err != nil {
+				return err
+			}
+			return handler(srv, &principalStream{ServerStream: ss, ctx: ctx})
+		}),
+	}
+}
+
+type authenticator struct {
+	r service.Repository
+	v *jwtauth.Verifier
+	l zerolog.Logger
+}
+
+// authenticate returns ctx with the principal of the credentials of the call.
+func (a *authenticator) authenticate(ctx context.Context, method string) (context.Context, error) {
+	scope, ok := methodScopes[method]
+	if !ok {
+		scope = service.ScopeAdmin
+	}
+
+	md, _ := metadata.FromIncomingContext(ctx)
+	var p *service.Principal
+	var err error
+	if a.r != nil {
+		p, err = a.apiKey(ctx, md)
+	}
+	if p == nil && err == nil && a.v != nil {
+		p, err = a.bearer(md)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		return nil, status.Error(codes.Unauthenticated, "api key or bearer token is required")
+	}
+	if !p.HasScope(scope) {
+		a.l.Debug().Str("client", p.Client).Str("scope", scope).Msg("missing scope")
+		return nil, status.Error(codes.PermissionDenied, "missing scope "+scope)
+	}
+
+	return service.WithPrincipal(ctx, p), nil
+}
+
+// apiKey returns the principal of the x-api-key metadata, or nil if the call
+// has none.
+func (a *authenticator) apiKey(ctx context.Context, md metadata.MD) (*service.Principal, error) {
+	keys := md.Get(apiKeyMetadata)
+	if len(keys) == 0 || keys[0] == "" {
+		return nil, nil
+	}
+
+	p, err := service.AuthenticateAPIKey(ctx, a.r, keys[0])
+	if err != nil {
+		if errors.Is(err, service.ErrAPIKeyNotFound) {
+			return nil, status.Error(codes.Unauthenticated, "api key is invalid")
+		}
+		a.l.Error().Err(err).Msg("authenticate api key failed")
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	return p, nil
+}
+
+// bearer returns the principal of the token of the authorization metadata, or
+// nil if the call has none.
+func (a *authenticator) bearer(md metadata.MD) (*service.Principal, error) {
+	hs := md.Get(authorizationMetadata)
+	if len(hs) == 0 || len(hs[0]) < 7 || !strings.EqualFold(hs[0][:7], "bearer ") {
+		return nil, nil
+	}
+
+	p, err := a.v.Verify(strings.TrimSpace(hs[0][7:]))
+	if err != nil {
+		a.l.Debug().Err(err).Msg("verify bearer token failed")
+		return nil, status.Error(codes.Unauthenticated, "bearer token is invalid")
+	}
+	return p, nil
+}
+
+// principalStream overrides the context of a stream with the authenticated one
+type principalStream struct {
+	grpc.ServerStream
+	ctx context.Context
+}
+
+func (s *principalStream) Context() context.Context {
+	return s.ctx
+}
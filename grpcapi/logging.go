@@ -0,0 +1,111 @@
+package grpcapi
+
+import (
+	"context"
+	"time"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/polarbit/bluelabs-wallet/grpcapi/walletpb"
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+// requestIDMetadata carries the request id of calls, like X-Request-ID
+const requestIDMetadata = "x-request-id"
+
+// Logging returns server options which put a logger with the request id,
+// client and wallet of each call on its context and log calls when served,
+// like the request logger of the REST api. The request id is sent back in
+// the header. They read the principal, so they go after Auth.
+func Logging(l zerolog.Logger) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			start := time.Now()
+			ctx = withCallLogger(ctx, l)
+			if wid, ok := callWallet(req); ok {
+				ctx = service.WithLogger(ctx, service.Logger(ctx, &l).With().Int("wid", wid).Logger())
+			}
+			res, err := handler(ctx, req)
+			logCall(service.Logger(ctx, &l), info.FullMethod, start, err)
+			return res, err
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			start := time.Now()
+			ls := &loggerStream{ServerStream: ss, ctx: withCallLogger(ss.Context(), l), l: l}
+			err := handler(srv, ls)
+			logCall(service.Logger(ls.ctx, &l), info.FullMethod, start, err)
+			return err
+		}),
+	}
+}
+
+// withCallLogger returns ctx with a logger of the request id and client of
+// the call.
+func withCallLogger(ctx context.Context, l zerolog.Logger) context.Context {
+	md, _ := metadata.FromIncomingContext(ctx)
+	id := ""
+	if ids := md.Get(requestIDMetadata); len(ids) > 0 {
+		id = ids[0]
+	}
+	id = service.RequestID(id)
+	_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDMetadata, id))
+
+	lc := l.With().Str("requestId", id)
+	if p := service.PrincipalFrom(ctx); p != nil {
+		lc = lc.Str("client", p.Client)
+	}
+	return service.WithLogger(ctx, lc.Logger())
+}
+
+// callWallet returns the wallet id of a request.
+func callWallet(req interface{}) (int, bool) {
+	switch r := req.(type) {
+	case interface{ GetWalletId() int32 }:
+		return int(r.GetWalletId()), true
+	case *walletpb.GetWalletRequest:
+		return int(r.GetId()), true
+	}
+	return 0, false
+}
+
+// logCall logs a served call; server failures are errors.
+func logCall(l *zerolog.Logger, method string, start time.Time, err error) {
+	code := status.Code(err)
+	e := l.Info()
+	switch code {
+	case codes.Internal, codes.Unknown, codes.Unavailable, codes.DataLoss:
+		e = l.Error().Err(err)
+	}
+	e.Str("method", method).
+		Str("code", code.String()).
+		Dur("latency", time.Since(start)).
+		Msg("call served")
+}
+
+// loggerStream overrides the context of a stream with one carrying the call
+// logger, which gets the wallet of the request once it is received.
+type loggerStream struct {
+	grpc.ServerStream
+	ctx      context.Context
+	l        zerolog.Logger
+	received bool
+}
+
+func (s *loggerStream) Context() context.Context {
+	return s.ctx
+}
+
+func (s *loggerStream) RecvMsg(m interface{}) error {
+	err := s.ServerStream.RecvMsg(m)
+	if err == nil && !s.received {
+		s.received = true
+		if wid, ok := callWallet(m); ok {
+			s.ctx = service.WithLogger(s.ctx, service.Logger(s.ctx, &s.l).With().Int("wid", wid).Logger())
+		}
+	}
+	return err
+}
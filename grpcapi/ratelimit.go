@@ -0,0 +1,122 @@
+package grpcapi
+
+import (
+	"context"
+	"math"
+	"net"
+	"strconv"
+
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+
+	"github.com/polarbit/bluelabs-wallet/grpcapi/walletpb"
+	"github.com/polarbit/bluelabs-wallet/ratelimit"
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+// retryAfterMetadata carries the seconds to wait of rejected calls
+const retryAfterMetadata = "retry-after"
+
+// RateLimit returns server options which reject calls over the limits of their
+// client, or of their wallet when adding transactions, with ResourceExhausted,
+// like the REST api. They chain after Auth, which sets the client.
+func RateLimit(lm *ratelimit.Limiter, l zerolog.Logger) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			wid := 0
+			if r, ok := req.(*walletpb.CreateTransactionRequest); ok {
+				wid = int(r.WalletId)
+			}
+			if err := allow(ctx, lm, wid, l); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := allow(ss.Context(), lm, 0, l); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
+
+// LimitIP returns server options which reject calls over the limit of their
+// peer address with ResourceExhausted, like the REST api. They go before
+// Auth, so calls failing to authenticate are limited too.
+func LimitIP(lm *ratelimit.Limiter, l zerolog.Logger) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if err := allowIP(ctx, lm, l); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.ChainStreamInterceptor(func(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := allowIP(ss.Context(), lm, l); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
+
+// allow takes a token of the client of the call, or of the peer address of
+// callers without a principal. Calls are allowed if the store fails.
+func allow(ctx context.Context, lm *ratelimit.Limiter, wid int, l zerolog.Logger) error {
+	client := "ip:" + peerHost(ctx)
+	if p := service.PrincipalFrom(ctx); p != nil {
+		client = p.Client
+	}
+
+	r, err := lm.Allow(ctx, client, wid)
+	if err != nil {
+		l.Error().Err(err).Msg("rate limit failed")
+		return nil
+	}
+	if r.Allowed {
+		return nil
+	}
+	l.Debug().Str("client", client).Int("wid", wid).Msg("rate limit exceeded")
+	return exhausted(ctx, r)
+}
+
+// allowIP takes a token of the peer address of the call. Calls are allowed if
+// the store fails.
+func allowIP(ctx context.Context, lm *ratelimit.Limiter, l zerolog.Logger) error {
+	ip := peerHost(ctx)
+	r, err := lm.AllowIP(ctx, ip)
+	if err != nil {
+		l.Error().Err(err).Msg("rate limit failed")
+		return nil
+	}
+	if r.Allowed {
+		return nil
+	}
+	l.Debug().Str("ip", ip).Msg("ip rate limit exceeded")
+	return exhausted(ctx, r)
+}
+
+// peerHost returns the address of the peer of the call, without its port.
+func peerHost(ctx context.Context) string {
+	pr, ok := peer.FromContext(ctx)
+	if !ok {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(pr.Addr.String())
+	if err != nil {
+		return pr.Addr.String()
+	}
+	return host
+}
+
+// exhausted returns the error of a rejected call, with its retry-after header.
+func exhausted(ctx context.Context, r ratelimit.Result) error {
+	retryAfter := strconv.Itoa(int(math.Ceil(r.RetryAfter.Seconds())))
+	grpc.SetHeader(ctx, metadata.Pairs(retryAfterMetadata, retryAfter))
+	return status.Error(codes.ResourceExhausted, "rate limit exceeded, retry after "+retryAfter+"s")
+}
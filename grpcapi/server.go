@@ -0,0 +1,278 @@
+// Package grpcapi serves the wallet service over gRPC, next to the REST api.
+package grpcapi
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative walletpb/wallet.proto
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/signal"
+	"time"
+
+	"github.com/go-playground/validator"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/timestamppb"
+
+	"github.com/polarbit/bluelabs-wallet/config"
+	"github.com/polarbit/bluelabs-wallet/grpcapi/walletpb"
+	"github.com/polarbit/bluelabs-wallet/jwtauth"
+	"github.com/polarbit/bluelabs-wallet/metrics"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/storage"
+)
+
+// pageSize is the number of transactions read per page of a history stream
+const pageSize = 500
+
+// defaultTick is the interval a followed history stream reads the store again
+const defaultTick = 15 * time.Second
+
+type server struct {
+	walletpb.UnimplementedWalletServiceServer
+
+	s service.Service
+	v *validator.Validate
+	l zerolog.Logger
+
+	// tick is the re-read interval of followed streams; defaultTick if zero
+	tick time.Duration
+}
+
+// NewServer returns a grpc server with the wallet service registered.
+func NewServer(s service.Service, l zerolog.Logger, opts ...grpc.ServerOption) *grpc.Server {
+	gs := grpc.NewServer(opts...)
+	walletpb.RegisterWalletServiceServer(gs, &server{s: s, v: validator.New(), l: l})
+	return gs
+}
+
+// Serve serves the grpc api on addr and blocks until interrupted. A non-empty
+// storage overrides the storage of the configuration.
+func Serve(storageName string, addr string) error {
+	config.Init()
+	if storageName != "" {
+		config.Config.Storage = storageName
+	}
+
+	repo, err := storage.NewRepository(config.Config, log.Logger)
+	if err != nil {
+		return err
+	}
+	// before repo is instrumented, so postgres stores share its connections
+	lm := storage.NewLimiter(config.Config, repo, log.Logger)
+	nonces := storage.NewNonceStore(config.Config, repo, log.Logger)
+	var m *metrics.Metrics
+	if config.Config.MetricsAddr != "" {
+		m = metrics.New()
+		repo = m.Repository(repo)
+	}
+
+	var opts []service.Option
+	if config.Config.Posting == config.PostingLocking {
+		opts = append(opts, service.WithLocking())
+	}
+	if config.Config.PolicyFile != "" {
+		policy, err := service.LoadPolicy(config.Config.PolicyFile)
+		if err != nil {
+			return err
+		}
+		opts = append(opts, service.WithPolicy(policy))
+	}
+	var sopts []grpc.ServerOption
+	if lm != nil {
+		sopts = LimitIP(lm, log.Logger)
+	}
+	var keys service.Repository
+	if config.Config.ApiKeys {
+		if config.Config.Storage == config.StorageMemory {
+			log.Warn().Msg("api keys are required, but memory storage has none; every request is unauthorized")
+		}
+		keys = repo
+	}
+	v, err := jwtauth.NewVerifier(config.Config)
+	if err != nil {
+		return err
+	}
+	if keys != nil || v != nil {
+		sopts = append(sopts, Auth(keys, v, log.Logger)...)
+	}
+	sopts = append(sopts, Logging(log.Logger)...)
+	if lm != nil {
+		sopts = append(sopts, RateLimit(lm, log.Logger)...)
+	}
+	if len(config.Config.SigningSecrets) > 0 {
+		tolerance, _ := time.ParseDuration(config.Config.SigningTolerance)
+		sopts = append(sopts, Signing(config.Config.SigningSecrets, nonces, tolerance, log.Logger)...)
+	}
+	s := service.NewWalletService(repo, log.Logger, opts...)
+	if m != nil {
+		s = m.Service(s)
+		go m.Serve(config.Config.MetricsAddr, log.Logger)
+	}
+	gs := NewServer(s, log.Logger, sopts...)
+
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		quit := make(chan os.Signal, 1)
+		signal.Notify(quit, os.Interrupt)
+		<-quit
+		gs.GracefulStop()
+	}()
+
+	log.Info().Str("addr", lis.Addr().String()).Msg("grpc server started")
+	return gs.Serve(lis)
+}
+
+func (h *server) CreateWallet(ctx context.Context, req *walletpb.CreateWalletRequest) (*walletpb.Wallet, error) {
+	m := &service.WalletModel{ExternalID: req.ExternalId, Labels: req.Labels}
+	if err := h.v.Struct(m); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	w, err := h.s.CreateWallet(ctx, m)
+	if err != nil {
+		return nil, h.statusError(ctx, err)
+	}
+	return toWallet(w), nil
+}
+
+func (h *server) GetWallet(ctx context.Context, req *walletpb.GetWalletRequest) (*walletpb.Wallet, error) {
+	w, err := h.s.GetWallet(ctx, int(req.Id))
+	if err != nil {
+		return nil, h.statusError(ctx, err)
+	}
+	return toWallet(w), nil
+}
+
+func (h *server) GetWalletBalance(ctx context.Context, req *walletpb.GetWalletBalanceRequest) (*walletpb.WalletBalance, error) {
+	b, err := h.s.GetWalletBalance(ctx, int(req.WalletId))
+	if err != nil {
+		return nil, h.statusError(ctx, err)
+	}
+	return &walletpb.WalletBalance{WalletId: req.WalletId, Balance: b}, nil
+}
+
+func (h *server) CreateTransaction(ctx context.Context, req *walletpb.CreateTransactionRequest) (*walletpb.Transaction, error) {
+	m := &service.TransactionModel{Amount: req.Amount, Description: req.Description, Labels: req.Labels, Fingerprint: req.Fingerprint}
+	if err := h.v.Struct(m); err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	t, err := h.s.CreateTransaction(ctx, int(req.WalletId), m)
+	if err != nil {
+		return nil, h.statusError(ctx, err)
+	}
+	return toTransaction(t), nil
+}
+
+func (h *server) GetLatestTransaction(ctx context.Context, req *walletpb.GetLatestTransactionRequest) (*walletpb.Transaction, error) {
+	t, err := h.s.GetLatestTransaction(ctx, int(req.WalletId))
+	if err != nil {
+		return nil, h.statusError(ctx, err)
+	}
+	return toTransaction(t), nil
+}
+
+func (h *server) ListTransactions(req *walletpb.ListTransactionsRequest, stream walletpb.WalletService_ListTransactionsServer) error {
+	ctx := stream.Context()
+	wid, after := int(req.WalletId), int(req.AfterRefno)
+	send := func(t *service.Transaction) error { return stream.Send(toTransaction(t)) }
+
+	if req.Follow {
+		tick := h.tick
+		if tick == 0 {
+			tick = defaultTick
+		}
+		err := h.s.FollowTransactions(ctx, wid, after, tick, send, func() error { return nil })
+		if err != nil {
+			return h.statusError(ctx, err)
+		}
+		return nil
+	}
+
+	for {
+		trs, err := h.s.ListTransactions(ctx, wid, after, pageSize)
+		if err != nil {
+			return h.statusError(ctx, err)
+		}
+		for _, t := range trs {
+			if err := send(t); err != nil {
+				return err
+			}
+			after = t.RefNo
+		}
+		if len(trs) < pageSize {
+			return nil
+		}
+	}
+}
+
+// statusError maps service errors to grpc status codes. Retriable conflicts
+// are Aborted, as the grpc guidelines suggest retrying at a higher level.
+func (h *server) statusError(ctx context.Context, err error) error {
+	var code codes.Code
+	switch {
+	case errors.Is(err, service.ErrWalletNotFound),
+		errors.Is(err, service.ErrTransactionNotFound):
+		code = codes.NotFound
+	case errors.Is(err, service.ErrWalletAlreadyExists),
+		errors.Is(err, service.ErrTransactionAlreadyExistsByFingerprint):
+		code = codes.AlreadyExists
+	case errors.Is(err, service.ErrTransactionConsistency),
+		errors.Is(err, service.ErrTransactionAlreadyExistsByRefNo):
+		code = codes.Aborted
+	case errors.Is(err, service.ErrNotEnoughWalletBalance):
+		code = codes.FailedPrecondition
+	case errors.Is(err, service.ErrInvalidAmount):
+		code = codes.InvalidArgument
+	case errors.Is(err, service.ErrPolicyDenied):
+		code = codes.PermissionDenied
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	case errors.As(err, new(*service.DbError)):
+		service.Logger(ctx, &h.l).Error().Err(err).Msg("storage failed")
+		return status.Error(codes.Unavailable, "storage is unavailable")
+	default:
+		if _, ok := status.FromError(err); ok {
+			return err
+		}
+		service.Logger(ctx, &h.l).Debug().Err(err).Msg("")
+		code = codes.Internal
+	}
+	return status.Error(code, err.Error())
+}
+
+func toWallet(w *service.Wallet) *walletpb.Wallet {
+	return &walletpb.Wallet{
+		Id:         int32(w.ID),
+		ExternalId: w.ExternalID,
+		Labels:     w.Labels,
+		Created:    timestamppb.New(w.Created),
+	}
+}
+
+func toTransaction(t *service.Transaction) *walletpb.Transaction {
+	return &walletpb.Transaction{
+		Id:          t.ID,
+		Refno:       int32(t.RefNo),
+		Amount:      t.Amount,
+		Description: t.Description,
+		Labels:      t.Labels,
+		Fingerprint: t.Fingerprint,
+		Created:     timestamppb.New(t.Created),
+		OldBalance:  t.OldBalance,
+		NewBalance:  t.NewBalance,
+		PrevHash:    t.PrevHash,
+		Hash:        t.Hash,
+		Client:      t.Client,
+	}
+}
@@ -0,0 +1,431 @@
+//go:build !integration
+// +build !integration
+
+package grpcapi
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/go-playground/validator"
+	"github.com/golang-jwt/jwt"
+	"github.com/polarbit/bluelabs-wallet/config"
+	"github.com/polarbit/bluelabs-wallet/grpcapi/walletpb"
+	"github.com/polarbit/bluelabs-wallet/jwtauth"
+	"github.com/polarbit/bluelabs-wallet/memdb"
+	"github.com/polarbit/bluelabs-wallet/ratelimit"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/signing"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+)
+
+func newClient(t *testing.T) walletpb.WalletServiceClient {
+	return newClientWith(t, memdb.NewRepository(zerolog.Nop()))
+}
+
+func newClientWith(t *testing.T, r service.Repository, opts ...grpc.ServerOption) walletpb.WalletServiceClient {
+	return dial(t, serve(t, r, opts...))
+}
+
+func serve(t *testing.T, r service.Repository, opts ...grpc.ServerOption) *bufconn.Listener {
+	s := service.NewWalletService(r, zerolog.Nop())
+	gs := grpc.NewServer(opts...)
+	walletpb.RegisterWalletServiceServer(gs, &server{s: s, v: validator.New(), l: zerolog.Nop(), tick: 50 * time.Millisecond})
+
+	lis := bufconn.Listen(1 << 20)
+	go gs.Serve(lis)
+	t.Cleanup(gs.Stop)
+	return lis
+}
+
+func dial(t *testing.T, lis *bufconn.Listener, opts ...grpc.DialOption) walletpb.WalletServiceClient {
+	opts = append(opts,
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return lis.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()))
+	conn, err := grpc.DialContext(context.Background(), "bufnet", opts...)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return walletpb.NewWalletServiceClient(conn)
+}
+
+func assertCode(t *testing.T, code codes.Code, err error) {
+	t.Helper()
+	assert.Equal(t, code, status.Code(err), "%v", err)
+}
+
+func TestWalletService(t *testing.T) {
+	c := newClient(t)
+	ctx := context.Background()
+
+	w, err := c.CreateWallet(ctx, &walletpb.CreateWalletRequest{ExternalId: "w1", Labels: map[string]string{"a": "b"}})
+	require.NoError(t, err)
+	assert.Equal(t, "b", w.Labels["a"])
+
+	_, err = c.CreateWallet(ctx, &walletpb.CreateWalletRequest{ExternalId: "w1"})
+	assertCode(t, codes.AlreadyExists, err)
+	_, err = c.CreateWallet(ctx, &walletpb.CreateWalletRequest{})
+	assertCode(t, codes.InvalidArgument, err)
+
+	got, err := c.GetWallet(ctx, &walletpb.GetWalletRequest{Id: w.Id})
+	require.NoError(t, err)
+	assert.Equal(t, "w1", got.ExternalId)
+	_, err = c.GetWallet(ctx, &walletpb.GetWalletRequest{Id: 99})
+	assertCode(t, codes.NotFound, err)
+
+	_, err = c.GetLatestTransaction(ctx, &walletpb.GetLatestTransactionRequest{WalletId: w.Id})
+	assertCode(t, codes.NotFound, err)
+
+	tr, err := c.CreateTransaction(ctx, &walletpb.CreateTransactionRequest{
+		WalletId: w.Id, Amount: 10, Description: "deposit", Fingerprint: "f1"})
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), tr.Refno)
+	assert.Equal(t, 10., tr.NewBalance)
+	assert.NotEmpty(t, tr.Hash)
+
+	_, err = c.CreateTransaction(ctx, &walletpb.CreateTransactionRequest{
+		WalletId: w.Id, Amount: 10, Description: "deposit", Fingerprint: "f1"})
+	assertCode(t, codes.AlreadyExists, err)
+	_, err = c.CreateTransaction(ctx, &walletpb.CreateTransactionRequest{
+		WalletId: w.Id, Amount: -20, Description: "withdraw", Fingerprint: "f2"})
+	assertCode(t, codes.FailedPrecondition, err)
+	_, err = c.CreateTransaction(ctx, &walletpb.CreateTransactionRequest{
+		WalletId: w.Id, Amount: 1, Fingerprint: "f3"})
+	assertCode(t, codes.InvalidArgument, err)
+	_, err = c.CreateTransaction(ctx, &walletpb.CreateTransactionRequest{
+		WalletId: w.Id, Amount: 0.5, Description: "tiny", Fingerprint: "f3"})
+	assertCode(t, codes.InvalidArgument, err)
+
+	b, err := c.GetWalletBalance(ctx, &walletpb.GetWalletBalanceRequest{WalletId: w.Id})
+	require.NoError(t, err)
+	assert.Equal(t, 10., b.Balance)
+
+	latest, err := c.GetLatestTransaction(ctx, &walletpb.GetLatestTransactionRequest{WalletId: w.Id})
+	require.NoError(t, err)
+	assert.Equal(t, tr.Id, latest.Id)
+}
+
+func TestListTransactions(t *testing.T) {
+	c := newClient(t)
+	ctx := context.Background()
+
+	w, err := c.CreateWallet(ctx, &walletpb.CreateWalletRequest{ExternalId: "w1"})
+	require.NoError(t, err)
+	deposit := func(fingerprint string) {
+		_, err := c.CreateTransaction(ctx, &walletpb.CreateTransactionRequest{
+			WalletId: w.Id, Amount: 5, Description: "deposit", Fingerprint: fingerprint})
+		require.NoError(t, err)
+	}
+	deposit("f1")
+	deposit("f2")
+	deposit("f3")
+
+	t.Run("History", func(t *testing.T) {
+		stream, err := c.ListTransactions(ctx, &walletpb.ListTransactionsRequest{WalletId: w.Id, AfterRefno: 1})
+		require.NoError(t, err)
+
+		refnos := []int32{}
+		for {
+			tr, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			require.NoError(t, err)
+			refnos = append(refnos, tr.Refno)
+		}
+		assert.Equal(t, []int32{2, 3}, refnos)
+	})
+
+	t.Run("WalletNotFound", func(t *testing.T) {
+		stream, err := c.ListTransactions(ctx, &walletpb.ListTransactionsRequest{WalletId: 99})
+		require.NoError(t, err)
+		_, err = stream.Recv()
+		assertCode(t, codes.NotFound, err)
+	})
+
+	t.Run("Follow", func(t *testing.T) {
+		fctx, cancel := context.WithTimeout(ctx, 5*time.Second)
+		defer cancel()
+
+		stream, err := c.ListTransactions(fctx, &walletpb.ListTransactionsRequest{WalletId: w.Id, AfterRefno: 2, Follow: true})
+		require.NoError(t, err)
+
+		tr, err := stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, int32(3), tr.Refno)
+
+		deposit("f4")
+		tr, err = stream.Recv()
+		require.NoError(t, err)
+		assert.Equal(t, int32(4), tr.Refno)
+
+		cancel()
+		_, err = stream.Recv()
+		assertCode(t, codes.Canceled, err)
+	})
+}
+
+func TestAPIKeyAuth(t *testing.T) {
+	ctx := context.Background()
+	repo := memdb.NewRepository(zerolog.Nop())
+	c := newClientWith(t, repo, Auth(repo, nil, zerolog.Nop())...)
+
+	newKey := func(name string, scopes ...string) context.Context {
+		key, k, err := service.GenerateAPIKey(name, scopes)
+		require.NoError(t, err)
+		require.NoError(t, repo.CreateAPIKey(ctx, k))
+		return metadata.AppendToOutgoingContext(ctx, apiKeyMetadata, key)
+	}
+	admin := newKey("admin", service.ScopeAdmin)
+	reader := newKey("reader", service.ScopeWalletsRead)
+	billing := newKey("billing", service.ScopeTransactionsWrite)
+
+	_, err := c.CreateWallet(ctx, &walletpb.CreateWalletRequest{ExternalId: "w1"})
+	assertCode(t, codes.Unauthenticated, err)
+	_, err = c.CreateWallet(metadata.AppendToOutgoingContext(ctx, apiKeyMetadata, "bwk_unknown"), &walletpb.CreateWalletRequest{ExternalId: "w1"})
+	assertCode(t, codes.Unauthenticated, err)
+	_, err = c.CreateWallet(reader, &walletpb.CreateWalletRequest{ExternalId: "w1"})
+	assertCode(t, codes.PermissionDenied, err)
+
+	w, err := c.CreateWallet(admin, &walletpb.CreateWalletRequest{ExternalId: "w1"})
+	require.NoError(t, err)
+
+	tr, err := c.CreateTransaction(billing, &walletpb.CreateTransactionRequest{WalletId: w.Id, Amount: 5, Description: "d", Fingerprint: "f1"})
+	require.NoError(t, err)
+	assert.Equal(t, "apikey:billing", tr.Client)
+
+	// streams are authorized too
+	stream, err := c.ListTransactions(billing, &walletpb.ListTransactionsRequest{WalletId: w.Id})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assertCode(t, codes.PermissionDenied, err)
+
+	stream, err = c.ListTransactions(reader, &walletpb.ListTransactionsRequest{WalletId: w.Id})
+	require.NoError(t, err)
+	got, err := stream.Recv()
+	require.NoError(t, err)
+	assert.Equal(t, "apikey:billing", got.Client)
+}
+
+func TestBearerAuth(t *testing.T) {
+	ctx := context.Background()
+	repo := memdb.NewRepository(zerolog.Nop())
+
+	k, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	b64 := base64.RawURLEncoding.EncodeToString
+	jwks, err := json.Marshal(map[string]interface{}{"keys": []map[string]string{{
+		"kid": "r1", "kty": "RSA", "alg": "RS256", "n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}}})
+	require.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "jwks.json")
+	require.NoError(t, os.WriteFile(path, jwks, 0600))
+	v, err := jwtauth.NewVerifier(&config.AppConfig{Jwks: path})
+	require.NoError(t, err)
+	c := newClientWith(t, repo, Auth(repo, v, zerolog.Nop())...)
+
+	bearer := func(claims jwt.MapClaims) context.Context {
+		claims["sub"], claims["exp"] = "svc-1", time.Now().Add(time.Hour).Unix()
+		tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+		tok.Header["kid"] = "r1"
+		s, err := tok.SignedString(k)
+		require.NoError(t, err)
+		return metadata.AppendToOutgoingContext(ctx, authorizationMetadata, "Bearer "+s)
+	}
+	admin := bearer(jwt.MapClaims{"scope": "admin", "tenant": "brand1"})
+	reader := bearer(jwt.MapClaims{"scope": "wallets:read"})
+
+	_, err = c.CreateWallet(metadata.AppendToOutgoingContext(ctx, authorizationMetadata, "Bearer a.b.c"), &walletpb.CreateWalletRequest{ExternalId: "w1"})
+	assertCode(t, codes.Unauthenticated, err)
+	_, err = c.CreateWallet(reader, &walletpb.CreateWalletRequest{ExternalId: "w1"})
+	assertCode(t, codes.PermissionDenied, err)
+
+	// wallets of a tenant are labeled with it, and other wallets are not found
+	w, err := c.CreateWallet(admin, &walletpb.CreateWalletRequest{ExternalId: "mine"})
+	require.NoError(t, err)
+	assert.Equal(t, "brand1", w.Labels[service.TenantLabel])
+	other, err := service.NewWalletService(repo, zerolog.Nop()).CreateWallet(ctx,
+		&service.WalletModel{ExternalID: "other", Labels: map[string]string{service.TenantLabel: "brand2"}})
+	require.NoError(t, err)
+	_, err = c.GetWallet(admin, &walletpb.GetWalletRequest{Id: int32(other.ID)})
+	assertCode(t, codes.NotFound, err)
+
+	tr, err := c.CreateTransaction(admin, &walletpb.CreateTransactionRequest{WalletId: w.Id, Amount: 5, Description: "d", Fingerprint: "f1"})
+	require.NoError(t, err)
+	assert.Equal(t, "jwt:svc-1", tr.Client)
+}
+
+func TestRateLimit(t *testing.T) {
+	ctx := context.Background()
+	repo := memdb.NewRepository(zerolog.Nop())
+	lm := ratelimit.NewLimiter(ratelimit.NewMemoryStore(), ratelimit.Limit{Rate: 0.001, Burst: 3}, ratelimit.Limit{Rate: 0.001, Burst: 1})
+	c := newClientWith(t, repo, append(Auth(repo, nil, zerolog.Nop()), RateLimit(lm, zerolog.Nop())...)...)
+
+	key, k, err := service.GenerateAPIKey("admin", []string{service.ScopeAdmin})
+	require.NoError(t, err)
+	require.NoError(t, repo.CreateAPIKey(ctx, k))
+	admin := metadata.AppendToOutgoingContext(ctx, apiKeyMetadata, key)
+
+	w, err := c.CreateWallet(admin, &walletpb.CreateWalletRequest{ExternalId: "w1"})
+	require.NoError(t, err)
+	_, err = c.CreateTransaction(admin, &walletpb.CreateTransactionRequest{WalletId: w.Id, Amount: 5, Description: "d", Fingerprint: "f1"})
+	require.NoError(t, err)
+
+	// the wallet limit is exhausted first, and then the client limit
+	var md metadata.MD
+	_, err = c.CreateTransaction(admin, &walletpb.CreateTransactionRequest{WalletId: w.Id, Amount: 5, Description: "d", Fingerprint: "f2"},
+		grpc.Header(&md))
+	assertCode(t, codes.ResourceExhausted, err)
+	assert.Equal(t, []string{"1000"}, md.Get(retryAfterMetadata))
+
+	_, err = c.GetWallet(admin, &walletpb.GetWalletRequest{Id: w.Id})
+	assertCode(t, codes.ResourceExhausted, err)
+}
+
+func TestLimitIP(t *testing.T) {
+	ctx := context.Background()
+	repo := memdb.NewRepository(zerolog.Nop())
+	lm := ratelimit.NewLimiter(ratelimit.NewMemoryStore(), ratelimit.Limit{}, ratelimit.Limit{})
+	lm.IP = ratelimit.Limit{Rate: 0.001, Burst: 2}
+	c := newClientWith(t, repo, append(LimitIP(lm, zerolog.Nop()), Auth(repo, nil, zerolog.Nop())...)...)
+
+	// failed attempts are limited by their address
+	invalid := metadata.AppendToOutgoingContext(ctx, apiKeyMetadata, "invalid")
+	_, err := c.GetWallet(invalid, &walletpb.GetWalletRequest{Id: 1})
+	assertCode(t, codes.Unauthenticated, err)
+	_, err = c.GetWallet(invalid, &walletpb.GetWalletRequest{Id: 1})
+	assertCode(t, codes.Unauthenticated, err)
+	var md metadata.MD
+	_, err = c.GetWallet(invalid, &walletpb.GetWalletRequest{Id: 1}, grpc.Header(&md))
+	assertCode(t, codes.ResourceExhausted, err)
+	assert.Equal(t, []string{"1000"}, md.Get(retryAfterMetadata))
+}
+
+func TestLogging(t *testing.T) {
+	ctx := context.Background()
+	repo := memdb.NewRepository(zerolog.Nop())
+	buf := &bytes.Buffer{}
+	c := newClientWith(t, repo, append(Auth(repo, nil, zerolog.Nop()), Logging(zerolog.New(buf))...)...)
+
+	key, k, err := service.GenerateAPIKey("reader", []string{service.ScopeWalletsRead})
+	require.NoError(t, err)
+	require.NoError(t, repo.CreateAPIKey(ctx, k))
+	ctx = metadata.AppendToOutgoingContext(ctx, apiKeyMetadata, key, requestIDMetadata, "req-1")
+
+	lines := func() []map[string]interface{} {
+		ls := []map[string]interface{}{}
+		for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+			m := map[string]interface{}{}
+			require.NoError(t, json.Unmarshal([]byte(line), &m), line)
+			ls = append(ls, m)
+		}
+		buf.Reset()
+		return ls
+	}
+
+	var header metadata.MD
+	_, err = c.GetWallet(ctx, &walletpb.GetWalletRequest{Id: 7}, grpc.Header(&header))
+	assertCode(t, codes.NotFound, err)
+	assert.Equal(t, []string{"req-1"}, header.Get(requestIDMetadata))
+	ls := lines()
+	require.Len(t, ls, 1)
+	assert.Equal(t, "call served", ls[0]["message"])
+	assert.Equal(t, "req-1", ls[0]["requestId"])
+	assert.Equal(t, "apikey:reader", ls[0]["client"])
+	assert.Equal(t, float64(7), ls[0]["wid"])
+	assert.Equal(t, "/wallet.v1.WalletService/GetWallet", ls[0]["method"])
+	assert.Equal(t, codes.NotFound.String(), ls[0]["code"])
+
+	// streams get the wallet of their request
+	stream, err := c.ListTransactions(ctx, &walletpb.ListTransactionsRequest{WalletId: 8})
+	require.NoError(t, err)
+	_, err = stream.Recv()
+	assertCode(t, codes.NotFound, err)
+	ls = lines()
+	require.Len(t, ls, 1)
+	assert.Equal(t, "req-1", ls[0]["requestId"])
+	assert.Equal(t, float64(8), ls[0]["wid"])
+}
+
+func TestSigning(t *testing.T) {
+	ctx := context.Background()
+	repo := memdb.NewRepository(zerolog.Nop())
+	nonces := signing.NewMemoryNonceStore()
+	lis := serve(t, repo, Signing(map[string]string{"billing": "s3cret"}, nonces, time.Minute, zerolog.Nop())...)
+	unsigned := dial(t, lis)
+
+	// only writes of transactions are signed
+	w, err := unsigned.CreateWallet(ctx, &walletpb.CreateWalletRequest{ExternalId: "w1"})
+	require.NoError(t, err)
+	req := &walletpb.CreateTransactionRequest{WalletId: w.Id, Amount: 5, Description: "d", Fingerprint: "f1", Labels: map[string]string{"a": "1", "b": "2"}}
+	_, err = unsigned.CreateTransaction(ctx, req)
+	assertCode(t, codes.Unauthenticated, err)
+
+	_, err = dial(t, lis, SignCalls("billing", "wrong")).CreateTransaction(ctx, req)
+	assertCode(t, codes.Unauthenticated, err)
+	_, err = dial(t, lis, SignCalls("other", "s3cret")).CreateTransaction(ctx, req)
+	assertCode(t, codes.Unauthenticated, err)
+
+	tr, err := dial(t, lis, SignCalls("Billing", "s3cret")).CreateTransaction(ctx, req)
+	require.NoError(t, err)
+	assert.Equal(t, 5., tr.NewBalance)
+
+	// a captured signature is not accepted again, nor for another request
+	req.Fingerprint = "f2"
+	body, err := marshalSigned(req)
+	require.NoError(t, err)
+	header := signing.Sign("s3cret", signedMethod, "/wallet.v1.WalletService/CreateTransaction", time.Now(), "n1", body)
+	signed := metadata.AppendToOutgoingContext(ctx, clientMetadata, "billing", signatureMetadata, header)
+	_, err = unsigned.CreateTransaction(signed, &walletpb.CreateTransactionRequest{WalletId: w.Id, Amount: 500, Description: "d", Fingerprint: "f2"})
+	assertCode(t, codes.Unauthenticated, err)
+	req.Fingerprint = "f3"
+	_, err = unsigned.CreateTransaction(signed, req)
+	assertCode(t, codes.Unauthenticated, err)
+	req.Fingerprint = "f2"
+	_, err = unsigned.CreateTransaction(signed, req)
+	require.NoError(t, err)
+	_, err = unsigned.CreateTransaction(signed, req)
+	assertCode(t, codes.Unauthenticated, err)
+}
+
+func TestSigningPrincipal(t *testing.T) {
+	ctx := context.Background()
+	repo := memdb.NewRepository(zerolog.Nop())
+	secrets := map[string]string{"apikey:billing": "s3cret", "apikey:payouts": "p4yout"}
+	lis := serve(t, repo, append(Auth(repo, nil, zerolog.Nop()), Signing(secrets, signing.NewMemoryNonceStore(), time.Minute, zerolog.Nop())...)...)
+
+	key, k, err := service.GenerateAPIKey("billing", []string{service.ScopeTransactionsWrite})
+	require.NoError(t, err)
+	require.NoError(t, repo.CreateAPIKey(ctx, k))
+	ctx = metadata.AppendToOutgoingContext(ctx, apiKeyMetadata, key)
+
+	w, err := service.NewWalletService(repo, zerolog.Nop()).CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+	require.NoError(t, err)
+	req := &walletpb.CreateTransactionRequest{WalletId: int32(w.ID), Amount: 5, Description: "d", Fingerprint: "f1"}
+
+	// a caller cannot sign with the secret of another client
+	_, err = dial(t, lis, SignCalls("apikey:payouts", "p4yout")).CreateTransaction(ctx, req)
+	assertCode(t, codes.PermissionDenied, err)
+
+	_, err = dial(t, lis, SignCalls("apikey:billing", "s3cret")).CreateTransaction(ctx, req)
+	require.NoError(t, err)
+}
@@ -0,0 +1,120 @@
+package grpcapi
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/signing"
+)
+
+// signedMethod is the method of the canonical request of signed calls
+const signedMethod = "POST"
+
+// signedMethods require a call signature, keyed by full method name, like
+// signedRoutes of the REST api
+var signedMethods = map[string]bool{
+	"/wallet.v1.WalletService/CreateTransaction": true,
+}
+
+// Metadata of signed calls, the headers of signed REST requests
+var (
+	clientMetadata    = strings.ToLower(signing.HeaderClient)
+	signatureMetadata = strings.ToLower(signing.HeaderSignature)
+)
+
+// Signing returns server options which reject calls of signedMethods without a
+// valid signature of a client of secrets, like the REST api. The canonical
+// request of a call has the method POST, the full method name as path and the
+// deterministic protobuf encoding of the request as body; see SignCalls.
+// The client must be the authenticated principal, if any.
+func Signing(secrets map[string]string, nonces signing.NonceStore, tolerance time.Duration, l zerolog.Logger) []grpc.ServerOption {
+	return []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(func(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+			if !signedMethods[info.FullMethod] {
+				return handler(ctx, req)
+			}
+			if err := verifySignature(ctx, secrets, nonces, tolerance, info.FullMethod, req, l); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+	}
+}
+
+func verifySignature(ctx context.Context, secrets map[string]string, nonces signing.NonceStore, tolerance time.Duration, method string, req interface{}, l zerolog.Logger) error {
+	md, _ := metadata.FromIncomingContext(ctx)
+	clients, headers := md.Get(clientMetadata), md.Get(signatureMetadata)
+	if len(clients) == 0 || len(headers) == 0 || clients[0] == "" || headers[0] == "" {
+		return status.Error(codes.Unauthenticated, "request signature is required")
+	}
+	// config keys are case-insensitive; nonces are tracked by the same key
+	client := strings.ToLower(clients[0])
+	secret, ok := secrets[client]
+	if !ok {
+		return status.Error(codes.Unauthenticated, signing.ErrInvalidSignature.Error())
+	}
+	if p := service.PrincipalFrom(ctx); p != nil && strings.ToLower(p.Client) != client {
+		l.Info().Str("client", client).Str("principal", p.Client).Msg("call signed by another client")
+		return status.Error(codes.PermissionDenied, signing.ErrOtherClient.Error())
+	}
+
+	body, err := marshalSigned(req)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	now := time.Now()
+	nonce, err := signing.Verify(secret, headers[0], signedMethod, method, body, tolerance, now)
+	if err != nil {
+		l.Debug().Err(err).Str("client", client).Msg("verify request signature failed")
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+
+	if err := nonces.Use(ctx, client, nonce, now.Add(2*tolerance)); err != nil {
+		if errors.Is(err, signing.ErrReplayedNonce) {
+			l.Info().Str("client", client).Str("nonce", nonce).Msg("replayed request rejected")
+			return status.Error(codes.Unauthenticated, err.Error())
+		}
+		l.Error().Err(err).Msg("use nonce failed")
+		return status.Error(codes.Internal, err.Error())
+	}
+	return nil
+}
+
+// SignCalls returns a dial option which signs the calls of signedMethods with
+// the secret of client, with a new nonce per call.
+func SignCalls(client, secret string) grpc.DialOption {
+	return grpc.WithChainUnaryInterceptor(func(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+		if !signedMethods[method] {
+			return invoker(ctx, method, req, reply, cc, opts...)
+		}
+		body, err := marshalSigned(req)
+		if err != nil {
+			return err
+		}
+		ctx = metadata.AppendToOutgoingContext(ctx,
+			clientMetadata, client,
+			signatureMetadata, signing.Sign(secret, signedMethod, method, time.Now(), uuid.NewString(), body))
+		return invoker(ctx, method, req, reply, cc, opts...)
+	})
+}
+
+// marshalSigned returns the body of the canonical request of a call.
+func marshalSigned(req interface{}) ([]byte, error) {
+	m, ok := req.(proto.Message)
+	if !ok {
+		return nil, errors.New("request is not a protobuf message")
+	}
+	return proto.MarshalOptions{Deterministic: true}.Marshal(m)
+}
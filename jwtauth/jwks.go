@@ -0,0 +1,212 @@
+package jwtauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// keySet is a JSON Web Key Set read from a file or an http(s) url. Keys are
+// read again every refresh, and when a token names an unknown key id, which is
+// how rotated keys are picked up, at most once every minRefresh. Keys are read
+// by one caller at a time, without the lock, so other callers keep being
+// served the keys we have meanwhile.
+type keySet struct {
+	source     string
+	client     *http.Client
+	refresh    time.Duration
+	minRefresh time.Duration
+	now        func() time.Time
+
+	mu      sync.Mutex
+	keys    map[string]interface{} // public keys by kid
+	loaded  time.Time
+	loading bool
+}
+
+// newKeySet reads the key set of source, a file path or an http(s) url.
+func newKeySet(source string) (*keySet, error) {
+	ks := &keySet{
+		source:     source,
+		client:     &http.Client{Timeout: 10 * time.Second},
+		refresh:    time.Hour,
+		minRefresh: time.Minute,
+		now:        time.Now,
+	}
+	keys, err := ks.read()
+	if err != nil {
+		return nil, err
+	}
+	ks.keys, ks.loaded = keys, ks.now()
+	return ks, nil
+}
+
+// key returns the public key of kid for alg. An empty kid matches the only key
+// of a set with a single key.
+func (ks *keySet) key(kid, alg string) (interface{}, error) {
+	ks.mu.Lock()
+	since := ks.now().Sub(ks.loaded)
+	k, ok := ks.lookup(kid)
+	if ((!ok && since >= ks.minRefresh) || since >= ks.refresh) && !ks.loading {
+		ks.loading = true
+		ks.mu.Unlock()
+		keys, err := ks.read()
+		ks.mu.Lock()
+		ks.loading = false
+		// keep serving the keys we have if the source is unavailable
+		if err == nil {
+			ks.keys, ks.loaded = keys, ks.now()
+			k, ok = ks.lookup(kid)
+		}
+	}
+	ks.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown key id %q", kid)
+	}
+
+	switch k.(type) {
+	case *rsa.PublicKey:
+		if alg == "RS256" {
+			return k, nil
+		}
+	case *ecdsa.PublicKey:
+		if alg == "ES256" {
+			return k, nil
+		}
+	}
+	return nil, fmt.Errorf("key %q does not match algorithm %s", kid, alg)
+}
+
+// lookup must be called with the lock held
+func (ks *keySet) lookup(kid string) (interface{}, bool) {
+	if kid == "" && len(ks.keys) == 1 {
+		for _, k := range ks.keys {
+			return k, true
+		}
+	}
+	k, ok := ks.keys[kid]
+	return k, ok
+}
+
+// read reads and parses the key set of the source; it does not need the lock.
+func (ks *keySet) read() (map[string]interface{}, error) {
+	var b []byte
+	var err error
+	if strings.HasPrefix(ks.source, "http://") || strings.HasPrefix(ks.source, "https://") {
+		b, err = ks.fetch()
+	} else {
+		b, err = os.ReadFile(ks.source)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read jwks %s: %w", ks.source, err)
+	}
+
+	keys, err := parseJWKS(b)
+	if err != nil {
+		return nil, fmt.Errorf("parse jwks %s: %w", ks.source, err)
+	}
+	return keys, nil
+}
+
+func (ks *keySet) fetch() ([]byte, error) {
+	res, err := ks.client.Get(ks.source)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("status %d", res.StatusCode)
+	}
+	return io.ReadAll(io.LimitReader(res.Body, 1<<20))
+}
+
+// jwk is a key of a JSON Web Key Set (RFC 7517); only RSA and P-256 EC
+// signing keys are used.
+type jwk struct {
+	Kid string `json:"kid"`
+	Kty string `json:"kty"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+
+	// RSA
+	N string `json:"n"`
+	E string `json:"e"`
+
+	// EC
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// parseJWKS returns the public keys of the set by kid. Keys of other types,
+// curves or uses are skipped, so that a set shared with other services can be
+// used.
+func parseJWKS(b []byte) (map[string]interface{}, error) {
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return nil, err
+	}
+
+	keys := map[string]interface{}{}
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		switch {
+		case k.Kty == "RSA" && (k.Alg == "" || k.Alg == "RS256"):
+			n, err := decodeBigInt(k.N)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: n: %w", k.Kid, err)
+			}
+			e, err := decodeBigInt(k.E)
+			if err != nil || !e.IsInt64() {
+				return nil, fmt.Errorf("key %q: e is incorrect", k.Kid)
+			}
+			keys[k.Kid] = &rsa.PublicKey{N: n, E: int(e.Int64())}
+
+		case k.Kty == "EC" && k.Crv == "P-256" && (k.Alg == "" || k.Alg == "ES256"):
+			x, err := decodeBigInt(k.X)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: x: %w", k.Kid, err)
+			}
+			y, err := decodeBigInt(k.Y)
+			if err != nil {
+				return nil, fmt.Errorf("key %q: y: %w", k.Kid, err)
+			}
+			if !elliptic.P256().IsOnCurve(x, y) {
+				return nil, fmt.Errorf("key %q: point is not on the curve", k.Kid)
+			}
+			keys[k.Kid] = &ecdsa.PublicKey{Curve: elliptic.P256(), X: x, Y: y}
+		}
+	}
+
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("no RS256 or ES256 signing keys")
+	}
+	return keys, nil
+}
+
+func decodeBigInt(s string) (*big.Int, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 0 {
+		return nil, fmt.Errorf("empty")
+	}
+	return new(big.Int).SetBytes(b), nil
+}
@@ -0,0 +1,131 @@
+// Package jwtauth verifies JWT bearer tokens against a JSON Web Key Set, for
+// the REST and gRPC apis alike.
+package jwtauth
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+
+	"github.com/polarbit/bluelabs-wallet/config"
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+// defaultTenantClaim is the claim of the tenant of a token unless configured
+const defaultTenantClaim = "tenant"
+
+// Verifier verifies RS256 and ES256 bearer tokens against a key set and
+// maps their claims to a principal: sub to Subject (and Client as jwt:<sub>),
+// scope (space separated) or scp to Scopes, and tenantClaim to Tenant.
+type Verifier struct {
+	keys        *keySet
+	issuer      string // required iss if not empty
+	audience    string // required aud if not empty
+	skew        time.Duration
+	tenantClaim string
+	now         func() time.Time
+}
+
+// NewVerifier returns the verifier of the configuration, or nil if Jwks is
+// empty.
+func NewVerifier(c *config.AppConfig) (*Verifier, error) {
+	if c.Jwks == "" {
+		return nil, nil
+	}
+
+	keys, err := newKeySet(c.Jwks)
+	if err != nil {
+		return nil, err
+	}
+
+	v := &Verifier{
+		keys:        keys,
+		issuer:      c.JwtIssuer,
+		audience:    c.JwtAudience,
+		tenantClaim: c.JwtTenantClaim,
+		now:         time.Now,
+	}
+	if c.JwtClockSkew != "" {
+		v.skew, _ = time.ParseDuration(c.JwtClockSkew)
+	}
+	if v.tenantClaim == "" {
+		v.tenantClaim = defaultTenantClaim
+	}
+	return v, nil
+}
+
+// Verify returns the principal of the raw token, or an error telling why the
+// token is rejected.
+func (v *Verifier) Verify(raw string) (*service.Principal, error) {
+	// claims are validated below with clock skew tolerance
+	p := &jwt.Parser{ValidMethods: []string{"RS256", "ES256"}, SkipClaimsValidation: true}
+	claims := jwt.MapClaims{}
+	_, err := p.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		return v.keys.key(kid, t.Method.Alg())
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	now := v.now()
+	if !claims.VerifyExpiresAt(now.Add(-v.skew).Unix(), true) {
+		return nil, errors.New("token is expired or has no exp")
+	}
+	if !claims.VerifyNotBefore(now.Add(v.skew).Unix(), false) {
+		return nil, errors.New("token is not valid yet")
+	}
+	if !claims.VerifyIssuedAt(now.Add(v.skew).Unix(), false) {
+		return nil, errors.New("token is issued in the future")
+	}
+	if v.issuer != "" && !claims.VerifyIssuer(v.issuer, true) {
+		return nil, errors.New("token issuer is incorrect")
+	}
+	if v.audience != "" && !claims.VerifyAudience(v.audience, true) {
+		return nil, errors.New("token audience is incorrect")
+	}
+
+	sub, _ := claims["sub"].(string)
+	if sub == "" {
+		return nil, errors.New("token has no sub")
+	}
+	scopes, err := claimScopes(claims)
+	if err != nil {
+		return nil, err
+	}
+	tenant, ok := claims[v.tenantClaim].(string)
+	if !ok && claims[v.tenantClaim] != nil {
+		return nil, fmt.Errorf("token claim %s should be a string", v.tenantClaim)
+	}
+
+	return &service.Principal{Client: "jwt:" + sub, Subject: sub, Scopes: scopes, Tenant: tenant}, nil
+}
+
+// claimScopes returns the scopes of the scope claim (RFC 8693, space
+// separated) or of the scp claim (a list, or a space separated string).
+func claimScopes(claims jwt.MapClaims) ([]string, error) {
+	if s, ok := claims["scope"].(string); ok {
+		return strings.Fields(s), nil
+	}
+
+	switch scp := claims["scp"].(type) {
+	case nil:
+		return nil, nil
+	case string:
+		return strings.Fields(scp), nil
+	case []interface{}:
+		scopes := make([]string, 0, len(scp))
+		for _, s := range scp {
+			str, ok := s.(string)
+			if !ok {
+				return nil, errors.New("token claim scp should be a list of strings")
+			}
+			scopes = append(scopes, str)
+		}
+		return scopes, nil
+	}
+	return nil, errors.New("token claim scp should be a list of strings")
+}
@@ -0,0 +1,209 @@
+//go:build !integration
+// +build !integration
+
+package jwtauth
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func rsaJWK(kid string, k *rsa.PrivateKey) map[string]string {
+	return map[string]string{"kid": kid, "kty": "RSA", "use": "sig", "alg": "RS256",
+		"n": b64(k.N.Bytes()), "e": b64(big.NewInt(int64(k.E)).Bytes())}
+}
+
+func ecJWK(kid string, k *ecdsa.PrivateKey) map[string]string {
+	return map[string]string{"kid": kid, "kty": "EC", "crv": "P-256", "x": b64(k.X.Bytes()), "y": b64(k.Y.Bytes())}
+}
+
+func writeJWKS(t *testing.T, path string, keys ...map[string]string) {
+	b, err := json.Marshal(map[string]interface{}{"keys": keys})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(path, b, 0600))
+}
+
+func sign(t *testing.T, method jwt.SigningMethod, kid string, key interface{}, claims jwt.MapClaims) string {
+	tok := jwt.NewWithClaims(method, claims)
+	tok.Header["kid"] = kid
+	s, err := tok.SignedString(key)
+	require.NoError(t, err)
+	return s
+}
+
+type jwtFixture struct {
+	path string
+	rsa  *rsa.PrivateKey
+	ec   *ecdsa.PrivateKey
+	now  time.Time
+	v    *Verifier
+}
+
+func newJWTFixture(t *testing.T) *jwtFixture {
+	f := &jwtFixture{path: filepath.Join(t.TempDir(), "jwks.json"), now: time.Now()}
+	var err error
+	f.rsa, err = rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	f.ec, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	writeJWKS(t, f.path, rsaJWK("r1", f.rsa), ecJWK("e1", f.ec))
+
+	keys, err := newKeySet(f.path)
+	require.NoError(t, err)
+	keys.now = func() time.Time { return f.now }
+	keys.loaded = f.now
+	f.v = &Verifier{keys: keys, issuer: "gateway", skew: time.Minute, tenantClaim: "tenant",
+		now: func() time.Time { return f.now }}
+	return f
+}
+
+func (f *jwtFixture) claims(c jwt.MapClaims) jwt.MapClaims {
+	base := jwt.MapClaims{"sub": "svc-1", "iss": "gateway", "exp": f.now.Add(time.Hour).Unix()}
+	for k, v := range c {
+		if v == nil {
+			delete(base, k)
+		} else {
+			base[k] = v
+		}
+	}
+	return base
+}
+
+func TestJWTVerify(t *testing.T) {
+	f := newJWTFixture(t)
+
+	p, err := f.v.Verify(sign(t, jwt.SigningMethodRS256, "r1", f.rsa, f.claims(jwt.MapClaims{
+		"scope": "wallets:read transactions:write", "tenant": "brand1"})))
+	require.NoError(t, err)
+	assert.Equal(t, &service.Principal{Client: "jwt:svc-1", Subject: "svc-1",
+		Scopes: []string{service.ScopeWalletsRead, service.ScopeTransactionsWrite}, Tenant: "brand1"}, p)
+
+	p, err = f.v.Verify(sign(t, jwt.SigningMethodES256, "e1", f.ec, f.claims(jwt.MapClaims{"scp": []string{"admin"}})))
+	require.NoError(t, err)
+	assert.Equal(t, []string{service.ScopeAdmin}, p.Scopes)
+	assert.Empty(t, p.Tenant)
+
+	rejected := map[string]string{
+		"ExpiredBeyondSkew": sign(t, jwt.SigningMethodRS256, "r1", f.rsa, f.claims(jwt.MapClaims{"exp": f.now.Add(-2 * time.Minute).Unix()})),
+		"NoExp":             sign(t, jwt.SigningMethodRS256, "r1", f.rsa, f.claims(jwt.MapClaims{"exp": nil})),
+		"NotBefore":         sign(t, jwt.SigningMethodRS256, "r1", f.rsa, f.claims(jwt.MapClaims{"nbf": f.now.Add(2 * time.Minute).Unix()})),
+		"Issuer":            sign(t, jwt.SigningMethodRS256, "r1", f.rsa, f.claims(jwt.MapClaims{"iss": "other"})),
+		"NoSub":             sign(t, jwt.SigningMethodRS256, "r1", f.rsa, f.claims(jwt.MapClaims{"sub": nil})),
+		"KeyOfOtherAlg":     sign(t, jwt.SigningMethodES256, "r1", f.ec, f.claims(nil)),
+		"UnknownKid":        sign(t, jwt.SigningMethodRS256, "r2", f.rsa, f.claims(nil)),
+		"HS256":             sign(t, jwt.SigningMethodHS256, "r1", []byte("secret"), f.claims(nil)),
+		"Garbage":           "a.b.c",
+	}
+	for name, tok := range rejected {
+		t.Run(name, func(t *testing.T) {
+			_, err := f.v.Verify(tok)
+			assert.Error(t, err)
+		})
+	}
+
+	// exp, nbf and iat are tolerated within the skew
+	_, err = f.v.Verify(sign(t, jwt.SigningMethodRS256, "r1", f.rsa, f.claims(jwt.MapClaims{
+		"exp": f.now.Add(-30 * time.Second).Unix(), "nbf": f.now.Add(30 * time.Second).Unix(), "iat": f.now.Add(30 * time.Second).Unix()})))
+	assert.NoError(t, err)
+}
+
+func TestJWTKeyRotation(t *testing.T) {
+	f := newJWTFixture(t)
+	next, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	writeJWKS(t, f.path, rsaJWK("r2", next))
+	tok := sign(t, jwt.SigningMethodRS256, "r2", next, f.claims(nil))
+
+	// unknown kids reload the set at most once a minute
+	_, err = f.v.Verify(tok)
+	assert.Error(t, err)
+	f.now = f.now.Add(time.Minute)
+	_, err = f.v.Verify(tok)
+	assert.NoError(t, err)
+
+	// the retired key is gone after the reload
+	_, err = f.v.Verify(sign(t, jwt.SigningMethodRS256, "r1", f.rsa, f.claims(nil)))
+	assert.Error(t, err)
+
+	// keys are kept if the set cannot be read
+	require.NoError(t, os.WriteFile(f.path, []byte("{"), 0600))
+	f.now = f.now.Add(2 * time.Hour)
+	_, err = f.v.Verify(sign(t, jwt.SigningMethodRS256, "r2", next, f.claims(nil)))
+	assert.NoError(t, err)
+}
+
+func TestJWKSURL(t *testing.T) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{
+			map[string]string{"kid": "enc", "kty": "RSA", "use": "enc"},
+			ecJWK("e1", k),
+		}})
+	}))
+	defer srv.Close()
+
+	ks, err := newKeySet(srv.URL)
+	require.NoError(t, err)
+	key, err := ks.key("e1", "ES256")
+	require.NoError(t, err)
+	assert.True(t, k.PublicKey.Equal(key))
+
+	_, err = parseJWKS([]byte(`{"keys": []}`))
+	assert.Error(t, err)
+}
+
+func TestJWKSFetchUnlocked(t *testing.T) {
+	k, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	fetching, release := make(chan struct{}), make(chan struct{})
+	fetches := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if fetches++; fetches > 1 {
+			close(fetching)
+			<-release
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"keys": []interface{}{ecJWK("e1", k)}})
+	}))
+	defer srv.Close()
+
+	ks, err := newKeySet(srv.URL)
+	require.NoError(t, err)
+	later := time.Now().Add(2 * time.Hour)
+	ks.now = func() time.Time { return later }
+
+	done := make(chan error)
+	go func() {
+		_, err := ks.key("e1", "ES256")
+		done <- err
+	}()
+	<-fetching
+
+	// the keys we have are served while they are fetched again
+	_, err = ks.key("e1", "ES256")
+	assert.NoError(t, err)
+
+	close(release)
+	assert.NoError(t, <-done)
+	assert.Equal(t, 2, fetches)
+}
@@ -0,0 +1,759 @@
+package memdb
+
+import (
+	"context"
+	"math"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+)
+
+// repository is an in-memory service.Repository. It mimics the constraints of
+// the postgres schema: unique externalid, unique fingerprint, unique
+// (wid, refno) and the conditional update of wallet balances.
+type repository struct {
+	mu sync.RWMutex
+	l  zerolog.Logger
+	n  *service.Notifier
+
+	seq          int
+	wallets      map[int]*service.Wallet
+	externalIDs  map[string]int
+	balances     map[int]float64
+	transactions map[int][]*service.Transaction // per wallet, ordered by refno
+	fingerprints map[string]struct{}
+	journal      []*service.JournalLine
+	repairs      []*repair
+	snapshots    map[snapshotKey]*service.Snapshot
+	outbox       []*outboxEvent // ordered by seq
+	eventSeq     int64
+	consumers    map[string]struct{}
+	checkpoints  map[string]int          // last replayed wallet per projection
+	apiKeys      []*service.APIKey       // ordered by id, which is index + 1
+	denials      []*service.PolicyDenial // ordered by id, which is index + 1
+
+	subSeq        int
+	subscriptions map[int]*service.Subscription
+	deliverySeq   int64
+	deliveries    []*service.Delivery // ordered by id
+	deliveryKeys  map[deliveryKey]struct{}
+}
+
+type deliveryKey struct {
+	sid int
+	seq int64
+}
+
+type snapshotKey struct {
+	wid int
+	day string
+}
+
+// outboxEvent is an event with the consumers which published it
+type outboxEvent struct {
+	e         service.Event
+	published map[string]struct{}
+}
+
+// repair is an audit record of a repaired balance
+type repair struct {
+	wid      int
+	refno    int
+	from, to float64
+	created  time.Time
+}
+
+func NewRepository(logger zerolog.Logger) service.Repository {
+	return &repository{
+		l:            logger,
+		n:            service.NewNotifier(),
+		wallets:      map[int]*service.Wallet{},
+		externalIDs:  map[string]int{},
+		balances:     map[int]float64{},
+		transactions: map[int][]*service.Transaction{},
+		fingerprints: map[string]struct{}{},
+		snapshots:    map[snapshotKey]*service.Snapshot{},
+		checkpoints:  map[string]int{},
+		consumers:    map[string]struct{}{},
+
+		subscriptions: map[int]*service.Subscription{},
+		deliveryKeys:  map[deliveryKey]struct{}{},
+	}
+}
+
+// log returns the logger of the request of ctx; see service.Logger.
+func (r *repository) log(ctx context.Context) *zerolog.Logger {
+	return service.Logger(ctx, &r.l)
+}
+
+func (r *repository) CreateWallet(ctx context.Context, w *service.Wallet) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.externalIDs[w.ExternalID]; ok {
+		return service.ErrWalletAlreadyExists
+	}
+
+	r.seq++
+	w.ID = r.seq
+
+	r.wallets[w.ID] = copyWallet(w)
+	r.externalIDs[w.ExternalID] = w.ID
+	r.balances[w.ID] = 0.
+	r.addEvents(service.WalletEvents(w))
+
+	return nil
+}
+
+func (r *repository) GetWallet(ctx context.Context, wid int) (*service.Wallet, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	w, ok := r.wallets[wid]
+	if !ok {
+		return nil, service.ErrWalletNotFound
+	}
+
+	return copyWallet(w), nil
+}
+
+func (r *repository) GetWalletBalance(ctx context.Context, wid int) (float64, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	b, ok := r.balances[wid]
+	if !ok {
+		return 0., service.ErrWalletNotFound
+	}
+
+	return b, nil
+}
+
+func (r *repository) CreateTransaction(ctx context.Context, wid int, t *service.Transaction) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.createTransaction(ctx, wid, t)
+}
+
+func (r *repository) PostTransaction(ctx context.Context, wid int, t *service.Transaction) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.balances[wid]
+	if !ok {
+		return service.ErrWalletNotFound
+	}
+
+	var lt *service.Transaction
+	t.RefNo = 1
+	if trs := r.transactions[wid]; len(trs) > 0 {
+		lt = trs[len(trs)-1]
+		t.RefNo = lt.RefNo + 1
+	}
+	t.OldBalance = b
+	t.NewBalance = b + t.Amount
+	if t.NewBalance < 0. {
+		return service.ErrNotEnoughWalletBalance
+	}
+	service.StampCreated(t, lt)
+	service.ChainTransaction(wid, t, lt)
+
+	return r.createTransaction(ctx, wid, t)
+}
+
+// createTransaction stores t; the caller must hold the write lock.
+func (r *repository) createTransaction(ctx context.Context, wid int, t *service.Transaction) error {
+	// unique constraints are checked in the same order as postgres does
+	if _, ok := r.fingerprints[t.Fingerprint]; ok {
+		return service.ErrTransactionAlreadyExistsByFingerprint
+	}
+
+	trs := r.transactions[wid]
+	i := sort.Search(len(trs), func(i int) bool { return trs[i].RefNo >= t.RefNo })
+	if i < len(trs) && trs[i].RefNo == t.RefNo {
+		return service.ErrTransactionAlreadyExistsByRefNo
+	}
+
+	// conditional balance update
+	b, ok := r.balances[wid]
+	if !ok || b != round(t.OldBalance) {
+		r.log(ctx).Error().Int("refno", t.RefNo).Msg("balance is changed")
+		return service.ErrTransactionConsistency
+	}
+
+	c := copyTransaction(t)
+	c.Journal = nil
+	c.Amount = round(c.Amount)
+	c.OldBalance = round(c.OldBalance)
+	c.NewBalance = round(c.NewBalance)
+
+	trs = append(trs, nil)
+	copy(trs[i+1:], trs[i:])
+	trs[i] = c
+
+	r.transactions[wid] = trs
+	r.fingerprints[t.Fingerprint] = struct{}{}
+	r.balances[wid] = c.NewBalance
+	for _, l := range t.Journal {
+		j := *l
+		j.Amount = round(j.Amount)
+		r.journal = append(r.journal, &j)
+	}
+	r.addEvents(service.TransactionEvents(wid, c))
+	r.n.Notify(wid, c.RefNo)
+
+	return nil
+}
+
+func (r *repository) GetLatestTransaction(ctx context.Context, wid int) (*service.Transaction, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	trs := r.transactions[wid]
+	if len(trs) == 0 {
+		return nil, service.ErrTransactionNotFound
+	}
+
+	return copyTransaction(trs[len(trs)-1]), nil
+}
+
+func (r *repository) GetTransactionAt(ctx context.Context, wid int, at time.Time) (*service.Transaction, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var last *service.Transaction
+	for _, t := range r.transactions[wid] {
+		if t.Created.After(at) {
+			continue
+		}
+		if last == nil || t.Created.After(last.Created) ||
+			(t.Created.Equal(last.Created) && t.RefNo > last.RefNo) {
+			last = t
+		}
+	}
+	if last == nil {
+		return nil, service.ErrTransactionNotFound
+	}
+
+	return copyTransaction(last), nil
+}
+
+func (r *repository) ListWallets(ctx context.Context, afterID int, limit int) ([]*service.Wallet, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	// ids are sequential
+	ws := []*service.Wallet{}
+	for id := afterID + 1; id <= r.seq && len(ws) < limit; id++ {
+		if w, ok := r.wallets[id]; ok {
+			ws = append(ws, copyWallet(w))
+		}
+	}
+
+	return ws, nil
+}
+
+func (r *repository) ListTransactions(ctx context.Context, wid int, afterRefNo int, limit int) ([]*service.Transaction, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	all := r.transactions[wid]
+	i := sort.Search(len(all), func(i int) bool { return all[i].RefNo > afterRefNo })
+
+	trs := []*service.Transaction{}
+	for ; i < len(all) && len(trs) < limit; i++ {
+		trs = append(trs, copyTransaction(all[i]))
+	}
+
+	return trs, nil
+}
+
+func (r *repository) TrialBalance(ctx context.Context) ([]*service.AccountBalance, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	bs := map[string]*service.AccountBalance{}
+	for _, a := range service.Accounts {
+		bs[a.Code] = &service.AccountBalance{Account: a}
+	}
+	for _, l := range r.journal {
+		b := bs[l.Account]
+		if l.Amount > 0 {
+			b.Debit = round(b.Debit + l.Amount)
+		} else {
+			b.Credit = round(b.Credit - l.Amount)
+		}
+	}
+
+	res := make([]*service.AccountBalance, 0, len(bs))
+	for _, b := range bs {
+		res = append(res, b)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Code < res[j].Code })
+
+	return res, nil
+}
+
+func (r *repository) RepairBalance(ctx context.Context, wid int, refno int, from, to float64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	b, ok := r.balances[wid]
+	if !ok {
+		return service.ErrWalletNotFound
+	}
+
+	latest := 0
+	if trs := r.transactions[wid]; len(trs) > 0 {
+		latest = trs[len(trs)-1].RefNo
+	}
+
+	if b != round(from) || latest != refno {
+		return service.ErrTransactionConsistency
+	}
+
+	r.balances[wid] = round(to)
+	r.repairs = append(r.repairs, &repair{wid: wid, refno: refno, from: from, to: to, created: time.Now().UTC()})
+	r.addEvents(service.RepairEvents(wid, refno, from, to))
+	r.log(ctx).Warn().Int("wid", wid).Int("refno", refno).Float64("from", from).Float64("to", to).Msg("balance is repaired")
+
+	return nil
+}
+
+func (r *repository) ListTransactionsBetween(ctx context.Context, wid int, from, to time.Time, afterRefNo int, limit int) ([]*service.Transaction, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	all := r.transactions[wid]
+	i := sort.Search(len(all), func(i int) bool { return all[i].RefNo > afterRefNo })
+
+	trs := []*service.Transaction{}
+	for ; i < len(all) && len(trs) < limit; i++ {
+		if all[i].Created.Before(from) || all[i].Created.After(to) {
+			continue
+		}
+		trs = append(trs, copyTransaction(all[i]))
+	}
+
+	return trs, nil
+}
+
+func (r *repository) SaveSnapshot(ctx context.Context, s *service.Snapshot) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c := *s
+	c.Day = service.Day(s.Day)
+	c.Balance = round(s.Balance)
+	r.snapshots[snapshotKey{wid: s.WalletID, day: c.Day.Format(service.DayLayout)}] = &c
+
+	return nil
+}
+
+func (r *repository) GetSnapshot(ctx context.Context, wid int, day time.Time) (*service.Snapshot, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	s, ok := r.snapshots[snapshotKey{wid: wid, day: service.Day(day).Format(service.DayLayout)}]
+	if !ok {
+		return nil, service.ErrSnapshotNotFound
+	}
+
+	c := *s
+	return &c, nil
+}
+
+func (r *repository) ListPendingEvents(ctx context.Context, consumer string, limit int) ([]*service.Event, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.consumers[consumer] = struct{}{}
+	es := []*service.Event{}
+	for _, o := range r.outbox {
+		if len(es) == limit {
+			break
+		}
+		if _, ok := o.published[consumer]; !ok {
+			e := o.e
+			es = append(es, &e)
+		}
+	}
+
+	return es, nil
+}
+
+func (r *repository) MarkEventsPublished(ctx context.Context, consumer string, seqs []int64) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.consumers[consumer] = struct{}{}
+	for _, seq := range seqs {
+		i := sort.Search(len(r.outbox), func(i int) bool { return r.outbox[i].e.Seq >= seq })
+		if i < len(r.outbox) && r.outbox[i].e.Seq == seq {
+			r.outbox[i].published[consumer] = struct{}{}
+		}
+	}
+
+	return nil
+}
+
+func (r *repository) PruneEvents(ctx context.Context, before time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.consumers) == 0 {
+		return 0, nil
+	}
+
+	kept := r.outbox[:0]
+	for _, o := range r.outbox {
+		if !o.e.Created.Before(before) || len(o.published) < len(r.consumers) {
+			kept = append(kept, o)
+		}
+	}
+	n := len(r.outbox) - len(kept)
+	for i := len(kept); i < len(r.outbox); i++ {
+		r.outbox[i] = nil
+	}
+	r.outbox = kept
+
+	return n, nil
+}
+
+// addEvents assigns seq numbers and appends es to the outbox; the caller must
+// hold the write lock.
+func (r *repository) addEvents(es []*service.Event) {
+	for _, e := range es {
+		r.eventSeq++
+		e.Seq = r.eventSeq
+		r.outbox = append(r.outbox, &outboxEvent{e: *e, published: map[string]struct{}{}})
+	}
+}
+
+func (r *repository) CreateSubscription(ctx context.Context, sub *service.Subscription) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.subSeq++
+	sub.ID = r.subSeq
+	r.subscriptions[sub.ID] = copySubscription(sub)
+
+	return nil
+}
+
+func (r *repository) GetSubscription(ctx context.Context, id int) (*service.Subscription, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	sub, ok := r.subscriptions[id]
+	if !ok {
+		return nil, service.ErrSubscriptionNotFound
+	}
+
+	return copySubscription(sub), nil
+}
+
+func (r *repository) ListSubscriptions(ctx context.Context) ([]*service.Subscription, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	subs := make([]*service.Subscription, 0, len(r.subscriptions))
+	for _, sub := range r.subscriptions {
+		subs = append(subs, copySubscription(sub))
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].ID < subs[j].ID })
+
+	return subs, nil
+}
+
+func (r *repository) DeleteSubscription(ctx context.Context, id int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if _, ok := r.subscriptions[id]; !ok {
+		return service.ErrSubscriptionNotFound
+	}
+	delete(r.subscriptions, id)
+
+	// cascade to deliveries
+	ds := r.deliveries[:0]
+	for _, d := range r.deliveries {
+		if d.SubscriptionID == id {
+			delete(r.deliveryKeys, deliveryKey{sid: id, seq: d.Event.Seq})
+			continue
+		}
+		ds = append(ds, d)
+	}
+	r.deliveries = ds
+
+	return nil
+}
+
+func (r *repository) CreateDeliveries(ctx context.Context, ds []*service.Delivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// all or nothing, like the insert transaction of postgres
+	for _, d := range ds {
+		if _, ok := r.subscriptions[d.SubscriptionID]; !ok {
+			return service.ErrSubscriptionNotFound
+		}
+	}
+
+	for _, d := range ds {
+		k := deliveryKey{sid: d.SubscriptionID, seq: d.Event.Seq}
+		if _, ok := r.deliveryKeys[k]; ok {
+			continue
+		}
+
+		r.deliverySeq++
+		d.ID = r.deliverySeq
+		r.deliveries = append(r.deliveries, copyDelivery(d))
+		r.deliveryKeys[k] = struct{}{}
+	}
+
+	return nil
+}
+
+func (r *repository) ClaimDueDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*service.Delivery, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	due := []*service.Delivery{}
+	for _, d := range r.deliveries {
+		if d.Status == service.DeliveryPending && !d.NextAttempt.After(now) {
+			due = append(due, d)
+		}
+	}
+	sort.SliceStable(due, func(i, j int) bool { return due[i].NextAttempt.Before(due[j].NextAttempt) })
+	if len(due) > limit {
+		due = due[:limit]
+	}
+
+	ds := make([]*service.Delivery, len(due))
+	for i, d := range due {
+		d.NextAttempt = now.Add(lease)
+		ds[i] = copyDelivery(d)
+	}
+	return ds, nil
+}
+
+func (r *repository) GetDelivery(ctx context.Context, id int64) (*service.Delivery, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if i := r.findDelivery(id); i >= 0 {
+		return copyDelivery(r.deliveries[i]), nil
+	}
+	return nil, service.ErrDeliveryNotFound
+}
+
+func (r *repository) ListDeliveries(ctx context.Context, sid int, afterID int64, limit int) ([]*service.Delivery, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ds := []*service.Delivery{}
+	for _, d := range r.deliveries {
+		if len(ds) == limit {
+			break
+		}
+		if d.SubscriptionID == sid && d.ID > afterID {
+			ds = append(ds, copyDelivery(d))
+		}
+	}
+
+	return ds, nil
+}
+
+func (r *repository) UpdateDelivery(ctx context.Context, d *service.Delivery) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.findDelivery(d.ID)
+	if i < 0 {
+		return service.ErrDeliveryNotFound
+	}
+
+	c := r.deliveries[i]
+	c.Status = d.Status
+	c.Attempts = d.Attempts
+	c.NextAttempt = d.NextAttempt
+	c.LastError = d.LastError
+	c.LastStatusCode = d.LastStatusCode
+	c.Updated = d.Updated
+
+	return nil
+}
+
+func (r *repository) Listen(ctx context.Context, wid int) (<-chan int, error) {
+	return r.n.Listen(ctx, wid), nil
+}
+
+func (r *repository) GetCheckpoint(ctx context.Context, projection string) (int, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	return r.checkpoints[projection], nil
+}
+
+func (r *repository) SaveCheckpoint(ctx context.Context, projection string, wid int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.checkpoints[projection] = wid
+	return nil
+}
+
+func (r *repository) CreateAPIKey(ctx context.Context, k *service.APIKey) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, x := range r.apiKeys {
+		if x.Name == k.Name {
+			return service.ErrAPIKeyAlreadyExists
+		}
+	}
+
+	k.ID = len(r.apiKeys) + 1
+	r.apiKeys = append(r.apiKeys, copyAPIKey(k))
+
+	return nil
+}
+
+func (r *repository) GetAPIKeyByHash(ctx context.Context, hash string) (*service.APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, k := range r.apiKeys {
+		if k.Hash == hash {
+			return copyAPIKey(k), nil
+		}
+	}
+
+	return nil, service.ErrAPIKeyNotFound
+}
+
+func (r *repository) ListAPIKeys(ctx context.Context) ([]*service.APIKey, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	keys := make([]*service.APIKey, 0, len(r.apiKeys))
+	for _, k := range r.apiKeys {
+		keys = append(keys, copyAPIKey(k))
+	}
+
+	return keys, nil
+}
+
+func (r *repository) RevokeAPIKey(ctx context.Context, id int, at time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if id < 1 || id > len(r.apiKeys) {
+		return service.ErrAPIKeyNotFound
+	}
+
+	// the first revocation time is kept
+	k := r.apiKeys[id-1]
+	if k.Revoked == nil {
+		at = at.UTC()
+		k.Revoked = &at
+	}
+
+	return nil
+}
+
+func (r *repository) CreatePolicyDenial(ctx context.Context, d *service.PolicyDenial) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d.ID = int64(len(r.denials) + 1)
+	c := *d
+	c.Amount = round(d.Amount)
+	c.Labels = copyLabels(d.Labels)
+	r.denials = append(r.denials, &c)
+
+	return nil
+}
+
+func (r *repository) ListPolicyDenials(ctx context.Context, afterID int64, limit int) ([]*service.PolicyDenial, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ds := []*service.PolicyDenial{}
+	if afterID < 0 {
+		afterID = 0
+	}
+	for i := afterID; i < int64(len(r.denials)) && len(ds) < limit; i++ {
+		c := *r.denials[i]
+		c.Labels = copyLabels(c.Labels)
+		ds = append(ds, &c)
+	}
+
+	return ds, nil
+}
+
+// findDelivery returns the index of the delivery or -1; the caller must hold
+// the lock.
+func (r *repository) findDelivery(id int64) int {
+	i := sort.Search(len(r.deliveries), func(i int) bool { return r.deliveries[i].ID >= id })
+	if i < len(r.deliveries) && r.deliveries[i].ID == id {
+		return i
+	}
+	return -1
+}
+
+// round mimics numeric(10,2) columns
+func round(f float64) float64 {
+	return math.Round(f*100) / 100
+}
+
+func copyLabels(m map[string]string) map[string]string {
+	if m == nil {
+		return nil
+	}
+	c := make(map[string]string, len(m))
+	for k, v := range m {
+		c[k] = v
+	}
+	return c
+}
+
+func copyWallet(w *service.Wallet) *service.Wallet {
+	c := *w
+	c.Labels = copyLabels(w.Labels)
+	return &c
+}
+
+func copyTransaction(t *service.Transaction) *service.Transaction {
+	c := *t
+	c.Labels = copyLabels(t.Labels)
+	return &c
+}
+
+func copySubscription(sub *service.Subscription) *service.Subscription {
+	c := *sub
+	c.EventTypes = append([]string(nil), sub.EventTypes...)
+	c.Labels = copyLabels(sub.Labels)
+	return &c
+}
+
+func copyAPIKey(k *service.APIKey) *service.APIKey {
+	c := *k
+	c.Scopes = append([]string(nil), k.Scopes...)
+	if k.Revoked != nil {
+		t := *k.Revoked
+		c.Revoked = &t
+	}
+	return &c
+}
+
+func copyDelivery(d *service.Delivery) *service.Delivery {
+	c := *d
+	c.Event.Payload = append([]byte(nil), d.Event.Payload...)
+	return &c
+}
@@ -0,0 +1,38 @@
+//go:build !integration
+// +build !integration
+
+package memdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/service/repotest"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRepository(t *testing.T) {
+	repotest.Run(t, func() service.Repository { return NewRepository(log.Logger) })
+}
+
+func TestWalletIsCopied(t *testing.T) {
+	r := NewRepository(log.Logger)
+	ctx := context.Background()
+
+	w := &service.Wallet{ExternalID: uuid.NewString(), Labels: map[string]string{"a": "b"}}
+	assert.NoError(t, r.CreateWallet(ctx, w))
+
+	// stored wallet is not affected by changes of the caller
+	w.Labels["a"] = "changed"
+	got, err := r.GetWallet(ctx, w.ID)
+	assert.NoError(t, err)
+	assert.Equal(t, "b", got.Labels["a"])
+}
+
+func BenchmarkCreateTransaction(b *testing.B) {
+	repotest.Benchmark(b, func() service.Repository { return NewRepository(zerolog.Nop()) })
+}
@@ -0,0 +1,87 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"math"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+// Service returns s recording wallet creations, added transactions by reason
+// and sign, insufficient balance rejections and retries of conflicted
+// transactions in m.
+func (m *Metrics) Service(s service.Service) service.Service {
+	return &instrumentedService{Service: s, m: m}
+}
+
+type instrumentedService struct {
+	service.Service
+	m *Metrics
+}
+
+func (s *instrumentedService) CreateWallet(ctx context.Context, wm *service.WalletModel) (*service.Wallet, error) {
+	w, err := s.Service.CreateWallet(ctx, wm)
+	if err == nil {
+		s.m.wallets.Inc()
+	}
+	return w, err
+}
+
+func (s *instrumentedService) CreateTransaction(ctx context.Context, wid int, tm *service.TransactionModel) (*service.Transaction, error) {
+	s.m.retry(tm.Fingerprint)
+
+	t, err := s.Service.CreateTransaction(ctx, wid, tm)
+	if errors.Is(err, service.ErrNotEnoughWalletBalance) {
+		s.m.rejections.Inc()
+	}
+	if err != nil {
+		return t, err
+	}
+
+	sign := service.OpCredit
+	if t.Amount < 0 {
+		sign = service.OpDebit
+	}
+	reason := s.m.reason(tm.Labels)
+	s.m.transactions.WithLabelValues(reason, sign).Inc()
+	s.m.amounts.WithLabelValues(reason, sign).Add(math.Abs(t.Amount))
+	return t, nil
+}
+
+// Repository returns r recording transactions conflicting with concurrent
+// ones in m. Statistics of the connection pool of r are collected too, if it
+// has one.
+func (m *Metrics) Repository(r service.Repository) service.Repository {
+	if p, ok := r.(interface{ Stat() *pgxpool.Stat }); ok {
+		m.registry.MustRegister(newPoolCollector(p.Stat))
+	}
+	return &instrumentedRepository{Repository: r, m: m}
+}
+
+type instrumentedRepository struct {
+	service.Repository
+	m *Metrics
+}
+
+func (r *instrumentedRepository) CreateTransaction(ctx context.Context, wid int, t *service.Transaction) error {
+	err := r.Repository.CreateTransaction(ctx, wid, t)
+	r.observe(t, err)
+	return err
+}
+
+func (r *instrumentedRepository) PostTransaction(ctx context.Context, wid int, t *service.Transaction) error {
+	err := r.Repository.PostTransaction(ctx, wid, t)
+	r.observe(t, err)
+	return err
+}
+
+// observe records a conflict if err is one.
+func (r *instrumentedRepository) observe(t *service.Transaction, err error) {
+	var se *service.ServiceError
+	if errors.As(err, &se) && (se == service.ErrTransactionConsistency || se == service.ErrTransactionAlreadyExistsByRefNo) {
+		r.m.conflict(se.Code, t.Fingerprint)
+	}
+}
@@ -0,0 +1,169 @@
+// Package metrics instruments the wallet with prometheus metrics: latencies
+// of api requests, statistics of the database connection pool and domain
+// counters. Domain counters are recorded by decorators of service.Service and
+// service.Repository, so the service is not aware of them.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/rs/zerolog"
+)
+
+// namespace prefixes the names of the metrics
+const namespace = "wallet"
+
+// Reasons of transactions without a reason label, and of reasons over
+// maxReasons. Reasons are labels set by callers, so they are bounded.
+const (
+	reasonNone  = "none"
+	reasonOther = "other"
+)
+
+// reasonLabel is the transaction label counted as reason
+const reasonLabel = "reason"
+
+// maxReasons bounds the distinct reasons counted
+const maxReasons = 100
+
+// maxConflicted bounds the fingerprints of conflicted transactions kept to
+// count their retries
+const maxConflicted = 10000
+
+// Metrics are the metrics of an instance of the wallet.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	requests     *prometheus.HistogramVec
+	wallets      prometheus.Counter
+	transactions *prometheus.CounterVec
+	amounts      *prometheus.CounterVec
+	rejections   prometheus.Counter
+	conflicts    *prometheus.CounterVec
+	retries      prometheus.Counter
+
+	mu         sync.Mutex
+	reasons    map[string]bool
+	conflicted map[string]bool // fingerprints
+}
+
+// New returns the metrics, with the go runtime and process collectors.
+func New() *Metrics {
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		requests: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: namespace,
+			Subsystem: "http",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of api requests by method, route and status.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+		wallets: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "wallets_created_total",
+			Help:      "Wallets created.",
+		}),
+		transactions: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "transactions_total",
+			Help:      "Transactions added by reason label and sign (credit or debit).",
+		}, []string{"reason", "sign"}),
+		amounts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "transaction_amount_total",
+			Help:      "Sum of the absolute amounts of transactions added by reason label and sign.",
+		}, []string{"reason", "sign"}),
+		rejections: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "insufficient_balance_total",
+			Help:      "Transactions rejected for insufficient wallet balance.",
+		}),
+		conflicts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "transaction_conflicts_total",
+			Help:      "Transactions which conflicted with a concurrent one, by error code.",
+		}, []string{"code"}),
+		retries: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "transaction_retries_total",
+			Help:      "Transactions added again after they conflicted.",
+		}),
+		reasons:    map[string]bool{},
+		conflicted: map[string]bool{},
+	}
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.requests, m.wallets, m.transactions, m.amounts, m.rejections, m.conflicts, m.retries,
+	)
+	return m
+}
+
+// Handler serves the metrics in the prometheus text format.
+func (m *Metrics) Handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// Serve serves the metrics on /metrics of addr until the server fails.
+func (m *Metrics) Serve(addr string, l zerolog.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m.Handler())
+	l.Info().Str("addr", addr).Msg("metrics server started")
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		l.Error().Err(err).Msg("metrics server failed")
+	}
+}
+
+// ObserveRequest records the latency of an api request of route, its path
+// pattern.
+func (m *Metrics) ObserveRequest(method, route string, status int, d time.Duration) {
+	m.requests.WithLabelValues(method, route, strconv.Itoa(status)).Observe(d.Seconds())
+}
+
+// reason returns the reason label of the labels of a transaction.
+func (m *Metrics) reason(labels map[string]string) string {
+	r, ok := labels[reasonLabel]
+	if !ok || r == "" {
+		return reasonNone
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if !m.reasons[r] {
+		if len(m.reasons) >= maxReasons {
+			return reasonOther
+		}
+		m.reasons[r] = true
+	}
+	return r
+}
+
+// conflict records a conflict of the transaction with fingerprint.
+func (m *Metrics) conflict(code, fingerprint string) {
+	m.conflicts.WithLabelValues(code).Inc()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.conflicted) >= maxConflicted {
+		m.conflicted = map[string]bool{}
+	}
+	m.conflicted[fingerprint] = true
+}
+
+// retry records a retry if the transaction with fingerprint conflicted.
+func (m *Metrics) retry(fingerprint string) {
+	m.mu.Lock()
+	retried := m.conflicted[fingerprint]
+	delete(m.conflicted, fingerprint)
+	m.mu.Unlock()
+
+	if retried {
+		m.retries.Inc()
+	}
+}
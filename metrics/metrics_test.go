@@ -0,0 +1,111 @@
+//go:build !integration
+// +build !integration
+
+package metrics
+
+import (
+	"context"
+	"strconv"
+	"testing"
+
+	"github.com/jackc/pgx/v4/pgxpool"
+	"github.com/polarbit/bluelabs-wallet/memdb"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// conflictRepository fails the next conflicts transactions with
+// ErrTransactionConsistency.
+type conflictRepository struct {
+	service.Repository
+	conflicts int
+}
+
+func (r *conflictRepository) CreateTransaction(ctx context.Context, wid int, t *service.Transaction) error {
+	if r.conflicts > 0 {
+		r.conflicts--
+		return service.ErrTransactionConsistency
+	}
+	return r.Repository.CreateTransaction(ctx, wid, t)
+}
+
+func TestDecorators(t *testing.T) {
+	ctx := context.Background()
+	m := New()
+	repo := &conflictRepository{Repository: memdb.NewRepository(zerolog.Nop())}
+	s := m.Service(service.NewWalletService(m.Repository(repo), zerolog.Nop()))
+
+	w, err := s.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+	require.NoError(t, err)
+	_, err = s.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+	require.ErrorIs(t, err, service.ErrWalletAlreadyExists)
+	assert.Equal(t, 1., testutil.ToFloat64(m.wallets))
+
+	tx := func(amount float64, fingerprint string, labels map[string]string) error {
+		_, err := s.CreateTransaction(ctx, w.ID, &service.TransactionModel{Amount: amount, Description: "d", Fingerprint: fingerprint, Labels: labels})
+		return err
+	}
+	require.NoError(t, tx(100, "f1", map[string]string{"reason": "deposit"}))
+	require.NoError(t, tx(50, "f2", map[string]string{"reason": "deposit"}))
+	require.NoError(t, tx(-30, "f3", map[string]string{"reason": "bet"}))
+	require.NoError(t, tx(5, "f4", nil))
+	require.ErrorIs(t, tx(-500, "f5", nil), service.ErrNotEnoughWalletBalance)
+
+	assert.Equal(t, 2., testutil.ToFloat64(m.transactions.WithLabelValues("deposit", service.OpCredit)))
+	assert.Equal(t, 150., testutil.ToFloat64(m.amounts.WithLabelValues("deposit", service.OpCredit)))
+	assert.Equal(t, 30., testutil.ToFloat64(m.amounts.WithLabelValues("bet", service.OpDebit)))
+	assert.Equal(t, 1., testutil.ToFloat64(m.transactions.WithLabelValues(reasonNone, service.OpCredit)))
+	assert.Equal(t, 1., testutil.ToFloat64(m.rejections))
+
+	// a conflicted transaction is retried with its fingerprint
+	repo.conflicts = 1
+	require.ErrorIs(t, tx(10, "f6", nil), service.ErrTransactionConsistency)
+	assert.Equal(t, 1., testutil.ToFloat64(m.conflicts.WithLabelValues(service.ErrTransactionConsistency.Code)))
+	assert.Zero(t, testutil.ToFloat64(m.retries))
+	require.NoError(t, tx(10, "f6", nil))
+	assert.Equal(t, 1., testutil.ToFloat64(m.retries))
+	require.NoError(t, tx(10, "f7", nil))
+	assert.Equal(t, 1., testutil.ToFloat64(m.retries))
+}
+
+func TestReasons(t *testing.T) {
+	m := New()
+	for i := 0; i < maxReasons; i++ {
+		assert.Equal(t, "r"+strconv.Itoa(i), m.reason(map[string]string{"reason": "r" + strconv.Itoa(i)}))
+	}
+	assert.Equal(t, reasonOther, m.reason(map[string]string{"reason": "new"}))
+	assert.Equal(t, "r0", m.reason(map[string]string{"reason": "r0"}))
+	assert.Equal(t, reasonNone, m.reason(map[string]string{"other": "x"}))
+}
+
+func TestPoolCollector(t *testing.T) {
+	config, err := pgxpool.ParseConfig("postgres://localhost/walletdb?pool_max_conns=7")
+	require.NoError(t, err)
+	config.LazyConnect = true
+	pool, err := pgxpool.ConnectConfig(context.Background(), config)
+	require.NoError(t, err)
+	defer pool.Close()
+
+	c := newPoolCollector(pool.Stat)
+	assert.Equal(t, 9, testutil.CollectAndCount(c))
+	assert.Equal(t, 1, testutil.CollectAndCount(c, "wallet_db_pool_max_connections"))
+
+	// repositories with a pool register its collector
+	m := New()
+	m.Repository(&poolRepository{Repository: memdb.NewRepository(zerolog.Nop()), pool: pool})
+	n, err := testutil.GatherAndCount(m.registry, "wallet_db_pool_max_connections")
+	require.NoError(t, err)
+	assert.Equal(t, 1, n)
+}
+
+type poolRepository struct {
+	service.Repository
+	pool *pgxpool.Pool
+}
+
+func (r *poolRepository) Stat() *pgxpool.Stat {
+	return r.pool.Stat()
+}
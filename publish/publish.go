@@ -0,0 +1,67 @@
+// Package publish has service.EventPublisher implementations.
+package publish
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+var _ service.EventPublisher = (*WriterPublisher)(nil)
+
+// WriterPublisher writes events as json lines; intended for local use.
+type WriterPublisher struct {
+	mu   sync.Mutex
+	w    io.Writer
+	file *os.File
+}
+
+// NewWriterPublisher returns a publisher writing to w.
+func NewWriterPublisher(w io.Writer) *WriterPublisher {
+	return &WriterPublisher{w: w}
+}
+
+// NewStdoutPublisher returns a publisher writing to the standard output.
+func NewStdoutPublisher() *WriterPublisher {
+	return NewWriterPublisher(os.Stdout)
+}
+
+// NewFilePublisher returns a publisher appending to the file at path. Every
+// event is synced to disk before Publish returns.
+func NewFilePublisher(path string) (*WriterPublisher, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &WriterPublisher{w: f, file: f}, nil
+}
+
+func (p *WriterPublisher) Publish(ctx context.Context, e *service.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, err := p.w.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	if p.file != nil {
+		return p.file.Sync()
+	}
+	return nil
+}
+
+// Close closes the file of publishers created by NewFilePublisher.
+func (p *WriterPublisher) Close() error {
+	if p.file != nil {
+		return p.file.Close()
+	}
+	return nil
+}
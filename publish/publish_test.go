@@ -0,0 +1,47 @@
+//go:build !integration
+// +build !integration
+
+package publish
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFilePublisher(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.jsonl")
+	ctx := context.Background()
+
+	// reopening appends
+	for seq := int64(1); seq <= 2; seq++ {
+		p, err := NewFilePublisher(path)
+		require.NoError(t, err)
+		e := &service.Event{Seq: seq, Type: service.EventWalletCreated, WalletID: 7,
+			Payload: json.RawMessage(`{"id":7}`), Created: time.Now().UTC()}
+		require.NoError(t, p.Publish(ctx, e))
+		require.NoError(t, p.Close())
+	}
+
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+
+	seqs := []int64{}
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		e := &service.Event{}
+		require.NoError(t, json.Unmarshal(s.Bytes(), e))
+		assert.JSONEq(t, `{"id":7}`, string(e.Payload))
+		seqs = append(seqs, e.Seq)
+	}
+	assert.Equal(t, []int64{1, 2}, seqs)
+}
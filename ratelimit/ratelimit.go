@@ -0,0 +1,173 @@
+// Package ratelimit limits requests with token buckets: a bucket holds up to
+// Burst tokens and refills at Rate tokens per second; every request takes a
+// token and is rejected when none is left. Buckets are kept by a Store, in
+// process memory or in a database shared by the instances of the api.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Limit of a bucket. A zero Rate disables the limit.
+type Limit struct {
+	Rate  float64 // tokens per second
+	Burst int
+}
+
+// Enabled reports whether the limit rejects requests.
+func (l Limit) Enabled() bool {
+	return l.Rate > 0
+}
+
+// Result of taking a token of a bucket.
+type Result struct {
+	Allowed   bool
+	Limit     int           // burst of the bucket
+	Remaining int           // whole tokens left
+	Reset     time.Duration // until the bucket is full again
+	// RetryAfter is the wait until a token is available, zero if allowed.
+	RetryAfter time.Duration
+}
+
+// Bucket is the state of a bucket kept by stores. A zero Bucket is full.
+type Bucket struct {
+	Tokens  float64
+	Updated time.Time
+}
+
+// Take refills the bucket up to now and takes a token if one is available.
+func (b *Bucket) Take(l Limit, now time.Time) Result {
+	burst := float64(l.Burst)
+	if b.Updated.IsZero() {
+		b.Tokens = burst
+	} else if elapsed := now.Sub(b.Updated); elapsed > 0 {
+		// clocks of instances may differ; a bucket never refills backwards
+		b.Tokens = math.Min(burst, b.Tokens+elapsed.Seconds()*l.Rate)
+	}
+	if b.Updated.Before(now) {
+		b.Updated = now
+	}
+
+	r := Result{Limit: l.Burst}
+	if b.Tokens >= 1 {
+		b.Tokens--
+		r.Allowed = true
+	} else {
+		r.RetryAfter = seconds((1 - b.Tokens) / l.Rate)
+	}
+	r.Remaining = int(b.Tokens)
+	r.Reset = seconds((burst - b.Tokens) / l.Rate)
+	return r
+}
+
+// Full returns the time the bucket is full again.
+func (b *Bucket) Full(l Limit) time.Time {
+	return b.Updated.Add(seconds((float64(l.Burst) - b.Tokens) / l.Rate))
+}
+
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// Store keeps buckets by key.
+type Store interface {
+	// Take takes a token of the bucket of key at now, see Bucket.Take.
+	Take(ctx context.Context, key string, l Limit, now time.Time) (Result, error)
+}
+
+// MemoryStore is a Store of a single process.
+type MemoryStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+	swept   time.Time
+}
+
+type memoryBucket struct {
+	Bucket
+	full time.Time
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: map[string]*memoryBucket{}}
+}
+
+func (s *MemoryStore) Take(ctx context.Context, key string, l Limit, now time.Time) (Result, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{}
+		s.buckets[key] = b
+	}
+	r := b.Take(l, now)
+	b.full = b.Full(l)
+
+	// drop full buckets once a minute; they are the same as missing ones
+	if now.Sub(s.swept) >= time.Minute {
+		for k, b := range s.buckets {
+			if !b.full.After(now) {
+				delete(s.buckets, k)
+			}
+		}
+		s.swept = now
+	}
+	return r, nil
+}
+
+// Limiter limits requests by their client and the transactions of a wallet.
+// IP limits requests by their address before they are authenticated, so
+// failed attempts are limited too.
+type Limiter struct {
+	Store  Store
+	Client Limit
+	Wallet Limit
+	IP     Limit
+	now    func() time.Time
+}
+
+func NewLimiter(store Store, client, wallet Limit) *Limiter {
+	return &Limiter{Store: store, Client: client, Wallet: wallet, now: time.Now}
+}
+
+// Allow takes a token of the client and, if wid is not zero, of the wallet.
+// It returns the result of the most restrictive bucket; a request rejected
+// by the client limit does not take a token of the wallet.
+func (lm *Limiter) Allow(ctx context.Context, client string, wid int) (Result, error) {
+	now := lm.now()
+	r := Result{Allowed: true, Remaining: math.MaxInt32}
+
+	if lm.Client.Enabled() {
+		cr, err := lm.Store.Take(ctx, "client:"+client, lm.Client, now)
+		if err != nil {
+			return Result{}, err
+		}
+		if !cr.Allowed {
+			return cr, nil
+		}
+		r = cr
+	}
+
+	if wid != 0 && lm.Wallet.Enabled() {
+		wr, err := lm.Store.Take(ctx, "wallet:"+strconv.Itoa(wid), lm.Wallet, now)
+		if err != nil {
+			return Result{}, err
+		}
+		if !wr.Allowed || wr.Remaining < r.Remaining {
+			r = wr
+		}
+	}
+	return r, nil
+}
+
+// AllowIP takes a token of the address of a request.
+func (lm *Limiter) AllowIP(ctx context.Context, ip string) (Result, error) {
+	if !lm.IP.Enabled() {
+		return Result{Allowed: true, Remaining: math.MaxInt32}, nil
+	}
+	return lm.Store.Take(ctx, "ip:"+ip, lm.IP, lm.now())
+}
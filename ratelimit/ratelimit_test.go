@@ -0,0 +1,121 @@
+//go:build !integration
+// +build !integration
+
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBucket(t *testing.T) {
+	l := Limit{Rate: 2, Burst: 3}
+	now := time.Now()
+	b := &Bucket{}
+
+	// a new bucket is full
+	for i := 2; i >= 0; i-- {
+		r := b.Take(l, now)
+		assert.True(t, r.Allowed)
+		assert.Equal(t, 3, r.Limit)
+		assert.Equal(t, i, r.Remaining)
+	}
+	assert.Equal(t, 1500*time.Millisecond, b.Take(l, now).Reset)
+
+	r := b.Take(l, now)
+	assert.False(t, r.Allowed)
+	assert.Equal(t, 500*time.Millisecond, r.RetryAfter)
+	assert.Equal(t, now.Add(1500*time.Millisecond), b.Full(l))
+
+	// tokens refill at the rate
+	r = b.Take(l, now.Add(500*time.Millisecond))
+	assert.True(t, r.Allowed)
+	assert.Equal(t, 0, r.Remaining)
+
+	// up to the burst
+	r = b.Take(l, now.Add(time.Hour))
+	assert.True(t, r.Allowed)
+	assert.Equal(t, 2, r.Remaining)
+
+	// time going backwards does not refill
+	b = &Bucket{Tokens: 0, Updated: now}
+	r = b.Take(l, now.Add(-time.Minute))
+	assert.False(t, r.Allowed)
+	assert.Equal(t, now, b.Updated)
+}
+
+func TestMemoryStore(t *testing.T) {
+	ctx := context.Background()
+	s := NewMemoryStore()
+	l := Limit{Rate: 1, Burst: 1}
+	now := time.Now()
+
+	r, err := s.Take(ctx, "a", l, now)
+	require.NoError(t, err)
+	assert.True(t, r.Allowed)
+	r, _ = s.Take(ctx, "a", l, now)
+	assert.False(t, r.Allowed)
+	r, _ = s.Take(ctx, "b", l, now)
+	assert.True(t, r.Allowed)
+
+	// full buckets are swept
+	r, _ = s.Take(ctx, "c", l, now.Add(time.Hour))
+	assert.True(t, r.Allowed)
+	assert.Len(t, s.buckets, 1)
+}
+
+func TestLimiter(t *testing.T) {
+	ctx := context.Background()
+	lm := NewLimiter(NewMemoryStore(), Limit{Rate: 1, Burst: 3}, Limit{Rate: 1, Burst: 2})
+	now := time.Now()
+	lm.now = func() time.Time { return now }
+
+	// the wallet bucket is the most restrictive
+	r, err := lm.Allow(ctx, "apikey:a", 1)
+	require.NoError(t, err)
+	assert.True(t, r.Allowed)
+	assert.Equal(t, 2, r.Limit)
+	assert.Equal(t, 1, r.Remaining)
+
+	r, _ = lm.Allow(ctx, "apikey:a", 1)
+	assert.True(t, r.Allowed)
+	r, _ = lm.Allow(ctx, "apikey:a", 1)
+	assert.False(t, r.Allowed)
+	assert.Equal(t, 2, r.Limit)
+
+	// other wallets and clients have their own buckets
+	r, _ = lm.Allow(ctx, "apikey:b", 1)
+	assert.False(t, r.Allowed)
+	r, _ = lm.Allow(ctx, "apikey:b", 2)
+	assert.True(t, r.Allowed)
+
+	// the client bucket of apikey:a is empty; the wallet keeps its token
+	r, _ = lm.Allow(ctx, "apikey:a", 3)
+	assert.False(t, r.Allowed)
+	assert.Equal(t, 3, r.Limit)
+	r, _ = lm.Allow(ctx, "apikey:c", 3)
+	assert.True(t, r.Allowed)
+	assert.Equal(t, 1, r.Remaining)
+
+	// requests without a wallet take client tokens only
+	lm = NewLimiter(NewMemoryStore(), Limit{}, Limit{Rate: 1, Burst: 1})
+	r, _ = lm.Allow(ctx, "apikey:a", 0)
+	assert.True(t, r.Allowed)
+	assert.Zero(t, r.Limit)
+
+	// addresses have their own buckets, apart from clients
+	r, _ = lm.AllowIP(ctx, "10.0.0.1")
+	assert.True(t, r.Allowed)
+	assert.Zero(t, r.Limit)
+	lm.IP = Limit{Rate: 1, Burst: 1}
+	r, _ = lm.AllowIP(ctx, "10.0.0.1")
+	assert.True(t, r.Allowed)
+	r, _ = lm.AllowIP(ctx, "10.0.0.1")
+	assert.False(t, r.Allowed)
+	r, _ = lm.AllowIP(ctx, "10.0.0.2")
+	assert.True(t, r.Allowed)
+}
@@ -0,0 +1,85 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// Scopes of api clients; ScopeAdmin grants every scope
+const (
+	ScopeWalletsRead       = "wallets:read"
+	ScopeTransactionsWrite = "transactions:write"
+	ScopeAdmin             = "admin"
+)
+
+// Scopes lists the valid scopes
+var Scopes = []string{ScopeWalletsRead, ScopeTransactionsWrite, ScopeAdmin}
+
+// apiKeyPrefix starts every api key, so that leaked keys are easy to find
+const apiKeyPrefix = "bwk_"
+
+// ValidateScopes returns an error if a scope is not one of Scopes.
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required, valid values are: %v", Scopes)
+	}
+	for _, s := range scopes {
+		valid := false
+		for _, v := range Scopes {
+			valid = valid || s == v
+		}
+		if !valid {
+			return fmt.Errorf("scope %q is incorrect, valid values are: %v", s, Scopes)
+		}
+	}
+	return nil
+}
+
+// GenerateAPIKey returns a new random key and its APIKey to store. The key
+// is shown once; only its hash is stored.
+func GenerateAPIKey(name string, scopes []string) (string, *APIKey, error) {
+	if name == "" || len(name) > 50 {
+		return "", nil, fmt.Errorf("name is required and should be at most 50 characters")
+	}
+	if err := ValidateScopes(scopes); err != nil {
+		return "", nil, err
+	}
+
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", nil, err
+	}
+	key := apiKeyPrefix + hex.EncodeToString(b)
+
+	return key, &APIKey{
+		Name:    name,
+		Prefix:  key[:len(apiKeyPrefix)+8],
+		Hash:    HashAPIKey(key),
+		Scopes:  scopes,
+		Created: time.Now().UTC().Truncate(time.Millisecond),
+	}, nil
+}
+
+// HashAPIKey returns the stored hash of key. Keys are random, so a fast hash
+// is enough.
+func HashAPIKey(key string) string {
+	h := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(h[:])
+}
+
+// AuthenticateAPIKey returns the principal of key, or ErrAPIKeyNotFound if
+// the key is unknown or revoked.
+func AuthenticateAPIKey(ctx context.Context, r Repository, key string) (*Principal, error) {
+	k, err := r.GetAPIKeyByHash(ctx, HashAPIKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if k.Revoked != nil {
+		return nil, ErrAPIKeyNotFound
+	}
+	return &Principal{Client: "apikey:" + k.Name, Scopes: k.Scopes}, nil
+}
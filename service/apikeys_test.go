@@ -0,0 +1,57 @@
+//go:build !integration
+// +build !integration
+
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerateAPIKey(t *testing.T) {
+	key, k, err := GenerateAPIKey("billing", []string{ScopeWalletsRead})
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(key, apiKeyPrefix))
+	assert.True(t, strings.HasPrefix(key, k.Prefix))
+	assert.Equal(t, HashAPIKey(key), k.Hash)
+	assert.NotContains(t, k.Hash, key)
+
+	_, _, err = GenerateAPIKey("billing", []string{"wallets:write"})
+	assert.Error(t, err)
+	_, _, err = GenerateAPIKey("billing", nil)
+	assert.Error(t, err)
+	_, _, err = GenerateAPIKey("", []string{ScopeAdmin})
+	assert.Error(t, err)
+}
+
+func TestPrincipalHasScope(t *testing.T) {
+	p := &Principal{Scopes: []string{ScopeWalletsRead}}
+	assert.True(t, p.HasScope(ScopeWalletsRead))
+	assert.False(t, p.HasScope(ScopeTransactionsWrite))
+
+	admin := &Principal{Scopes: []string{ScopeAdmin}}
+	assert.True(t, admin.HasScope(ScopeTransactionsWrite))
+}
+
+func TestAuthenticateAPIKey(t *testing.T) {
+	key := "bwk_0123"
+	revoked := time.Now()
+
+	var mok = &mockRepository{}
+	mok.On("GetAPIKeyByHash", mock.Anything, HashAPIKey(key)).Return(&APIKey{Name: "billing", Scopes: []string{ScopeAdmin}}, nil).Once()
+	mok.On("GetAPIKeyByHash", mock.Anything, HashAPIKey(key)).Return(&APIKey{Name: "billing", Revoked: &revoked}, nil).Once()
+
+	p, err := AuthenticateAPIKey(context.Background(), mok, key)
+	require.NoError(t, err)
+	assert.Equal(t, "apikey:billing", p.Client)
+	assert.Equal(t, "apikey:billing", clientFrom(WithPrincipal(context.Background(), p)))
+
+	_, err = AuthenticateAPIKey(context.Background(), mok, key)
+	assert.ErrorIs(t, err, ErrAPIKeyNotFound)
+}
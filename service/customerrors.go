@@ -4,18 +4,31 @@ type DbError struct {
 	Err error
 }
 
+// ServiceError is an expected failure of the service. Code identifies it
+// for machines and never changes; Msg may be reworded.
 type ServiceError struct {
-	Msg string
+	Code string
+	Msg  string
 }
 
 var (
-	ErrWalletNotFound                        = &ServiceError{Msg: "wallet not found"}
-	ErrWalletAlreadyExists                   = &ServiceError{Msg: "wallet already exists"}
-	ErrTransactionConsistency                = &ServiceError{Msg: "transaction failed due to consistency but retriable"}
-	ErrTransactionAlreadyExistsByRefNo       = &ServiceError{Msg: "a transaction already exists with same refno"}
-	ErrTransactionAlreadyExistsByFingerprint = &ServiceError{Msg: "a transaction already exists with same fingerprint"}
-	ErrTransactionNotFound                   = &ServiceError{Msg: "transaction not found"}
-	ErrNotEnoughWalletBalance                = &ServiceError{Msg: "wallet balance is not enough"}
+	ErrWalletNotFound                        = &ServiceError{Code: "wallet_not_found", Msg: "wallet not found"}
+	ErrWalletAlreadyExists                   = &ServiceError{Code: "wallet_already_exists", Msg: "wallet already exists"}
+	ErrTransactionConsistency                = &ServiceError{Code: "transaction_conflict", Msg: "transaction failed due to consistency but retriable"}
+	ErrTransactionAlreadyExistsByRefNo       = &ServiceError{Code: "transaction_refno_exists", Msg: "a transaction already exists with same refno"}
+	ErrTransactionAlreadyExistsByFingerprint = &ServiceError{Code: "transaction_fingerprint_exists", Msg: "a transaction already exists with same fingerprint"}
+	ErrTransactionNotFound                   = &ServiceError{Code: "transaction_not_found", Msg: "transaction not found"}
+	ErrNotEnoughWalletBalance                = &ServiceError{Code: "insufficient_balance", Msg: "wallet balance is not enough"}
+	ErrInvalidAmount                         = &ServiceError{Code: "invalid_amount", Msg: "amount should not be between -1.0 and 1.0, and have at most two decimals"}
+	ErrSnapshotNotFound                      = &ServiceError{Code: "snapshot_not_found", Msg: "snapshot not found"}
+	ErrSubscriptionNotFound                  = &ServiceError{Code: "subscription_not_found", Msg: "subscription not found"}
+	ErrDeliveryNotFound                      = &ServiceError{Code: "delivery_not_found", Msg: "delivery not found"}
+	ErrAPIKeyNotFound                        = &ServiceError{Code: "api_key_not_found", Msg: "api key not found"}
+	ErrAPIKeyAlreadyExists                   = &ServiceError{Code: "api_key_already_exists", Msg: "an api key already exists with same name"}
+	ErrPolicyDenied                          = &ServiceError{Code: "policy_denied", Msg: "operation is not allowed by policy"}
+	ErrUnbalancedJournal                     = &ServiceError{Code: "unbalanced_journal", Msg: "journal lines of transaction do not sum to zero"}
+	ErrStatementRangeTooLong                 = &ServiceError{Code: "statement_range_too_long", Msg: "statement should cover at most 366 days"}
+	ErrStatementTooLarge                     = &ServiceError{Code: "statement_too_large", Msg: "statement has more than 10000 transactions, request fewer days"}
 )
 
 func (e *ServiceError) Error() string {
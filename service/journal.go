@@ -0,0 +1,97 @@
+package service
+
+// Accounts of the general ledger. Every wallet movement is posted between the
+// wallets liability account and a counter account chosen by its reason label.
+const (
+	AccountWallets    = "wallets"
+	AccountCashIn     = "cash_in"
+	AccountBetRevenue = "bet_revenue"
+	AccountPayouts    = "payouts"
+	AccountBonusCost  = "bonus_cost"
+	AccountSuspense   = "suspense"
+)
+
+// ReasonLabel is the transaction label which selects the counter account
+const ReasonLabel = "reason"
+
+type (
+	Account struct {
+		Code string `json:"code"`
+		Name string `json:"name"`
+		Type string `json:"type"`
+	}
+
+	// JournalLine is one side of a posting; debits are positive, credits are
+	// negative amounts and the lines of a posting sum to zero.
+	JournalLine struct {
+		TransactionID string  `json:"transactionid"`
+		WalletID      int     `json:"wid"`
+		Account       string  `json:"account"`
+		Amount        float64 `json:"amount"`
+	}
+
+	AccountBalance struct {
+		Account
+		Debit  float64 `json:"debit"`
+		Credit float64 `json:"credit"`
+	}
+)
+
+// Accounts is the chart of accounts every storage is seeded with
+var Accounts = []Account{
+	{Code: AccountWallets, Name: "Customer wallets", Type: "liability"},
+	{Code: AccountCashIn, Name: "Cash in", Type: "asset"},
+	{Code: AccountBetRevenue, Name: "Bet revenue", Type: "revenue"},
+	{Code: AccountPayouts, Name: "Payouts", Type: "expense"},
+	{Code: AccountBonusCost, Name: "Bonus cost", Type: "expense"},
+	{Code: AccountSuspense, Name: "Suspense", Type: "asset"},
+}
+
+var reasonAccounts = map[string]string{
+	"deposit":  AccountCashIn,
+	"withdraw": AccountCashIn,
+	"stake":    AccountBetRevenue,
+	"prize":    AccountPayouts,
+	"bonus":    AccountBonusCost,
+}
+
+// CounterAccount returns the account a transaction is posted against. Unknown
+// reasons go to the suspense account to be reclassified by finance.
+func CounterAccount(labels map[string]string) string {
+	if a, ok := reasonAccounts[labels[ReasonLabel]]; ok {
+		return a
+	}
+	return AccountSuspense
+}
+
+// JournalLines returns the balanced posting of t: the wallets account is
+// credited by the amount (the operator owes more to the customer) and the
+// counter account is debited.
+func JournalLines(wid int, t *Transaction) []*JournalLine {
+	return []*JournalLine{
+		{TransactionID: t.ID, WalletID: wid, Account: AccountWallets, Amount: -t.Amount},
+		{TransactionID: t.ID, WalletID: wid, Account: CounterAccount(t.Labels), Amount: t.Amount},
+	}
+}
+
+// ValidateJournal returns ErrUnbalancedJournal unless lines sum to zero.
+func ValidateJournal(lines []*JournalLine) error {
+	if len(lines) < 2 {
+		return ErrUnbalancedJournal
+	}
+
+	var sum int64
+	for _, l := range lines {
+		sum += cents(l.Amount)
+	}
+	if sum != 0 {
+		return ErrUnbalancedJournal
+	}
+
+	return nil
+}
+
+// Balance is debit minus credit
+func (b *AccountBalance) Balance() float64 {
+	return fromCents(cents(b.Debit) - cents(b.Credit))
+}
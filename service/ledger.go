@@ -0,0 +1,176 @@
+package service
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// listPageSize is the page size used while walking wallets and transactions
+const listPageSize = 500
+
+// maxDecimals is the scale of amounts and balances in storage
+const maxDecimals = 2
+
+// hashContent is the canonical content of a transaction; field order and
+// formatting must never change, or every stored hash becomes invalid. Client
+// is omitted if empty, so hashes of transactions without one are unchanged.
+type hashContent struct {
+	WalletID    int               `json:"wid"`
+	RefNo       int               `json:"refno"`
+	ID          string            `json:"id"`
+	Amount      string            `json:"amount"`
+	Description string            `json:"description"`
+	Labels      map[string]string `json:"labels"`
+	Fingerprint string            `json:"fingerprint"`
+	Created     string            `json:"created"`
+	OldBalance  string            `json:"oldbalance"`
+	NewBalance  string            `json:"newbalance"`
+	PrevHash    string            `json:"prevhash"`
+	Client      string            `json:"client,omitempty"`
+}
+
+// ComputeHash returns the sha256 hash of the canonical content of t, which
+// includes the hash of the previous transaction of the wallet (t.PrevHash).
+func ComputeHash(wid int, t *Transaction) string {
+	c := hashContent{
+		WalletID:    wid,
+		RefNo:       t.RefNo,
+		ID:          t.ID,
+		Amount:      fmt.Sprintf("%.2f", t.Amount),
+		Description: t.Description,
+		Fingerprint: t.Fingerprint,
+		Created:     t.Created.UTC().Format(time.RFC3339Nano),
+		OldBalance:  fmt.Sprintf("%.2f", t.OldBalance),
+		NewBalance:  fmt.Sprintf("%.2f", t.NewBalance),
+		PrevHash:    t.PrevHash,
+		Client:      t.Client,
+	}
+	if len(t.Labels) > 0 {
+		c.Labels = t.Labels
+	}
+
+	// json encodes map keys sorted, which keeps labels canonical
+	data, _ := json.Marshal(c)
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// validDecimals reports whether f has at most maxDecimals decimals as it is
+// sent to storage. Storage rounds further decimals half up, while hashes
+// format amounts rounding the binary float (2.675 is stored as 2.68 but
+// hashed as 2.67), so such amounts are rejected rather than rounded.
+func validDecimals(f float64) bool {
+	s := strconv.FormatFloat(f, 'f', -1, 64)
+	i := strings.IndexByte(s, '.')
+	return i < 0 || len(s)-i-1 <= maxDecimals
+}
+
+// StampCreated sets the creation time of t to now, or to the creation time of
+// the previous transaction of the wallet if the clock is behind it, so that
+// creation times follow refno order. It is called once the refno of t is
+// decided, before ChainTransaction, as the time is hashed.
+func StampCreated(t *Transaction, prev *Transaction) {
+	t.Created = time.Now().UTC().Truncate(time.Millisecond)
+	if prev != nil && prev.Created.After(t.Created) {
+		t.Created = prev.Created
+	}
+}
+
+// ChainTransaction links t to the previous transaction of the wallet (nil for
+// the first one) and sets its hash.
+func ChainTransaction(wid int, t *Transaction, prev *Transaction) {
+	t.PrevHash = ""
+	if prev != nil {
+		t.PrevHash = prev.Hash
+	}
+	t.Hash = ComputeHash(wid, t)
+}
+
+// BrokenLink is the first transaction of a wallet which breaks its chain.
+type BrokenLink struct {
+	WalletID int
+	RefNo    int
+	Reason   string
+}
+
+func (b *BrokenLink) String() string {
+	return fmt.Sprintf("wallet %d: broken link at refno %d: %s", b.WalletID, b.RefNo, b.Reason)
+}
+
+// VerifyWalletChain walks the transactions of the wallet in refno order and
+// returns the first broken link, or nil if the chain is intact.
+func VerifyWalletChain(ctx context.Context, r Repository, wid int) (*BrokenLink, error) {
+	var prev *Transaction
+	for {
+		after := 0
+		if prev != nil {
+			after = prev.RefNo
+		}
+
+		trs, err := r.ListTransactions(ctx, wid, after, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range trs {
+			broken := func(reason string) *BrokenLink {
+				return &BrokenLink{WalletID: wid, RefNo: t.RefNo, Reason: reason}
+			}
+
+			expectedRefNo, prevHash := 1, ""
+			if prev != nil {
+				expectedRefNo, prevHash = prev.RefNo+1, prev.Hash
+			}
+
+			if t.RefNo != expectedRefNo {
+				return broken(fmt.Sprintf("refno %d is missing", expectedRefNo)), nil
+			}
+			if t.PrevHash != prevHash {
+				return broken("prevhash does not match hash of previous transaction"), nil
+			}
+			if t.Hash != ComputeHash(wid, t) {
+				return broken("hash does not match content"), nil
+			}
+
+			prev = t
+		}
+
+		if len(trs) < listPageSize {
+			return nil, nil
+		}
+	}
+}
+
+// VerifyLedger verifies the chain of every wallet and calls report for each
+// broken one. It returns the number of verified wallets.
+func VerifyLedger(ctx context.Context, r Repository, report func(*BrokenLink)) (int, error) {
+	n, after := 0, 0
+	for {
+		ws, err := r.ListWallets(ctx, after, listPageSize)
+		if err != nil {
+			return n, err
+		}
+
+		for _, w := range ws {
+			b, err := VerifyWalletChain(ctx, r, w.ID)
+			if err != nil {
+				return n, err
+			}
+			if b != nil {
+				report(b)
+			}
+			n++
+			after = w.ID
+		}
+
+		if len(ws) < listPageSize {
+			return n, nil
+		}
+	}
+}
@@ -0,0 +1,134 @@
+//go:build !integration
+// +build !integration
+
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newChain(wid int, n int) []*Transaction {
+	var trs []*Transaction
+	var prev *Transaction
+	for i := 1; i <= n; i++ {
+		t := &Transaction{ID: "id", RefNo: i, Amount: 10, OldBalance: float64(10 * (i - 1)),
+			NewBalance: float64(10 * i), Labels: map[string]string{"i": "x"}, Created: time.Now().UTC()}
+		ChainTransaction(wid, t, prev)
+		trs = append(trs, t)
+		prev = t
+	}
+	return trs
+}
+
+func TestComputeHash(t *testing.T) {
+	tr := &Transaction{ID: "id", RefNo: 1, Amount: 10, Created: time.Now()}
+	h := ComputeHash(1, tr)
+	assert.Len(t, h, 64)
+	assert.Equal(t, h, ComputeHash(1, tr))
+
+	// nil and empty labels are the same content, balances are compared in cents
+	tr.Labels = map[string]string{}
+	tr.NewBalance = 10.000000001
+	other := *tr
+	other.NewBalance = 10
+	assert.Equal(t, ComputeHash(1, tr), ComputeHash(1, &other))
+
+	assert.NotEqual(t, h, ComputeHash(2, tr))
+	tr.Description = "changed"
+	assert.NotEqual(t, h, ComputeHash(1, tr))
+
+	// the client is hashed, so it cannot be changed either
+	other = *tr
+	other.Client = "apikey:billing"
+	assert.NotEqual(t, ComputeHash(1, tr), ComputeHash(1, &other))
+}
+
+func TestValidDecimals(t *testing.T) {
+	for _, f := range []float64{10, -5, 2.67, 2.6, -1.01} {
+		assert.True(t, validDecimals(f), "%v", f)
+	}
+	// stored rounded half up, but hashed as rounded binary floats
+	for _, f := range []float64{2.675, 1.005, -3.001} {
+		assert.False(t, validDecimals(f), "%v", f)
+	}
+}
+
+func TestVerifyWalletChain(t *testing.T) {
+	t.Run("Intact", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("ListTransactions", mock.Anything, 1, 0, listPageSize).Return(newChain(1, 3), nil)
+		b, err := VerifyWalletChain(context.Background(), mok, 1)
+		assert.NoError(t, err)
+		assert.Nil(t, b)
+	})
+
+	t.Run("ContentChanged", func(t *testing.T) {
+		trs := newChain(1, 3)
+		trs[1].Amount = 11
+		var mok = &mockRepository{}
+		mok.On("ListTransactions", mock.Anything, 1, 0, listPageSize).Return(trs, nil)
+		b, err := VerifyWalletChain(context.Background(), mok, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, &BrokenLink{WalletID: 1, RefNo: 2, Reason: "hash does not match content"}, b)
+	})
+
+	t.Run("PrevHashChanged", func(t *testing.T) {
+		trs := newChain(1, 3)
+		trs[2].PrevHash = trs[0].Hash
+		var mok = &mockRepository{}
+		mok.On("ListTransactions", mock.Anything, 1, 0, listPageSize).Return(trs, nil)
+		b, err := VerifyWalletChain(context.Background(), mok, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, b.RefNo)
+	})
+
+	t.Run("RefNoMissing", func(t *testing.T) {
+		trs := newChain(1, 3)
+		var mok = &mockRepository{}
+		mok.On("ListTransactions", mock.Anything, 1, 0, listPageSize).Return([]*Transaction{trs[0], trs[2]}, nil)
+		b, err := VerifyWalletChain(context.Background(), mok, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, &BrokenLink{WalletID: 1, RefNo: 3, Reason: "refno 2 is missing"}, b)
+	})
+}
+
+func TestVerifyLedger(t *testing.T) {
+	broken := newChain(2, 2)
+	broken[0].Description = "changed"
+
+	var mok = &mockRepository{}
+	mok.On("ListWallets", mock.Anything, 0, listPageSize).Return([]*Wallet{{ID: 1}, {ID: 2}}, nil)
+	mok.On("ListTransactions", mock.Anything, 1, 0, listPageSize).Return(newChain(1, 2), nil)
+	mok.On("ListTransactions", mock.Anything, 2, 0, listPageSize).Return(broken, nil)
+
+	var reported []*BrokenLink
+	n, err := VerifyLedger(context.Background(), mok, func(b *BrokenLink) { reported = append(reported, b) })
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []*BrokenLink{{WalletID: 2, RefNo: 1, Reason: "hash does not match content"}}, reported)
+}
+
+func TestJournalLines(t *testing.T) {
+	tr := &Transaction{ID: "id", Amount: -30, Labels: map[string]string{ReasonLabel: "stake"}}
+	lines := JournalLines(7, tr)
+	assert.Equal(t, []*JournalLine{
+		{TransactionID: "id", WalletID: 7, Account: AccountWallets, Amount: 30},
+		{TransactionID: "id", WalletID: 7, Account: AccountBetRevenue, Amount: -30},
+	}, lines)
+	assert.NoError(t, ValidateJournal(lines))
+
+	assert.Equal(t, AccountSuspense, CounterAccount(nil))
+	assert.Equal(t, AccountCashIn, CounterAccount(map[string]string{ReasonLabel: "withdraw"}))
+}
+
+func TestValidateJournal(t *testing.T) {
+	assert.NoError(t, ValidateJournal([]*JournalLine{{Amount: 0.1}, {Amount: 0.2}, {Amount: -0.3}}))
+	assert.ErrorIs(t, ValidateJournal([]*JournalLine{{Amount: 10}, {Amount: -9.99}}), ErrUnbalancedJournal)
+	assert.ErrorIs(t, ValidateJournal([]*JournalLine{{Amount: 0}}), ErrUnbalancedJournal)
+	assert.ErrorIs(t, ValidateJournal(nil), ErrUnbalancedJournal)
+}
@@ -0,0 +1,44 @@
+package service
+
+import (
+	"context"
+
+	"github.com/google/uuid"
+	"github.com/rs/zerolog"
+)
+
+// maxRequestIDLength bounds the request ids accepted from callers
+const maxRequestIDLength = 128
+
+// Logger returns the logger of ctx, which carries the fields of the request
+// being served (request id, client, wallet), or l if ctx has none. Service
+// and repositories log through it, so the lines of a request can be traced.
+func Logger(ctx context.Context, l *zerolog.Logger) *zerolog.Logger {
+	if cl := zerolog.Ctx(ctx); cl.GetLevel() != zerolog.Disabled {
+		return cl
+	}
+	return l
+}
+
+// WithLogger returns a context carrying l; see Logger.
+func WithLogger(ctx context.Context, l zerolog.Logger) context.Context {
+	return l.WithContext(ctx)
+}
+
+// RequestID returns id, the request id sent by a caller, if it may be logged
+// and echoed back, or a new one. Ids of callers are up to maxRequestIDLength
+// letters, digits and -_.: characters.
+func RequestID(id string) string {
+	if id == "" || len(id) > maxRequestIDLength {
+		return uuid.NewString()
+	}
+	for _, r := range id {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '-', r == '_', r == '.', r == ':':
+		default:
+			return uuid.NewString()
+		}
+	}
+	return id
+}
@@ -0,0 +1,35 @@
+//go:build !integration
+// +build !integration
+
+package service
+
+import (
+	"bytes"
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLogger(t *testing.T) {
+	fallback := zerolog.Nop()
+	ctx := context.Background()
+	assert.Same(t, &fallback, Logger(ctx, &fallback))
+
+	buf := &bytes.Buffer{}
+	ctx = WithLogger(ctx, zerolog.New(buf).With().Str("requestId", "r1").Logger())
+	ctx = WithPrincipal(ctx, &Principal{Client: "apikey:a"})
+	Logger(ctx, &fallback).Info().Msg("m")
+	assert.JSONEq(t, `{"level": "info", "requestId": "r1", "client": "apikey:a", "message": "m"}`, buf.String())
+}
+
+func TestRequestID(t *testing.T) {
+	assert.Equal(t, "req-1_a.b:c", RequestID("req-1_a.b:c"))
+	for _, id := range []string{"", "a b", "a\nb", "ä", strings.Repeat("a", 129)} {
+		got := RequestID(id)
+		assert.NotEqual(t, id, got)
+		assert.Len(t, got, 36)
+	}
+}
@@ -0,0 +1,126 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Domain event types
+const (
+	EventWalletCreated      = "WalletCreated"
+	EventTransactionCreated = "TransactionCreated"
+	EventBalanceChanged     = "BalanceChanged"
+
+	// EventTransactionVoid is reserved; transactions can not be voided yet.
+	EventTransactionVoid = "TransactionVoid"
+)
+
+// Consumers of the outbox. Each consumer publishes every event once,
+// independently of the others.
+const (
+	ConsumerRelay    = "relay"
+	ConsumerWebhooks = "webhooks"
+)
+
+// EventPublisher delivers outbox events to the outside world. Publish returns
+// once the event is durably handed over; the relay retries failed events, so
+// consumers may see an event more than once and should dedupe by Seq.
+type EventPublisher interface {
+	Publish(ctx context.Context, e *Event) error
+}
+
+func newEvent(typ string, wid int, payload interface{}) *Event {
+	// payloads are plain structs, marshaling can not fail
+	b, _ := json.Marshal(payload)
+	return &Event{Type: typ, WalletID: wid, Payload: b, Created: time.Now().UTC().Truncate(time.Millisecond)}
+}
+
+// WalletEvents are the outbox events of a created wallet.
+func WalletEvents(w *Wallet) []*Event {
+	return []*Event{newEvent(EventWalletCreated, w.ID, w)}
+}
+
+// TransactionEvents are the outbox events of a stored transaction.
+func TransactionEvents(wid int, t *Transaction) []*Event {
+	return []*Event{
+		newEvent(EventTransactionCreated, wid, t),
+		newEvent(EventBalanceChanged, wid, &BalanceChange{WalletID: wid, RefNo: t.RefNo, OldBalance: t.OldBalance, NewBalance: t.NewBalance}),
+	}
+}
+
+// RepairEvents are the outbox events of a repaired balance.
+func RepairEvents(wid int, refno int, from, to float64) []*Event {
+	return []*Event{newEvent(EventBalanceChanged, wid, &BalanceChange{WalletID: wid, RefNo: refno, OldBalance: from, NewBalance: to})}
+}
+
+// RelayEvents publishes up to limit events pending for the consumer in Seq
+// order and marks the published ones. It stops at the first failure so that
+// the events of a wallet are never published out of order.
+func RelayEvents(ctx context.Context, r Repository, consumer string, p EventPublisher, limit int) (int, error) {
+	es, err := r.ListPendingEvents(ctx, consumer, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	seqs := make([]int64, 0, len(es))
+	var perr error
+	for _, e := range es {
+		if perr = p.Publish(ctx, e); perr != nil {
+			break
+		}
+		seqs = append(seqs, e.Seq)
+	}
+
+	if len(seqs) > 0 {
+		if err := r.MarkEventsPublished(ctx, consumer, seqs); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(seqs), perr
+}
+
+// RunRelay relays events pending for the consumer until ctx is done; it
+// waits for interval whenever the outbox is drained or publishing fails.
+func RunRelay(ctx context.Context, r Repository, consumer string, p EventPublisher, interval time.Duration, batch int, l zerolog.Logger) {
+	for {
+		n, err := RelayEvents(ctx, r, consumer, p, batch)
+		if err != nil {
+			l.Error().Err(err).Int("published", n).Msg("relay failed")
+		} else if n > 0 {
+			l.Debug().Int("published", n).Msg("events relayed")
+		}
+
+		if err == nil && n == batch {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
+
+// RunPrune deletes the events published by every consumer once they are older
+// than retention, every interval until ctx is done.
+func RunPrune(ctx context.Context, r Repository, retention, interval time.Duration, l zerolog.Logger) {
+	for {
+		n, err := r.PruneEvents(ctx, time.Now().UTC().Add(-retention))
+		if err != nil {
+			l.Error().Err(err).Msg("prune outbox failed")
+		} else if n > 0 {
+			l.Debug().Int("pruned", n).Msg("outbox pruned")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
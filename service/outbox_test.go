@@ -0,0 +1,76 @@
+//go:build !integration
+// +build !integration
+
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+type fakePublisher struct {
+	published []int64
+	failAt    int64
+}
+
+func (p *fakePublisher) Publish(ctx context.Context, e *Event) error {
+	if e.Seq == p.failAt {
+		return errors.New("broker is down")
+	}
+	p.published = append(p.published, e.Seq)
+	return nil
+}
+
+func TestRelayEvents(t *testing.T) {
+	es := []*Event{{Seq: 3, WalletID: 1}, {Seq: 4, WalletID: 2}, {Seq: 7, WalletID: 1}}
+
+	t.Run("PublishesAll", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("ListPendingEvents", mock.Anything, ConsumerRelay, 10).Return(es, nil)
+		mok.On("MarkEventsPublished", mock.Anything, ConsumerRelay, []int64{3, 4, 7}).Return(nil)
+		p := &fakePublisher{}
+
+		n, err := RelayEvents(context.Background(), mok, ConsumerRelay, p, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+		assert.Equal(t, []int64{3, 4, 7}, p.published)
+		mok.AssertExpectations(t)
+	})
+
+	t.Run("StopsAtFailure", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("ListPendingEvents", mock.Anything, ConsumerRelay, 10).Return(es, nil)
+		mok.On("MarkEventsPublished", mock.Anything, ConsumerRelay, []int64{3}).Return(nil)
+		p := &fakePublisher{failAt: 4}
+
+		n, err := RelayEvents(context.Background(), mok, ConsumerRelay, p, 10)
+		assert.Error(t, err)
+		assert.Equal(t, 1, n)
+		assert.Equal(t, []int64{3}, p.published)
+		mok.AssertExpectations(t)
+	})
+
+	t.Run("NothingPending", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("ListPendingEvents", mock.Anything, ConsumerRelay, 10).Return([]*Event{}, nil)
+
+		n, err := RelayEvents(context.Background(), mok, ConsumerRelay, &fakePublisher{}, 10)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+		mok.AssertNotCalled(t, "MarkEventsPublished", mock.Anything, mock.Anything, mock.Anything)
+	})
+}
+
+func TestTransactionEvents(t *testing.T) {
+	es := TransactionEvents(5, &Transaction{RefNo: 2, Amount: 3, OldBalance: 1, NewBalance: 4, Journal: JournalLines(5, &Transaction{ID: "t", Amount: 3})})
+	if assert.Len(t, es, 2) {
+		assert.Equal(t, EventTransactionCreated, es[0].Type)
+		assert.NotContains(t, string(es[0].Payload), "journal")
+		assert.Equal(t, EventBalanceChanged, es[1].Type)
+		assert.JSONEq(t, `{"wid":5,"refno":2,"oldbalance":1,"newbalance":4}`, string(es[1].Payload))
+	}
+}
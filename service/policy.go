@@ -0,0 +1,218 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"time"
+)
+
+// Operations authorized by policies
+const (
+	OpCreateWallet = "wallet.create"
+	OpCredit       = "credit" // transaction with a positive amount
+	OpDebit        = "debit"  // transaction with a negative amount
+)
+
+// Effects of policy rules
+const (
+	EffectAllow = "allow"
+	EffectDeny  = "deny"
+)
+
+// anonymousClient is the client of callers without a principal
+const anonymousClient = "anonymous"
+
+// Policy authorizes operations of callers. The first rule matching the
+// caller, the operation and the labels decides; Default decides when none
+// matches. A policy file is json:
+//
+//	{
+//	  "default": "deny",
+//	  "rules": [
+//	    {"name": "payments-withdraw", "clients": ["apikey:payments"], "operations": ["debit"], "labels": {"reason": ["withdraw"]}},
+//	    {"name": "betting-stake", "clients": ["apikey:betting"], "operations": ["debit"], "labels": {"reason": ["stake"]}},
+//	    {"name": "betting-prize", "clients": ["apikey:betting"], "operations": ["credit"], "labels": {"reason": ["prize"]}},
+//	    {"name": "admins", "clients": ["jwt:*"]}
+//	  ]
+//	}
+type Policy struct {
+	// Default is the effect when no rule matches, EffectDeny if empty
+	Default string        `json:"default"`
+	Rules   []*PolicyRule `json:"rules"`
+}
+
+// PolicyRule matches operations; empty fields match everything.
+type PolicyRule struct {
+	Name string `json:"name"`
+	// Effect is EffectAllow if empty
+	Effect string `json:"effect"`
+	// Clients are patterns of Principal.Client, e.g. apikey:betting or jwt:*
+	// (see path.Match); callers without a principal are "anonymous"
+	Clients    []string `json:"clients"`
+	Operations []string `json:"operations"`
+	// Labels maps label names to allowed values; every label must be set to
+	// one of its values
+	Labels map[string][]string `json:"labels"`
+}
+
+// PolicyDenial is an audit record of an operation denied by the policy.
+type PolicyDenial struct {
+	ID        int64             `json:"id"`
+	Client    string            `json:"client"`
+	Operation string            `json:"operation"`
+	WalletID  int               `json:"wid"`
+	Amount    float64           `json:"amount"`
+	Labels    map[string]string `json:"labels"`
+	Rule      string            `json:"rule"` // name of the denying rule, empty for the default
+	Created   time.Time         `json:"created"`
+}
+
+// LoadPolicy reads and validates the policy file at path. Unknown fields are
+// rejected, so that a misspelled field does not silently widen a rule.
+func LoadPolicy(path string) (*Policy, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	d := json.NewDecoder(bytes.NewReader(b))
+	d.DisallowUnknownFields()
+	p := &Policy{}
+	if err := d.Decode(p); err != nil {
+		return nil, fmt.Errorf("parse policy %s: %w", path, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("policy %s: %w", path, err)
+	}
+	return p, nil
+}
+
+// Validate returns an error for unknown effects and operations, and for
+// malformed client patterns.
+func (p *Policy) Validate() error {
+	if p.Default != "" && p.Default != EffectAllow && p.Default != EffectDeny {
+		return fmt.Errorf("default is incorrect, valid values are: %s, %s. default:%s", EffectAllow, EffectDeny, p.Default)
+	}
+
+	for i, r := range p.Rules {
+		if r.Effect != "" && r.Effect != EffectAllow && r.Effect != EffectDeny {
+			return fmt.Errorf("rule %d: effect is incorrect, valid values are: %s, %s. effect:%s", i, EffectAllow, EffectDeny, r.Effect)
+		}
+		for _, op := range r.Operations {
+			if op != OpCreateWallet && op != OpCredit && op != OpDebit {
+				return fmt.Errorf("rule %d: operation is incorrect, valid values are: %s, %s, %s. operation:%s",
+					i, OpCreateWallet, OpCredit, OpDebit, op)
+			}
+		}
+		for _, c := range r.Clients {
+			if _, err := path.Match(c, ""); err != nil {
+				return fmt.Errorf("rule %d: client pattern %q is incorrect: %w", i, c, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Evaluate reports whether the client may run the operation with the labels,
+// and the name of the deciding rule (empty for the default).
+func (p *Policy) Evaluate(client, op string, labels map[string]string) (bool, string) {
+	if client == "" {
+		client = anonymousClient
+	}
+
+	for _, r := range p.Rules {
+		if r.matches(client, op, labels) {
+			return r.Effect != EffectDeny, r.Name
+		}
+	}
+	return p.Default == EffectAllow, ""
+}
+
+func (r *PolicyRule) matches(client, op string, labels map[string]string) bool {
+	if len(r.Clients) > 0 {
+		matched := false
+		for _, c := range r.Clients {
+			if ok, _ := path.Match(c, client); ok {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	if len(r.Operations) > 0 {
+		matched := false
+		for _, o := range r.Operations {
+			matched = matched || o == op
+		}
+		if !matched {
+			return false
+		}
+	}
+
+	for name, values := range r.Labels {
+		v, ok := labels[name]
+		if !ok {
+			return false
+		}
+		matched := false
+		for _, allowed := range values {
+			matched = matched || v == allowed
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// WithPolicy makes the wallet service authorize wallet creations and
+// transactions by p. Denials return ErrPolicyDenied and are audited by
+// Repository.CreatePolicyDenial.
+func WithPolicy(p *Policy) Option {
+	return func(s *walletService) { s.policy = p }
+}
+
+// authorizeOperation returns ErrPolicyDenied if the policy denies the
+// operation of the caller.
+func (s *walletService) authorizeOperation(ctx context.Context, op string, wid int, amount float64, labels map[string]string) error {
+	if s.policy == nil {
+		return nil
+	}
+
+	client := clientFrom(ctx)
+	if client == "" {
+		client = anonymousClient
+	}
+	allowed, rule := s.policy.Evaluate(client, op, labels)
+	if allowed {
+		return nil
+	}
+
+	d := &PolicyDenial{
+		Client:    client,
+		Operation: op,
+		WalletID:  wid,
+		Amount:    amount,
+		Labels:    labels,
+		Rule:      rule,
+		Created:   time.Now().UTC().Truncate(time.Millisecond),
+	}
+	if d.Labels == nil {
+		d.Labels = map[string]string{}
+	}
+	s.log(ctx).Warn().Str("operation", op).Str("rule", rule).Interface("labels", labels).
+		Msg("operation denied by policy")
+
+	// the operation is denied even if the audit record is lost
+	if err := s.r.CreatePolicyDenial(ctx, d); err != nil {
+		s.log(ctx).Error().Err(err).Msg("audit policy denial failed")
+	}
+	return ErrPolicyDenied
+}
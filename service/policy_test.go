@@ -0,0 +1,142 @@
+//go:build !integration
+// +build !integration
+
+package service
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+const testPolicy = `{
+  "default": "deny",
+  "rules": [
+    {"name": "payments-withdraw", "clients": ["apikey:payments"], "operations": ["debit"], "labels": {"reason": ["withdraw"]}},
+    {"name": "payments-deposit", "clients": ["apikey:payments"], "operations": ["credit", "wallet.create"]},
+    {"name": "betting-stake", "clients": ["apikey:betting"], "operations": ["debit"], "labels": {"reason": ["stake"]}},
+    {"name": "betting-prize", "clients": ["apikey:betting"], "operations": ["credit"], "labels": {"reason": ["prize", "refund"]}},
+    {"name": "no-anonymous", "effect": "deny", "clients": ["anonymous"]},
+    {"name": "admins", "clients": ["jwt:*"]}
+  ]
+}`
+
+func loadTestPolicy(t *testing.T, content string) (*Policy, error) {
+	path := filepath.Join(t.TempDir(), "policy.json")
+	require.NoError(t, os.WriteFile(path, []byte(content), 0600))
+	return LoadPolicy(path)
+}
+
+func TestPolicyEvaluate(t *testing.T) {
+	p, err := loadTestPolicy(t, testPolicy)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name    string
+		client  string
+		op      string
+		labels  map[string]string
+		allowed bool
+		rule    string
+	}{
+		{"Withdraw", "apikey:payments", OpDebit, map[string]string{"reason": "withdraw"}, true, "payments-withdraw"},
+		{"PaymentsStake", "apikey:payments", OpDebit, map[string]string{"reason": "stake"}, false, ""},
+		{"Deposit", "apikey:payments", OpCredit, nil, true, "payments-deposit"},
+		{"Stake", "apikey:betting", OpDebit, map[string]string{"reason": "stake"}, true, "betting-stake"},
+		{"Refund", "apikey:betting", OpCredit, map[string]string{"reason": "refund", "game": "7"}, true, "betting-prize"},
+		{"BettingWithdraw", "apikey:betting", OpDebit, map[string]string{"reason": "withdraw"}, false, ""},
+		{"BettingNoLabel", "apikey:betting", OpDebit, nil, false, ""},
+		{"BettingCreateWallet", "apikey:betting", OpCreateWallet, nil, false, ""},
+		{"Anonymous", "", OpCredit, nil, false, "no-anonymous"},
+		{"Jwt", "jwt:svc-1", OpDebit, nil, true, "admins"},
+		{"Unknown", "apikey:other", OpCredit, nil, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			allowed, rule := p.Evaluate(tt.client, tt.op, tt.labels)
+			assert.Equal(t, tt.allowed, allowed)
+			assert.Equal(t, tt.rule, rule)
+		})
+	}
+
+	// the default is deny unless it is allow
+	allowed, _ := (&Policy{}).Evaluate("apikey:any", OpCredit, nil)
+	assert.False(t, allowed)
+	allowed, _ = (&Policy{Default: EffectAllow}).Evaluate("apikey:any", OpCredit, nil)
+	assert.True(t, allowed)
+}
+
+func TestLoadPolicy(t *testing.T) {
+	invalid := map[string]string{
+		"UnknownField":     `{"rules": [{"client": ["apikey:betting"]}]}`,
+		"UnknownOperation": `{"rules": [{"operations": ["transfer"]}]}`,
+		"UnknownEffect":    `{"rules": [{"effect": "maybe"}]}`,
+		"UnknownDefault":   `{"default": "permit"}`,
+		"BadPattern":       `{"rules": [{"clients": ["apikey:["]}]}`,
+		"NotJson":          `{`,
+	}
+	for name, content := range invalid {
+		t.Run(name, func(t *testing.T) {
+			_, err := loadTestPolicy(t, content)
+			assert.Error(t, err)
+		})
+	}
+
+	_, err := LoadPolicy(filepath.Join(t.TempDir(), "missing.json"))
+	assert.Error(t, err)
+}
+
+func TestPolicyDenial(t *testing.T) {
+	p, err := loadTestPolicy(t, testPolicy)
+	require.NoError(t, err)
+	ctx := WithPrincipal(context.Background(), &Principal{Client: "apikey:betting"})
+
+	var mok = &mockRepository{}
+	mok.On("CreatePolicyDenial", mock.Anything, mock.Anything).Return(nil)
+	svc := NewWalletService(mok, log.Logger, WithPolicy(p))
+
+	_, err = svc.CreateTransaction(ctx, 7, &TransactionModel{Amount: -5, Labels: map[string]string{"reason": "withdraw"}})
+	assert.ErrorIs(t, err, ErrPolicyDenied)
+	_, err = svc.CreateWallet(ctx, &WalletModel{ExternalID: "w"})
+	assert.ErrorIs(t, err, ErrPolicyDenied)
+
+	mok.AssertNumberOfCalls(t, "CreatePolicyDenial", 2)
+	d := mok.Calls[0].Arguments.Get(1).(*PolicyDenial)
+	assert.Equal(t, "apikey:betting", d.Client)
+	assert.Equal(t, OpDebit, d.Operation)
+	assert.Equal(t, 7, d.WalletID)
+	assert.Equal(t, -5., d.Amount)
+	assert.Equal(t, map[string]string{"reason": "withdraw"}, d.Labels)
+	assert.Empty(t, d.Rule)
+
+	d = mok.Calls[1].Arguments.Get(1).(*PolicyDenial)
+	assert.Equal(t, OpCreateWallet, d.Operation)
+	assert.Equal(t, map[string]string{}, d.Labels)
+
+	// anonymous callers are denied by their rule
+	_, err = svc.CreateTransaction(context.Background(), 7, &TransactionModel{Amount: 5})
+	assert.ErrorIs(t, err, ErrPolicyDenied)
+	d = mok.Calls[2].Arguments.Get(1).(*PolicyDenial)
+	assert.Equal(t, anonymousClient, d.Client)
+	assert.Equal(t, "no-anonymous", d.Rule)
+}
+
+func TestPolicyAllowed(t *testing.T) {
+	p, err := loadTestPolicy(t, testPolicy)
+	require.NoError(t, err)
+	ctx := WithPrincipal(context.Background(), &Principal{Client: "apikey:payments"})
+
+	var mok = &mockRepository{}
+	mok.On("CreateWallet", mock.Anything, mock.Anything).Return(nil)
+	svc := NewWalletService(mok, log.Logger, WithPolicy(p))
+
+	_, err = svc.CreateWallet(ctx, &WalletModel{ExternalID: "w"})
+	assert.NoError(t, err)
+	mok.AssertNotCalled(t, "CreatePolicyDenial", mock.Anything, mock.Anything)
+}
@@ -0,0 +1,73 @@
+package service
+
+import (
+	"context"
+
+	"github.com/rs/zerolog"
+)
+
+// TenantLabel is the wallet label holding the tenant of the wallet. Callers
+// of a tenant only access wallets labeled with it.
+const TenantLabel = "tenant"
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	// Client identifies the caller; it is recorded on transactions
+	Client string
+	Scopes []string
+
+	// Subject is the sub claim of a token, empty for api keys
+	Subject string
+	// Tenant restricts the caller to wallets of the tenant if not empty
+	Tenant string
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns a context carrying p. The logger of the context, if
+// any, is extended with the client.
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	if l := zerolog.Ctx(ctx); l.GetLevel() != zerolog.Disabled {
+		ctx = WithLogger(ctx, l.With().Str("client", p.Client).Logger())
+	}
+	return context.WithValue(ctx, principalKey{}, p)
+}
+
+// PrincipalFrom returns the principal of ctx, or nil if the request is not
+// authenticated.
+func PrincipalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// clientFrom returns the client of the principal of ctx, or empty.
+func clientFrom(ctx context.Context) string {
+	if p := PrincipalFrom(ctx); p != nil {
+		return p.Client
+	}
+	return ""
+}
+
+// tenantFrom returns the tenant of the principal of ctx, or empty.
+func tenantFrom(ctx context.Context) string {
+	if p := PrincipalFrom(ctx); p != nil {
+		return p.Tenant
+	}
+	return ""
+}
+
+// HasScope reports whether the principal is granted scope.
+func (p *Principal) HasScope(scope string) bool {
+	for _, s := range p.Scopes {
+		if s == scope || s == ScopeAdmin {
+			return true
+		}
+	}
+	return false
+}
+
+// CanAccess reports whether the principal may access the wallet: callers
+// without a tenant access every wallet.
+func (p *Principal) CanAccess(w *Wallet) bool {
+	return p == nil || p.Tenant == "" || w.Labels[TenantLabel] == p.Tenant
+}
@@ -0,0 +1,50 @@
+//go:build !integration
+// +build !integration
+
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTenantAccess(t *testing.T) {
+	ctx := WithPrincipal(context.Background(), &Principal{Client: "jwt:svc", Tenant: "brand1"})
+
+	var mok = &mockRepository{}
+	mok.On("GetWallet", mock.Anything, 1).Return(&Wallet{ID: 1, Labels: map[string]string{TenantLabel: "brand1"}}, nil)
+	mok.On("GetWallet", mock.Anything, 2).Return(&Wallet{ID: 2, Labels: map[string]string{TenantLabel: "brand2"}}, nil)
+	mok.On("GetWalletBalance", mock.Anything, 1).Return(10., nil)
+	mok.On("CreateWallet", mock.Anything, mock.Anything).Return(nil)
+	svc := NewWalletService(mok, log.Logger)
+
+	_, err := svc.GetWallet(ctx, 1)
+	assert.NoError(t, err)
+	b, err := svc.GetWalletBalance(ctx, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, 10., b)
+
+	// wallets of other tenants are not revealed
+	_, err = svc.GetWallet(ctx, 2)
+	assert.ErrorIs(t, err, ErrWalletNotFound)
+	_, err = svc.GetWalletBalance(ctx, 2)
+	assert.ErrorIs(t, err, ErrWalletNotFound)
+	_, err = svc.CreateTransaction(ctx, 2, &TransactionModel{Amount: 5})
+	assert.ErrorIs(t, err, ErrWalletNotFound)
+
+	// the tenant label is set without changing the model
+	m := &WalletModel{ExternalID: "w", Labels: map[string]string{TenantLabel: "brand2", "a": "b"}}
+	w, err := svc.CreateWallet(ctx, m)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{TenantLabel: "brand1", "a": "b"}, w.Labels)
+	assert.Equal(t, "brand2", m.Labels[TenantLabel])
+
+	// callers without a tenant access every wallet
+	_, err = svc.GetWallet(context.Background(), 2)
+	assert.NoError(t, err)
+}
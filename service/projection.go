@@ -0,0 +1,236 @@
+package service
+
+import (
+	"context"
+	"errors"
+)
+
+// ProjectionBalances is the name of the projection of wallet_balances
+const ProjectionBalances = "balances"
+
+const (
+	// checkpointInterval is the number of wallets replayed between checkpoints
+	checkpointInterval = 100
+
+	// maxReplayAttempts is the number of times a wallet is replayed while
+	// transactions are committed to it concurrently
+	maxReplayAttempts = 3
+)
+
+type (
+	// Projection is a read model built purely from the transaction log. A
+	// wallet is replayed by calling Reset, Apply for each of its transactions
+	// in refno order and then Commit.
+	Projection interface {
+		Name() string
+
+		// Reset starts the replay of the wallet.
+		Reset(ctx context.Context, wid int) error
+
+		// Apply folds the next transaction of the wallet into the read model.
+		Apply(ctx context.Context, t *Transaction) error
+
+		// Commit writes the read model of the wallet replayed up to refno and
+		// reports whether it changed. It returns ErrTransactionConsistency if
+		// a transaction was committed to the wallet during the replay.
+		Commit(ctx context.Context, wid int, refno int) (bool, error)
+	}
+
+	// RebuildProgress is the progress of a rebuild of projections.
+	RebuildProgress struct {
+		Projections  []string `json:"projections"`
+		Wallets      int      `json:"wallets"`
+		Transactions int      `json:"transactions"`
+		Changed      int      `json:"changed"`
+		Skipped      []int    `json:"skipped"`
+		LastWalletID int      `json:"last_wid"`
+	}
+)
+
+// Projections returns all projections, by name.
+func Projections(r Repository) map[string]Projection {
+	return map[string]Projection{
+		ProjectionBalances: NewBalanceProjection(r),
+	}
+}
+
+// RebuildProjections replays the transactions of every wallet into the
+// projections. Progress is checkpointed every checkpointInterval wallets; an
+// interrupted rebuild resumes after the lowest checkpoint of the projections
+// unless restart is given. Wallets still receiving transactions after
+// maxReplayAttempts replays are skipped and reported. progress, if given, is
+// called at every checkpoint.
+func RebuildProjections(ctx context.Context, r Repository, ps []Projection, restart bool,
+	progress func(*RebuildProgress)) (*RebuildProgress, error) {
+	p := &RebuildProgress{Projections: []string{}, Skipped: []int{}}
+	for _, pr := range ps {
+		p.Projections = append(p.Projections, pr.Name())
+	}
+
+	after := 0
+	if !restart {
+		for i, pr := range ps {
+			wid, err := r.GetCheckpoint(ctx, pr.Name())
+			if err != nil {
+				return p, err
+			}
+			if i == 0 || wid < after {
+				after = wid
+			}
+		}
+	}
+
+	checkpoint := func(wid int) error {
+		for _, pr := range ps {
+			if err := r.SaveCheckpoint(ctx, pr.Name(), wid); err != nil {
+				return err
+			}
+		}
+		if progress != nil {
+			progress(p)
+		}
+		return nil
+	}
+
+	for {
+		ws, err := r.ListWallets(ctx, after, listPageSize)
+		if err != nil {
+			return p, err
+		}
+
+		for _, w := range ws {
+			n, changed, err := RebuildWallet(ctx, r, ps, w.ID)
+			if errors.Is(err, ErrTransactionConsistency) {
+				p.Skipped = append(p.Skipped, w.ID)
+			} else if err != nil {
+				return p, err
+			}
+
+			p.Wallets++
+			p.Transactions += n
+			p.Changed += changed
+			p.LastWalletID = w.ID
+			after = w.ID
+
+			if p.Wallets%checkpointInterval == 0 {
+				if err := checkpoint(w.ID); err != nil {
+					return p, err
+				}
+			}
+		}
+
+		if len(ws) < listPageSize {
+			break
+		}
+	}
+
+	// a finished rebuild leaves no checkpoint behind
+	return p, checkpoint(0)
+}
+
+// RebuildWallet replays the transactions of the wallet into the projections
+// and returns the number of transactions replayed and of projections changed.
+// The replay is retried while transactions are committed to the wallet
+// concurrently; ErrTransactionConsistency is returned after maxReplayAttempts.
+func RebuildWallet(ctx context.Context, r Repository, ps []Projection, wid int) (int, int, error) {
+	if _, err := r.GetWallet(ctx, wid); err != nil {
+		return 0, 0, err
+	}
+
+	var err error
+	for i := 0; i < maxReplayAttempts; i++ {
+		var n, changed int
+		n, changed, err = replayWallet(ctx, r, ps, wid)
+		if !errors.Is(err, ErrTransactionConsistency) {
+			return n, changed, err
+		}
+	}
+
+	return 0, 0, err
+}
+
+func replayWallet(ctx context.Context, r Repository, ps []Projection, wid int) (int, int, error) {
+	for _, p := range ps {
+		if err := p.Reset(ctx, wid); err != nil {
+			return 0, 0, err
+		}
+	}
+
+	n, refno := 0, 0
+	for {
+		trs, err := r.ListTransactions(ctx, wid, refno, listPageSize)
+		if err != nil {
+			return 0, 0, err
+		}
+
+		for _, t := range trs {
+			for _, p := range ps {
+				if err := p.Apply(ctx, t); err != nil {
+					return 0, 0, err
+				}
+			}
+			refno = t.RefNo
+			n++
+		}
+
+		if len(trs) < listPageSize {
+			break
+		}
+	}
+
+	changed := 0
+	for _, p := range ps {
+		c, err := p.Commit(ctx, wid, refno)
+		if err != nil {
+			return 0, 0, err
+		}
+		if c {
+			changed++
+		}
+	}
+
+	return n, changed, nil
+}
+
+// balanceProjection rebuilds wallet_balances as the sum of transaction
+// amounts. Balances are written by Repository.RepairBalance, so every change
+// is audited and a transaction committed during the replay fails the write
+// instead of being overwritten.
+type balanceProjection struct {
+	r   Repository
+	sum int64
+}
+
+// NewBalanceProjection returns the projection of wallet balances.
+func NewBalanceProjection(r Repository) Projection {
+	return &balanceProjection{r: r}
+}
+
+func (p *balanceProjection) Name() string {
+	return ProjectionBalances
+}
+
+func (p *balanceProjection) Reset(ctx context.Context, wid int) error {
+	p.sum = 0
+	return nil
+}
+
+func (p *balanceProjection) Apply(ctx context.Context, t *Transaction) error {
+	p.sum += cents(t.Amount)
+	return nil
+}
+
+func (p *balanceProjection) Commit(ctx context.Context, wid int, refno int) (bool, error) {
+	balance, err := p.r.GetWalletBalance(ctx, wid)
+	if err != nil {
+		return false, err
+	}
+	if cents(balance) == p.sum {
+		return false, nil
+	}
+
+	if err := p.r.RepairBalance(ctx, wid, refno, balance, fromCents(p.sum)); err != nil {
+		return false, err
+	}
+	return true, nil
+}
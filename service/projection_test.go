@@ -0,0 +1,69 @@
+//go:build !integration
+// +build !integration
+
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestRebuildWallet(t *testing.T) {
+	chain := newChain(1, 3)
+
+	t.Run("ReplayedAfterConcurrentTransaction", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("GetWallet", mock.Anything, 1).Return(&Wallet{ID: 1}, nil)
+		mok.On("ListTransactions", mock.Anything, 1, 0, listPageSize).Return(chain[:2], nil).Once()
+		mok.On("GetWalletBalance", mock.Anything, 1).Return(0., nil).Once()
+		mok.On("RepairBalance", mock.Anything, 1, 2, 0., 20.).Return(ErrTransactionConsistency)
+		mok.On("ListTransactions", mock.Anything, 1, 0, listPageSize).Return(chain, nil).Once()
+		mok.On("GetWalletBalance", mock.Anything, 1).Return(0., nil).Once()
+		mok.On("RepairBalance", mock.Anything, 1, 3, 0., 30.).Return(nil)
+
+		n, changed, err := RebuildWallet(context.Background(), mok, []Projection{NewBalanceProjection(mok)}, 1)
+		assert.NoError(t, err)
+		assert.Equal(t, 3, n)
+		assert.Equal(t, 1, changed)
+	})
+
+	t.Run("GivesUp", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("GetWallet", mock.Anything, 1).Return(&Wallet{ID: 1}, nil)
+		mok.On("ListTransactions", mock.Anything, 1, 0, listPageSize).Return(chain, nil)
+		mok.On("GetWalletBalance", mock.Anything, 1).Return(0., nil)
+		mok.On("RepairBalance", mock.Anything, 1, 3, 0., 30.).Return(ErrTransactionConsistency)
+
+		_, _, err := RebuildWallet(context.Background(), mok, []Projection{NewBalanceProjection(mok)}, 1)
+		assert.ErrorIs(t, err, ErrTransactionConsistency)
+		mok.AssertNumberOfCalls(t, "RepairBalance", maxReplayAttempts)
+	})
+}
+
+func TestRebuildProjectionsCheckpoints(t *testing.T) {
+	ws := make([]*Wallet, checkpointInterval+1)
+	for i := range ws {
+		ws[i] = &Wallet{ID: 10 + i}
+	}
+
+	var mok = &mockRepository{}
+	mok.On("GetCheckpoint", mock.Anything, ProjectionBalances).Return(9, nil)
+	mok.On("ListWallets", mock.Anything, 9, listPageSize).Return(ws, nil)
+	mok.On("GetWallet", mock.Anything, mock.Anything).Return(&Wallet{}, nil)
+	mok.On("ListTransactions", mock.Anything, mock.Anything, 0, listPageSize).Return([]*Transaction{}, nil)
+	mok.On("GetWalletBalance", mock.Anything, mock.Anything).Return(0., nil)
+	mok.On("SaveCheckpoint", mock.Anything, ProjectionBalances, 10+checkpointInterval-1).Return(nil)
+	mok.On("SaveCheckpoint", mock.Anything, ProjectionBalances, 0).Return(nil)
+
+	calls := 0
+	p, err := RebuildProjections(context.Background(), mok, []Projection{NewBalanceProjection(mok)}, false,
+		func(*RebuildProgress) { calls++ })
+	assert.NoError(t, err)
+	assert.Equal(t, checkpointInterval+1, p.Wallets)
+	assert.Equal(t, 10+checkpointInterval, p.LastWalletID)
+	assert.Equal(t, 2, calls)
+	mok.AssertExpectations(t)
+}
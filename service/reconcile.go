@@ -0,0 +1,188 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Kinds of discrepancies found by reconciliation
+const (
+	DiscrepancyRefNoGap        = "refno_gap"
+	DiscrepancyBrokenChain     = "broken_chain"
+	DiscrepancySumMismatch     = "sum_mismatch"
+	DiscrepancyBalanceMismatch = "balance_mismatch"
+)
+
+type (
+	// Discrepancy is a difference between the materialized wallet balance and
+	// the transaction ledger, or an inconsistency inside the ledger.
+	Discrepancy struct {
+		WalletID int     `json:"wid"`
+		RefNo    int     `json:"refno"`
+		Kind     string  `json:"kind"`
+		Expected float64 `json:"expected"`
+		Actual   float64 `json:"actual"`
+		Detail   string  `json:"detail"`
+		Repaired bool    `json:"repaired"`
+	}
+
+	ReconcileReport struct {
+		Wallets       int            `json:"wallets"`
+		Discrepancies []*Discrepancy `json:"discrepancies"`
+	}
+)
+
+// Reconcile checks every wallet; with repair, mismatching materialized
+// balances are set to the new balance of the latest transaction.
+func Reconcile(ctx context.Context, r Repository, repair bool) (*ReconcileReport, error) {
+	report := &ReconcileReport{Discrepancies: []*Discrepancy{}}
+
+	after := 0
+	for {
+		ws, err := r.ListWallets(ctx, after, listPageSize)
+		if err != nil {
+			return report, err
+		}
+
+		for _, w := range ws {
+			ds, err := ReconcileWallet(ctx, r, w.ID, repair)
+			if err != nil {
+				return report, err
+			}
+			report.Discrepancies = append(report.Discrepancies, ds...)
+			report.Wallets++
+			after = w.ID
+		}
+
+		if len(ws) < listPageSize {
+			return report, nil
+		}
+	}
+}
+
+// ReconcileWallet walks the transactions of the wallet and reports refno gaps,
+// transactions whose old balance is not the new balance of the previous one
+// (or new balance is not old balance plus amount), a last new balance which is
+// not the sum of amounts, and a materialized balance which is not the last
+// new balance.
+func ReconcileWallet(ctx context.Context, r Repository, wid int, repair bool) ([]*Discrepancy, error) {
+	ds := []*Discrepancy{}
+	add := func(refno int, kind string, expected, actual float64, detail string) *Discrepancy {
+		d := &Discrepancy{WalletID: wid, RefNo: refno, Kind: kind, Expected: expected, Actual: actual, Detail: detail}
+		ds = append(ds, d)
+		return d
+	}
+
+	before, err := r.GetWalletBalance(ctx, wid)
+	if err != nil {
+		return nil, err
+	}
+
+	var last *Transaction
+	var sum int64
+	for {
+		after := 0
+		if last != nil {
+			after = last.RefNo
+		}
+
+		trs, err := r.ListTransactions(ctx, wid, after, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, t := range trs {
+			expectedRefNo, expectedOld := 1, 0.
+			if last != nil {
+				expectedRefNo, expectedOld = last.RefNo+1, last.NewBalance
+			}
+
+			if t.RefNo != expectedRefNo {
+				add(t.RefNo, DiscrepancyRefNoGap, float64(expectedRefNo), float64(t.RefNo),
+					fmt.Sprintf("refno %d to %d are missing", expectedRefNo, t.RefNo-1))
+			}
+			if cents(t.OldBalance) != cents(expectedOld) {
+				add(t.RefNo, DiscrepancyBrokenChain, expectedOld, t.OldBalance,
+					"old balance is not new balance of previous transaction")
+			}
+			if cents(t.NewBalance) != cents(t.OldBalance)+cents(t.Amount) {
+				add(t.RefNo, DiscrepancyBrokenChain, fromCents(cents(t.OldBalance)+cents(t.Amount)), t.NewBalance,
+					"new balance is not old balance plus amount")
+			}
+
+			sum += cents(t.Amount)
+			last = t
+		}
+
+		if len(trs) < listPageSize {
+			break
+		}
+	}
+
+	refno, balance := 0, 0.
+	if last != nil {
+		refno, balance = last.RefNo, last.NewBalance
+		if sum != cents(balance) {
+			add(refno, DiscrepancySumMismatch, fromCents(sum), balance, "new balance is not sum of amounts")
+		}
+	}
+
+	// a balance changed while walking belongs to a transaction in flight
+	after, err := r.GetWalletBalance(ctx, wid)
+	if err != nil {
+		return nil, err
+	}
+	if cents(before) == cents(after) && cents(after) != cents(balance) {
+		d := add(refno, DiscrepancyBalanceMismatch, balance, after, "materialized balance is not new balance of latest transaction")
+
+		if repair {
+			err := r.RepairBalance(ctx, wid, refno, after, balance)
+			if err != nil && !errors.Is(err, ErrTransactionConsistency) {
+				return nil, err
+			}
+			d.Repaired = err == nil
+		}
+	}
+
+	return ds, nil
+}
+
+// RunReconcileJob reconciles all wallets every interval until ctx is done.
+// Discrepancies are logged, not repaired.
+func RunReconcileJob(ctx context.Context, r Repository, interval time.Duration, l zerolog.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		report, err := Reconcile(ctx, r, false)
+		if err != nil {
+			l.Error().Err(err).Msg("reconcile failed")
+			continue
+		}
+
+		for _, d := range report.Discrepancies {
+			l.Warn().Int("wid", d.WalletID).Int("refno", d.RefNo).Str("kind", d.Kind).
+				Float64("expected", d.Expected).Float64("actual", d.Actual).Msg(d.Detail)
+		}
+		l.Info().Int("wallets", report.Wallets).Int("discrepancies", len(report.Discrepancies)).Msg("reconcile completed")
+	}
+}
+
+func cents(f float64) int64 {
+	return int64(math.Round(f * 100))
+}
+
+func fromCents(c int64) float64 {
+	return float64(c) / 100
+}
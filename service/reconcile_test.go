@@ -0,0 +1,55 @@
+//go:build !integration
+// +build !integration
+
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestReconcile(t *testing.T) {
+	chain := newChain(1, 2)
+
+	t.Run("Repaired", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("ListWallets", mock.Anything, 0, listPageSize).Return([]*Wallet{{ID: 1}}, nil)
+		mok.On("ListTransactions", mock.Anything, 1, 0, listPageSize).Return(chain, nil)
+		mok.On("GetWalletBalance", mock.Anything, 1).Return(30., nil)
+		mok.On("RepairBalance", mock.Anything, 1, 2, 30., 20.).Return(nil)
+
+		report, err := Reconcile(context.Background(), mok, true)
+		assert.NoError(t, err)
+		assert.Equal(t, 1, report.Wallets)
+		assert.Equal(t, []*Discrepancy{{WalletID: 1, RefNo: 2, Kind: DiscrepancyBalanceMismatch, Expected: 20,
+			Actual: 30, Detail: "materialized balance is not new balance of latest transaction", Repaired: true}},
+			report.Discrepancies)
+	})
+
+	t.Run("RepairLostRace", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("ListTransactions", mock.Anything, 1, 0, listPageSize).Return(chain, nil)
+		mok.On("GetWalletBalance", mock.Anything, 1).Return(30., nil)
+		mok.On("RepairBalance", mock.Anything, 1, 2, 30., 20.).Return(ErrTransactionConsistency)
+
+		ds, err := ReconcileWallet(context.Background(), mok, 1, true)
+		assert.NoError(t, err)
+		assert.Len(t, ds, 1)
+		assert.False(t, ds[0].Repaired)
+	})
+
+	t.Run("BalanceChangedWhileWalking", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("ListTransactions", mock.Anything, 1, 0, listPageSize).Return(chain, nil)
+		mok.On("GetWalletBalance", mock.Anything, 1).Return(30., nil).Once()
+		mok.On("GetWalletBalance", mock.Anything, 1).Return(40., nil).Once()
+
+		ds, err := ReconcileWallet(context.Background(), mok, 1, true)
+		assert.NoError(t, err)
+		assert.Empty(t, ds)
+		mok.AssertNotCalled(t, "RepairBalance", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+	})
+}
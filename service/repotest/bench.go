@@ -0,0 +1,71 @@
+package repotest
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+)
+
+// Benchmark measures CreateTransaction throughput of the wallet service on top
+// of the repository, once with optimistic concurrency and once with locking.
+// Parallel writers share a few wallets; conflicts are retried and reported as
+// the conflicts/op metric.
+func Benchmark(b *testing.B, newRepo func() service.Repository) {
+	modes := []struct {
+		name string
+		opts []service.Option
+	}{
+		{"Optimistic", nil},
+		{"Locking", []service.Option{service.WithLocking()}},
+	}
+
+	for _, m := range modes {
+		m := m
+		b.Run(m.name, func(b *testing.B) {
+			benchmarkCreateTransaction(b, service.NewWalletService(newRepo(), zerolog.Nop(), m.opts...))
+		})
+	}
+}
+
+func benchmarkCreateTransaction(b *testing.B, s service.Service) {
+	ctx := context.Background()
+
+	const wallets = 4
+	wids := make([]int, wallets)
+	for i := range wids {
+		w, err := s.CreateWallet(ctx, &service.WalletModel{ExternalID: uuid.NewString()})
+		if err != nil {
+			b.Fatal(err)
+		}
+		wids[i] = w.ID
+	}
+
+	var next, conflicts int64
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		wid := wids[atomic.AddInt64(&next, 1)%wallets]
+		for pb.Next() {
+			m := &service.TransactionModel{Amount: 1, Description: "benchmark", Fingerprint: uuid.NewString()}
+			for {
+				_, err := s.CreateTransaction(ctx, wid, m)
+				if errors.Is(err, service.ErrTransactionConsistency) ||
+					errors.Is(err, service.ErrTransactionAlreadyExistsByRefNo) {
+					atomic.AddInt64(&conflicts, 1)
+					time.Sleep(time.Millisecond)
+					continue
+				}
+				if err != nil {
+					b.Error(err)
+				}
+				break
+			}
+		}
+	})
+	b.ReportMetric(float64(conflicts)/float64(b.N), "conflicts/op")
+}
@@ -0,0 +1,1351 @@
+// Package repotest implements a conformance test suite for service.Repository
+// implementations. Every backend is expected to run it from its own tests:
+//
+//	func TestRepository(t *testing.T) {
+//		repotest.Run(t, func() service.Repository { return NewRepository(...) })
+//	}
+//
+// Tests create their own wallets with random external ids, so backends that
+// share state between runs (e.g. a postgres database) are supported.
+package repotest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Run runs the whole suite against repositories created by newRepo.
+func Run(t *testing.T, newRepo func() service.Repository) {
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, r service.Repository)
+	}{
+		{"CreateWallet", testCreateWallet},
+		{"CreateWalletDuplicate", testCreateWalletDuplicate},
+		{"WalletNotFound", testWalletNotFound},
+		{"TransactionNotFound", testTransactionNotFound},
+		{"CreateTransaction", testCreateTransaction},
+		{"CreateTransactionDuplicateRefNo", testCreateTransactionDuplicateRefNo},
+		{"CreateTransactionDuplicateFingerprint", testCreateTransactionDuplicateFingerprint},
+		{"CreateTransactionStaleBalance", testCreateTransactionStaleBalance},
+		{"CreateTransactionUnknownWallet", testCreateTransactionUnknownWallet},
+		{"RefNoSequence", testRefNoSequence},
+		{"ConcurrentConflictingWrites", testConcurrentConflictingWrites},
+		{"ConcurrentBalanceInvariants", testConcurrentBalanceInvariants},
+		{"PostTransaction", testPostTransaction},
+		{"PostTransactionWalletNotFound", testPostTransactionWalletNotFound},
+		{"PostTransactionNotEnoughBalance", testPostTransactionNotEnoughBalance},
+		{"PostTransactionDuplicateFingerprint", testPostTransactionDuplicateFingerprint},
+		{"ConcurrentPosts", testConcurrentPosts},
+		{"ListWallets", testListWallets},
+		{"ListTransactions", testListTransactions},
+		{"HashChain", testHashChain},
+		{"HashChainDecimals", testHashChainDecimals},
+		{"TrialBalance", testTrialBalance},
+		{"GetTransactionAt", testGetTransactionAt},
+		{"RepairBalance", testRepairBalance},
+		{"Reconcile", testReconcile},
+		{"ListTransactionsBetween", testListTransactionsBetween},
+		{"Snapshots", testSnapshots},
+		{"Statement", testStatement},
+		{"Outbox", testOutbox},
+		{"PruneEvents", testPruneEvents},
+		{"Subscriptions", testSubscriptions},
+		{"Deliveries", testDeliveries},
+		{"Listen", testListen},
+		{"FollowTransactions", testFollowTransactions},
+		{"Checkpoints", testCheckpoints},
+		{"RebuildProjections", testRebuildProjections},
+		{"APIKeys", testAPIKeys},
+		{"TransactionClient", testTransactionClient},
+		{"PolicyDenials", testPolicyDenials},
+	}
+
+	for _, tt := range tests {
+		tt := tt
+		t.Run(tt.name, func(t *testing.T) {
+			tt.fn(t, newRepo())
+		})
+	}
+}
+
+func testAPIKeys(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	name := uuid.NewString()[:20]
+
+	key, k, err := service.GenerateAPIKey(name, []string{service.ScopeWalletsRead, service.ScopeTransactionsWrite})
+	require.NoError(t, err)
+	require.NoError(t, r.CreateAPIKey(ctx, k))
+	assert.NotZero(t, k.ID)
+
+	_, dup, err := service.GenerateAPIKey(name, []string{service.ScopeAdmin})
+	require.NoError(t, err)
+	assert.ErrorIs(t, r.CreateAPIKey(ctx, dup), service.ErrAPIKeyAlreadyExists)
+
+	gk, err := r.GetAPIKeyByHash(ctx, service.HashAPIKey(key))
+	require.NoError(t, err)
+	assert.Equal(t, k.ID, gk.ID)
+	assert.Equal(t, name, gk.Name)
+	assert.Equal(t, k.Prefix, gk.Prefix)
+	assert.Equal(t, k.Scopes, gk.Scopes)
+	assert.WithinDuration(t, k.Created, gk.Created, time.Millisecond)
+	assert.Nil(t, gk.Revoked)
+
+	_, err = r.GetAPIKeyByHash(ctx, service.HashAPIKey("unknown"))
+	assert.ErrorIs(t, err, service.ErrAPIKeyNotFound)
+
+	// the first revocation is kept
+	at := time.Now().UTC().Truncate(time.Millisecond)
+	require.NoError(t, r.RevokeAPIKey(ctx, k.ID, at))
+	require.NoError(t, r.RevokeAPIKey(ctx, k.ID, at.Add(time.Hour)))
+	gk, err = r.GetAPIKeyByHash(ctx, service.HashAPIKey(key))
+	require.NoError(t, err)
+	require.NotNil(t, gk.Revoked)
+	assert.WithinDuration(t, at, *gk.Revoked, time.Millisecond)
+
+	_, err = service.AuthenticateAPIKey(ctx, r, key)
+	assert.ErrorIs(t, err, service.ErrAPIKeyNotFound)
+
+	assert.ErrorIs(t, r.RevokeAPIKey(ctx, 1<<30, at), service.ErrAPIKeyNotFound)
+
+	keys, err := r.ListAPIKeys(ctx)
+	require.NoError(t, err)
+	found := false
+	for i, lk := range keys {
+		if i > 0 {
+			assert.Less(t, keys[i-1].ID, lk.ID)
+		}
+		found = found || lk.ID == k.ID
+	}
+	assert.True(t, found)
+}
+
+func testTransactionClient(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+
+	tr := newTransaction(1, 10, 0)
+	tr.Client = "apikey:billing"
+	service.ChainTransaction(w.ID, tr, nil)
+	require.NoError(t, r.CreateTransaction(ctx, w.ID, tr))
+
+	pt := newTransaction(0, 5, 0)
+	pt.Client = "apikey:payouts"
+	require.NoError(t, r.PostTransaction(ctx, w.ID, pt))
+
+	ts, err := r.ListTransactions(ctx, w.ID, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, ts, 2)
+	assert.Equal(t, "apikey:billing", ts[0].Client)
+	assert.Equal(t, "apikey:payouts", ts[1].Client)
+
+	// clients are part of the hashed content
+	broken, err := service.VerifyWalletChain(ctx, r, w.ID)
+	require.NoError(t, err)
+	assert.Nil(t, broken)
+}
+
+func testPolicyDenials(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+
+	last, err := r.ListPolicyDenials(ctx, 0, 1<<30)
+	require.NoError(t, err)
+	after := int64(0)
+	if len(last) > 0 {
+		after = last[len(last)-1].ID
+	}
+
+	d1 := &service.PolicyDenial{Client: "apikey:betting", Operation: service.OpDebit, WalletID: 7, Amount: -12.34,
+		Labels: map[string]string{"reason": "withdraw"}, Created: time.Now().UTC().Truncate(time.Millisecond)}
+	d2 := &service.PolicyDenial{Client: "anonymous", Operation: service.OpCreateWallet, Labels: map[string]string{},
+		Rule: "no-anonymous", Created: time.Now().UTC().Truncate(time.Millisecond)}
+	require.NoError(t, r.CreatePolicyDenial(ctx, d1))
+	require.NoError(t, r.CreatePolicyDenial(ctx, d2))
+	assert.Greater(t, d2.ID, d1.ID)
+
+	ds, err := r.ListPolicyDenials(ctx, after, 10)
+	require.NoError(t, err)
+	require.Len(t, ds, 2)
+	for i, want := range []*service.PolicyDenial{d1, d2} {
+		got := ds[i]
+		assert.Equal(t, want.ID, got.ID)
+		assert.Equal(t, want.Client, got.Client)
+		assert.Equal(t, want.Operation, got.Operation)
+		assert.Equal(t, want.WalletID, got.WalletID)
+		assert.Equal(t, want.Amount, got.Amount)
+		assert.Equal(t, want.Labels, got.Labels)
+		assert.Equal(t, want.Rule, got.Rule)
+		assert.WithinDuration(t, want.Created, got.Created, time.Millisecond)
+	}
+
+	ds, err = r.ListPolicyDenials(ctx, d1.ID, 10)
+	require.NoError(t, err)
+	require.Len(t, ds, 1)
+	assert.Equal(t, d2.ID, ds[0].ID)
+
+	ds, err = r.ListPolicyDenials(ctx, after, 1)
+	require.NoError(t, err)
+	assert.Len(t, ds, 1)
+}
+
+func newWallet(t *testing.T, r service.Repository) *service.Wallet {
+	w := &service.Wallet{
+		ExternalID: uuid.NewString(),
+		Labels:     map[string]string{"source": "repotest"},
+		Created:    time.Now().UTC().Truncate(time.Millisecond),
+	}
+	require.NoError(t, r.CreateWallet(context.Background(), w))
+	return w
+}
+
+func newTransaction(refno int, amount, oldBalance float64) *service.Transaction {
+	return &service.Transaction{
+		ID:          uuid.NewString(),
+		RefNo:       refno,
+		Amount:      amount,
+		Description: "repotest transaction",
+		Labels:      map[string]string{"source": "repotest"},
+		Fingerprint: uuid.NewString(),
+		Created:     time.Now().UTC().Truncate(time.Millisecond),
+		OldBalance:  oldBalance,
+		NewBalance:  oldBalance + amount,
+	}
+}
+
+// post appends a transaction to the wallet the same way the wallet service
+// does, retrying on conflicts.
+func post(ctx context.Context, r service.Repository, wid int, amount float64) error {
+	for {
+		refno, balance := 1, 0.
+		lt, err := r.GetLatestTransaction(ctx, wid)
+		if err == nil {
+			refno, balance = lt.RefNo+1, lt.NewBalance
+		} else if !errors.Is(err, service.ErrTransactionNotFound) {
+			return err
+		}
+
+		tr := newTransaction(refno, amount, balance)
+		service.ChainTransaction(wid, tr, lt)
+		tr.Journal = service.JournalLines(wid, tr)
+		err = r.CreateTransaction(ctx, wid, tr)
+		if errors.Is(err, service.ErrTransactionConsistency) ||
+			errors.Is(err, service.ErrTransactionAlreadyExistsByRefNo) {
+			continue
+		}
+		return err
+	}
+}
+
+func testCreateWallet(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+	assert.Positive(t, w.ID)
+
+	got, err := r.GetWallet(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, w.ID, got.ID)
+	assert.Equal(t, w.ExternalID, got.ExternalID)
+	assert.Equal(t, w.Labels, got.Labels)
+	assert.WithinDuration(t, w.Created, got.Created, time.Millisecond)
+
+	b, err := r.GetWalletBalance(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 0., b)
+
+	other := newWallet(t, r)
+	assert.NotEqual(t, w.ID, other.ID)
+}
+
+func testCreateWalletDuplicate(t *testing.T, r service.Repository) {
+	w := newWallet(t, r)
+
+	dup := &service.Wallet{ExternalID: w.ExternalID, Labels: map[string]string{}, Created: w.Created}
+	err := r.CreateWallet(context.Background(), dup)
+	assert.ErrorIs(t, err, service.ErrWalletAlreadyExists)
+}
+
+func testWalletNotFound(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+
+	_, err := r.GetWallet(ctx, -1)
+	assert.ErrorIs(t, err, service.ErrWalletNotFound)
+
+	_, err = r.GetWalletBalance(ctx, -1)
+	assert.ErrorIs(t, err, service.ErrWalletNotFound)
+}
+
+func testTransactionNotFound(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+
+	_, err := r.GetLatestTransaction(ctx, -1)
+	assert.ErrorIs(t, err, service.ErrTransactionNotFound)
+
+	w := newWallet(t, r)
+	_, err = r.GetLatestTransaction(ctx, w.ID)
+	assert.ErrorIs(t, err, service.ErrTransactionNotFound)
+}
+
+func testCreateTransaction(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+
+	tr := newTransaction(1, 24.75, 0)
+	service.ChainTransaction(w.ID, tr, nil)
+	require.NoError(t, r.CreateTransaction(ctx, w.ID, tr))
+
+	b, err := r.GetWalletBalance(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 24.75, b)
+
+	lt, err := r.GetLatestTransaction(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, tr.ID, lt.ID)
+	assert.Equal(t, tr.RefNo, lt.RefNo)
+	assert.Equal(t, tr.Amount, lt.Amount)
+	assert.Equal(t, tr.Description, lt.Description)
+	assert.Equal(t, tr.Labels, lt.Labels)
+	assert.Equal(t, tr.Fingerprint, lt.Fingerprint)
+	assert.Equal(t, tr.OldBalance, lt.OldBalance)
+	assert.Equal(t, tr.NewBalance, lt.NewBalance)
+	assert.Equal(t, tr.PrevHash, lt.PrevHash)
+	assert.Equal(t, tr.Hash, lt.Hash)
+	assert.WithinDuration(t, tr.Created, lt.Created, time.Millisecond)
+}
+
+func testCreateTransactionDuplicateRefNo(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+	require.NoError(t, r.CreateTransaction(ctx, w.ID, newTransaction(1, 10, 0)))
+
+	err := r.CreateTransaction(ctx, w.ID, newTransaction(1, 5, 10))
+	assert.ErrorIs(t, err, service.ErrTransactionAlreadyExistsByRefNo)
+
+	// same refno on another wallet is fine
+	other := newWallet(t, r)
+	assert.NoError(t, r.CreateTransaction(ctx, other.ID, newTransaction(1, 10, 0)))
+}
+
+func testCreateTransactionDuplicateFingerprint(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+	tr := newTransaction(1, 10, 0)
+	require.NoError(t, r.CreateTransaction(ctx, w.ID, tr))
+
+	dup := newTransaction(2, 5, 10)
+	dup.Fingerprint = tr.Fingerprint
+	assert.ErrorIs(t, r.CreateTransaction(ctx, w.ID, dup), service.ErrTransactionAlreadyExistsByFingerprint)
+
+	// fingerprints are unique across wallets
+	other := newWallet(t, r)
+	dup = newTransaction(1, 5, 0)
+	dup.Fingerprint = tr.Fingerprint
+	assert.ErrorIs(t, r.CreateTransaction(ctx, other.ID, dup), service.ErrTransactionAlreadyExistsByFingerprint)
+
+	// failed transactions leave no trace
+	b, err := r.GetWalletBalance(ctx, other.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 0., b)
+	_, err = r.GetLatestTransaction(ctx, other.ID)
+	assert.ErrorIs(t, err, service.ErrTransactionNotFound)
+}
+
+func testCreateTransactionStaleBalance(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+	require.NoError(t, r.CreateTransaction(ctx, w.ID, newTransaction(1, 10, 0)))
+
+	err := r.CreateTransaction(ctx, w.ID, newTransaction(2, 5, 0))
+	assert.ErrorIs(t, err, service.ErrTransactionConsistency)
+
+	lt, err := r.GetLatestTransaction(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, lt.RefNo)
+
+	b, err := r.GetWalletBalance(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 10., b)
+}
+
+func testCreateTransactionUnknownWallet(t *testing.T, r service.Repository) {
+	err := r.CreateTransaction(context.Background(), -1, newTransaction(1, 10, 0))
+	assert.ErrorIs(t, err, service.ErrTransactionConsistency)
+}
+
+func testRefNoSequence(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+
+	amounts := []float64{10, -2.5, 7.25, -4, 1}
+	for _, a := range amounts {
+		require.NoError(t, post(ctx, r, w.ID, a))
+	}
+
+	lt, err := r.GetLatestTransaction(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, len(amounts), lt.RefNo)
+	assert.Equal(t, 11.75, lt.NewBalance)
+	assert.Equal(t, 10.75, lt.OldBalance)
+}
+
+func testConcurrentConflictingWrites(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+
+	// every writer competes for the same refno; exactly one of them wins
+	const writers = 10
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- r.CreateTransaction(ctx, w.ID, newTransaction(1, 10, 0))
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	won := 0
+	for err := range errs {
+		if err == nil {
+			won++
+			continue
+		}
+		if !errors.Is(err, service.ErrTransactionAlreadyExistsByRefNo) &&
+			!errors.Is(err, service.ErrTransactionConsistency) {
+			t.Errorf("unexpected error: %v", err)
+		}
+	}
+	assert.Equal(t, 1, won)
+
+	b, err := r.GetWalletBalance(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 10., b)
+}
+
+func testConcurrentBalanceInvariants(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+
+	const writers, posts = 5, 4
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < posts; j++ {
+				assert.NoError(t, post(ctx, r, w.ID, 1.5))
+			}
+		}()
+	}
+	wg.Wait()
+
+	lt, err := r.GetLatestTransaction(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, writers*posts, lt.RefNo)
+	assert.Equal(t, writers*posts*1.5, lt.NewBalance)
+
+	b, err := r.GetWalletBalance(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, lt.NewBalance, b)
+}
+
+func testPostTransaction(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+
+	// posting continues the sequence of optimistically created transactions,
+	// also if they were created by an instance with a clock ahead
+	first := newTransaction(1, 10, 0)
+	first.Created = first.Created.Add(time.Hour)
+	require.NoError(t, r.CreateTransaction(ctx, w.ID, first))
+
+	tr := newTransaction(0, 2.5, 0)
+	require.NoError(t, r.PostTransaction(ctx, w.ID, tr))
+	assert.Equal(t, 2, tr.RefNo)
+	assert.Equal(t, 10., tr.OldBalance)
+	assert.Equal(t, 12.5, tr.NewBalance)
+	assert.True(t, tr.Created.Equal(first.Created), "created %v, previous %v", tr.Created, first.Created)
+
+	tr = newTransaction(0, -12.5, 0)
+	require.NoError(t, r.PostTransaction(ctx, w.ID, tr))
+	assert.Equal(t, 3, tr.RefNo)
+	assert.Equal(t, 0., tr.NewBalance)
+
+	lt, err := r.GetLatestTransaction(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, tr.ID, lt.ID)
+	assert.Equal(t, 12.5, lt.OldBalance)
+
+	b, err := r.GetWalletBalance(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 0., b)
+}
+
+func testPostTransactionWalletNotFound(t *testing.T, r service.Repository) {
+	err := r.PostTransaction(context.Background(), -1, newTransaction(0, 10, 0))
+	assert.ErrorIs(t, err, service.ErrWalletNotFound)
+}
+
+func testPostTransactionNotEnoughBalance(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+	require.NoError(t, r.PostTransaction(ctx, w.ID, newTransaction(0, 5, 0)))
+
+	err := r.PostTransaction(ctx, w.ID, newTransaction(0, -6, 0))
+	assert.ErrorIs(t, err, service.ErrNotEnoughWalletBalance)
+
+	lt, err := r.GetLatestTransaction(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, lt.RefNo)
+
+	b, err := r.GetWalletBalance(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 5., b)
+}
+
+func testPostTransactionDuplicateFingerprint(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+	tr := newTransaction(0, 5, 0)
+	require.NoError(t, r.PostTransaction(ctx, w.ID, tr))
+
+	dup := newTransaction(0, 5, 0)
+	dup.Fingerprint = tr.Fingerprint
+	assert.ErrorIs(t, r.PostTransaction(ctx, w.ID, dup), service.ErrTransactionAlreadyExistsByFingerprint)
+
+	b, err := r.GetWalletBalance(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 5., b)
+}
+
+func testConcurrentPosts(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+
+	// posting never conflicts, every writer succeeds without retries
+	const writers, posts = 5, 4
+	var wg sync.WaitGroup
+	for i := 0; i < writers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < posts; j++ {
+				assert.NoError(t, r.PostTransaction(ctx, w.ID, newTransaction(0, 1.5, 0)))
+			}
+		}()
+	}
+	wg.Wait()
+
+	lt, err := r.GetLatestTransaction(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, writers*posts, lt.RefNo)
+	assert.Equal(t, writers*posts*1.5, lt.NewBalance)
+
+	b, err := r.GetWalletBalance(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, lt.NewBalance, b)
+
+	// transactions are stamped in the lock, so creation times follow refnos
+	trs, err := r.ListTransactions(ctx, w.ID, 0, writers*posts)
+	require.NoError(t, err)
+	for i := 1; i < len(trs); i++ {
+		assert.False(t, trs[i].Created.Before(trs[i-1].Created), "refno %d is created before refno %d", trs[i].RefNo, trs[i-1].RefNo)
+	}
+}
+
+func testListWallets(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w1, w2, w3 := newWallet(t, r), newWallet(t, r), newWallet(t, r)
+
+	ws, err := r.ListWallets(ctx, w1.ID-1, 2)
+	require.NoError(t, err)
+	require.Len(t, ws, 2)
+	assert.Equal(t, w1.ID, ws[0].ID)
+	assert.Equal(t, w1.ExternalID, ws[0].ExternalID)
+	assert.Equal(t, w2.ID, ws[1].ID)
+
+	ws, err = r.ListWallets(ctx, w2.ID, 10)
+	require.NoError(t, err)
+	require.NotEmpty(t, ws)
+	assert.Equal(t, w3.ID, ws[0].ID)
+}
+
+func testListTransactions(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+
+	trs, err := r.ListTransactions(ctx, w.ID, 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, trs)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, post(ctx, r, w.ID, 2))
+	}
+
+	trs, err = r.ListTransactions(ctx, w.ID, 0, 3)
+	require.NoError(t, err)
+	require.Len(t, trs, 3)
+	for i, tr := range trs {
+		assert.Equal(t, i+1, tr.RefNo)
+		assert.Equal(t, float64(2*i), tr.OldBalance)
+	}
+
+	trs, err = r.ListTransactions(ctx, w.ID, 3, 3)
+	require.NoError(t, err)
+	require.Len(t, trs, 2)
+	assert.Equal(t, 4, trs[0].RefNo)
+	assert.Equal(t, 5, trs[1].RefNo)
+}
+
+func testHashChain(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+
+	// optimistic and locking posts extend the same chain
+	require.NoError(t, post(ctx, r, w.ID, 10))
+	tr := newTransaction(0, -3.3, 0)
+	require.NoError(t, r.PostTransaction(ctx, w.ID, tr))
+	require.NoError(t, post(ctx, r, w.ID, 0.1))
+	require.NoError(t, r.PostTransaction(ctx, w.ID, newTransaction(0, 0.2, 0)))
+
+	trs, err := r.ListTransactions(ctx, w.ID, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, trs, 4)
+	assert.Empty(t, trs[0].PrevHash)
+	assert.Equal(t, trs[0].Hash, trs[1].PrevHash)
+	assert.Equal(t, tr.Hash, trs[1].Hash)
+	assert.Equal(t, trs[2].Hash, trs[3].PrevHash)
+
+	// hashes survive the round trip through the backend
+	broken, err := service.VerifyWalletChain(ctx, r, w.ID)
+	require.NoError(t, err)
+	assert.Nil(t, broken)
+}
+
+func testHashChainDecimals(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	s := service.NewWalletService(r, zerolog.Nop())
+	w := newWallet(t, r)
+
+	// storage would round 2.675 to 2.68, which would not match its hash
+	_, err := s.CreateTransaction(ctx, w.ID, &service.TransactionModel{Amount: 2.675, Description: "d", Fingerprint: uuid.NewString()})
+	require.ErrorIs(t, err, service.ErrInvalidAmount)
+
+	for _, amount := range []float64{2.67, 1.05, 1.1, -1.01, 7.3} {
+		_, err := s.CreateTransaction(ctx, w.ID, &service.TransactionModel{Amount: amount, Description: "d", Fingerprint: uuid.NewString()})
+		require.NoError(t, err)
+	}
+	broken, err := service.VerifyWalletChain(ctx, r, w.ID)
+	require.NoError(t, err)
+	assert.Nil(t, broken)
+}
+
+func trialBalance(t *testing.T, r service.Repository) map[string]float64 {
+	bs, err := r.TrialBalance(context.Background())
+	require.NoError(t, err)
+
+	m := map[string]float64{}
+	for _, b := range bs {
+		m[b.Code] = b.Balance()
+	}
+	return m
+}
+
+func testTrialBalance(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+
+	before := trialBalance(t, r)
+	for _, a := range service.Accounts {
+		assert.Contains(t, before, a.Code)
+	}
+
+	postWithReason := func(amount float64, reason string) *service.Transaction {
+		tr := newTransaction(0, amount, 0)
+		tr.Labels = map[string]string{service.ReasonLabel: reason}
+		tr.Journal = service.JournalLines(w.ID, tr)
+		require.NoError(t, r.PostTransaction(ctx, w.ID, tr))
+		return tr
+	}
+
+	deposit := postWithReason(100, "deposit")
+	postWithReason(-30, "stake")
+	postWithReason(50, "prize")
+	postWithReason(5, "unknown")
+
+	// failed postings leave no journal lines
+	dup := newTransaction(0, 10, 0)
+	dup.Fingerprint = deposit.Fingerprint
+	dup.Journal = service.JournalLines(w.ID, dup)
+	require.ErrorIs(t, r.PostTransaction(ctx, w.ID, dup), service.ErrTransactionAlreadyExistsByFingerprint)
+
+	after := trialBalance(t, r)
+	delta := func(account string) float64 {
+		return math.Round((after[account]-before[account])*100) / 100
+	}
+	assert.Equal(t, -125., delta(service.AccountWallets))
+	assert.Equal(t, 100., delta(service.AccountCashIn))
+	assert.Equal(t, -30., delta(service.AccountBetRevenue))
+	assert.Equal(t, 50., delta(service.AccountPayouts))
+	assert.Equal(t, 5., delta(service.AccountSuspense))
+	assert.Equal(t, 0., delta(service.AccountBonusCost))
+
+	sum := 0.
+	for _, b := range after {
+		sum += b
+	}
+	assert.InDelta(t, 0., sum, 0.001)
+}
+
+func testGetTransactionAt(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+	t0 := time.Now().UTC().Truncate(time.Millisecond).Add(-time.Hour)
+
+	_, err := r.GetTransactionAt(ctx, w.ID, t0)
+	assert.ErrorIs(t, err, service.ErrTransactionNotFound)
+
+	var prev *service.Transaction
+	for i := 1; i <= 3; i++ {
+		tr := newTransaction(i, 10, float64(10*(i-1)))
+		tr.Created = t0.Add(time.Duration(i) * time.Minute)
+		service.ChainTransaction(w.ID, tr, prev)
+		require.NoError(t, r.CreateTransaction(ctx, w.ID, tr))
+		prev = tr
+	}
+
+	tests := []struct {
+		at    time.Time
+		refno int
+	}{
+		{t0.Add(time.Minute + time.Second), 1},
+		{t0.Add(2 * time.Minute), 2},
+		{t0.Add(2*time.Minute - time.Millisecond), 1},
+		{t0.Add(time.Hour), 3},
+	}
+	for _, tt := range tests {
+		tr, err := r.GetTransactionAt(ctx, w.ID, tt.at)
+		require.NoError(t, err)
+		assert.Equal(t, tt.refno, tr.RefNo, "at %v", tt.at)
+		assert.Equal(t, float64(10*tt.refno), tr.NewBalance)
+	}
+
+	_, err = r.GetTransactionAt(ctx, w.ID, t0.Add(time.Minute-time.Millisecond))
+	assert.ErrorIs(t, err, service.ErrTransactionNotFound)
+
+	_, err = r.GetTransactionAt(ctx, -1, t0.Add(time.Hour))
+	assert.ErrorIs(t, err, service.ErrTransactionNotFound)
+}
+
+func testRepairBalance(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w := newWallet(t, r)
+	require.NoError(t, post(ctx, r, w.ID, 10))
+	require.NoError(t, post(ctx, r, w.ID, 5))
+
+	require.NoError(t, r.RepairBalance(ctx, w.ID, 2, 15, 20))
+	b, err := r.GetWalletBalance(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 20., b)
+
+	// balance or latest refno changed in the meantime
+	assert.ErrorIs(t, r.RepairBalance(ctx, w.ID, 2, 15, 0), service.ErrTransactionConsistency)
+	assert.ErrorIs(t, r.RepairBalance(ctx, w.ID, 1, 20, 15), service.ErrTransactionConsistency)
+
+	assert.ErrorIs(t, r.RepairBalance(ctx, -1, 0, 0, 0), service.ErrWalletNotFound)
+}
+
+func testReconcile(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+
+	// a healthy wallet
+	w := newWallet(t, r)
+	require.NoError(t, post(ctx, r, w.ID, 10))
+	require.NoError(t, post(ctx, r, w.ID, -2.5))
+
+	ds, err := service.ReconcileWallet(ctx, r, w.ID, false)
+	require.NoError(t, err)
+	assert.Empty(t, ds)
+
+	// diverged materialized balance is detected and repaired
+	require.NoError(t, r.RepairBalance(ctx, w.ID, 2, 7.5, 100))
+	ds, err = service.ReconcileWallet(ctx, r, w.ID, true)
+	require.NoError(t, err)
+	require.Len(t, ds, 1)
+	assert.Equal(t, service.DiscrepancyBalanceMismatch, ds[0].Kind)
+	assert.Equal(t, 7.5, ds[0].Expected)
+	assert.Equal(t, 100., ds[0].Actual)
+	assert.True(t, ds[0].Repaired)
+
+	b, err := r.GetWalletBalance(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 7.5, b)
+
+	// inconsistencies inside the ledger
+	w = newWallet(t, r)
+	for _, tr := range []*service.Transaction{
+		newTransaction(1, 10, 0),
+		newTransaction(3, 5, 10), // gap
+		{ID: uuid.NewString(), RefNo: 4, Amount: 5, OldBalance: 15, NewBalance: 25,
+			Fingerprint: uuid.NewString(), Description: "broken", Created: time.Now().UTC()},
+	} {
+		require.NoError(t, r.CreateTransaction(ctx, w.ID, tr))
+	}
+
+	ds, err = service.ReconcileWallet(ctx, r, w.ID, false)
+	require.NoError(t, err)
+	kinds := []string{}
+	for _, d := range ds {
+		kinds = append(kinds, d.Kind)
+	}
+	assert.Equal(t, []string{service.DiscrepancyRefNoGap, service.DiscrepancyBrokenChain, service.DiscrepancySumMismatch}, kinds)
+	assert.Equal(t, 3, ds[0].RefNo)
+	assert.Equal(t, 4, ds[1].RefNo)
+	assert.Equal(t, 20., ds[2].Expected)
+}
+
+// dailyHistory creates a wallet three days ago with transactions of 10 and 5
+// on the day after and -3 on the day after that; it returns the wallet and the
+// first day with transactions.
+func dailyHistory(t *testing.T, r service.Repository) (*service.Wallet, time.Time) {
+	ctx := context.Background()
+	d0 := service.Day(time.Now()).AddDate(0, 0, -3)
+	d1 := d0.AddDate(0, 0, 1)
+
+	w := &service.Wallet{ExternalID: uuid.NewString(), Labels: map[string]string{}, Created: d0.Add(time.Hour)}
+	require.NoError(t, r.CreateWallet(ctx, w))
+
+	var prev *service.Transaction
+	for i, h := range []struct {
+		amount float64
+		at     time.Time
+	}{
+		{10, d1.Add(time.Hour)},
+		{5, d1.Add(24*time.Hour - time.Millisecond)},
+		{-3, d1.AddDate(0, 0, 1).Add(time.Hour)},
+	} {
+		balance := 0.
+		if prev != nil {
+			balance = prev.NewBalance
+		}
+		tr := newTransaction(i+1, h.amount, balance)
+		tr.Created = h.at
+		service.ChainTransaction(w.ID, tr, prev)
+		require.NoError(t, r.CreateTransaction(ctx, w.ID, tr))
+		prev = tr
+	}
+
+	return w, d1
+}
+
+func testListTransactionsBetween(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w, d1 := dailyHistory(t, r)
+	to := d1.Add(24*time.Hour - time.Microsecond)
+
+	trs, err := r.ListTransactionsBetween(ctx, w.ID, d1, to, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, trs, 2)
+	assert.Equal(t, 1, trs[0].RefNo)
+	assert.Equal(t, 2, trs[1].RefNo)
+
+	trs, err = r.ListTransactionsBetween(ctx, w.ID, d1, to, 1, 1)
+	require.NoError(t, err)
+	require.Len(t, trs, 1)
+	assert.Equal(t, 2, trs[0].RefNo)
+
+	trs, err = r.ListTransactionsBetween(ctx, w.ID, d1.AddDate(0, 0, -1), d1.Add(-time.Microsecond), 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, trs)
+}
+
+func testSnapshots(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w, d1 := dailyHistory(t, r)
+
+	_, err := r.GetSnapshot(ctx, w.ID, d1)
+	assert.ErrorIs(t, err, service.ErrSnapshotNotFound)
+
+	// the day before the wallet is created has no snapshot
+	_, err = service.SnapshotDay(ctx, r, d1.AddDate(0, 0, -2))
+	require.NoError(t, err)
+	_, err = r.GetSnapshot(ctx, w.ID, d1.AddDate(0, 0, -2))
+	assert.ErrorIs(t, err, service.ErrSnapshotNotFound)
+
+	for _, tt := range []struct {
+		day     time.Time
+		balance float64
+		refno   int
+	}{
+		{d1.AddDate(0, 0, -1), 0, 0},
+		{d1, 15, 2},
+		{d1.AddDate(0, 0, 1), 12, 3},
+	} {
+		n, err := service.SnapshotDay(ctx, r, tt.day)
+		require.NoError(t, err)
+		assert.Positive(t, n)
+
+		s, err := r.GetSnapshot(ctx, w.ID, tt.day.Add(time.Hour))
+		require.NoError(t, err)
+		assert.Equal(t, w.ID, s.WalletID)
+		assert.True(t, tt.day.Equal(s.Day), "day %v", s.Day)
+		assert.Equal(t, tt.balance, s.Balance)
+		assert.Equal(t, tt.refno, s.RefNo)
+	}
+
+	// snapshots of a day are overwritten
+	require.NoError(t, r.SaveSnapshot(ctx, &service.Snapshot{WalletID: w.ID, Day: d1, Balance: 1.25, RefNo: 2, Created: time.Now().UTC()}))
+	s, err := r.GetSnapshot(ctx, w.ID, d1)
+	require.NoError(t, err)
+	assert.Equal(t, 1.25, s.Balance)
+}
+
+func testStatement(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	w, d1 := dailyHistory(t, r)
+	s := service.NewWalletService(r, zerolog.Nop())
+
+	st, err := s.GetStatement(ctx, w.ID, d1, d1)
+	require.NoError(t, err)
+	assert.Equal(t, 0., st.OpeningBalance)
+	require.Len(t, st.Transactions, 2)
+	assert.Equal(t, 15., st.ClosingBalance)
+
+	_, err = service.SnapshotDay(ctx, r, d1)
+	require.NoError(t, err)
+
+	d2 := d1.AddDate(0, 0, 1)
+	st, err = s.GetStatement(ctx, w.ID, d2, d2.AddDate(0, 0, 1))
+	require.NoError(t, err)
+	assert.Equal(t, d2.Format(service.DayLayout), st.From)
+	assert.Equal(t, 15., st.OpeningBalance)
+	require.Len(t, st.Transactions, 1)
+	assert.Equal(t, 3, st.Transactions[0].RefNo)
+	assert.Equal(t, 12., st.ClosingBalance)
+}
+
+// drainEvents marks every event pending for the relay consumer published and
+// returns the ones of the wallet in the order they were listed.
+func drainEvents(t *testing.T, r service.Repository, wid int) []*service.Event {
+	return drainConsumer(t, r, service.ConsumerRelay, wid)
+}
+
+func drainConsumer(t *testing.T, r service.Repository, consumer string, wid int) []*service.Event {
+	ctx := context.Background()
+	var last int64
+	res := []*service.Event{}
+	for {
+		es, err := r.ListPendingEvents(ctx, consumer, 100)
+		require.NoError(t, err)
+		if len(es) == 0 {
+			return res
+		}
+
+		seqs := []int64{}
+		for _, e := range es {
+			assert.Greater(t, e.Seq, last)
+			last = e.Seq
+			seqs = append(seqs, e.Seq)
+			if e.WalletID == wid {
+				res = append(res, e)
+			}
+		}
+		require.NoError(t, r.MarkEventsPublished(ctx, consumer, seqs))
+	}
+}
+
+func testOutbox(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	drainEvents(t, r, 0)
+
+	w := newWallet(t, r)
+	require.NoError(t, post(ctx, r, w.ID, 10))
+	require.NoError(t, r.PostTransaction(ctx, w.ID, newTransaction(0, -4, 0)))
+	require.NoError(t, r.RepairBalance(ctx, w.ID, 2, 6, 7))
+
+	// failed mutations leave no events
+	assert.ErrorIs(t, r.CreateTransaction(ctx, w.ID, newTransaction(3, 1, 0)), service.ErrTransactionConsistency)
+	assert.ErrorIs(t, r.PostTransaction(ctx, w.ID, newTransaction(0, -100, 0)), service.ErrNotEnoughWalletBalance)
+
+	es := drainEvents(t, r, w.ID)
+	types := []string{}
+	for _, e := range es {
+		types = append(types, e.Type)
+	}
+	assert.Equal(t, []string{
+		service.EventWalletCreated,
+		service.EventTransactionCreated, service.EventBalanceChanged,
+		service.EventTransactionCreated, service.EventBalanceChanged,
+		service.EventBalanceChanged,
+	}, types)
+
+	created := &service.Wallet{}
+	require.NoError(t, json.Unmarshal(es[0].Payload, created))
+	assert.Equal(t, w.ID, created.ID)
+	assert.Equal(t, w.ExternalID, created.ExternalID)
+
+	tr := &service.Transaction{}
+	require.NoError(t, json.Unmarshal(es[3].Payload, tr))
+	assert.Equal(t, 2, tr.RefNo)
+	assert.Equal(t, -4., tr.Amount)
+
+	for _, tt := range []struct {
+		event int
+		want  service.BalanceChange
+	}{
+		{2, service.BalanceChange{WalletID: w.ID, RefNo: 1, OldBalance: 0, NewBalance: 10}},
+		{4, service.BalanceChange{WalletID: w.ID, RefNo: 2, OldBalance: 10, NewBalance: 6}},
+		{5, service.BalanceChange{WalletID: w.ID, RefNo: 2, OldBalance: 6, NewBalance: 7}},
+	} {
+		got := service.BalanceChange{}
+		require.NoError(t, json.Unmarshal(es[tt.event].Payload, &got))
+		assert.Equal(t, tt.want, got)
+	}
+
+	// published events are not listed again
+	es, err := r.ListPendingEvents(ctx, service.ConsumerRelay, 100)
+	require.NoError(t, err)
+	assert.Empty(t, es)
+
+	// but they are still pending for other consumers
+	es = drainConsumer(t, r, service.ConsumerWebhooks, w.ID)
+	assert.Len(t, es, 6)
+}
+
+func testPruneEvents(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	drainEvents(t, r, 0)
+	drainConsumer(t, r, service.ConsumerWebhooks, 0)
+	later := time.Now().Add(time.Hour)
+	_, err := r.PruneEvents(ctx, later)
+	require.NoError(t, err)
+
+	// events are kept until every consumer published them
+	w := newWallet(t, r)
+	require.NoError(t, post(ctx, r, w.ID, 10))
+	require.Len(t, drainEvents(t, r, w.ID), 3)
+	n, err := r.PruneEvents(ctx, later)
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	// and until they are old enough
+	require.Len(t, drainConsumer(t, r, service.ConsumerWebhooks, w.ID), 3)
+	n, err = r.PruneEvents(ctx, time.Now().Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Zero(t, n)
+
+	n, err = r.PruneEvents(ctx, later)
+	require.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	// later events are listed as before
+	require.NoError(t, post(ctx, r, w.ID, 5))
+	es := drainConsumer(t, r, service.ConsumerWebhooks, w.ID)
+	require.Len(t, es, 2)
+	assert.Equal(t, service.EventTransactionCreated, es[0].Type)
+}
+
+func newSubscription(t *testing.T, r service.Repository) *service.Subscription {
+	sub := &service.Subscription{
+		URL:        "http://localhost/hook",
+		EventTypes: []string{service.EventTransactionCreated, service.EventBalanceChanged},
+		Labels:     map[string]string{"brand": "repotest"},
+		Secret:     uuid.NewString(),
+		Created:    time.Now().UTC().Truncate(time.Millisecond),
+	}
+	require.NoError(t, r.CreateSubscription(context.Background(), sub))
+	return sub
+}
+
+func newDelivery(sid int, seq int64, next time.Time) *service.Delivery {
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	return &service.Delivery{
+		SubscriptionID: sid,
+		Event: service.Event{Seq: seq, Type: service.EventBalanceChanged, WalletID: 1,
+			Payload: json.RawMessage(`{"wid":1}`), Created: now},
+		Status:      service.DeliveryPending,
+		NextAttempt: next,
+		Created:     now,
+		Updated:     now,
+	}
+}
+
+func testSubscriptions(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	sub := newSubscription(t, r)
+	assert.Positive(t, sub.ID)
+
+	got, err := r.GetSubscription(ctx, sub.ID)
+	require.NoError(t, err)
+	assert.Equal(t, sub.URL, got.URL)
+	assert.Equal(t, sub.EventTypes, got.EventTypes)
+	assert.Equal(t, sub.Labels, got.Labels)
+	assert.Equal(t, sub.Secret, got.Secret)
+	assert.WithinDuration(t, sub.Created, got.Created, time.Millisecond)
+
+	other := newSubscription(t, r)
+	subs, err := r.ListSubscriptions(ctx)
+	require.NoError(t, err)
+	ids := []int{}
+	for _, s := range subs {
+		ids = append(ids, s.ID)
+	}
+	assert.Contains(t, ids, sub.ID)
+	assert.Contains(t, ids, other.ID)
+
+	// deliveries go with the subscription
+	require.NoError(t, r.CreateDeliveries(ctx, []*service.Delivery{newDelivery(sub.ID, 1, time.Now())}))
+	require.NoError(t, r.DeleteSubscription(ctx, sub.ID))
+	_, err = r.GetSubscription(ctx, sub.ID)
+	assert.ErrorIs(t, err, service.ErrSubscriptionNotFound)
+	ds, err := r.ListDeliveries(ctx, sub.ID, 0, 10)
+	require.NoError(t, err)
+	assert.Empty(t, ds)
+
+	assert.ErrorIs(t, r.DeleteSubscription(ctx, sub.ID), service.ErrSubscriptionNotFound)
+	assert.ErrorIs(t, r.CreateDeliveries(ctx, []*service.Delivery{newDelivery(sub.ID, 2, time.Now())}),
+		service.ErrSubscriptionNotFound)
+}
+
+func testDeliveries(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	sub := newSubscription(t, r)
+	now := time.Now().UTC().Truncate(time.Millisecond)
+
+	require.NoError(t, r.CreateDeliveries(ctx, []*service.Delivery{
+		newDelivery(sub.ID, 1, now.Add(-time.Minute)),
+		newDelivery(sub.ID, 2, now.Add(-2*time.Minute)),
+		newDelivery(sub.ID, 3, now.Add(time.Hour)),
+	}))
+
+	// the same event is delivered once per subscription
+	require.NoError(t, r.CreateDeliveries(ctx, []*service.Delivery{newDelivery(sub.ID, 1, now)}))
+
+	ds, err := r.ListDeliveries(ctx, sub.ID, 0, 10)
+	require.NoError(t, err)
+	require.Len(t, ds, 3)
+	assert.Equal(t, int64(1), ds[0].Event.Seq)
+	assert.Equal(t, service.EventBalanceChanged, ds[0].Event.Type)
+	assert.JSONEq(t, `{"wid":1}`, string(ds[0].Event.Payload))
+	assert.Equal(t, service.DeliveryPending, ds[0].Status)
+
+	page, err := r.ListDeliveries(ctx, sub.ID, ds[0].ID, 1)
+	require.NoError(t, err)
+	require.Len(t, page, 1)
+	assert.Equal(t, ds[1].ID, page[0].ID)
+
+	// due deliveries are claimed until the lease ends
+	lease := time.Minute
+	claim := func(at time.Time) []int64 {
+		due, err := r.ClaimDueDeliveries(ctx, at, lease, 100)
+		require.NoError(t, err)
+		mine := []int64{}
+		for _, d := range due {
+			if d.SubscriptionID == sub.ID {
+				mine = append(mine, d.Event.Seq)
+				assert.WithinDuration(t, at.Add(lease), d.NextAttempt, time.Millisecond)
+			}
+		}
+		return mine
+	}
+	assert.Equal(t, []int64{2, 1}, claim(now))
+	assert.Empty(t, claim(now))
+	assert.ElementsMatch(t, []int64{1, 2}, claim(now.Add(lease)))
+
+	// attempts are saved
+	d := ds[0]
+	d.Status = service.DeliveryDead
+	d.Attempts = 5
+	d.LastError = "connection refused"
+	d.LastStatusCode = 503
+	d.NextAttempt = now.Add(time.Minute)
+	d.Updated = now
+	require.NoError(t, r.UpdateDelivery(ctx, d))
+
+	got, err := r.GetDelivery(ctx, d.ID)
+	require.NoError(t, err)
+	assert.Equal(t, service.DeliveryDead, got.Status)
+	assert.Equal(t, 5, got.Attempts)
+	assert.Equal(t, "connection refused", got.LastError)
+	assert.Equal(t, 503, got.LastStatusCode)
+	assert.WithinDuration(t, d.NextAttempt, got.NextAttempt, time.Millisecond)
+
+	due, err := r.ClaimDueDeliveries(ctx, now.Add(time.Hour), lease, 100)
+	require.NoError(t, err)
+	for _, dd := range due {
+		assert.NotEqual(t, d.ID, dd.ID)
+	}
+
+	_, err = r.GetDelivery(ctx, -1)
+	assert.ErrorIs(t, err, service.ErrDeliveryNotFound)
+	assert.ErrorIs(t, r.UpdateDelivery(ctx, &service.Delivery{ID: -1}), service.ErrDeliveryNotFound)
+}
+
+func testListen(t *testing.T, r service.Repository) {
+	ctx, cancel := context.WithCancel(context.Background())
+	w, other := newWallet(t, r), newWallet(t, r)
+
+	notes, err := r.Listen(ctx, w.ID)
+	require.NoError(t, err)
+
+	require.NoError(t, post(context.Background(), r, other.ID, 1))
+	require.NoError(t, r.PostTransaction(context.Background(), w.ID, newTransaction(0, 1, 0)))
+
+	select {
+	case refno := <-notes:
+		assert.Equal(t, 1, refno)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification")
+	}
+
+	// the channel is closed with ctx
+	cancel()
+	for {
+		select {
+		case _, ok := <-notes:
+			if !ok {
+				return
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("channel is not closed")
+		}
+	}
+}
+
+func testFollowTransactions(t *testing.T, r service.Repository) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := newWallet(t, r)
+	s := service.NewWalletService(r, zerolog.Nop())
+
+	require.NoError(t, post(ctx, r, w.ID, 1))
+	require.NoError(t, post(ctx, r, w.ID, 2))
+
+	refnos := make(chan int, 10)
+	done := make(chan error, 1)
+	go func() {
+		// resumes after refno 1; the tick is long so that new transactions
+		// arrive by notifications
+		done <- s.FollowTransactions(ctx, w.ID, 1, time.Hour, func(t *service.Transaction) error {
+			refnos <- t.RefNo
+			return nil
+		}, func() error { return nil })
+	}()
+
+	next := func() int {
+		select {
+		case refno := <-refnos:
+			return refno
+		case <-time.After(5 * time.Second):
+			t.Fatal("no transaction")
+			return 0
+		}
+	}
+
+	assert.Equal(t, 2, next())
+	require.NoError(t, post(ctx, r, w.ID, 3))
+	assert.Equal(t, 3, next())
+	require.NoError(t, r.PostTransaction(ctx, w.ID, newTransaction(0, 4, 0)))
+	assert.Equal(t, 4, next())
+
+	cancel()
+	assert.NoError(t, <-done)
+
+	err := s.FollowTransactions(context.Background(), -1, 0, time.Hour, nil, nil)
+	assert.ErrorIs(t, err, service.ErrWalletNotFound)
+}
+
+func testCheckpoints(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	name := uuid.NewString()[:20]
+
+	wid, err := r.GetCheckpoint(ctx, name)
+	require.NoError(t, err)
+	assert.Equal(t, 0, wid)
+
+	require.NoError(t, r.SaveCheckpoint(ctx, name, 7))
+	require.NoError(t, r.SaveCheckpoint(ctx, name, 42))
+	wid, err = r.GetCheckpoint(ctx, name)
+	require.NoError(t, err)
+	assert.Equal(t, 42, wid)
+
+	require.NoError(t, r.SaveCheckpoint(ctx, name, 0))
+	wid, err = r.GetCheckpoint(ctx, name)
+	require.NoError(t, err)
+	assert.Equal(t, 0, wid)
+}
+
+func testRebuildProjections(t *testing.T, r service.Repository) {
+	ctx := context.Background()
+	ps := []service.Projection{service.NewBalanceProjection(r)}
+	balance := func(wid int) float64 {
+		b, err := r.GetWalletBalance(ctx, wid)
+		require.NoError(t, err)
+		return b
+	}
+
+	w1, w2, empty := newWallet(t, r), newWallet(t, r), newWallet(t, r)
+	for _, w := range []*service.Wallet{w1, w2} {
+		require.NoError(t, post(ctx, r, w.ID, 10))
+		require.NoError(t, post(ctx, r, w.ID, -2.5))
+		require.NoError(t, r.RepairBalance(ctx, w.ID, 2, 7.5, 99))
+	}
+	require.NoError(t, r.RepairBalance(ctx, empty.ID, 0, 0, 1))
+
+	// a single wallet
+	n, changed, err := service.RebuildWallet(ctx, r, ps, w1.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 1, changed)
+	assert.Equal(t, 7.5, balance(w1.ID))
+
+	n, changed, err = service.RebuildWallet(ctx, r, ps, w1.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, 0, changed)
+
+	_, _, err = service.RebuildWallet(ctx, r, ps, -1)
+	assert.ErrorIs(t, err, service.ErrWalletNotFound)
+
+	// an interrupted rebuild resumes after its checkpoint
+	require.NoError(t, r.RepairBalance(ctx, w1.ID, 2, 7.5, 99))
+	require.NoError(t, r.SaveCheckpoint(ctx, service.ProjectionBalances, w1.ID))
+	p, err := service.RebuildProjections(ctx, r, ps, false, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []string{service.ProjectionBalances}, p.Projections)
+	assert.GreaterOrEqual(t, p.Changed, 2)
+	assert.Equal(t, 99., balance(w1.ID))
+	assert.Equal(t, 7.5, balance(w2.ID))
+	assert.Equal(t, 0., balance(empty.ID))
+
+	wid, err := r.GetCheckpoint(ctx, service.ProjectionBalances)
+	require.NoError(t, err)
+	assert.Equal(t, 0, wid)
+
+	// restart ignores the checkpoint
+	require.NoError(t, r.SaveCheckpoint(ctx, service.ProjectionBalances, w2.ID))
+	p, err = service.RebuildProjections(ctx, r, ps, true, nil)
+	require.NoError(t, err)
+	assert.GreaterOrEqual(t, p.Wallets, 3)
+	assert.GreaterOrEqual(t, p.Transactions, 4)
+	assert.Empty(t, p.Skipped)
+	assert.Equal(t, 7.5, balance(w1.ID))
+
+	// later transactions are replayed too
+	require.NoError(t, post(ctx, r, w2.ID, 1))
+	_, _, err = service.RebuildWallet(ctx, r, ps, w2.ID)
+	require.NoError(t, err)
+	assert.Equal(t, 8.5, balance(w2.ID))
+}
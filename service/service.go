@@ -14,25 +14,174 @@ type Service interface {
 	CreateWallet(ctx context.Context, m *WalletModel) (*Wallet, error)
 	GetWallet(ctx context.Context, wid int) (*Wallet, error)
 	GetWalletBalance(ctx context.Context, wid int) (float64, error)
+	GetBalanceAt(ctx context.Context, wid int, at time.Time) (float64, error)
 	CreateTransaction(ctx context.Context, wid int, m *TransactionModel) (*Transaction, error)
 	GetLatestTransaction(ctx context.Context, wid int) (*Transaction, error)
+	ListTransactions(ctx context.Context, wid int, afterRefNo int, limit int) ([]*Transaction, error)
+	GetStatement(ctx context.Context, wid int, from, to time.Time) (*Statement, error)
+	FollowTransactions(ctx context.Context, wid int, after int, tick time.Duration,
+		fn func(*Transaction) error, heartbeat func() error) error
 }
 
+// Repository stores wallets and transactions. Every mutation writes its
+// outbox events (see WalletEvents, TransactionEvents and RepairEvents) in the
+// same database transaction.
 type Repository interface {
 	CreateWallet(ctx context.Context, w *Wallet) error
 	GetWallet(ctx context.Context, wid int) (*Wallet, error)
 	GetWalletBalance(ctx context.Context, wid int) (float64, error)
-	CreateTransaction(ctx context.Context, wid int, t *Transaction) error
 	GetLatestTransaction(ctx context.Context, wid int) (*Transaction, error)
+
+	// GetTransactionAt returns the last transaction of the wallet created at or
+	// before at, or ErrTransactionNotFound.
+	GetTransactionAt(ctx context.Context, wid int, at time.Time) (*Transaction, error)
+
+	// CreateTransaction stores t with its journal lines if the wallet balance
+	// is still t.OldBalance.
+	CreateTransaction(ctx context.Context, wid int, t *Transaction) error
+
+	// PostTransaction locks the wallet balance, assigns RefNo, OldBalance and
+	// NewBalance of t from it, stamps and chains t after the latest
+	// transaction (see StampCreated and ChainTransaction) and stores t with
+	// its journal lines, all in one database transaction.
+	PostTransaction(ctx context.Context, wid int, t *Transaction) error
+
+	// ListWallets returns up to limit wallets with id greater than afterID, ordered by id.
+	ListWallets(ctx context.Context, afterID int, limit int) ([]*Wallet, error)
+
+	// ListTransactions returns up to limit transactions of the wallet with refno
+	// greater than afterRefNo, ordered by refno.
+	ListTransactions(ctx context.Context, wid int, afterRefNo int, limit int) ([]*Transaction, error)
+
+	// TrialBalance returns debit and credit totals of the journal per account.
+	TrialBalance(ctx context.Context) ([]*AccountBalance, error)
+
+	// RepairBalance sets the materialized balance of the wallet from `from` to
+	// `to` and records it in the audit table, in one database transaction. It
+	// returns ErrTransactionConsistency if the balance is not `from` or the
+	// latest refno is not refno anymore.
+	RepairBalance(ctx context.Context, wid int, refno int, from, to float64) error
+
+	// ListTransactionsBetween returns up to limit transactions of the wallet
+	// created between from and to (inclusive) with refno greater than
+	// afterRefNo, ordered by refno.
+	ListTransactionsBetween(ctx context.Context, wid int, from, to time.Time, afterRefNo int, limit int) ([]*Transaction, error)
+
+	// SaveSnapshot inserts or replaces the snapshot of the wallet and day.
+	SaveSnapshot(ctx context.Context, s *Snapshot) error
+
+	// GetSnapshot returns the snapshot of the wallet and day, or ErrSnapshotNotFound.
+	GetSnapshot(ctx context.Context, wid int, day time.Time) (*Snapshot, error)
+
+	// ListPendingEvents returns up to limit outbox events not published by
+	// the consumer, ordered by Seq, and registers the consumer.
+	ListPendingEvents(ctx context.Context, consumer string, limit int) ([]*Event, error)
+
+	// MarkEventsPublished marks the outbox events as published by the consumer.
+	MarkEventsPublished(ctx context.Context, consumer string, seqs []int64) error
+
+	// PruneEvents deletes the outbox events created before `before` which are
+	// published by every registered consumer, and returns how many.
+	PruneEvents(ctx context.Context, before time.Time) (int, error)
+
+	// CreateSubscription stores sub and assigns its ID.
+	CreateSubscription(ctx context.Context, sub *Subscription) error
+
+	// GetSubscription returns the subscription or ErrSubscriptionNotFound.
+	GetSubscription(ctx context.Context, id int) (*Subscription, error)
+
+	// ListSubscriptions returns all subscriptions ordered by id.
+	ListSubscriptions(ctx context.Context) ([]*Subscription, error)
+
+	// DeleteSubscription deletes the subscription with its deliveries, or
+	// returns ErrSubscriptionNotFound.
+	DeleteSubscription(ctx context.Context, id int) error
+
+	// CreateDeliveries stores the deliveries; a delivery of the same event to
+	// the same subscription is ignored, so republished events are not delivered
+	// twice.
+	CreateDeliveries(ctx context.Context, ds []*Delivery) error
+
+	// ClaimDueDeliveries returns up to limit pending deliveries with next
+	// attempt at or before now, ordered by next attempt, and moves their next
+	// attempt to the end of the lease, now+lease, so that other dispatchers
+	// skip them until then. Returned deliveries have the moved next attempt.
+	ClaimDueDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Delivery, error)
+
+	// GetDelivery returns the delivery or ErrDeliveryNotFound.
+	GetDelivery(ctx context.Context, id int64) (*Delivery, error)
+
+	// ListDeliveries returns up to limit deliveries of the subscription with id
+	// greater than afterID, ordered by id.
+	ListDeliveries(ctx context.Context, sid int, afterID int64, limit int) ([]*Delivery, error)
+
+	// UpdateDelivery saves the state (status, attempts, next attempt, last
+	// error and status code) of the delivery, or returns ErrDeliveryNotFound.
+	UpdateDelivery(ctx context.Context, d *Delivery) error
+
+	// Listen returns a channel receiving refnos of transactions of the wallet
+	// as they commit; it is closed when ctx is done or the listener is lost.
+	// Notifications may be coalesced, receivers read transactions from the
+	// store.
+	Listen(ctx context.Context, wid int) (<-chan int, error)
+
+	// GetCheckpoint returns the id of the last wallet replayed by an
+	// unfinished rebuild of the projection, or 0.
+	GetCheckpoint(ctx context.Context, projection string) (int, error)
+
+	// SaveCheckpoint inserts or replaces the checkpoint of the projection; 0
+	// clears it.
+	SaveCheckpoint(ctx context.Context, projection string, wid int) error
+
+	// CreateAPIKey stores k and assigns its ID, or returns
+	// ErrAPIKeyAlreadyExists if its name is taken.
+	CreateAPIKey(ctx context.Context, k *APIKey) error
+
+	// GetAPIKeyByHash returns the api key, revoked or not, or ErrAPIKeyNotFound.
+	GetAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error)
+
+	// ListAPIKeys returns all api keys ordered by id.
+	ListAPIKeys(ctx context.Context) ([]*APIKey, error)
+
+	// RevokeAPIKey marks the api key revoked at `at` unless it is revoked
+	// already, or returns ErrAPIKeyNotFound.
+	RevokeAPIKey(ctx context.Context, id int, at time.Time) error
+
+	// CreatePolicyDenial stores the audit record and assigns its ID.
+	CreatePolicyDenial(ctx context.Context, d *PolicyDenial) error
+
+	// ListPolicyDenials returns up to limit denials with id greater than
+	// afterID, ordered by id.
+	ListPolicyDenials(ctx context.Context, afterID int64, limit int) ([]*PolicyDenial, error)
 }
 
 type walletService struct {
-	r Repository
-	l zerolog.Logger
+	r       Repository
+	l       zerolog.Logger
+	locking bool
+	policy  *Policy
+}
+
+// Option customizes the wallet service.
+type Option func(*walletService)
+
+// WithLocking makes CreateTransaction post by locking the wallet balance
+// (Repository.PostTransaction) instead of optimistic concurrency.
+func WithLocking() Option {
+	return func(s *walletService) { s.locking = true }
 }
 
-func NewWalletService(r Repository, logger zerolog.Logger) Service {
-	return &walletService{r: r, l: logger}
+// log returns the logger of the request of ctx; see Logger.
+func (s *walletService) log(ctx context.Context) *zerolog.Logger {
+	return Logger(ctx, &s.l)
+}
+
+func NewWalletService(r Repository, logger zerolog.Logger, opts ...Option) Service {
+	s := &walletService{r: r, l: logger}
+	for _, o := range opts {
+		o(s)
+	}
+	return s
 }
 
 func (s *walletService) CreateWallet(ctx context.Context, m *WalletModel) (*Wallet, error) {
@@ -42,6 +191,19 @@ func (s *walletService) CreateWallet(ctx context.Context, m *WalletModel) (*Wall
 		Created:    time.Now().UTC().Truncate(time.Millisecond),
 	}
 
+	// wallets of a tenant are labeled with it
+	if tenant := tenantFrom(ctx); tenant != "" {
+		w.Labels = make(map[string]string, len(m.Labels)+1)
+		for k, v := range m.Labels {
+			w.Labels[k] = v
+		}
+		w.Labels[TenantLabel] = tenant
+	}
+
+	if err := s.authorizeOperation(ctx, OpCreateWallet, 0, 0., w.Labels); err != nil {
+		return nil, err
+	}
+
 	if err := s.r.CreateWallet(ctx, w); err != nil {
 		return nil, err
 	}
@@ -50,25 +212,97 @@ func (s *walletService) CreateWallet(ctx context.Context, m *WalletModel) (*Wall
 }
 
 func (s *walletService) GetWallet(ctx context.Context, wid int) (*Wallet, error) {
+	return s.getWallet(ctx, wid)
+}
+
+// getWallet returns the wallet, or ErrWalletNotFound if the caller may not
+// access it, so that wallets of other tenants are not revealed.
+func (s *walletService) getWallet(ctx context.Context, wid int) (*Wallet, error) {
 	w, err := s.r.GetWallet(ctx, wid)
 	if err != nil {
 		return nil, err
 	}
+	if !PrincipalFrom(ctx).CanAccess(w) {
+		return nil, ErrWalletNotFound
+	}
 	return w, nil
 }
 
+// authorize returns ErrWalletNotFound if the caller may not access the wallet.
+// The wallet is read only for callers of a tenant.
+func (s *walletService) authorize(ctx context.Context, wid int) error {
+	if tenantFrom(ctx) == "" {
+		return nil
+	}
+	_, err := s.getWallet(ctx, wid)
+	return err
+}
+
 func (s *walletService) GetWalletBalance(ctx context.Context, wid int) (float64, error) {
+	if err := s.authorize(ctx, wid); err != nil {
+		return 0., err
+	}
 	return s.r.GetWalletBalance(ctx, wid)
 }
 
+// GetBalanceAt returns the balance of the wallet at the given time, which is
+// the new balance of the last transaction at or before it. Returns
+// ErrWalletNotFound if the wallet was not created yet.
+func (s *walletService) GetBalanceAt(ctx context.Context, wid int, at time.Time) (float64, error) {
+	w, err := s.getWallet(ctx, wid)
+	if err != nil {
+		return 0., err
+	}
+	if w.Created.After(at) {
+		return 0., ErrWalletNotFound
+	}
+
+	t, err := s.r.GetTransactionAt(ctx, wid, at)
+	if errors.Is(err, ErrTransactionNotFound) {
+		return 0., nil
+	}
+	if err != nil {
+		return 0., err
+	}
+
+	return t.NewBalance, nil
+}
+
 func (s *walletService) CreateTransaction(ctx context.Context, wid int, m *TransactionModel) (*Transaction, error) {
-	l := s.l.With().Int("wid", wid).Str("fingerprint", m.Fingerprint).Logger()
+	l := s.log(ctx).With().Str("fingerprint", m.Fingerprint).Logger()
+
+	if math.Abs(m.Amount) < 1.0 || !validDecimals(m.Amount) {
+		return nil, ErrInvalidAmount
+	}
+
+	op := OpCredit
+	if m.Amount < 0 {
+		op = OpDebit
+	}
+	if err := s.authorizeOperation(ctx, op, wid, m.Amount, m.Labels); err != nil {
+		return nil, err
+	}
+
+	if s.locking {
+		if err := s.authorize(ctx, wid); err != nil {
+			l.Info().Err(err).Send()
+			return nil, err
+		}
 
-	if math.Abs(m.Amount) < 1.0 {
-		return nil, errors.New("amount should not be between -1.0 and 1.0")
+		tr := newTransaction(ctx, m)
+		tr.Journal = JournalLines(wid, tr)
+		if err := ValidateJournal(tr.Journal); err != nil {
+			l.Error().Err(err).Send()
+			return nil, err
+		}
+		if err := s.r.PostTransaction(ctx, wid, tr); err != nil {
+			l.Info().Err(err).Send()
+			return nil, err
+		}
+		return tr, nil
 	}
 
-	_, err := s.r.GetWallet(ctx, wid)
+	_, err := s.getWallet(ctx, wid)
 	if err != nil {
 		l.Info().Err(err).Send()
 		return nil, err
@@ -80,15 +314,7 @@ func (s *walletService) CreateTransaction(ctx context.Context, wid int, m *Trans
 		return nil, err
 	}
 
-	tr := &Transaction{
-		ID:          uuid.NewString(),
-		Amount:      m.Amount,
-		Description: m.Description,
-		Labels:      m.Labels,
-		Fingerprint: m.Fingerprint,
-		Created:     time.Now().UTC().Truncate(time.Millisecond),
-	}
-
+	tr := newTransaction(ctx, m)
 	if lt == nil {
 		tr.OldBalance = 0.
 		tr.NewBalance = tr.Amount
@@ -103,6 +329,15 @@ func (s *walletService) CreateTransaction(ctx context.Context, wid int, m *Trans
 		return nil, ErrNotEnoughWalletBalance
 	}
 
+	StampCreated(tr, lt)
+	ChainTransaction(wid, tr, lt)
+
+	tr.Journal = JournalLines(wid, tr)
+	if err := ValidateJournal(tr.Journal); err != nil {
+		l.Error().Err(err).Send()
+		return nil, err
+	}
+
 	err = s.r.CreateTransaction(ctx, wid, tr)
 	if err != nil {
 		l.Info().Err(err).Send()
@@ -112,10 +347,34 @@ func (s *walletService) CreateTransaction(ctx context.Context, wid int, m *Trans
 	return tr, nil
 }
 
+func newTransaction(ctx context.Context, m *TransactionModel) *Transaction {
+	return &Transaction{
+		Client:      clientFrom(ctx),
+		ID:          uuid.NewString(),
+		Amount:      m.Amount,
+		Description: m.Description,
+		Labels:      m.Labels,
+		Fingerprint: m.Fingerprint,
+	}
+}
+
 func (s *walletService) GetLatestTransaction(ctx context.Context, wid int) (*Transaction, error) {
+	if err := s.authorize(ctx, wid); err != nil {
+		return nil, err
+	}
+
 	tr, err := s.r.GetLatestTransaction(ctx, wid)
 	if err != nil {
 		return nil, err
 	}
 	return tr, nil
 }
+
+// ListTransactions returns up to limit transactions of the wallet with refno
+// greater than afterRefNo, ordered by refno.
+func (s *walletService) ListTransactions(ctx context.Context, wid int, afterRefNo int, limit int) ([]*Transaction, error) {
+	if _, err := s.getWallet(ctx, wid); err != nil {
+		return nil, err
+	}
+	return s.r.ListTransactions(ctx, wid, afterRefNo, limit)
+}
@@ -98,6 +98,51 @@ func TestGetWalletBalance(t *testing.T) {
 	})
 }
 
+func TestGetBalanceAt(t *testing.T) {
+	created := time.Now().UTC().Add(-time.Hour)
+
+	t.Run("WalletNotFound", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("GetWallet", mock.Anything, 10).Return((*Wallet)(nil), ErrWalletNotFound)
+		svc := NewWalletService(mok, log.Logger)
+
+		_, err := svc.GetBalanceAt(context.Background(), 10, time.Now())
+		assert.ErrorIs(t, err, ErrWalletNotFound)
+	})
+
+	t.Run("WalletNotCreatedYet", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("GetWallet", mock.Anything, 10).Return(&Wallet{ID: 10, Created: created}, nil)
+		svc := NewWalletService(mok, log.Logger)
+
+		_, err := svc.GetBalanceAt(context.Background(), 10, created.Add(-time.Second))
+		assert.ErrorIs(t, err, ErrWalletNotFound)
+	})
+
+	t.Run("NoTransactionYet", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("GetWallet", mock.Anything, 10).Return(&Wallet{ID: 10, Created: created}, nil)
+		mok.On("GetTransactionAt", mock.Anything, 10, created).Return((*Transaction)(nil), ErrTransactionNotFound)
+		svc := NewWalletService(mok, log.Logger)
+
+		b, err := svc.GetBalanceAt(context.Background(), 10, created)
+		assert.NoError(t, err)
+		assert.Equal(t, 0., b)
+	})
+
+	t.Run("ReturnsNewBalance", func(t *testing.T) {
+		at := created.Add(time.Minute)
+		var mok = &mockRepository{}
+		mok.On("GetWallet", mock.Anything, 10).Return(&Wallet{ID: 10, Created: created}, nil)
+		mok.On("GetTransactionAt", mock.Anything, 10, at).Return(&Transaction{RefNo: 3, NewBalance: 42}, nil)
+		svc := NewWalletService(mok, log.Logger)
+
+		b, err := svc.GetBalanceAt(context.Background(), 10, at)
+		assert.NoError(t, err)
+		assert.Equal(t, 42., b)
+	})
+}
+
 func TestCreateTransaction(t *testing.T) {
 	t.Run("WalletNotExists", func(t *testing.T) {
 		var mok = &mockRepository{}
@@ -130,13 +175,14 @@ func TestCreateTransaction(t *testing.T) {
 		assert.Equal(t, m.Description, tr.Description)
 		assert.Equal(t, m.Labels, tr.Labels)
 		assert.Greater(t, tr.Created.UnixMilli(), time.Now().Add(-3*time.Second).UnixMilli())
+		assert.Equal(t, JournalLines(10, tr), tr.Journal)
 	})
 
 	t.Run("SecondTransaction", func(t *testing.T) {
 		var mok = &mockRepository{}
 		mok.On("GetWallet", mock.Anything, 10).Return(&Wallet{}, nil)
 		mok.On("GetLatestTransaction", mock.Anything, mock.Anything).Return(
-			&Transaction{RefNo: 1, NewBalance: 99}, nil)
+			&Transaction{RefNo: 1, NewBalance: 99, Hash: "prev"}, nil)
 		mok.On("CreateTransaction", mock.Anything, mock.Anything, mock.Anything).Return(nil)
 		svc := NewWalletService(mok, log.Logger)
 
@@ -150,6 +196,8 @@ func TestCreateTransaction(t *testing.T) {
 		assert.Equal(t, m.Amount, tr.Amount)
 		assert.Equal(t, 99., tr.OldBalance)
 		assert.Equal(t, 99.+m.Amount, tr.NewBalance)
+		assert.Equal(t, "prev", tr.PrevHash)
+		assert.Equal(t, ComputeHash(10, tr), tr.Hash)
 	})
 
 	t.Run("NotEnoughBalance", func(t *testing.T) {
@@ -184,6 +232,38 @@ func TestCreateTransaction(t *testing.T) {
 	})
 }
 
+func TestCreateTransactionLocking(t *testing.T) {
+	t.Run("Posted", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("PostTransaction", mock.Anything, 10, mock.MatchedBy(func(tr *Transaction) bool {
+			tr.RefNo, tr.OldBalance, tr.NewBalance = 2, 99, 99+tr.Amount
+			return true
+		})).Return(nil)
+		svc := NewWalletService(mok, log.Logger, WithLocking())
+
+		m := &TransactionModel{Amount: 25, Description: "desc", Fingerprint: uuid.NewString()}
+
+		tr, err := svc.CreateTransaction(context.Background(), 10, m)
+		assert.NoError(t, err)
+		assert.NotEmpty(t, tr.ID)
+		assert.Equal(t, 2, tr.RefNo)
+		assert.Equal(t, 124., tr.NewBalance)
+		assert.Equal(t, m.Fingerprint, tr.Fingerprint)
+		mok.AssertNotCalled(t, "GetLatestTransaction", mock.Anything, mock.Anything)
+		mok.AssertNotCalled(t, "CreateTransaction", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("NotEnoughBalance", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("PostTransaction", mock.Anything, 10, mock.Anything).Return(ErrNotEnoughWalletBalance)
+		svc := NewWalletService(mok, log.Logger, WithLocking())
+
+		tr, err := svc.CreateTransaction(context.Background(), 10, &TransactionModel{Amount: -2})
+		assert.ErrorIs(t, err, ErrNotEnoughWalletBalance)
+		assert.Nil(t, tr)
+	})
+}
+
 func TestGetLatestTransaction(t *testing.T) {
 	t.Run("TransactionNotFound", func(t *testing.T) {
 		var mok = &mockRepository{}
@@ -5,6 +5,7 @@ package service
 
 import (
 	"context"
+	"time"
 
 	"github.com/stretchr/testify/mock"
 )
@@ -38,3 +39,153 @@ func (m *mockRepository) GetLatestTransaction(ctx context.Context, wid int) (*Tr
 	args := m.Called(ctx, wid)
 	return args.Get(0).(*Transaction), args.Error(1)
 }
+
+func (m *mockRepository) PostTransaction(ctx context.Context, wid int, t *Transaction) error {
+	args := m.Called(ctx, wid, t)
+	return args.Error(0)
+}
+
+func (m *mockRepository) ListWallets(ctx context.Context, afterID int, limit int) ([]*Wallet, error) {
+	args := m.Called(ctx, afterID, limit)
+	return args.Get(0).([]*Wallet), args.Error(1)
+}
+
+func (m *mockRepository) ListTransactions(ctx context.Context, wid int, afterRefNo int, limit int) ([]*Transaction, error) {
+	args := m.Called(ctx, wid, afterRefNo, limit)
+	return args.Get(0).([]*Transaction), args.Error(1)
+}
+
+func (m *mockRepository) TrialBalance(ctx context.Context) ([]*AccountBalance, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]*AccountBalance), args.Error(1)
+}
+
+func (m *mockRepository) GetTransactionAt(ctx context.Context, wid int, at time.Time) (*Transaction, error) {
+	args := m.Called(ctx, wid, at)
+	return args.Get(0).(*Transaction), args.Error(1)
+}
+
+func (m *mockRepository) RepairBalance(ctx context.Context, wid int, refno int, from, to float64) error {
+	args := m.Called(ctx, wid, refno, from, to)
+	return args.Error(0)
+}
+
+func (m *mockRepository) ListTransactionsBetween(ctx context.Context, wid int, from, to time.Time, afterRefNo int, limit int) ([]*Transaction, error) {
+	args := m.Called(ctx, wid, from, to, afterRefNo, limit)
+	return args.Get(0).([]*Transaction), args.Error(1)
+}
+
+func (m *mockRepository) SaveSnapshot(ctx context.Context, s *Snapshot) error {
+	args := m.Called(ctx, s)
+	return args.Error(0)
+}
+
+func (m *mockRepository) GetSnapshot(ctx context.Context, wid int, day time.Time) (*Snapshot, error) {
+	args := m.Called(ctx, wid, day)
+	return args.Get(0).(*Snapshot), args.Error(1)
+}
+
+func (m *mockRepository) ListPendingEvents(ctx context.Context, consumer string, limit int) ([]*Event, error) {
+	args := m.Called(ctx, consumer, limit)
+	return args.Get(0).([]*Event), args.Error(1)
+}
+
+func (m *mockRepository) MarkEventsPublished(ctx context.Context, consumer string, seqs []int64) error {
+	args := m.Called(ctx, consumer, seqs)
+	return args.Error(0)
+}
+
+func (m *mockRepository) PruneEvents(ctx context.Context, before time.Time) (int, error) {
+	args := m.Called(ctx, before)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *mockRepository) CreateSubscription(ctx context.Context, sub *Subscription) error {
+	args := m.Called(ctx, sub)
+	return args.Error(0)
+}
+
+func (m *mockRepository) GetSubscription(ctx context.Context, id int) (*Subscription, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(*Subscription), args.Error(1)
+}
+
+func (m *mockRepository) ListSubscriptions(ctx context.Context) ([]*Subscription, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]*Subscription), args.Error(1)
+}
+
+func (m *mockRepository) DeleteSubscription(ctx context.Context, id int) error {
+	args := m.Called(ctx, id)
+	return args.Error(0)
+}
+
+func (m *mockRepository) CreateDeliveries(ctx context.Context, ds []*Delivery) error {
+	args := m.Called(ctx, ds)
+	return args.Error(0)
+}
+
+func (m *mockRepository) ClaimDueDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*Delivery, error) {
+	args := m.Called(ctx, now, lease, limit)
+	return args.Get(0).([]*Delivery), args.Error(1)
+}
+
+func (m *mockRepository) GetDelivery(ctx context.Context, id int64) (*Delivery, error) {
+	args := m.Called(ctx, id)
+	return args.Get(0).(*Delivery), args.Error(1)
+}
+
+func (m *mockRepository) ListDeliveries(ctx context.Context, sid int, afterID int64, limit int) ([]*Delivery, error) {
+	args := m.Called(ctx, sid, afterID, limit)
+	return args.Get(0).([]*Delivery), args.Error(1)
+}
+
+func (m *mockRepository) UpdateDelivery(ctx context.Context, d *Delivery) error {
+	args := m.Called(ctx, d)
+	return args.Error(0)
+}
+
+func (m *mockRepository) Listen(ctx context.Context, wid int) (<-chan int, error) {
+	args := m.Called(ctx, wid)
+	return args.Get(0).(<-chan int), args.Error(1)
+}
+
+func (m *mockRepository) GetCheckpoint(ctx context.Context, projection string) (int, error) {
+	args := m.Called(ctx, projection)
+	return args.Int(0), args.Error(1)
+}
+
+func (m *mockRepository) SaveCheckpoint(ctx context.Context, projection string, wid int) error {
+	args := m.Called(ctx, projection, wid)
+	return args.Error(0)
+}
+
+func (m *mockRepository) CreateAPIKey(ctx context.Context, k *APIKey) error {
+	args := m.Called(ctx, k)
+	return args.Error(0)
+}
+
+func (m *mockRepository) GetAPIKeyByHash(ctx context.Context, hash string) (*APIKey, error) {
+	args := m.Called(ctx, hash)
+	return args.Get(0).(*APIKey), args.Error(1)
+}
+
+func (m *mockRepository) ListAPIKeys(ctx context.Context) ([]*APIKey, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]*APIKey), args.Error(1)
+}
+
+func (m *mockRepository) RevokeAPIKey(ctx context.Context, id int, at time.Time) error {
+	args := m.Called(ctx, id, at)
+	return args.Error(0)
+}
+
+func (m *mockRepository) CreatePolicyDenial(ctx context.Context, d *PolicyDenial) error {
+	args := m.Called(ctx, d)
+	return args.Error(0)
+}
+
+func (m *mockRepository) ListPolicyDenials(ctx context.Context, afterID int64, limit int) ([]*PolicyDenial, error) {
+	args := m.Called(ctx, afterID, limit)
+	return args.Get(0).([]*PolicyDenial), args.Error(1)
+}
@@ -0,0 +1,170 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// DayLayout is the layout of days in statements and snapshots
+const DayLayout = "2006-01-02"
+
+// Limits of statements, which are built in memory; their errors name them
+const (
+	MaxStatementDays         = 366
+	MaxStatementTransactions = 10000
+)
+
+// Day truncates t to the start of its day in UTC.
+func Day(t time.Time) time.Time {
+	y, m, d := t.UTC().Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// endOfDay is the last instant (in storage precision) of the day
+func endOfDay(day time.Time) time.Time {
+	return Day(day).AddDate(0, 0, 1).Add(-time.Microsecond)
+}
+
+// closingBalance computes the balance of the wallet at the end of day from the
+// transaction history; refno is the last transaction of the day or before.
+func closingBalance(ctx context.Context, r Repository, wid int, day time.Time) (balance float64, refno int, err error) {
+	t, err := r.GetTransactionAt(ctx, wid, endOfDay(day))
+	if errors.Is(err, ErrTransactionNotFound) {
+		return 0., 0, nil
+	}
+	if err != nil {
+		return 0., 0, err
+	}
+	return t.NewBalance, t.RefNo, nil
+}
+
+// SnapshotDay writes the closing balances of the day for every wallet created
+// until the end of it. Existing snapshots of the day are overwritten.
+func SnapshotDay(ctx context.Context, r Repository, day time.Time) (int, error) {
+	day = Day(day)
+	n, after := 0, 0
+	for {
+		ws, err := r.ListWallets(ctx, after, listPageSize)
+		if err != nil {
+			return n, err
+		}
+
+		for _, w := range ws {
+			after = w.ID
+			if w.Created.After(endOfDay(day)) {
+				continue
+			}
+
+			b, refno, err := closingBalance(ctx, r, w.ID, day)
+			if err != nil {
+				return n, err
+			}
+
+			s := &Snapshot{WalletID: w.ID, Day: day, Balance: b, RefNo: refno, Created: time.Now().UTC().Truncate(time.Millisecond)}
+			if err := r.SaveSnapshot(ctx, s); err != nil {
+				return n, err
+			}
+			n++
+		}
+
+		if len(ws) < listPageSize {
+			return n, nil
+		}
+	}
+}
+
+// snapshotGrace is the wait after midnight before the day before is
+// snapshotted. Transactions are stamped before they commit, so the ones
+// stamped just before midnight may commit after it; the grace is far longer
+// than a posting transaction lasts.
+const snapshotGrace = 5 * time.Minute
+
+// snapshotSchedule returns the last day which can be snapshotted at now, and
+// the time of the next snapshot, snapshotGrace after the next midnight (UTC).
+func snapshotSchedule(now time.Time) (day time.Time, next time.Time) {
+	settled := now.Add(-snapshotGrace)
+	return Day(settled).AddDate(0, 0, -1), Day(settled).AddDate(0, 0, 1).Add(snapshotGrace)
+}
+
+// RunSnapshotJob snapshots the previous day at start and snapshotGrace after
+// every midnight (UTC) until ctx is done.
+func RunSnapshotJob(ctx context.Context, r Repository, l zerolog.Logger) {
+	for {
+		day, next := snapshotSchedule(time.Now())
+		n, err := SnapshotDay(ctx, r, day)
+		if err != nil {
+			l.Error().Err(err).Str("day", day.Format(DayLayout)).Msg("snapshot failed")
+		} else {
+			l.Info().Int("wallets", n).Str("day", day.Format(DayLayout)).Msg("snapshot completed")
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Until(next)):
+		}
+	}
+}
+
+// GetStatement returns the statement of the wallet for the days from and to,
+// both inclusive. Opening balance comes from the snapshot of the day before
+// from when there is one, otherwise from the transaction history. Statements
+// cover at most MaxStatementDays days and MaxStatementTransactions
+// transactions.
+func (s *walletService) GetStatement(ctx context.Context, wid int, from, to time.Time) (*Statement, error) {
+	from, to = Day(from), Day(to)
+	if to.After(from.AddDate(0, 0, MaxStatementDays-1)) {
+		return nil, ErrStatementRangeTooLong
+	}
+
+	if _, err := s.getWallet(ctx, wid); err != nil {
+		return nil, err
+	}
+
+	st := &Statement{
+		WalletID:     wid,
+		From:         from.Format(DayLayout),
+		To:           to.Format(DayLayout),
+		Transactions: []*Transaction{},
+	}
+
+	// opening balance
+	prev := from.AddDate(0, 0, -1)
+	snap, err := s.r.GetSnapshot(ctx, wid, prev)
+	switch {
+	case err == nil:
+		st.OpeningBalance = snap.Balance
+	case errors.Is(err, ErrSnapshotNotFound):
+		if st.OpeningBalance, _, err = closingBalance(ctx, s.r, wid, prev); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, err
+	}
+
+	// transactions
+	st.ClosingBalance = st.OpeningBalance
+	after := 0
+	for {
+		trs, err := s.r.ListTransactionsBetween(ctx, wid, from, endOfDay(to), after, listPageSize)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(st.Transactions)+len(trs) > MaxStatementTransactions {
+			return nil, ErrStatementTooLarge
+		}
+		for _, t := range trs {
+			st.Transactions = append(st.Transactions, t)
+			st.ClosingBalance = t.NewBalance
+			after = t.RefNo
+		}
+
+		if len(trs) < listPageSize {
+			return st, nil
+		}
+	}
+}
@@ -0,0 +1,129 @@
+//go:build !integration
+// +build !integration
+
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestGetStatement(t *testing.T) {
+	from := time.Date(2021, 11, 2, 0, 0, 0, 0, time.UTC)
+	prev := from.AddDate(0, 0, -1)
+	to := from.AddDate(0, 0, 1)
+	trs := []*Transaction{{RefNo: 4, NewBalance: 12}, {RefNo: 5, NewBalance: 7.5}}
+
+	t.Run("WalletNotFound", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("GetWallet", mock.Anything, 10).Return((*Wallet)(nil), ErrWalletNotFound)
+		svc := NewWalletService(mok, log.Logger)
+
+		_, err := svc.GetStatement(context.Background(), 10, from, to)
+		assert.ErrorIs(t, err, ErrWalletNotFound)
+	})
+
+	t.Run("OpeningFromSnapshot", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("GetWallet", mock.Anything, 10).Return(&Wallet{ID: 10}, nil)
+		mok.On("GetSnapshot", mock.Anything, 10, prev).Return(&Snapshot{WalletID: 10, Day: prev, Balance: 8, RefNo: 3}, nil)
+		mok.On("ListTransactionsBetween", mock.Anything, 10, from, endOfDay(to), 0, listPageSize).Return(trs, nil)
+		svc := NewWalletService(mok, log.Logger)
+
+		st, err := svc.GetStatement(context.Background(), 10, from.Add(time.Hour), to)
+		assert.NoError(t, err)
+		assert.Equal(t, "2021-11-02", st.From)
+		assert.Equal(t, "2021-11-03", st.To)
+		assert.Equal(t, 8., st.OpeningBalance)
+		assert.Len(t, st.Transactions, 2)
+		assert.Equal(t, 7.5, st.ClosingBalance)
+		mok.AssertNotCalled(t, "GetTransactionAt", mock.Anything, mock.Anything, mock.Anything)
+	})
+
+	t.Run("OpeningFromHistory", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("GetWallet", mock.Anything, 10).Return(&Wallet{ID: 10}, nil)
+		mok.On("GetSnapshot", mock.Anything, 10, prev).Return((*Snapshot)(nil), ErrSnapshotNotFound)
+		mok.On("GetTransactionAt", mock.Anything, 10, endOfDay(prev)).Return(&Transaction{RefNo: 3, NewBalance: 6}, nil)
+		mok.On("ListTransactionsBetween", mock.Anything, 10, from, endOfDay(to), 0, listPageSize).Return([]*Transaction{}, nil)
+		svc := NewWalletService(mok, log.Logger)
+
+		st, err := svc.GetStatement(context.Background(), 10, from, to)
+		assert.NoError(t, err)
+		assert.Equal(t, 6., st.OpeningBalance)
+		assert.Empty(t, st.Transactions)
+		assert.Equal(t, 6., st.ClosingBalance)
+	})
+
+	t.Run("RangeTooLong", func(t *testing.T) {
+		var mok = &mockRepository{}
+		svc := NewWalletService(mok, log.Logger)
+
+		_, err := svc.GetStatement(context.Background(), 10, from, from.AddDate(0, 0, MaxStatementDays))
+		assert.ErrorIs(t, err, ErrStatementRangeTooLong)
+		mok.AssertNotCalled(t, "GetWallet", mock.Anything, mock.Anything)
+	})
+
+	t.Run("TooLarge", func(t *testing.T) {
+		page := make([]*Transaction, listPageSize)
+		for i := range page {
+			page[i] = &Transaction{RefNo: i + 1}
+		}
+		var mok = &mockRepository{}
+		mok.On("GetWallet", mock.Anything, 10).Return(&Wallet{ID: 10}, nil)
+		mok.On("GetSnapshot", mock.Anything, 10, prev).Return(&Snapshot{WalletID: 10, Day: prev}, nil)
+		mok.On("ListTransactionsBetween", mock.Anything, 10, from, endOfDay(to), mock.Anything, listPageSize).Return(page, nil)
+		svc := NewWalletService(mok, log.Logger)
+
+		_, err := svc.GetStatement(context.Background(), 10, from, to)
+		assert.ErrorIs(t, err, ErrStatementTooLarge)
+		mok.AssertNumberOfCalls(t, "ListTransactionsBetween", MaxStatementTransactions/listPageSize+1)
+	})
+}
+
+func TestSnapshotDay(t *testing.T) {
+	day := time.Date(2021, 11, 2, 0, 0, 0, 0, time.UTC)
+
+	var mok = &mockRepository{}
+	mok.On("ListWallets", mock.Anything, 0, listPageSize).Return([]*Wallet{
+		{ID: 1, Created: day.Add(-time.Hour)},
+		{ID: 2, Created: day.Add(time.Hour)},
+		{ID: 3, Created: day.AddDate(0, 0, 1)}, // created after the day
+	}, nil)
+	mok.On("GetTransactionAt", mock.Anything, 1, endOfDay(day)).Return(&Transaction{RefNo: 7, NewBalance: 21}, nil)
+	mok.On("GetTransactionAt", mock.Anything, 2, endOfDay(day)).Return((*Transaction)(nil), ErrTransactionNotFound)
+	mok.On("SaveSnapshot", mock.Anything, mock.Anything).Return(nil)
+
+	n, err := SnapshotDay(context.Background(), mok, day.Add(12*time.Hour))
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	mok.AssertCalled(t, "SaveSnapshot", mock.Anything, mock.MatchedBy(func(s *Snapshot) bool {
+		return s.WalletID == 1 && s.Day.Equal(day) && s.Balance == 21 && s.RefNo == 7
+	}))
+	mok.AssertCalled(t, "SaveSnapshot", mock.Anything, mock.MatchedBy(func(s *Snapshot) bool {
+		return s.WalletID == 2 && s.Balance == 0 && s.RefNo == 0
+	}))
+}
+
+func TestSnapshotSchedule(t *testing.T) {
+	midnight := time.Date(2021, 11, 3, 0, 0, 0, 0, time.UTC)
+
+	for _, tt := range []struct {
+		now, day, next time.Time
+	}{
+		// within the grace the day before is not settled yet
+		{midnight.Add(time.Minute), midnight.AddDate(0, 0, -2), midnight.Add(snapshotGrace)},
+		{midnight.Add(snapshotGrace), midnight.AddDate(0, 0, -1), midnight.AddDate(0, 0, 1).Add(snapshotGrace)},
+		{midnight.Add(12 * time.Hour), midnight.AddDate(0, 0, -1), midnight.AddDate(0, 0, 1).Add(snapshotGrace)},
+	} {
+		day, next := snapshotSchedule(tt.now)
+		assert.Equal(t, tt.day, day, tt.now)
+		assert.Equal(t, tt.next, next, tt.now)
+	}
+}
@@ -0,0 +1,116 @@
+package service
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Notifier fans out refnos of committed transactions to in-process listeners
+// of the wallet. Backends without a database level notification mechanism use
+// it to implement Repository.Listen.
+type Notifier struct {
+	mu        sync.Mutex
+	listeners map[int]map[chan int]struct{}
+}
+
+func NewNotifier() *Notifier {
+	return &Notifier{listeners: map[int]map[chan int]struct{}{}}
+}
+
+// Listen returns a channel receiving refnos notified for the wallet; it is
+// closed when ctx is done.
+func (n *Notifier) Listen(ctx context.Context, wid int) <-chan int {
+	ch := make(chan int, 1)
+
+	n.mu.Lock()
+	if n.listeners[wid] == nil {
+		n.listeners[wid] = map[chan int]struct{}{}
+	}
+	n.listeners[wid][ch] = struct{}{}
+	n.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		n.mu.Lock()
+		defer n.mu.Unlock()
+		delete(n.listeners[wid], ch)
+		if len(n.listeners[wid]) == 0 {
+			delete(n.listeners, wid)
+		}
+		close(ch)
+	}()
+
+	return ch
+}
+
+// Notify wakes up the listeners of the wallet. It never blocks; a listener
+// which has not consumed its previous notification misses this one, which is
+// fine as listeners read transactions from the store.
+func (n *Notifier) Notify(wid int, refno int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for ch := range n.listeners[wid] {
+		select {
+		case ch <- refno:
+		default:
+		}
+	}
+}
+
+// FollowTransactions calls fn with the transactions of the wallet with refno
+// greater than after, in refno order: first the stored ones, then the new ones
+// as they commit. Every tick heartbeat is called and the store is read again,
+// in case a notification is lost. It returns nil when ctx is done, or the
+// first error of fn or heartbeat.
+func (s *walletService) FollowTransactions(ctx context.Context, wid int, after int, tick time.Duration,
+	fn func(*Transaction) error, heartbeat func() error) error {
+	if _, err := s.getWallet(ctx, wid); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// listen before reading, so that nothing committed in between is missed
+	notes, err := s.r.Listen(ctx, wid)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+
+	for {
+		for {
+			trs, err := s.r.ListTransactions(ctx, wid, after, listPageSize)
+			if err != nil {
+				return err
+			}
+			for _, t := range trs {
+				if err := fn(t); err != nil {
+					return err
+				}
+				after = t.RefNo
+			}
+			if len(trs) < listPageSize {
+				break
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case _, ok := <-notes:
+			if !ok && ctx.Err() == nil {
+				// listener is lost, keep following by ticks
+				s.log(ctx).Warn().Msg("transaction notifications are lost, polling")
+				notes = nil
+			}
+		case <-ticker.C:
+			if err := heartbeat(); err != nil {
+				return err
+			}
+		}
+	}
+}
@@ -1,6 +1,9 @@
 package service
 
-import "time"
+import (
+	"encoding/json"
+	"time"
+)
 
 type (
 	Wallet struct {
@@ -32,5 +35,98 @@ type (
 		Created     time.Time         `json:"created"`
 		OldBalance  float64           `json:"oldbalance"`
 		NewBalance  float64           `json:"newbalance"`
+		PrevHash    string            `json:"prevhash"`
+		Hash        string            `json:"hash"`
+
+		// Client is the authenticated caller which created the transaction,
+		// empty if authentication is disabled
+		Client string `json:"client"`
+
+		// Journal is the general ledger posting stored with the transaction
+		Journal []*JournalLine `json:"-"`
+	}
+
+	// Snapshot is the closing balance of a wallet at the end of a day (UTC)
+	Snapshot struct {
+		WalletID int       `json:"wid"`
+		Day      time.Time `json:"day"`
+		Balance  float64   `json:"balance"`
+		RefNo    int       `json:"refno"`
+		Created  time.Time `json:"created"`
+	}
+
+	// Event is a domain event written to the outbox in the same database
+	// transaction as the change it describes. Seq orders events globally and
+	// per wallet.
+	Event struct {
+		Seq      int64           `json:"seq"`
+		Type     string          `json:"type"`
+		WalletID int             `json:"wid"`
+		Payload  json.RawMessage `json:"payload"`
+		Created  time.Time       `json:"created"`
+	}
+
+	// BalanceChange is the payload of BalanceChanged events
+	BalanceChange struct {
+		WalletID   int     `json:"wid"`
+		RefNo      int     `json:"refno"`
+		OldBalance float64 `json:"oldbalance"`
+		NewBalance float64 `json:"newbalance"`
+	}
+
+	// SubscriptionModel is the request of a webhook subscription
+	SubscriptionModel struct {
+		URL        string            `json:"url" validate:"required,url,max=500"`
+		EventTypes []string          `json:"eventtypes" validate:"required,min=1,dive,oneof=WalletCreated TransactionCreated BalanceChanged TransactionVoid"`
+		Labels     map[string]string `json:"labels" validate:"max=10"`
+		Secret     string            `json:"secret" validate:"max=100"`
+	}
+
+	// Subscription delivers events of EventTypes to URL for wallets having
+	// all of Labels. Secret signs the deliveries.
+	Subscription struct {
+		ID         int               `json:"id"`
+		URL        string            `json:"url"`
+		EventTypes []string          `json:"eventtypes"`
+		Labels     map[string]string `json:"labels"`
+		Secret     string            `json:"secret,omitempty"`
+		Created    time.Time         `json:"created"`
+	}
+
+	// Delivery is the delivery state of an event to a subscription
+	Delivery struct {
+		ID             int64     `json:"id"`
+		SubscriptionID int       `json:"subscriptionid"`
+		Event          Event     `json:"event"`
+		Status         string    `json:"status"`
+		Attempts       int       `json:"attempts"`
+		NextAttempt    time.Time `json:"nextattempt"`
+		LastError      string    `json:"lasterror"`
+		LastStatusCode int       `json:"laststatuscode"`
+		Created        time.Time `json:"created"`
+		Updated        time.Time `json:"updated"`
+	}
+
+	// Statement lists transactions of a wallet created between From and To
+	// days (inclusive), with balances before and after them.
+	Statement struct {
+		WalletID       int            `json:"wid"`
+		From           string         `json:"from"`
+		To             string         `json:"to"`
+		OpeningBalance float64        `json:"openingbalance"`
+		Transactions   []*Transaction `json:"transactions"`
+		ClosingBalance float64        `json:"closingbalance"`
+	}
+
+	// APIKey authenticates a client of the api. Only the hash of the key is
+	// stored; Prefix identifies the key in listings.
+	APIKey struct {
+		ID      int        `json:"id"`
+		Name    string     `json:"name"`
+		Prefix  string     `json:"prefix"`
+		Hash    string     `json:"-"`
+		Scopes  []string   `json:"scopes"`
+		Created time.Time  `json:"created"`
+		Revoked *time.Time `json:"revoked,omitempty"`
 	}
 )
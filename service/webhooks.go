@@ -0,0 +1,186 @@
+package service
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"time"
+
+	"github.com/rs/zerolog"
+)
+
+// Delivery statuses
+const (
+	DeliveryPending   = "pending"
+	DeliverySucceeded = "succeeded"
+	DeliveryDead      = "dead"
+)
+
+type WebhookService interface {
+	CreateSubscription(ctx context.Context, m *SubscriptionModel) (*Subscription, error)
+	GetSubscription(ctx context.Context, id int) (*Subscription, error)
+	ListSubscriptions(ctx context.Context) ([]*Subscription, error)
+	DeleteSubscription(ctx context.Context, id int) error
+	ListDeliveries(ctx context.Context, sid int, afterID int64, limit int) ([]*Delivery, error)
+	Redeliver(ctx context.Context, sid int, did int64) (*Delivery, error)
+}
+
+type webhookService struct {
+	r Repository
+	l zerolog.Logger
+}
+
+func NewWebhookService(r Repository, logger zerolog.Logger) WebhookService {
+	return &webhookService{r: r, l: logger}
+}
+
+// CreateSubscription stores the subscription; a secret is generated when the
+// model has none. The secret is only returned here.
+func (s *webhookService) CreateSubscription(ctx context.Context, m *SubscriptionModel) (*Subscription, error) {
+	sub := &Subscription{
+		URL:        m.URL,
+		EventTypes: m.EventTypes,
+		Labels:     m.Labels,
+		Secret:     m.Secret,
+		Created:    time.Now().UTC().Truncate(time.Millisecond),
+	}
+	if sub.Labels == nil {
+		sub.Labels = map[string]string{}
+	}
+	if sub.Secret == "" {
+		b := make([]byte, 32)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		sub.Secret = hex.EncodeToString(b)
+	}
+
+	if err := s.r.CreateSubscription(ctx, sub); err != nil {
+		return nil, err
+	}
+
+	return sub, nil
+}
+
+func (s *webhookService) GetSubscription(ctx context.Context, id int) (*Subscription, error) {
+	sub, err := s.r.GetSubscription(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	sub.Secret = ""
+	return sub, nil
+}
+
+func (s *webhookService) ListSubscriptions(ctx context.Context) ([]*Subscription, error) {
+	subs, err := s.r.ListSubscriptions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subs {
+		sub.Secret = ""
+	}
+	return subs, nil
+}
+
+func (s *webhookService) DeleteSubscription(ctx context.Context, id int) error {
+	return s.r.DeleteSubscription(ctx, id)
+}
+
+func (s *webhookService) ListDeliveries(ctx context.Context, sid int, afterID int64, limit int) ([]*Delivery, error) {
+	if _, err := s.r.GetSubscription(ctx, sid); err != nil {
+		return nil, err
+	}
+	return s.r.ListDeliveries(ctx, sid, afterID, limit)
+}
+
+// Redeliver schedules the delivery for an immediate attempt with a fresh
+// retry budget, whatever its status is.
+func (s *webhookService) Redeliver(ctx context.Context, sid int, did int64) (*Delivery, error) {
+	d, err := s.r.GetDelivery(ctx, did)
+	if err != nil {
+		return nil, err
+	}
+	if d.SubscriptionID != sid {
+		return nil, ErrDeliveryNotFound
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	d.Status = DeliveryPending
+	d.Attempts = 0
+	d.NextAttempt = now
+	d.Updated = now
+	if err := s.r.UpdateDelivery(ctx, d); err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Matches reports whether events of the type and wallet labels are delivered
+// to the subscription.
+func (sub *Subscription) Matches(eventType string, labels map[string]string) bool {
+	found := false
+	for _, t := range sub.EventTypes {
+		if t == eventType {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	for k, v := range sub.Labels {
+		if labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// WebhookPublisher is an EventPublisher that fans events out to deliveries
+// of matching subscriptions; webhook.Dispatcher sends them.
+type WebhookPublisher struct {
+	r Repository
+}
+
+func NewWebhookPublisher(r Repository) *WebhookPublisher {
+	return &WebhookPublisher{r: r}
+}
+
+func (p *WebhookPublisher) Publish(ctx context.Context, e *Event) error {
+	subs, err := p.r.ListSubscriptions(ctx)
+	if err != nil || len(subs) == 0 {
+		return err
+	}
+
+	var labels map[string]string
+	w, err := p.r.GetWallet(ctx, e.WalletID)
+	if err == nil {
+		labels = w.Labels
+	} else if !errors.Is(err, ErrWalletNotFound) {
+		return err
+	}
+
+	now := time.Now().UTC().Truncate(time.Millisecond)
+	ds := []*Delivery{}
+	for _, sub := range subs {
+		if !sub.Matches(e.Type, labels) {
+			continue
+		}
+		ds = append(ds, &Delivery{
+			SubscriptionID: sub.ID,
+			Event:          *e,
+			Status:         DeliveryPending,
+			NextAttempt:    now,
+			Created:        now,
+			Updated:        now,
+		})
+	}
+	if len(ds) == 0 {
+		return nil
+	}
+
+	return p.r.CreateDeliveries(ctx, ds)
+}
@@ -0,0 +1,67 @@
+//go:build !integration
+// +build !integration
+
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestSubscriptionMatches(t *testing.T) {
+	sub := &Subscription{EventTypes: []string{EventBalanceChanged}, Labels: map[string]string{"brand": "b1"}}
+
+	assert.True(t, sub.Matches(EventBalanceChanged, map[string]string{"brand": "b1", "country": "tr"}))
+	assert.False(t, sub.Matches(EventWalletCreated, map[string]string{"brand": "b1"}))
+	assert.False(t, sub.Matches(EventBalanceChanged, map[string]string{"brand": "b2"}))
+	assert.False(t, sub.Matches(EventBalanceChanged, nil))
+
+	all := &Subscription{EventTypes: []string{EventBalanceChanged}}
+	assert.True(t, all.Matches(EventBalanceChanged, nil))
+}
+
+func TestWebhookPublisher(t *testing.T) {
+	e := &Event{Seq: 9, Type: EventBalanceChanged, WalletID: 10}
+
+	var mok = &mockRepository{}
+	mok.On("ListSubscriptions", mock.Anything).Return([]*Subscription{
+		{ID: 1, EventTypes: []string{EventBalanceChanged}},
+		{ID: 2, EventTypes: []string{EventWalletCreated}},
+		{ID: 3, EventTypes: []string{EventBalanceChanged}, Labels: map[string]string{"brand": "b1"}},
+	}, nil)
+	mok.On("GetWallet", mock.Anything, 10).Return(&Wallet{ID: 10, Labels: map[string]string{"brand": "b2"}}, nil)
+	mok.On("CreateDeliveries", mock.Anything, mock.MatchedBy(func(ds []*Delivery) bool {
+		return len(ds) == 1 && ds[0].SubscriptionID == 1 && ds[0].Event.Seq == 9 && ds[0].Status == DeliveryPending
+	})).Return(nil)
+
+	assert.NoError(t, NewWebhookPublisher(mok).Publish(context.Background(), e))
+	mok.AssertExpectations(t)
+}
+
+func TestRedeliver(t *testing.T) {
+	t.Run("OtherSubscription", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("GetDelivery", mock.Anything, int64(5)).Return(&Delivery{ID: 5, SubscriptionID: 2}, nil)
+		svc := NewWebhookService(mok, log.Logger)
+
+		_, err := svc.Redeliver(context.Background(), 1, 5)
+		assert.ErrorIs(t, err, ErrDeliveryNotFound)
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		var mok = &mockRepository{}
+		mok.On("GetDelivery", mock.Anything, int64(5)).Return(&Delivery{ID: 5, SubscriptionID: 1, Status: DeliveryDead, Attempts: 8}, nil)
+		mok.On("UpdateDelivery", mock.Anything, mock.Anything).Return(nil)
+		svc := NewWebhookService(mok, log.Logger)
+
+		d, err := svc.Redeliver(context.Background(), 1, 5)
+		assert.NoError(t, err)
+		assert.Equal(t, DeliveryPending, d.Status)
+		assert.Equal(t, 0, d.Attempts)
+		assert.False(t, d.NextAttempt.IsZero())
+	})
+}
@@ -0,0 +1,62 @@
+//go:build !integration
+// +build !integration
+
+package signing
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignVerify(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"amount": 10}`)
+	h := Sign("s3cret", "POST", "/wallets/1/transactions", now, "n1", body)
+
+	nonce, err := Verify("s3cret", h, "POST", "/wallets/1/transactions", body, 5*time.Minute, now.Add(time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, "n1", nonce)
+
+	tests := map[string]struct {
+		secret, header, method, path string
+		body                         []byte
+		now                          time.Time
+		err                          error
+	}{
+		"Secret":  {"other", h, "POST", "/wallets/1/transactions", body, now, ErrInvalidSignature},
+		"Method":  {"s3cret", h, "PUT", "/wallets/1/transactions", body, now, ErrInvalidSignature},
+		"Path":    {"s3cret", h, "POST", "/wallets/2/transactions", body, now, ErrInvalidSignature},
+		"Body":    {"s3cret", h, "POST", "/wallets/1/transactions", []byte(`{"amount": 100}`), now, ErrInvalidSignature},
+		"Nonce":   {"s3cret", strings.Replace(h, "n=n1", "n=n2", 1), "POST", "/wallets/1/transactions", body, now, ErrInvalidSignature},
+		"Stale":   {"s3cret", h, "POST", "/wallets/1/transactions", body, now.Add(6 * time.Minute), ErrStaleSignature},
+		"Future":  {"s3cret", h, "POST", "/wallets/1/transactions", body, now.Add(-6 * time.Minute), ErrStaleSignature},
+		"Garbage": {"s3cret", "v1=abc", "POST", "/wallets/1/transactions", body, now, ErrInvalidSignature},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := Verify(tt.secret, tt.header, tt.method, tt.path, tt.body, 5*time.Minute, tt.now)
+			assert.ErrorIs(t, err, tt.err)
+		})
+	}
+}
+
+func TestMemoryNonceStore(t *testing.T) {
+	ctx := context.Background()
+	now := time.Now()
+	s := NewMemoryNonceStore()
+	s.now = func() time.Time { return now }
+
+	require.NoError(t, s.Use(ctx, "billing", "n1", now.Add(time.Minute)))
+	assert.ErrorIs(t, s.Use(ctx, "billing", "n1", now.Add(time.Minute)), ErrReplayedNonce)
+	assert.NoError(t, s.Use(ctx, "payouts", "n1", now.Add(time.Minute)))
+
+	// expired nonces are forgotten
+	now = now.Add(2 * time.Minute)
+	assert.NoError(t, s.Use(ctx, "billing", "n2", now.Add(time.Minute)))
+	assert.Len(t, s.nonces, 1)
+}
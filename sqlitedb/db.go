@@ -0,0 +1,281 @@
+package sqlitedb
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	_ "github.com/glebarez/go-sqlite"
+	"github.com/polarbit/bluelabs-wallet/service"
+)
+
+// migrations are applied in order; a migration is never changed once released,
+// append a new one instead.
+var migrations = []string{
+	// 1: initial schema
+	`
+CREATE TABLE wallets (
+	id			integer		PRIMARY KEY AUTOINCREMENT,
+	labels		text		not null,
+	created		integer		not null,
+	externalid	varchar(50)	not null unique
+);
+
+CREATE TABLE wallet_transactions (
+	id			varchar(36)		PRIMARY KEY,
+	wid			integer			not null,
+	refno		integer			not null,
+	amount		integer			not null,
+	description	varchar(100)	not null,
+	labels		text			not null,
+	fingerprint	varchar(50)		not null unique,
+	created		integer			not null,
+	old_balance	integer			not null,
+	new_balance	integer			not null
+);
+
+CREATE TABLE wallet_balances (
+	wid			integer			PRIMARY KEY,
+	amount		integer			not null
+);
+
+CREATE UNIQUE INDEX ix_wid_refno ON wallet_transactions (wid, refno);
+`,
+	// 2: hash chain of transactions
+	`
+ALTER TABLE wallet_transactions ADD COLUMN prev_hash varchar(64) not null default '';
+ALTER TABLE wallet_transactions ADD COLUMN hash varchar(64) not null default '';
+`,
+	// 3: general ledger
+	`
+CREATE TABLE accounts (
+	code		varchar(50)		PRIMARY KEY,
+	name		varchar(100)	not null,
+	type		varchar(20)		not null
+);
+
+CREATE TABLE journal_entries (
+	id				integer			PRIMARY KEY AUTOINCREMENT,
+	transaction_id	varchar(36)		not null references wallet_transactions (id),
+	wid				integer			not null,
+	account			varchar(50)		not null references accounts (code),
+	amount			integer			not null,
+	created			integer			not null
+);
+
+CREATE INDEX ix_journal_account ON journal_entries (account);
+`,
+	// 4: point in time balances
+	`
+CREATE INDEX ix_wid_created ON wallet_transactions (wid, created);
+`,
+	// 5: audit of balance repairs
+	`
+CREATE TABLE balance_repairs (
+	id			integer		PRIMARY KEY AUTOINCREMENT,
+	wid			integer		not null,
+	refno		integer		not null,
+	old_amount	integer		not null,
+	new_amount	integer		not null,
+	created		integer		not null
+);
+`,
+	// 6: daily balance snapshots
+	`
+CREATE TABLE balance_snapshots (
+	wid			integer		not null,
+	day			varchar(10)	not null,
+	balance		integer		not null,
+	refno		integer		not null,
+	created		integer		not null,
+	PRIMARY KEY (wid, day)
+);
+`,
+	// 7: transactional outbox
+	`
+CREATE TABLE outbox (
+	seq			integer		PRIMARY KEY AUTOINCREMENT,
+	type		varchar(50)	not null,
+	wid			integer		not null,
+	payload		text		not null,
+	created		integer		not null,
+	published	integer
+);
+
+CREATE INDEX ix_outbox_pending ON outbox (seq) WHERE published IS NULL;
+`,
+	// 8: webhooks
+	`
+CREATE TABLE webhook_subscriptions (
+	id			integer			PRIMARY KEY AUTOINCREMENT,
+	url			varchar(500)	not null,
+	event_types	text			not null,
+	labels		text			not null,
+	secret		varchar(100)	not null,
+	created		integer			not null
+);
+
+CREATE TABLE webhook_deliveries (
+	id					integer		PRIMARY KEY AUTOINCREMENT,
+	subscription_id		integer		not null,
+	event_seq			integer		not null,
+	event_type			varchar(50)	not null,
+	wid					integer		not null,
+	payload				text		not null,
+	event_created		integer		not null,
+	status				varchar(20)	not null,
+	attempts			integer		not null,
+	next_attempt		integer		not null,
+	last_error			text		not null,
+	last_status_code	integer		not null,
+	created				integer		not null,
+	updated				integer		not null,
+	UNIQUE (subscription_id, event_seq)
+);
+
+CREATE INDEX ix_deliveries_due ON webhook_deliveries (next_attempt) WHERE status = 'pending';
+`,
+	// 9: projection checkpoints
+	`
+CREATE TABLE projection_checkpoints (
+	name		varchar(50)	PRIMARY KEY,
+	wid			integer		not null,
+	updated		integer		not null
+);
+`,
+	// 10: api keys and the client of transactions
+	`
+ALTER TABLE wallet_transactions ADD COLUMN client varchar(100) not null default '';
+
+CREATE TABLE api_keys (
+	id			integer			PRIMARY KEY AUTOINCREMENT,
+	name		varchar(50)		not null unique,
+	prefix		varchar(20)		not null,
+	hash		varchar(64)		not null unique,
+	scopes		text			not null,
+	created		integer			not null,
+	revoked		integer			null
+);
+`,
+	// 11: policy denials
+	`
+CREATE TABLE policy_denials (
+	id			integer			PRIMARY KEY AUTOINCREMENT,
+	client		varchar(100)	not null,
+	operation	varchar(20)		not null,
+	wid			integer			not null,
+	amount		integer			not null,
+	labels		text			not null,
+	rule		varchar(100)	not null,
+	created		integer			not null
+);
+`,
+	// 12: outbox consumers; events published before were published for both
+	`
+CREATE TABLE outbox_consumers (
+	name		varchar(50)		PRIMARY KEY
+);
+
+CREATE TABLE outbox_published (
+	consumer	varchar(50)		not null,
+	seq			integer			not null,
+	published	integer			not null,
+	PRIMARY KEY (consumer, seq)
+);
+
+INSERT INTO outbox_published (consumer, seq, published)
+SELECT c.name, o.seq, o.published FROM outbox o, (SELECT 'relay' AS name UNION ALL SELECT 'webhooks') c
+WHERE o.published IS NOT NULL;
+
+DROP INDEX ix_outbox_pending;
+ALTER TABLE outbox DROP COLUMN published;
+CREATE INDEX ix_outbox_created ON outbox (created);
+`,
+}
+
+// open opens the database file and brings its schema up to date.
+func open(path string) (*sql.DB, error) {
+	dsn := path
+	if !strings.Contains(dsn, "?") {
+		dsn += "?"
+	} else {
+		dsn += "&"
+	}
+	dsn += "_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite allows a single writer; serializing connections avoids busy errors
+	// and keeps ":memory:" databases on a single connection.
+	db.SetMaxOpenConns(1)
+
+	if err := migrate(context.Background(), db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := seed(context.Background(), db); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func migrate(ctx context.Context, db *sql.DB) error {
+	_, err := db.ExecContext(ctx, `CREATE TABLE IF NOT EXISTS schema_migrations (
+		version	integer	PRIMARY KEY,
+		applied	integer	not null
+	)`)
+	if err != nil {
+		return fmt.Errorf("create schema_migrations: %w", err)
+	}
+
+	var version int
+	err = db.QueryRowContext(ctx, `select coalesce(max(version), 0) from schema_migrations`).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.ExecContext(ctx, migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		_, err = tx.ExecContext(ctx, `insert into schema_migrations (version, applied) values (?, ?)`,
+			i+1, time.Now().UTC().Unix())
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+	}
+
+	return nil
+}
+
+// seed inserts the chart of accounts
+func seed(ctx context.Context, db *sql.DB) error {
+	for _, a := range service.Accounts {
+		_, err := db.ExecContext(ctx, `insert or ignore into accounts (code, name, type) values (?, ?, ?)`,
+			a.Code, a.Name, a.Type)
+		if err != nil {
+			return fmt.Errorf("seed accounts: %w", err)
+		}
+	}
+	return nil
+}
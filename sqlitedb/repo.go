@@ -0,0 +1,1177 @@
+package sqlitedb
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+)
+
+const (
+	errTextWalletAlreadyExists                   = `UNIQUE constraint failed: wallets.externalid`
+	errTextTransactionAlreadyExistsByRefno       = `UNIQUE constraint failed: wallet_transactions.wid, wallet_transactions.refno`
+	errTextTransactionAlreadyExistsByFingerprint = `UNIQUE constraint failed: wallet_transactions.fingerprint`
+	errTextAPIKeyAlreadyExists                   = `UNIQUE constraint failed: api_keys.name`
+)
+
+const deliveryColumns = `id, subscription_id, event_seq, event_type, wid, payload, event_created,
+	status, attempts, next_attempt, last_error, last_status_code, created, updated`
+
+const apiKeyColumns = `id, name, prefix, hash, scopes, created, revoked`
+
+const transactionColumns = `id, refno, amount, description, labels, fingerprint, created, old_balance, new_balance, prev_hash, hash, client`
+
+// repository is a service.Repository on a single sqlite file. Amounts are
+// stored as integer cents, which gives the exact comparisons numeric(10,2)
+// columns give in postgres.
+type repository struct {
+	db *sql.DB
+	l  zerolog.Logger
+
+	// n notifies listeners of this process only; listeners of other processes
+	// catch up by polling
+	n *service.Notifier
+}
+
+// NewRepository opens (or creates) the sqlite database at path and applies
+// pending migrations. Use ":memory:" for a throwaway database.
+func NewRepository(path string, logger zerolog.Logger) (service.Repository, error) {
+	db, err := open(path)
+	if err != nil {
+		return nil, err
+	}
+	return &repository{db: db, l: logger, n: service.NewNotifier()}, nil
+}
+
+// log returns the logger of the request of ctx; see service.Logger.
+func (r *repository) log(ctx context.Context) *zerolog.Logger {
+	return service.Logger(ctx, &r.l)
+}
+
+func (r *repository) CreateWallet(ctx context.Context, w *service.Wallet) error {
+	labels, err := json.Marshal(w.Labels)
+	if err != nil {
+		return service.NewDbError(err)
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	// insert wallet
+	res, err := tx.ExecContext(ctx, `insert into wallets (externalid, labels, created) values (?, ?, ?)`,
+		w.ExternalID, string(labels), w.Created.UnixMicro())
+	if err != nil {
+		tx.Rollback()
+		if strings.Contains(err.Error(), errTextWalletAlreadyExists) {
+			return service.ErrWalletAlreadyExists
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		tx.Rollback()
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	// insert balance
+	_, err = tx.ExecContext(ctx, `insert into wallet_balances (wid, amount) values (?, ?)`, id, 0)
+	if err != nil {
+		tx.Rollback()
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	// insert events
+	created := *w
+	created.ID = int(id)
+	if err := r.insertEvents(ctx, tx, service.WalletEvents(&created)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	w.ID = int(id)
+	return nil
+}
+
+func (r *repository) GetWallet(ctx context.Context, wid int) (*service.Wallet, error) {
+	var labels string
+	var created int64
+	w := service.Wallet{}
+
+	err := r.db.QueryRowContext(ctx, `select id, externalid, labels, created from wallets where id = ?`, wid).
+		Scan(&w.ID, &w.ExternalID, &labels, &created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, service.ErrWalletNotFound
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	if err := json.Unmarshal([]byte(labels), &w.Labels); err != nil {
+		return nil, service.NewDbError(err)
+	}
+	w.Created = time.UnixMicro(created).UTC()
+
+	return &w, nil
+}
+
+func (r *repository) GetWalletBalance(ctx context.Context, wid int) (float64, error) {
+	var b int64
+	err := r.db.QueryRowContext(ctx, `select amount from wallet_balances where wid = ?`, wid).Scan(&b)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0., service.ErrWalletNotFound
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return 0., service.NewDbError(err)
+	}
+
+	return fromCents(b), nil
+}
+
+func (r *repository) CreateTransaction(ctx context.Context, wid int, t *service.Transaction) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	// insert transaction
+	if err := r.insertTransaction(ctx, tx, wid, t); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// insert journal
+	if err := r.insertJournal(ctx, tx, t); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	// update balance
+	res, err := tx.ExecContext(ctx, `update wallet_balances set amount = ? where wid = ? and amount = ?`,
+		toCents(t.NewBalance), wid, toCents(t.OldBalance))
+	if err != nil {
+		tx.Rollback()
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		tx.Rollback()
+		r.log(ctx).Error().Err(err).Msg("balance is changed")
+		return service.ErrTransactionConsistency
+	}
+
+	// insert events
+	if err := r.insertEvents(ctx, tx, service.TransactionEvents(wid, t)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	r.n.Notify(wid, t.RefNo)
+	return nil
+}
+
+func (r *repository) PostTransaction(ctx context.Context, wid int, t *service.Transaction) (err error) {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer conn.Close()
+
+	// an immediate transaction takes the write lock of the database upfront,
+	// so the balance can not change between reading and updating it
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer func() {
+		if err != nil {
+			conn.ExecContext(context.Background(), `ROLLBACK`)
+		}
+	}()
+
+	// read balance
+	var balance int64
+	err = conn.QueryRowContext(ctx, `select amount from wallet_balances where wid = ?`, wid).Scan(&balance)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return service.ErrWalletNotFound
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	// latest transaction
+	var lt *service.Transaction
+	var refno int
+	var hash string
+	var created int64
+	err = conn.QueryRowContext(ctx, `select refno, hash, created from wallet_transactions where wid = ? order by wid, refno desc limit 1`, wid).
+		Scan(&refno, &hash, &created)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	if err == nil {
+		lt = &service.Transaction{RefNo: refno, Hash: hash, Created: time.UnixMicro(created).UTC()}
+	}
+
+	t.RefNo = refno + 1
+	t.OldBalance = fromCents(balance)
+	t.NewBalance = t.OldBalance + t.Amount
+	if t.NewBalance < 0. {
+		return service.ErrNotEnoughWalletBalance
+	}
+	service.StampCreated(t, lt)
+	service.ChainTransaction(wid, t, lt)
+
+	// insert transaction
+	if err = r.insertTransaction(ctx, conn, wid, t); err != nil {
+		return err
+	}
+
+	// insert journal
+	if err = r.insertJournal(ctx, conn, t); err != nil {
+		return err
+	}
+
+	// update balance
+	_, err = conn.ExecContext(ctx, `update wallet_balances set amount = ? where wid = ?`, toCents(t.NewBalance), wid)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	// insert events
+	if err = r.insertEvents(ctx, conn, service.TransactionEvents(wid, t)); err != nil {
+		return err
+	}
+
+	if _, err = conn.ExecContext(ctx, `COMMIT`); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	r.n.Notify(wid, t.RefNo)
+	return nil
+}
+
+func (r *repository) insertTransaction(ctx context.Context, ex execer, wid int, t *service.Transaction) error {
+	labels, err := json.Marshal(t.Labels)
+	if err != nil {
+		return service.NewDbError(err)
+	}
+
+	stmt := `insert into wallet_transactions
+	(id, wid, refno, amount, description, labels, fingerprint, old_balance, new_balance, created, prev_hash, hash, client)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	_, err = ex.ExecContext(ctx, stmt, t.ID, wid, t.RefNo, toCents(t.Amount), t.Description, string(labels),
+		t.Fingerprint, toCents(t.OldBalance), toCents(t.NewBalance), t.Created.UnixMicro(), t.PrevHash, t.Hash, t.Client)
+	if err != nil {
+		if strings.Contains(err.Error(), errTextTransactionAlreadyExistsByRefno) {
+			return service.ErrTransactionAlreadyExistsByRefNo
+		}
+		if strings.Contains(err.Error(), errTextTransactionAlreadyExistsByFingerprint) {
+			return service.ErrTransactionAlreadyExistsByFingerprint
+		}
+		r.log(ctx).Error().Err(err).Msg("insert transaction failed")
+		return service.NewDbError(err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetLatestTransaction(ctx context.Context, wid int) (*service.Transaction, error) {
+	stmt := `select ` + transactionColumns + `
+	from wallet_transactions where wid = ?
+	order by wid, refno desc
+	limit 1`
+
+	t, err := scanTransaction(r.db.QueryRowContext(ctx, stmt, wid))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, service.ErrTransactionNotFound
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return t, nil
+}
+
+func (r *repository) GetTransactionAt(ctx context.Context, wid int, at time.Time) (*service.Transaction, error) {
+	// uses ix_wid_created
+	stmt := `select ` + transactionColumns + `
+	from wallet_transactions where wid = ? and created <= ?
+	order by wid, created desc, refno desc
+	limit 1`
+	t, err := scanTransaction(r.db.QueryRowContext(ctx, stmt, wid, at.UnixMicro()))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, service.ErrTransactionNotFound
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return t, nil
+}
+
+func (r *repository) ListWallets(ctx context.Context, afterID int, limit int) ([]*service.Wallet, error) {
+	rows, err := r.db.QueryContext(ctx,
+		`select id, externalid, labels, created from wallets where id > ? order by id limit ?`, afterID, limit)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	ws := []*service.Wallet{}
+	for rows.Next() {
+		var labels string
+		var created int64
+		w := service.Wallet{}
+		if err := rows.Scan(&w.ID, &w.ExternalID, &labels, &created); err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		if err := json.Unmarshal([]byte(labels), &w.Labels); err != nil {
+			return nil, service.NewDbError(err)
+		}
+		w.Created = time.UnixMicro(created).UTC()
+		ws = append(ws, &w)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return ws, nil
+}
+
+func (r *repository) ListTransactions(ctx context.Context, wid int, afterRefNo int, limit int) ([]*service.Transaction, error) {
+	stmt := `select ` + transactionColumns + `
+	from wallet_transactions where wid = ? and refno > ?
+	order by wid, refno
+	limit ?`
+	rows, err := r.db.QueryContext(ctx, stmt, wid, afterRefNo, limit)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	trs := []*service.Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		trs = append(trs, t)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return trs, nil
+}
+
+func (r *repository) TrialBalance(ctx context.Context) ([]*service.AccountBalance, error) {
+	stmt := `select a.code, a.name, a.type,
+		coalesce(sum(case when j.amount > 0 then j.amount end), 0),
+		coalesce(-sum(case when j.amount < 0 then j.amount end), 0)
+	from accounts a left join journal_entries j on j.account = a.code
+	group by a.code, a.name, a.type
+	order by a.code`
+	rows, err := r.db.QueryContext(ctx, stmt)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	bs := []*service.AccountBalance{}
+	for rows.Next() {
+		var debit, credit int64
+		b := service.AccountBalance{}
+		if err := rows.Scan(&b.Code, &b.Name, &b.Type, &debit, &credit); err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		b.Debit, b.Credit = fromCents(debit), fromCents(credit)
+		bs = append(bs, &b)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return bs, nil
+}
+
+func (r *repository) RepairBalance(ctx context.Context, wid int, refno int, from, to float64) (err error) {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, `BEGIN IMMEDIATE`); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer func() {
+		if err != nil {
+			conn.ExecContext(context.Background(), `ROLLBACK`)
+		}
+	}()
+
+	var balance int64
+	err = conn.QueryRowContext(ctx, `select amount from wallet_balances where wid = ?`, wid).Scan(&balance)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return service.ErrWalletNotFound
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	var latest int
+	err = conn.QueryRowContext(ctx, `select coalesce(max(refno), 0) from wallet_transactions where wid = ?`, wid).Scan(&latest)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	if balance != toCents(from) || latest != refno {
+		return service.ErrTransactionConsistency
+	}
+
+	_, err = conn.ExecContext(ctx, `update wallet_balances set amount = ? where wid = ?`, toCents(to), wid)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	_, err = conn.ExecContext(ctx, `insert into balance_repairs (wid, refno, old_amount, new_amount, created) values (?, ?, ?, ?, ?)`,
+		wid, refno, toCents(from), toCents(to), time.Now().UTC().UnixMicro())
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	if err = r.insertEvents(ctx, conn, service.RepairEvents(wid, refno, from, to)); err != nil {
+		return err
+	}
+
+	if _, err = conn.ExecContext(ctx, `COMMIT`); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	r.log(ctx).Warn().Int("wid", wid).Int("refno", refno).Float64("from", from).Float64("to", to).Msg("balance is repaired")
+	return nil
+}
+
+func (r *repository) ListTransactionsBetween(ctx context.Context, wid int, from, to time.Time, afterRefNo int, limit int) ([]*service.Transaction, error) {
+	stmt := `select ` + transactionColumns + `
+	from wallet_transactions where wid = ? and created >= ? and created <= ? and refno > ?
+	order by wid, refno
+	limit ?`
+	rows, err := r.db.QueryContext(ctx, stmt, wid, from.UnixMicro(), to.UnixMicro(), afterRefNo, limit)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	trs := []*service.Transaction{}
+	for rows.Next() {
+		t, err := scanTransaction(rows)
+		if err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		trs = append(trs, t)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return trs, nil
+}
+
+func (r *repository) SaveSnapshot(ctx context.Context, s *service.Snapshot) error {
+	stmt := `insert into balance_snapshots (wid, day, balance, refno, created) values (?, ?, ?, ?, ?)
+	on conflict (wid, day) do update set balance = excluded.balance, refno = excluded.refno, created = excluded.created`
+	_, err := r.db.ExecContext(ctx, stmt, s.WalletID, service.Day(s.Day).Format(service.DayLayout),
+		toCents(s.Balance), s.RefNo, s.Created.UnixMicro())
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	return nil
+}
+
+func (r *repository) GetSnapshot(ctx context.Context, wid int, day time.Time) (*service.Snapshot, error) {
+	var d string
+	var balance, created int64
+	s := service.Snapshot{}
+
+	stmt := `select wid, day, balance, refno, created from balance_snapshots where wid = ? and day = ?`
+	err := r.db.QueryRowContext(ctx, stmt, wid, service.Day(day).Format(service.DayLayout)).
+		Scan(&s.WalletID, &d, &balance, &s.RefNo, &created)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, service.ErrSnapshotNotFound
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	if s.Day, err = time.Parse(service.DayLayout, d); err != nil {
+		return nil, service.NewDbError(err)
+	}
+	s.Balance = fromCents(balance)
+	s.Created = time.UnixMicro(created).UTC()
+
+	return &s, nil
+}
+
+func (r *repository) ListPendingEvents(ctx context.Context, consumer string, limit int) ([]*service.Event, error) {
+	if err := r.registerConsumer(ctx, consumer); err != nil {
+		return nil, err
+	}
+
+	stmt := `select seq, type, wid, payload, created from outbox o
+	where not exists (select 1 from outbox_published p where p.consumer = ? and p.seq = o.seq)
+	order by seq limit ?`
+	rows, err := r.db.QueryContext(ctx, stmt, consumer, limit)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	es := []*service.Event{}
+	for rows.Next() {
+		var payload string
+		var created int64
+		e := &service.Event{}
+		if err := rows.Scan(&e.Seq, &e.Type, &e.WalletID, &payload, &created); err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		e.Payload = json.RawMessage(payload)
+		e.Created = time.UnixMicro(created).UTC()
+		es = append(es, e)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return es, nil
+}
+
+func (r *repository) MarkEventsPublished(ctx context.Context, consumer string, seqs []int64) error {
+	if len(seqs) == 0 {
+		return nil
+	}
+	if err := r.registerConsumer(ctx, consumer); err != nil {
+		return err
+	}
+
+	// sqlite has no arrays, seqs are inlined as placeholders; events pruned
+	// meanwhile are skipped
+	args := make([]interface{}, 0, len(seqs)+2)
+	args = append(args, consumer, time.Now().UTC().UnixMicro())
+	for _, seq := range seqs {
+		args = append(args, seq)
+	}
+	stmt := `insert or ignore into outbox_published (consumer, seq, published)
+	select ?, seq, ? from outbox where seq in (?` + strings.Repeat(`, ?`, len(seqs)-1) + `)`
+
+	if _, err := r.db.ExecContext(ctx, stmt, args...); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	return nil
+}
+
+func (r *repository) PruneEvents(ctx context.Context, before time.Time) (int, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return 0, service.NewDbError(err)
+	}
+
+	// uses ix_outbox_created
+	stmt := `delete from outbox where created < ?
+	and exists (select 1 from outbox_consumers)
+	and not exists (select 1 from outbox_consumers c where not exists
+		(select 1 from outbox_published p where p.consumer = c.name and p.seq = outbox.seq))`
+	res, err := tx.ExecContext(ctx, stmt, before.UnixMicro())
+	if err != nil {
+		tx.Rollback()
+		r.log(ctx).Error().Err(err).Send()
+		return 0, service.NewDbError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		tx.Rollback()
+		r.log(ctx).Error().Err(err).Send()
+		return 0, service.NewDbError(err)
+	}
+
+	// sqlite has no cascades here, published rows of the events go too
+	stmt = `delete from outbox_published where not exists (select 1 from outbox o where o.seq = outbox_published.seq)`
+	if _, err := tx.ExecContext(ctx, stmt); err != nil {
+		tx.Rollback()
+		r.log(ctx).Error().Err(err).Send()
+		return 0, service.NewDbError(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return 0, service.NewDbError(err)
+	}
+
+	return int(n), nil
+}
+
+// registerConsumer records the consumer of the outbox, so events are pruned
+// once it published them.
+func (r *repository) registerConsumer(ctx context.Context, consumer string) error {
+	if _, err := r.db.ExecContext(ctx, `insert or ignore into outbox_consumers (name) values (?)`, consumer); err != nil {
+		r.log(ctx).Error().Err(err).Msg("register consumer failed")
+		return service.NewDbError(err)
+	}
+	return nil
+}
+
+func (r *repository) CreateSubscription(ctx context.Context, sub *service.Subscription) error {
+	eventTypes, err := json.Marshal(sub.EventTypes)
+	if err != nil {
+		return service.NewDbError(err)
+	}
+	labels, err := json.Marshal(sub.Labels)
+	if err != nil {
+		return service.NewDbError(err)
+	}
+
+	res, err := r.db.ExecContext(ctx, `insert into webhook_subscriptions (url, event_types, labels, secret, created) values (?, ?, ?, ?, ?)`,
+		sub.URL, string(eventTypes), string(labels), sub.Secret, sub.Created.UnixMicro())
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return service.NewDbError(err)
+	}
+	sub.ID = int(id)
+
+	return nil
+}
+
+func (r *repository) GetSubscription(ctx context.Context, id int) (*service.Subscription, error) {
+	subs, err := r.querySubscriptions(ctx, `select id, url, event_types, labels, secret, created from webhook_subscriptions where id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(subs) == 0 {
+		return nil, service.ErrSubscriptionNotFound
+	}
+	return subs[0], nil
+}
+
+func (r *repository) ListSubscriptions(ctx context.Context) ([]*service.Subscription, error) {
+	return r.querySubscriptions(ctx, `select id, url, event_types, labels, secret, created from webhook_subscriptions order by id`)
+}
+
+func (r *repository) querySubscriptions(ctx context.Context, stmt string, args ...interface{}) ([]*service.Subscription, error) {
+	rows, err := r.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	subs := []*service.Subscription{}
+	for rows.Next() {
+		var eventTypes, labels string
+		var created int64
+		sub := &service.Subscription{}
+		if err := rows.Scan(&sub.ID, &sub.URL, &eventTypes, &labels, &sub.Secret, &created); err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		if err := json.Unmarshal([]byte(eventTypes), &sub.EventTypes); err != nil {
+			return nil, service.NewDbError(err)
+		}
+		if err := json.Unmarshal([]byte(labels), &sub.Labels); err != nil {
+			return nil, service.NewDbError(err)
+		}
+		sub.Created = time.UnixMicro(created).UTC()
+		subs = append(subs, sub)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return subs, nil
+}
+
+func (r *repository) DeleteSubscription(ctx context.Context, id int) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer tx.Rollback()
+
+	res, err := tx.ExecContext(ctx, `delete from webhook_subscriptions where id = ?`, id)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return service.ErrSubscriptionNotFound
+	}
+
+	// foreign keys are not enforced, deliveries are deleted explicitly
+	if _, err := tx.ExecContext(ctx, `delete from webhook_deliveries where subscription_id = ?`, id); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	return nil
+}
+
+func (r *repository) CreateDeliveries(ctx context.Context, ds []*service.Delivery) error {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	defer tx.Rollback()
+
+	stmt := `insert or ignore into webhook_deliveries
+	(subscription_id, event_seq, event_type, wid, payload, event_created,
+	status, attempts, next_attempt, last_error, last_status_code, created, updated)
+	values (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+	for _, d := range ds {
+		var found int
+		err := tx.QueryRowContext(ctx, `select count(*) from webhook_subscriptions where id = ?`, d.SubscriptionID).Scan(&found)
+		if err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return service.NewDbError(err)
+		}
+		if found == 0 {
+			return service.ErrSubscriptionNotFound
+		}
+
+		_, err = tx.ExecContext(ctx, stmt, d.SubscriptionID, d.Event.Seq, d.Event.Type, d.Event.WalletID, string(d.Event.Payload),
+			d.Event.Created.UnixMicro(), d.Status, d.Attempts, d.NextAttempt.UnixMicro(), d.LastError, d.LastStatusCode,
+			d.Created.UnixMicro(), d.Updated.UnixMicro())
+		if err != nil {
+			r.log(ctx).Error().Err(err).Msg("insert delivery failed")
+			return service.NewDbError(err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	return nil
+}
+
+func (r *repository) ClaimDueDeliveries(ctx context.Context, now time.Time, lease time.Duration, limit int) ([]*service.Delivery, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer tx.Rollback()
+
+	// uses ix_deliveries_due
+	stmt := `select ` + deliveryColumns + ` from webhook_deliveries
+	where status = ? and next_attempt <= ?
+	order by next_attempt, id
+	limit ?`
+	rows, err := tx.QueryContext(ctx, stmt, service.DeliveryPending, now.UnixMicro(), limit)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	ds, err := r.scanDeliveries(ctx, rows)
+	if err != nil {
+		return nil, err
+	}
+
+	end := now.Add(lease).UTC()
+	for _, d := range ds {
+		if _, err := tx.ExecContext(ctx, `update webhook_deliveries set next_attempt = ? where id = ?`, end.UnixMicro(), d.ID); err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		d.NextAttempt = end
+	}
+	if err := tx.Commit(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return ds, nil
+}
+
+func (r *repository) GetDelivery(ctx context.Context, id int64) (*service.Delivery, error) {
+	ds, err := r.queryDeliveries(ctx, `select `+deliveryColumns+` from webhook_deliveries where id = ?`, id)
+	if err != nil {
+		return nil, err
+	}
+	if len(ds) == 0 {
+		return nil, service.ErrDeliveryNotFound
+	}
+	return ds[0], nil
+}
+
+func (r *repository) ListDeliveries(ctx context.Context, sid int, afterID int64, limit int) ([]*service.Delivery, error) {
+	stmt := `select ` + deliveryColumns + ` from webhook_deliveries
+	where subscription_id = ? and id > ?
+	order by id
+	limit ?`
+	return r.queryDeliveries(ctx, stmt, sid, afterID, limit)
+}
+
+func (r *repository) UpdateDelivery(ctx context.Context, d *service.Delivery) error {
+	stmt := `update webhook_deliveries
+	set status = ?, attempts = ?, next_attempt = ?, last_error = ?, last_status_code = ?, updated = ?
+	where id = ?`
+	res, err := r.db.ExecContext(ctx, stmt, d.Status, d.Attempts, d.NextAttempt.UnixMicro(), d.LastError, d.LastStatusCode,
+		d.Updated.UnixMicro(), d.ID)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return service.ErrDeliveryNotFound
+	}
+
+	return nil
+}
+
+func (r *repository) Listen(ctx context.Context, wid int) (<-chan int, error) {
+	return r.n.Listen(ctx, wid), nil
+}
+
+func (r *repository) GetCheckpoint(ctx context.Context, projection string) (int, error) {
+	var wid int
+	err := r.db.QueryRowContext(ctx, `select wid from projection_checkpoints where name = ?`, projection).Scan(&wid)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return 0, nil
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return 0, service.NewDbError(err)
+	}
+
+	return wid, nil
+}
+
+func (r *repository) SaveCheckpoint(ctx context.Context, projection string, wid int) error {
+	stmt := `insert into projection_checkpoints (name, wid, updated) values (?, ?, ?)
+	on conflict (name) do update set wid = excluded.wid, updated = excluded.updated`
+	if _, err := r.db.ExecContext(ctx, stmt, projection, wid, time.Now().UTC().UnixMicro()); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	return nil
+}
+
+func (r *repository) CreateAPIKey(ctx context.Context, k *service.APIKey) error {
+	scopes, err := json.Marshal(k.Scopes)
+	if err != nil {
+		return service.NewDbError(err)
+	}
+
+	res, err := r.db.ExecContext(ctx, `insert into api_keys (name, prefix, hash, scopes, created) values (?, ?, ?, ?, ?)`,
+		k.Name, k.Prefix, k.Hash, string(scopes), k.Created.UnixMicro())
+	if err != nil {
+		if strings.Contains(err.Error(), errTextAPIKeyAlreadyExists) {
+			return service.ErrAPIKeyAlreadyExists
+		}
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	id, err := res.LastInsertId()
+	if err != nil {
+		return service.NewDbError(err)
+	}
+	k.ID = int(id)
+
+	return nil
+}
+
+func (r *repository) GetAPIKeyByHash(ctx context.Context, hash string) (*service.APIKey, error) {
+	keys, err := r.queryAPIKeys(ctx, `select `+apiKeyColumns+` from api_keys where hash = ?`, hash)
+	if err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, service.ErrAPIKeyNotFound
+	}
+	return keys[0], nil
+}
+
+func (r *repository) ListAPIKeys(ctx context.Context) ([]*service.APIKey, error) {
+	return r.queryAPIKeys(ctx, `select `+apiKeyColumns+` from api_keys order by id`)
+}
+
+func (r *repository) RevokeAPIKey(ctx context.Context, id int, at time.Time) error {
+	// the first revocation time is kept
+	res, err := r.db.ExecContext(ctx, `update api_keys set revoked = coalesce(revoked, ?) where id = ?`, at.UnixMicro(), id)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+	if n, err := res.RowsAffected(); err != nil || n != 1 {
+		return service.ErrAPIKeyNotFound
+	}
+
+	return nil
+}
+
+func (r *repository) queryAPIKeys(ctx context.Context, stmt string, args ...interface{}) ([]*service.APIKey, error) {
+	rows, err := r.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	keys := []*service.APIKey{}
+	for rows.Next() {
+		var scopes string
+		var created int64
+		var revoked sql.NullInt64
+		k := &service.APIKey{}
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.Hash, &scopes, &created, &revoked); err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		if err := json.Unmarshal([]byte(scopes), &k.Scopes); err != nil {
+			return nil, service.NewDbError(err)
+		}
+		k.Created = time.UnixMicro(created).UTC()
+		if revoked.Valid {
+			t := time.UnixMicro(revoked.Int64).UTC()
+			k.Revoked = &t
+		}
+		keys = append(keys, k)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return keys, nil
+}
+
+func (r *repository) CreatePolicyDenial(ctx context.Context, d *service.PolicyDenial) error {
+	labels, err := json.Marshal(d.Labels)
+	if err != nil {
+		return service.NewDbError(err)
+	}
+
+	stmt := `insert into policy_denials (client, operation, wid, amount, labels, rule, created) values (?, ?, ?, ?, ?, ?, ?)`
+	res, err := r.db.ExecContext(ctx, stmt, d.Client, d.Operation, d.WalletID, toCents(d.Amount), string(labels), d.Rule, d.Created.UnixMicro())
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return service.NewDbError(err)
+	}
+
+	if d.ID, err = res.LastInsertId(); err != nil {
+		return service.NewDbError(err)
+	}
+
+	return nil
+}
+
+func (r *repository) ListPolicyDenials(ctx context.Context, afterID int64, limit int) ([]*service.PolicyDenial, error) {
+	stmt := `select id, client, operation, wid, amount, labels, rule, created from policy_denials
+	where id > ? order by id limit ?`
+	rows, err := r.db.QueryContext(ctx, stmt, afterID, limit)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	defer rows.Close()
+
+	ds := []*service.PolicyDenial{}
+	for rows.Next() {
+		var labels string
+		var amount, created int64
+		d := &service.PolicyDenial{}
+		if err := rows.Scan(&d.ID, &d.Client, &d.Operation, &d.WalletID, &amount, &labels, &d.Rule, &created); err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		if err := json.Unmarshal([]byte(labels), &d.Labels); err != nil {
+			return nil, service.NewDbError(err)
+		}
+		d.Amount = fromCents(amount)
+		d.Created = time.UnixMicro(created).UTC()
+		ds = append(ds, d)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return ds, nil
+}
+
+func (r *repository) queryDeliveries(ctx context.Context, stmt string, args ...interface{}) ([]*service.Delivery, error) {
+	rows, err := r.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+	return r.scanDeliveries(ctx, rows)
+}
+
+// scanDeliveries scans and closes rows selected with deliveryColumns
+func (r *repository) scanDeliveries(ctx context.Context, rows *sql.Rows) ([]*service.Delivery, error) {
+	defer rows.Close()
+
+	ds := []*service.Delivery{}
+	for rows.Next() {
+		var payload string
+		var eventCreated, nextAttempt, created, updated int64
+		d := &service.Delivery{}
+		err := rows.Scan(&d.ID, &d.SubscriptionID, &d.Event.Seq, &d.Event.Type, &d.Event.WalletID, &payload,
+			&eventCreated, &d.Status, &d.Attempts, &nextAttempt, &d.LastError, &d.LastStatusCode, &created, &updated)
+		if err != nil {
+			r.log(ctx).Error().Err(err).Send()
+			return nil, service.NewDbError(err)
+		}
+		d.Event.Payload = json.RawMessage(payload)
+		d.Event.Created = time.UnixMicro(eventCreated).UTC()
+		d.NextAttempt = time.UnixMicro(nextAttempt).UTC()
+		d.Created = time.UnixMicro(created).UTC()
+		d.Updated = time.UnixMicro(updated).UTC()
+		ds = append(ds, d)
+	}
+	if err := rows.Err(); err != nil {
+		r.log(ctx).Error().Err(err).Send()
+		return nil, service.NewDbError(err)
+	}
+
+	return ds, nil
+}
+
+func (r *repository) insertEvents(ctx context.Context, ex execer, es []*service.Event) error {
+	stmt := `insert into outbox (type, wid, payload, created) values (?, ?, ?, ?)`
+	for _, e := range es {
+		res, err := ex.ExecContext(ctx, stmt, e.Type, e.WalletID, string(e.Payload), e.Created.UnixMicro())
+		if err != nil {
+			r.log(ctx).Error().Err(err).Msg("insert event failed")
+			return service.NewDbError(err)
+		}
+		if e.Seq, err = res.LastInsertId(); err != nil {
+			return service.NewDbError(err)
+		}
+	}
+	return nil
+}
+
+func (r *repository) insertJournal(ctx context.Context, ex execer, t *service.Transaction) error {
+	stmt := `insert into journal_entries (transaction_id, wid, account, amount, created) values (?, ?, ?, ?, ?)`
+	for _, l := range t.Journal {
+		_, err := ex.ExecContext(ctx, stmt, l.TransactionID, l.WalletID, l.Account, toCents(l.Amount), t.Created.UnixMicro())
+		if err != nil {
+			r.log(ctx).Error().Err(err).Msg("insert journal failed")
+			return service.NewDbError(err)
+		}
+	}
+	return nil
+}
+
+// execer is implemented by *sql.Tx and *sql.Conn
+type execer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+func scanTransaction(row interface{ Scan(...interface{}) error }) (*service.Transaction, error) {
+	var labels string
+	var amount, oldBalance, newBalance, created int64
+	t := service.Transaction{}
+
+	err := row.Scan(&t.ID, &t.RefNo, &amount, &t.Description, &labels,
+		&t.Fingerprint, &created, &oldBalance, &newBalance, &t.PrevHash, &t.Hash, &t.Client)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal([]byte(labels), &t.Labels); err != nil {
+		return nil, err
+	}
+	t.Amount = fromCents(amount)
+	t.OldBalance = fromCents(oldBalance)
+	t.NewBalance = fromCents(newBalance)
+	t.Created = time.UnixMicro(created).UTC()
+
+	return &t, nil
+}
+
+func toCents(f float64) int64 {
+	return int64(math.Round(f * 100))
+}
+
+func fromCents(c int64) float64 {
+	return float64(c) / 100
+}
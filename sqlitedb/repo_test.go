@@ -0,0 +1,50 @@
+//go:build !integration
+// +build !integration
+
+package sqlitedb
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/service/repotest"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRepository(t *testing.T) {
+	r, err := NewRepository(filepath.Join(t.TempDir(), "wallet.db"), log.Logger)
+	require.NoError(t, err)
+
+	repotest.Run(t, func() service.Repository { return r })
+}
+
+func TestReopenKeepsData(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wallet.db")
+	ctx := context.Background()
+
+	r, err := NewRepository(path, log.Logger)
+	require.NoError(t, err)
+	w := &service.Wallet{ExternalID: uuid.NewString()}
+	require.NoError(t, r.CreateWallet(ctx, w))
+
+	// migrations are not applied twice
+	r, err = NewRepository(path, log.Logger)
+	require.NoError(t, err)
+	got, err := r.GetWallet(ctx, w.ID)
+	require.NoError(t, err)
+	assert.Equal(t, w.ExternalID, got.ExternalID)
+}
+
+func BenchmarkCreateTransaction(b *testing.B) {
+	repotest.Benchmark(b, func() service.Repository {
+		r, err := NewRepository(filepath.Join(b.TempDir(), "wallet.db"), zerolog.Nop())
+		require.NoError(b, err)
+		return r
+	})
+}
@@ -0,0 +1,29 @@
+package storage
+
+import (
+	"github.com/polarbit/bluelabs-wallet/config"
+	"github.com/polarbit/bluelabs-wallet/db"
+	"github.com/polarbit/bluelabs-wallet/ratelimit"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+)
+
+// NewLimiter returns the rate limiter of the configuration, or nil if every
+// limit is disabled. Its buckets are kept in the RateLimitStore; the postgres
+// store shares the connections of repo if it is the repository of the database.
+func NewLimiter(c *config.AppConfig, repo service.Repository, logger zerolog.Logger) *ratelimit.Limiter {
+	client := ratelimit.Limit{Rate: c.RateLimitClientRate, Burst: c.RateLimitClientBurst}
+	wallet := ratelimit.Limit{Rate: c.RateLimitWalletRate, Burst: c.RateLimitWalletBurst}
+	ip := ratelimit.Limit{Rate: c.RateLimitIPRate, Burst: c.RateLimitIPBurst}
+	if !client.Enabled() && !wallet.Enabled() && !ip.Enabled() {
+		return nil
+	}
+
+	var store ratelimit.Store = ratelimit.NewMemoryStore()
+	if c.RateLimitStore == config.RateLimitStorePostgres {
+		store = db.NewRateLimitStore(c.Db, repo, logger)
+	}
+	lm := ratelimit.NewLimiter(store, client, wallet)
+	lm.IP = ip
+	return lm
+}
@@ -0,0 +1,19 @@
+package storage
+
+import (
+	"github.com/polarbit/bluelabs-wallet/config"
+	"github.com/polarbit/bluelabs-wallet/db"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/signing"
+	"github.com/rs/zerolog"
+)
+
+// NewNonceStore returns the store of nonces of signed requests. With postgres
+// storage nonces are kept in the database, shared by every instance, with the
+// connections of repo; otherwise they are kept in process memory.
+func NewNonceStore(c *config.AppConfig, repo service.Repository, logger zerolog.Logger) signing.NonceStore {
+	if c.Storage == config.StoragePostgres {
+		return db.NewNonceStore(c.Db, repo, logger)
+	}
+	return signing.NewMemoryNonceStore()
+}
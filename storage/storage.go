@@ -0,0 +1,28 @@
+// Package storage creates the service.Repository selected by the application
+// configuration.
+package storage
+
+import (
+	"github.com/polarbit/bluelabs-wallet/config"
+	"github.com/polarbit/bluelabs-wallet/db"
+	"github.com/polarbit/bluelabs-wallet/memdb"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/polarbit/bluelabs-wallet/sqlitedb"
+	"github.com/rs/zerolog"
+)
+
+func NewRepository(c *config.AppConfig, logger zerolog.Logger) (service.Repository, error) {
+	if err := config.ValidateStorage(c.Storage); err != nil {
+		return nil, err
+	}
+
+	switch c.Storage {
+	case config.StorageMemory:
+		logger.Warn().Msg("using in-memory storage, data will be lost on exit")
+		return memdb.NewRepository(logger), nil
+	case config.StorageSqlite:
+		return sqlitedb.NewRepository(c.Sqlite, logger)
+	default:
+		return db.NewRepository(c.Db, logger), nil
+	}
+}
@@ -0,0 +1,228 @@
+// Package webhook delivers events to webhook subscriptions.
+//
+// Every delivery is a POST of the service.Event as json with the headers
+//
+//	Wallet-Event:      event type
+//	Wallet-Delivery:   delivery id
+//	Wallet-Signature:  t=<unix seconds>,v1=<hex hmac-sha256 of "<t>.<body>" keyed by the subscription secret>
+//
+// Any 2xx response acknowledges the delivery. Failed deliveries are retried
+// with exponential backoff and dead-lettered after MaxAttempts.
+package webhook
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+)
+
+// Headers of deliveries
+const (
+	HeaderEvent     = "Wallet-Event"
+	HeaderDelivery  = "Wallet-Delivery"
+	HeaderSignature = "Wallet-Signature"
+)
+
+var ErrInvalidSignature = errors.New("invalid webhook signature")
+
+// Sign returns the signature header value of body sent at ts.
+func Sign(secret string, ts time.Time, body []byte) string {
+	t := strconv.FormatInt(ts.Unix(), 10)
+	return "t=" + t + ",v1=" + mac(secret, t, body)
+}
+
+// Verify checks a signature header for receivers; signatures older than
+// tolerance are rejected to limit replays.
+func Verify(secret, header string, body []byte, tolerance time.Duration, now time.Time) error {
+	var t, v1 string
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		switch kv[0] {
+		case "t":
+			t = kv[1]
+		case "v1":
+			v1 = kv[1]
+		}
+	}
+
+	sec, err := strconv.ParseInt(t, 10, 64)
+	if err != nil || v1 == "" {
+		return ErrInvalidSignature
+	}
+	if d := now.Sub(time.Unix(sec, 0)); d > tolerance || d < -tolerance {
+		return ErrInvalidSignature
+	}
+	if !hmac.Equal([]byte(v1), []byte(mac(secret, t, body))) {
+		return ErrInvalidSignature
+	}
+	return nil
+}
+
+func mac(secret, t string, body []byte) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	h.Write([]byte(t))
+	h.Write([]byte("."))
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// Backoff is the wait after the given number of failed attempts: base doubled
+// for every attempt after the first, capped at max.
+func Backoff(base, max time.Duration, attempts int) time.Duration {
+	d := base
+	for i := 1; i < attempts && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// Dispatcher sends due deliveries of the repository. Dispatchers claim the
+// deliveries they send for Lease, so that dispatchers of several relays send
+// each delivery once; a delivery claimed by a dispatcher which stopped is sent
+// again once its lease ends.
+type Dispatcher struct {
+	r service.Repository
+	l zerolog.Logger
+
+	Client      *http.Client
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Lease       time.Duration
+
+	now func() time.Time
+}
+
+func NewDispatcher(r service.Repository, logger zerolog.Logger) *Dispatcher {
+	return &Dispatcher{
+		r:           r,
+		l:           logger,
+		Client:      &http.Client{Timeout: 10 * time.Second},
+		MaxAttempts: 8,
+		BaseDelay:   time.Second,
+		MaxDelay:    time.Hour,
+		Lease:       5 * time.Minute,
+		now:         func() time.Time { return time.Now().UTC().Truncate(time.Millisecond) },
+	}
+}
+
+// DeliverDue claims up to limit due deliveries, attempts them and returns the
+// number of attempts. Deliveries which cannot be sent before their lease ends
+// are left to the next claim.
+func (d *Dispatcher) DeliverDue(ctx context.Context, limit int) (int, error) {
+	now := d.now()
+	ds, err := d.r.ClaimDueDeliveries(ctx, now, d.Lease, limit)
+	if err != nil {
+		return 0, err
+	}
+
+	end := now.Add(d.Lease)
+	for i, dl := range ds {
+		if d.now().Add(d.Client.Timeout).After(end) {
+			return i, nil
+		}
+		if err := d.Deliver(ctx, dl); err != nil {
+			return i, err
+		}
+	}
+
+	return len(ds), nil
+}
+
+// Deliver makes one attempt of the delivery and saves its outcome. The
+// returned error is about the repository, not the receiver.
+func (d *Dispatcher) Deliver(ctx context.Context, dl *service.Delivery) error {
+	sub, err := d.r.GetSubscription(ctx, dl.SubscriptionID)
+	if err != nil {
+		return err
+	}
+
+	code, err := d.send(ctx, sub, dl)
+
+	now := d.now()
+	dl.Attempts++
+	dl.LastStatusCode = code
+	dl.Updated = now
+	dl.LastError = ""
+	switch {
+	case err == nil:
+		dl.Status = service.DeliverySucceeded
+	case dl.Attempts >= d.MaxAttempts:
+		dl.Status = service.DeliveryDead
+		dl.LastError = err.Error()
+		d.l.Warn().Err(err).Int64("delivery", dl.ID).Int("subscription", sub.ID).Msg("delivery is dead")
+	default:
+		dl.LastError = err.Error()
+		dl.NextAttempt = now.Add(Backoff(d.BaseDelay, d.MaxDelay, dl.Attempts))
+		d.l.Debug().Err(err).Int64("delivery", dl.ID).Time("next", dl.NextAttempt).Msg("delivery failed")
+	}
+
+	return d.r.UpdateDelivery(ctx, dl)
+}
+
+func (d *Dispatcher) send(ctx context.Context, sub *service.Subscription, dl *service.Delivery) (int, error) {
+	body, err := json.Marshal(&dl.Event)
+	if err != nil {
+		return 0, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, dl.Event.Type)
+	req.Header.Set(HeaderDelivery, strconv.FormatInt(dl.ID, 10))
+	req.Header.Set(HeaderSignature, Sign(sub.Secret, d.now(), body))
+
+	res, err := d.Client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64<<10))
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("receiver responded %d", res.StatusCode)
+	}
+	return res.StatusCode, nil
+}
+
+// Run delivers due deliveries until ctx is done, polling every interval.
+func (d *Dispatcher) Run(ctx context.Context, interval time.Duration, batch int) {
+	for {
+		n, err := d.DeliverDue(ctx, batch)
+		if err != nil {
+			d.l.Error().Err(err).Msg("webhook delivery failed")
+		}
+
+		if err == nil && n == batch {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(interval):
+		}
+	}
+}
@@ -0,0 +1,217 @@
+//go:build !integration
+// +build !integration
+
+package webhook
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/polarbit/bluelabs-wallet/memdb"
+	"github.com/polarbit/bluelabs-wallet/service"
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSignVerify(t *testing.T) {
+	now := time.Now()
+	body := []byte(`{"seq":1}`)
+	sig := Sign("s3cret", now, body)
+
+	assert.NoError(t, Verify("s3cret", sig, body, time.Minute, now))
+	assert.ErrorIs(t, Verify("other", sig, body, time.Minute, now), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("s3cret", sig, []byte(`{"seq":2}`), time.Minute, now), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("s3cret", sig, body, time.Minute, now.Add(2*time.Minute)), ErrInvalidSignature)
+	assert.ErrorIs(t, Verify("s3cret", "garbage", body, time.Minute, now), ErrInvalidSignature)
+}
+
+func TestBackoff(t *testing.T) {
+	assert.Equal(t, time.Second, Backoff(time.Second, time.Minute, 1))
+	assert.Equal(t, 2*time.Second, Backoff(time.Second, time.Minute, 2))
+	assert.Equal(t, 16*time.Second, Backoff(time.Second, time.Minute, 5))
+	assert.Equal(t, time.Minute, Backoff(time.Second, time.Minute, 20))
+}
+
+// receiver is an httptest server recording verified deliveries
+type receiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	secret   string
+	received []string
+}
+
+func newReceiver(t *testing.T, secret string) *receiver {
+	rc := &receiver{status: http.StatusOK, secret: secret}
+	rc.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		if err := Verify(rc.secret, r.Header.Get(HeaderSignature), body, time.Minute, time.Now()); err != nil {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		rc.mu.Lock()
+		defer rc.mu.Unlock()
+		rc.received = append(rc.received, r.Header.Get(HeaderEvent))
+		w.WriteHeader(rc.status)
+	}))
+	t.Cleanup(rc.Close)
+	return rc
+}
+
+func (rc *receiver) setStatus(status int) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	rc.status = status
+}
+
+func (rc *receiver) events() []string {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	return append([]string(nil), rc.received...)
+}
+
+type fixture struct {
+	r     service.Repository
+	s     service.Service
+	ws    service.WebhookService
+	d     *Dispatcher
+	clock time.Time
+}
+
+func newFixture() *fixture {
+	r := memdb.NewRepository(zerolog.Nop())
+	f := &fixture{
+		r:  r,
+		s:  service.NewWalletService(r, zerolog.Nop()),
+		ws: service.NewWebhookService(r, zerolog.Nop()),
+		d:  NewDispatcher(r, zerolog.Nop()),
+	}
+	f.d.now = func() time.Time { return f.clock }
+	return f
+}
+
+// relay fans the pending outbox events out to deliveries and moves the clock
+// of the dispatcher to the time they are due.
+func (f *fixture) relay(t *testing.T) {
+	_, err := service.RelayEvents(context.Background(), f.r, service.ConsumerWebhooks, service.NewWebhookPublisher(f.r), 100)
+	require.NoError(t, err)
+	f.clock = time.Now().UTC()
+}
+
+func TestDispatcher(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Delivered", func(t *testing.T) {
+		f := newFixture()
+		rc := newReceiver(t, "s3cret")
+		sub, err := f.ws.CreateSubscription(ctx, &service.SubscriptionModel{
+			URL: rc.URL, EventTypes: []string{service.EventTransactionCreated, service.EventBalanceChanged},
+			Labels: map[string]string{"brand": "b1"}, Secret: "s3cret",
+		})
+		require.NoError(t, err)
+
+		w, err := f.s.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1", Labels: map[string]string{"brand": "b1"}})
+		require.NoError(t, err)
+		_, err = f.s.CreateTransaction(ctx, w.ID, &service.TransactionModel{Amount: 10, Description: "deposit", Fingerprint: "f1"})
+		require.NoError(t, err)
+
+		// wallets of other brands are filtered out
+		other, err := f.s.CreateWallet(ctx, &service.WalletModel{ExternalID: "w2", Labels: map[string]string{"brand": "b2"}})
+		require.NoError(t, err)
+		_, err = f.s.CreateTransaction(ctx, other.ID, &service.TransactionModel{Amount: 10, Description: "deposit", Fingerprint: "f2"})
+		require.NoError(t, err)
+
+		f.relay(t)
+		n, err := f.d.DeliverDue(ctx, 10)
+		require.NoError(t, err)
+		assert.Equal(t, 2, n)
+		assert.Equal(t, []string{service.EventTransactionCreated, service.EventBalanceChanged}, rc.events())
+
+		ds, err := f.ws.ListDeliveries(ctx, sub.ID, 0, 10)
+		require.NoError(t, err)
+		require.Len(t, ds, 2)
+		for _, d := range ds {
+			assert.Equal(t, service.DeliverySucceeded, d.Status)
+			assert.Equal(t, 1, d.Attempts)
+			assert.Equal(t, http.StatusOK, d.LastStatusCode)
+		}
+	})
+
+	t.Run("RetriedDeadLetteredAndRedelivered", func(t *testing.T) {
+		f := newFixture()
+		f.d.MaxAttempts = 3
+		rc := newReceiver(t, "s3cret")
+		rc.setStatus(http.StatusServiceUnavailable)
+		sub, err := f.ws.CreateSubscription(ctx, &service.SubscriptionModel{
+			URL: rc.URL, EventTypes: []string{service.EventWalletCreated}, Secret: "s3cret",
+		})
+		require.NoError(t, err)
+
+		_, err = f.s.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+		require.NoError(t, err)
+		f.relay(t)
+
+		for attempt, wait := range []time.Duration{0, time.Second, 2 * time.Second} {
+			f.clock = f.clock.Add(wait)
+			n, err := f.d.DeliverDue(ctx, 10)
+			require.NoError(t, err)
+			assert.Equal(t, 1, n, "attempt %d", attempt+1)
+
+			// not due again before the backoff
+			n, err = f.d.DeliverDue(ctx, 10)
+			require.NoError(t, err)
+			assert.Equal(t, 0, n)
+		}
+
+		ds, err := f.ws.ListDeliveries(ctx, sub.ID, 0, 10)
+		require.NoError(t, err)
+		require.Len(t, ds, 1)
+		assert.Equal(t, service.DeliveryDead, ds[0].Status)
+		assert.Equal(t, 3, ds[0].Attempts)
+		assert.Equal(t, http.StatusServiceUnavailable, ds[0].LastStatusCode)
+		assert.NotEmpty(t, ds[0].LastError)
+
+		// manual redelivery after the receiver is fixed
+		rc.setStatus(http.StatusNoContent)
+		_, err = f.ws.Redeliver(ctx, sub.ID, ds[0].ID)
+		require.NoError(t, err)
+		f.clock = time.Now().UTC().Add(time.Second)
+		n, err := f.d.DeliverDue(ctx, 10)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		d, err := f.r.GetDelivery(ctx, ds[0].ID)
+		require.NoError(t, err)
+		assert.Equal(t, service.DeliverySucceeded, d.Status)
+		assert.Len(t, rc.events(), 4)
+	})
+
+	t.Run("WrongSecretIsRejected", func(t *testing.T) {
+		f := newFixture()
+		rc := newReceiver(t, "expected")
+		sub, err := f.ws.CreateSubscription(ctx, &service.SubscriptionModel{
+			URL: rc.URL, EventTypes: []string{service.EventWalletCreated}, Secret: "other",
+		})
+		require.NoError(t, err)
+
+		_, err = f.s.CreateWallet(ctx, &service.WalletModel{ExternalID: "w1"})
+		require.NoError(t, err)
+		f.relay(t)
+		_, err = f.d.DeliverDue(ctx, 10)
+		require.NoError(t, err)
+
+		ds, err := f.ws.ListDeliveries(ctx, sub.ID, 0, 10)
+		require.NoError(t, err)
+		require.Len(t, ds, 1)
+		assert.Equal(t, service.DeliveryPending, ds[0].Status)
+		assert.Equal(t, http.StatusUnauthorized, ds[0].LastStatusCode)
+		assert.Empty(t, rc.events())
+	})
+}